@@ -31,9 +31,18 @@ var logger *log.Logger
 
 type mdnsScanner interface {
 	ScanInterfaces() (string, error)
+	Stop()
 }
 
-var _mdns mdnsScanner
+var (
+	// mu protects the registration, updated from the polling loop and on
+	// hostname changes made by snapweb
+	mu sync.Mutex
+	// _mdns publishes registeredHostname, once InitMDNS has been called
+	_mdns              mdnsScanner
+	registeredHostname string
+	initialized        bool
+)
 
 var initOnce sync.Once
 
@@ -47,37 +56,79 @@ var defaultNewMDNS = func(hostname, p1, p2 string, p3 bool, p4 int) (mdnsScanner
 
 var newMDNS = defaultNewMDNS
 
+var startAddressUpdates = func() {
+	go addressUpdateLoop()
+}
+
 // InitMDNS initializes the avahi subsystem.
 func InitMDNS(l *log.Logger) error {
 	logger = l
 
-	// the hostname is read once on startup; there is no Linux interface to
-	// pickup hostname changes, so either polling has to be used to detect
-	// these or snapweb has to be restarted
-	var err error
+	mu.Lock()
+	initialized = true
+	err := register(getHostname())
+	mu.Unlock()
+
+	// poll to update published IP addresses for this mDNS name and to pick
+	// up hostname changes, for which there is no Linux notification;
+	// ideally we'd use something like netlink to trigger updates to avoid
+	// wakeups; this might require extra permissions though
+	initOnce.Do(startAddressUpdates)
+	return err
+}
+
+// UpdateHostname registers the mDNS name again if the hostname changed. It
+// does nothing until InitMDNS is called.
+func UpdateHostname() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if !initialized {
+		return nil
+	}
+
 	hostname := getHostname()
+	if _mdns != nil && hostname == registeredHostname {
+		return nil
+	}
+
+	return register(hostname)
+}
+
+// register publishes hostname in place of the previous name; the caller
+// holds mu
+func register(hostname string) error {
+	if _mdns != nil {
+		logger.Println("Unregistering hostname:", registeredHostname)
+		_mdns.Stop()
+		_mdns = nil
+	}
+
 	logger.Println("Registering hostname:", hostname)
-	_mdns, err = newMDNS(hostname, "", "", false, 0)
+	m, err := newMDNS(hostname, "", "", false, 0)
 	if err != nil {
 		logger.Println("Cannot create mDNS instance:", err)
 		return fmt.Errorf("Cannot create mDNS instance: %s", err.Error())
 	}
-	// poll to update published IP addresses for this mDNS name; ideally
-	// we'd use something like netlink to trigger updates to avoid wakeups;
-	// this might require extra permissions though
-	initOnce.Do(addressUpdateLoop)
+
+	_mdns = m
+	registeredHostname = hostname
 	return nil
 }
 
 func addressUpdateLoop() {
-	timer := time.NewTimer(addressUpdateDelay)
+	ticker := time.NewTicker(addressUpdateDelay)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// errors are logged, and registering is tried again on next tick
+		UpdateHostname()
 
-	{
+		mu.Lock()
 		if _mdns != nil {
 			_mdns.ScanInterfaces()
 		}
-		timer.Reset(addressUpdateDelay)
-		<-timer.C
+		mu.Unlock()
 	}
 }
 
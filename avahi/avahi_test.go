@@ -33,6 +33,23 @@ func (*NullMdnsScanner) ScanInterfaces() (string, error) {
 	return "", nil
 }
 
+func (*NullMdnsScanner) Stop() {}
+
+// recordingScanner remembers the name it was created for and whether it
+// was stopped
+type recordingScanner struct {
+	hostname string
+	stopped  bool
+}
+
+func (*recordingScanner) ScanInterfaces() (string, error) {
+	return "", nil
+}
+
+func (r *recordingScanner) Stop() {
+	r.stopped = true
+}
+
 func Test(t *testing.T) { TestingT(t) }
 
 type AvahiSuite struct {
@@ -46,10 +63,18 @@ func (s *AvahiSuite) SetUpTest(c *C) {
 	s.logger = log.New(ioutil.Discard, "", 0)
 
 	osHostname = func() (string, error) { return s.mockHostname, nil }
+	startAddressUpdates = func() {}
 }
 
 func (s *AvahiSuite) TearDownTest(c *C) {
 	osHostname = os.Hostname
+	newMDNS = defaultNewMDNS
+
+	mu.Lock()
+	_mdns = nil
+	registeredHostname = ""
+	initialized = false
+	mu.Unlock()
 }
 
 func (s *AvahiSuite) TestGetHostname(c *C) {
@@ -75,6 +100,56 @@ func (s *AvahiSuite) TestErrorMdnsInit(c *C) {
 	newMDNS = defaultNewMDNS
 }
 
+func (s *AvahiSuite) TestUpdateHostname(c *C) {
+	var scanners []*recordingScanner
+	newMDNS = func(hostname, p1, p2 string, p3 bool, p4 int) (mdnsScanner, error) {
+		scanner := &recordingScanner{hostname: hostname}
+		scanners = append(scanners, scanner)
+		return scanner, nil
+	}
+
+	// nothing is registered before the initialization
+	s.mockHostname = "device"
+	c.Assert(UpdateHostname(), IsNil)
+	c.Check(scanners, HasLen, 0)
+
+	c.Assert(InitMDNS(s.logger), IsNil)
+	c.Assert(scanners, HasLen, 1)
+	c.Check(scanners[0].hostname, Equals, "device")
+
+	// unchanged hostname
+	c.Assert(UpdateHostname(), IsNil)
+	c.Check(scanners, HasLen, 1)
+
+	s.mockHostname = "kitchen.example.com"
+	c.Assert(UpdateHostname(), IsNil)
+	c.Assert(scanners, HasLen, 2)
+	c.Check(scanners[0].stopped, Equals, true)
+	c.Check(scanners[1].hostname, Equals, "kitchen")
+	c.Check(scanners[1].stopped, Equals, false)
+}
+
+func (s *AvahiSuite) TestUpdateHostnameRetries(c *C) {
+	newMDNS = func(hostname, p1, p2 string, p3 bool, p4 int) (mdnsScanner, error) {
+		return &NullMdnsScanner{}, nil
+	}
+	s.mockHostname = "device"
+	c.Assert(InitMDNS(s.logger), IsNil)
+
+	s.mockHostname = "kitchen"
+	newMDNS = func(hostname, p1, p2 string, p3 bool, p4 int) (mdnsScanner, error) {
+		return nil, errors.New("Error")
+	}
+	c.Check(UpdateHostname(), NotNil)
+
+	// the same name is registered again once possible
+	newMDNS = func(hostname, p1, p2 string, p3 bool, p4 int) (mdnsScanner, error) {
+		return &recordingScanner{hostname: hostname}, nil
+	}
+	c.Assert(UpdateHostname(), IsNil)
+	c.Check(_mdns.(*recordingScanner).hostname, Equals, "kitchen")
+}
+
 /*
 func (s *AvahiSuite) TestLoopLocalAddressOnly(c *C) {
 	netInterfaceAddrs = func() ([]net.Addr, error) {
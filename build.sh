@@ -66,6 +66,8 @@ gobuild() {
     GOARCH=$arch GOARM=7 CGO_ENABLED=1 CC=${plat_abi}-gcc go build ${build_tags} github.com/snapcore/snapweb/cmd/snapweb
     GOARCH=$arch GOARM=7 CGO_ENABLED=1 CC=${plat_abi}-gcc go build -o generate-token -ldflags "-extld=${plat_abi}-gcc" $srcdir/cmd/generate-token/main.go
     cp generate-token ../../
+    GOARCH=$arch GOARM=7 CGO_ENABLED=1 CC=${plat_abi}-gcc go build ${build_tags} -o config-check -ldflags "-extld=${plat_abi}-gcc" github.com/snapcore/snapweb/cmd/config-check
+    cp config-check ../../
     cd - > /dev/null
 }
 
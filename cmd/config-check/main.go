@@ -0,0 +1,64 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/snapcore/snapweb/snappy/app"
+)
+
+var importSnapctl = flag.Bool("import-snapctl", false,
+	"import the values set with \"snap set\" (used by the configure hook)")
+
+// printConfig writes the effective configuration, merged from all the
+// configuration sources, to w
+func printConfig(w io.Writer) error {
+	config, err := snappy.ReadConfig()
+	if err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, string(out))
+	return nil
+}
+
+func main() {
+	flag.Parse()
+
+	var err error
+	if *importSnapctl {
+		err = snappy.ImportSnapctlConfig()
+	} else {
+		err = printConfig(os.Stdout)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
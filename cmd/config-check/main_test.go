@@ -0,0 +1,69 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapweb/snappy/app"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ConfigCheckSuite struct {
+	snapcommon string
+}
+
+var _ = Suite(&ConfigCheckSuite{})
+
+func (s *ConfigCheckSuite) SetUpTest(c *C) {
+	s.snapcommon = c.MkDir()
+	os.Setenv("SNAP_COMMON", s.snapcommon)
+	os.Setenv("SNAP_DATA", c.MkDir())
+}
+
+func (s *ConfigCheckSuite) TestPrintConfig(c *C) {
+	c.Assert(ioutil.WriteFile(filepath.Join(s.snapcommon, "settings.json"),
+		[]byte(`{"disableHttps": true}`), 0644), IsNil)
+
+	var out bytes.Buffer
+	c.Assert(printConfig(&out), IsNil)
+
+	var config snappy.Config
+	c.Assert(json.Unmarshal(out.Bytes(), &config), IsNil)
+
+	expected := snappy.DefaultConfig()
+	expected.DisableHTTPS = true
+	c.Assert(config, DeepEquals, expected)
+}
+
+func (s *ConfigCheckSuite) TestPrintInvalidConfig(c *C) {
+	c.Assert(ioutil.WriteFile(filepath.Join(s.snapcommon, "settings.json"),
+		[]byte(`{"httpPort": 70000}`), 0644), IsNil)
+
+	var out bytes.Buffer
+	c.Assert(printConfig(&out), ErrorMatches, "Invalid configuration: Invalid httpPort: 70000 is not a port number between 1 and 65535")
+	c.Assert(out.Len(), Equals, 0)
+}
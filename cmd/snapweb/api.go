@@ -29,18 +29,39 @@ import (
 const apiVersion = "v2"
 
 // makeAPIHandler create a handler for all API calls that need authorization
-func makeAPIHandler(apiRootPath string, config snappy.Config) http.Handler {
+func makeAPIHandler(apiRootPath string, settings *snappy.ConfigWatcher) http.Handler {
 	var apiPath = path.Join(apiRootPath, apiVersion)
 
 	router := mux.NewRouter().PathPrefix(apiPath).Subrouter()
-	router.Handle("/packages/", snappy.NewHandler().MakeMuxer("/packages", router))
+	router.Handle("/packages/", snappy.NewHandler(settings).MakeMuxer("/packages", router))
 	router.HandleFunc("/validate-token", validateToken)
 	router.HandleFunc("/sections", handleSections)
+	router.HandleFunc("/assertions", handleAssertions)
+	router.HandleFunc("/assertions/{type}", handleAssertionType)
 	router.HandleFunc("/time-info", handleTimeInfo)
+	router.HandleFunc("/timezones", handleTimezones)
+	router.HandleFunc("/locale", handleLocale)
 	router.HandleFunc("/device-info", handleDeviceInfo)
 	router.HandleFunc("/device-action", handleDeviceAction)
+	router.Handle("/settings", makeSettingsHandler(settings))
+	router.Handle("/certificate", makeCertificateHandler(settings))
+	router.Handle("/certificate/ca", makeCertificateAuthorityHandler(settings))
+	router.Handle("/network", makeNetworkHandler(settings))
+	router.Handle("/network/confirm", makeNetworkChangeHandler(networkChanges.confirm))
+	router.Handle("/network/revert", makeNetworkChangeHandler(networkChanges.revert))
+	router.HandleFunc("/system/stats", handleSystemStats)
+	router.HandleFunc("/events", handleEvents)
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := settings.Config()
+
+		// clients authenticated by a certificate need no access token
+		if id, ok := authenticatedClient(r, config); ok {
+			logger.Printf("%s %s by client certificate %s", r.Method, r.URL.Path, id)
+			router.ServeHTTP(w, r)
+			return
+		}
+
 		if config.DisableAccessToken || SimpleCookieCheck(w, r) == nil {
 			router.ServeHTTP(w, r)
 		} else {
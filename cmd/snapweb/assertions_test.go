@@ -0,0 +1,223 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/client"
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapweb/snappy/app"
+	"github.com/snapcore/snapweb/snappy/snapdclient"
+)
+
+// headersAssertion is an assertion made of its headers only
+type headersAssertion map[string]interface{}
+
+func (a headersAssertion) Type() *asserts.AssertionType {
+	name, _ := a["type"].(string)
+	return asserts.Type(name)
+}
+
+func (a headersAssertion) Revision() int                   { return 0 }
+func (a headersAssertion) Header(name string) interface{}  { return a[name] }
+func (a headersAssertion) Headers() map[string]interface{} { return a }
+func (a headersAssertion) Body() []byte                    { return nil }
+
+func (a headersAssertion) Signature() (content, signature []byte) {
+	return []byte("type: " + a["type"].(string)), []byte("SIGNATURE")
+}
+
+type AssertionsSuite struct {
+	snapd   *snapdclient.FakeSnapdClient
+	handler http.Handler
+}
+
+var _ = Suite(&AssertionsSuite{})
+
+func (s *AssertionsSuite) SetUpTest(c *C) {
+	s.snapd = &snapdclient.FakeSnapdClient{
+		Assertions: map[string][]asserts.Assertion{
+			"account": {
+				headersAssertion{"type": "account", "account-id": "canonical", "validation": "certified"},
+				headersAssertion{"type": "account", "account-id": "acme", "validation": "unproven"},
+			},
+		},
+	}
+	newSnapdClient = func() snapdclient.SnapdClient {
+		return s.snapd
+	}
+
+	os.Setenv("SNAP_DATA", c.MkDir())
+	c.Assert(ioutil.WriteFile(tokenFilename(), []byte("1234"), 0600), IsNil)
+
+	s.handler = initURLHandlers(log.New(ioutil.Discard, "", 0), snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
+}
+
+func (s *AssertionsSuite) TearDownTest(c *C) {
+	newSnapdClient = newSnapdClientImpl
+}
+
+func (s *AssertionsSuite) request(c *C, method, url, contentType, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	c.Assert(err, IsNil)
+	req.Header.Set("Cookie", "SM=1234")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func (s *AssertionsSuite) TestGetAssertions(c *C) {
+	rec := s.request(c, "GET", "/api/v2/assertions/account", "", "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Check(rec.Header().Get("Content-Type"), Equals, "application/json")
+
+	var assertions []snapdclient.Assertion
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &assertions), IsNil)
+	c.Assert(assertions, HasLen, 2)
+	c.Check(assertions[0].Type, Equals, "account")
+	c.Check(assertions[0].Headers["account-id"], Equals, "canonical")
+	c.Check(assertions[0].Signed, Equals, "type: account\n\nSIGNATURE")
+}
+
+func (s *AssertionsSuite) TestGetAssertionsFiltered(c *C) {
+	rec := s.request(c, "GET", "/api/v2/assertions/account?validation=unproven", "", "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	var assertions []snapdclient.Assertion
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &assertions), IsNil)
+	c.Assert(assertions, HasLen, 1)
+	c.Check(assertions[0].Headers["account-id"], Equals, "acme")
+}
+
+func (s *AssertionsSuite) TestGetAssertionsUnknownType(c *C) {
+	rec := s.request(c, "GET", "/api/v2/assertions/fruit", "", "")
+	c.Check(rec.Code, Equals, http.StatusNotFound)
+}
+
+func (s *AssertionsSuite) TestGetAssertionsMalformed(c *C) {
+	s.snapd.Assertions["account"] = append(s.snapd.Assertions["account"],
+		headersAssertion{"type": "account", "account-id": "broken", "timestamp": 42})
+
+	rec := s.request(c, "GET", "/api/v2/assertions/account", "", "")
+	c.Check(rec.Code, Equals, http.StatusInternalServerError)
+}
+
+func (s *AssertionsSuite) TestGetAssertionsInvalidMethod(c *C) {
+	rec := s.request(c, "DELETE", "/api/v2/assertions/account", "", "")
+	c.Check(rec.Code, Equals, http.StatusMethodNotAllowed)
+
+	var resp snappy.ErrorResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), IsNil)
+	c.Check(resp, DeepEquals, snappy.ErrorResponse{Kind: "method-not-allowed", Message: "Method DELETE not allowed"})
+}
+
+func (s *AssertionsSuite) TestAckAssertion(c *C) {
+	rec := s.request(c, "POST", "/api/v2/assertions", assertionContentType, "type: account\n\nSIGNATURE")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Check(rec.Body.String(), Equals, "{}")
+	c.Check(s.snapd.Acked, DeepEquals, [][]byte{[]byte("type: account\n\nSIGNATURE")})
+}
+
+func (s *AssertionsSuite) TestAckAssertionRefused(c *C) {
+	s.snapd.AckErr = &client.Error{Kind: client.ErrorKindLoginRequired, Message: "access denied"}
+
+	rec := s.request(c, "POST", "/api/v2/assertions", assertionContentType, "type: account\n\nSIGNATURE")
+	c.Check(rec.Code, Equals, http.StatusForbidden)
+
+	var resp snappy.ErrorResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), IsNil)
+	c.Check(resp, DeepEquals, snappy.ErrorResponse{
+		Kind:    "forbidden",
+		Message: "access denied",
+		Snapd:   &snappy.SnapdError{Kind: "login-required"},
+	})
+}
+
+func (s *AssertionsSuite) TestAckAssertionFailed(c *C) {
+	s.snapd.AckErr = errors.New("cannot assert: signature does not verify")
+
+	rec := s.request(c, "POST", "/api/v2/assertions", assertionContentType, "type: account\n\nFORGED")
+	c.Check(rec.Code, Equals, http.StatusInternalServerError)
+
+	var resp snappy.ErrorResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), IsNil)
+	c.Check(resp.Kind, Equals, "internal-error")
+	c.Check(resp.Message, Matches, "cannot assert: .*")
+}
+
+func (s *AssertionsSuite) TestAckAssertionInvalidContent(c *C) {
+	rec := s.request(c, "POST", "/api/v2/assertions", "application/json", "{}")
+	c.Check(rec.Code, Equals, http.StatusUnsupportedMediaType)
+
+	rec = s.request(c, "POST", "/api/v2/assertions", assertionContentType, "")
+	c.Check(rec.Code, Equals, http.StatusBadRequest)
+
+	rec = s.request(c, "POST", "/api/v2/assertions", assertionContentType, strings.Repeat("x", maxAssertionSize+1))
+	c.Check(rec.Code, Equals, http.StatusRequestEntityTooLarge)
+
+	// as large as allowed
+	rec = s.request(c, "POST", "/api/v2/assertions", assertionContentType, strings.Repeat("x", maxAssertionSize))
+	c.Check(rec.Code, Equals, http.StatusOK)
+	c.Check(s.snapd.Acked, HasLen, 1)
+	s.snapd.Acked = nil
+
+	c.Check(s.snapd.Acked, HasLen, 0)
+}
+
+// brokenBody fails as a client going away does
+type brokenBody struct{}
+
+func (brokenBody) Read([]byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func (s *AssertionsSuite) TestAckAssertionUnreadable(c *C) {
+	req, err := http.NewRequest("POST", "/api/v2/assertions", brokenBody{})
+	c.Assert(err, IsNil)
+	req.Header.Set("Cookie", "SM=1234")
+	req.Header.Set("Content-Type", assertionContentType)
+
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	c.Check(rec.Code, Equals, http.StatusBadRequest)
+
+	var resp snappy.ErrorResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), IsNil)
+	c.Check(resp.Message, Equals, "Cannot read the assertion: unexpected EOF")
+	c.Check(s.snapd.Acked, HasLen, 0)
+}
+
+func (s *AssertionsSuite) TestAckAssertionInvalidMethod(c *C) {
+	rec := s.request(c, "GET", "/api/v2/assertions", "", "")
+	c.Check(rec.Code, Equals, http.StatusMethodNotAllowed)
+}
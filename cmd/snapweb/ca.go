@@ -0,0 +1,190 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// files of the certificate authority signing the server certificates in
+	// local CA mode, in $SNAP_DATA. An operator can provide their own,
+	// otherwise one is generated for the device.
+	caCertFilename = "ca.pem"
+	caKeyFilename  = "ca.key"
+)
+
+// validity of the generated certificate authorities
+var caValidity = 10 * 365 * 24 * time.Hour
+
+func caCertPath() string {
+	return filepath.Join(os.Getenv("SNAP_DATA"), caCertFilename)
+}
+
+func caKeyPath() string {
+	return filepath.Join(os.Getenv("SNAP_DATA"), caKeyFilename)
+}
+
+// certAuthority signs the server certificates
+type certAuthority struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// issued checks whether a certificate was signed by the authority or, for a
+// nil authority, whether it is self-signed
+func (ca *certAuthority) issued(cert *x509.Certificate) bool {
+	if ca == nil {
+		return bytes.Equal(cert.RawIssuer, cert.RawSubject)
+	}
+	return cert.CheckSignatureFrom(ca.cert) == nil
+}
+
+// ensureCertificateFor makes sure the certificate exists and is up to date,
+// signed by the local certificate authority if the settings ask for it
+func ensureCertificateFor(settings certSettings) (bool, error) {
+	var ca *certAuthority
+	if settings.localCA {
+		var err error
+		if ca, err = loadCertificateAuthority(settings.keyType); err != nil {
+			return false, err
+		}
+	}
+
+	return ensureCertificate(settings.certFile, settings.keyFile, settings.keyType, ca)
+}
+
+// loadCertificateAuthority reads the certificate authority from $SNAP_DATA,
+// generating it the first time with a key of the given type
+func loadCertificateAuthority(keyType string) (*certAuthority, error) {
+	_, err1 := os.Stat(caCertPath())
+	_, err2 := os.Stat(caKeyPath())
+
+	if os.IsNotExist(err1) && os.IsNotExist(err2) {
+		log.Println("Generating the local certificate authority")
+		if err := generateCertificateAuthority(caCertPath(), caKeyPath(), keyType); err != nil {
+			return nil, err
+		}
+	}
+
+	cert, err := readCertificate(caCertPath())
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read the certificate authority: %s", err)
+	}
+
+	if !cert.IsCA || cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return nil, fmt.Errorf("Invalid certificate authority %s: not allowed to sign certificates", caCertPath())
+	}
+
+	data, err := ioutil.ReadFile(caKeyPath())
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read the certificate authority key: %s", err)
+	}
+
+	key, err := parsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid certificate authority key %s: %s", caKeyPath(), err)
+	}
+
+	return &certAuthority{cert: cert, key: key}, nil
+}
+
+// parsePrivateKey decodes a PEM private key in PKCS#1, PKCS#8 or SEC 1 format
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New("unsupported private key format")
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+
+	return signer, nil
+}
+
+// generateCertificateAuthority creates a certificate authority for the device
+func generateCertificateAuthority(certFilename string, keyFilename string, keyType string) error {
+	priv, err := generateKey(keyType)
+	if err != nil {
+		return fmt.Errorf("Failed to generate private key: %s", err)
+	}
+
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return fmt.Errorf("Failed to generate serial number: %s", err)
+	}
+
+	name := "snapweb local CA"
+	if hostname, err := osHostname(); err == nil && hostname != "" {
+		name += " for " + hostname
+	}
+
+	notBefore := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{certOrganization},
+			CommonName:   name,
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, priv.Public(), priv)
+	if err != nil {
+		return fmt.Errorf("Failed to create certificate authority: %s", err)
+	}
+
+	if err := createPrivateKeyFile(keyFilename, priv); err != nil {
+		return err
+	}
+	return createPublicKeycertFile(certFilename, derBytes)
+}
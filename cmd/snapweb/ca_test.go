@@ -0,0 +1,222 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapweb/snappy/app"
+)
+
+type CASuite struct {
+	certFilename string
+	keyFilename  string
+}
+
+var _ = Suite(&CASuite{})
+
+func (s *CASuite) SetUpTest(c *C) {
+	os.Setenv("SNAP_DATA", c.MkDir())
+
+	s.certFilename = filepath.Join(os.Getenv("SNAP_DATA"), "cert.pem")
+	s.keyFilename = filepath.Join(os.Getenv("SNAP_DATA"), "key.pem")
+
+	osHostname = func() (string, error) { return "device", nil }
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{&net.IPNet{IP: net.ParseIP("192.168.0.2"), Mask: net.CIDRMask(24, 32)}}, nil
+	}
+}
+
+func (s *CASuite) settings(localCA bool) certSettings {
+	return certSettings{certFile: s.certFilename, keyFile: s.keyFilename, localCA: localCA}
+}
+
+func (s *CASuite) TearDownTest(c *C) {
+	osHostname = os.Hostname
+	interfaceAddrs = net.InterfaceAddrs
+}
+
+// verify checks the certificate chain served for the given host against the
+// certificate authority
+func (s *CASuite) verify(c *C, caCert *x509.Certificate, host string) error {
+	pair, err := tls.LoadX509KeyPair(s.certFilename, s.keyFilename)
+	c.Assert(err, IsNil)
+
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	c.Assert(err, IsNil)
+
+	intermediates := x509.NewCertPool()
+	for _, der := range pair.Certificate[1:] {
+		cert, err := x509.ParseCertificate(der)
+		c.Assert(err, IsNil)
+		intermediates.AddCert(cert)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	_, err = leaf.Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+func (s *CASuite) TestLocalCAChain(c *C) {
+	renewed, err := ensureCertificateFor(s.settings(true))
+	c.Assert(err, IsNil)
+	c.Check(renewed, Equals, true)
+
+	ca, err := readCertificate(caCertPath())
+	c.Assert(err, IsNil)
+	c.Check(ca.IsCA, Equals, true)
+	c.Check(ca.Subject.CommonName, Equals, "snapweb local CA for device")
+
+	for _, host := range []string{"localhost", "device", "device.local", "127.0.0.1", "::1", "192.168.0.2"} {
+		c.Check(s.verify(c, ca, host), IsNil, Commentf(host))
+	}
+	c.Check(s.verify(c, ca, "other.local"), NotNil)
+
+	// the certificate authority is kept across renewals
+	caData, err := ioutil.ReadFile(caCertPath())
+	c.Assert(err, IsNil)
+
+	c.Assert(os.Remove(s.certFilename), IsNil)
+	_, err = ensureCertificateFor(s.settings(true))
+	c.Assert(err, IsNil)
+
+	caData2, err := ioutil.ReadFile(caCertPath())
+	c.Assert(err, IsNil)
+	c.Check(caData2, DeepEquals, caData)
+	c.Check(s.verify(c, ca, "device.local"), IsNil)
+}
+
+func (s *CASuite) TestSwitchingMode(c *C) {
+	c.Assert(GenerateCertificate(s.certFilename, s.keyFilename), IsNil)
+
+	// a self-signed certificate is replaced by one signed by the authority
+	renewed, err := ensureCertificateFor(s.settings(true))
+	c.Assert(err, IsNil)
+	c.Check(renewed, Equals, true)
+
+	renewed, err = ensureCertificateFor(s.settings(true))
+	c.Assert(err, IsNil)
+	c.Check(renewed, Equals, false)
+
+	// and back
+	renewed, err = ensureCertificateFor(s.settings(false))
+	c.Assert(err, IsNil)
+	c.Check(renewed, Equals, true)
+
+	cert, err := readCertificate(s.certFilename)
+	c.Assert(err, IsNil)
+	c.Check((*certAuthority)(nil).issued(cert), Equals, true)
+}
+
+func (s *CASuite) TestOperatorCA(c *C) {
+	// an operator provided authority, with an ECDSA key in PKCS#8 format
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(42),
+		Subject:               pkix.Name{Organization: []string{"ACME"}, CommonName: "ACME fleet CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour * 365),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	c.Assert(err, IsNil)
+	keyDer, err := x509.MarshalPKCS8PrivateKey(priv)
+	c.Assert(err, IsNil)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	c.Assert(ioutil.WriteFile(caCertPath(), certPEM, 0644), IsNil)
+	c.Assert(ioutil.WriteFile(caKeyPath(), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600), IsNil)
+
+	_, err = ensureCertificateFor(s.settings(true))
+	c.Assert(err, IsNil)
+
+	ca, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+	c.Check(s.verify(c, ca, "device.local"), IsNil)
+	c.Check(s.verify(c, ca, "192.168.0.2"), IsNil)
+
+	// the operator files are left untouched
+	data, err := ioutil.ReadFile(caCertPath())
+	c.Assert(err, IsNil)
+	c.Check(data, DeepEquals, certPEM)
+}
+
+func (s *CASuite) TestInvalidOperatorCA(c *C) {
+	// a certificate that is not an authority
+	c.Assert(GenerateCertificate(caCertPath(), caKeyPath()), IsNil)
+
+	_, err := ensureCertificateFor(s.settings(true))
+	c.Check(err, ErrorMatches, "Invalid certificate authority .*: not allowed to sign certificates")
+
+	// only the key is there
+	c.Assert(os.Remove(caCertPath()), IsNil)
+	_, err = ensureCertificateFor(s.settings(true))
+	c.Check(err, ErrorMatches, "Cannot read the certificate authority: .*")
+}
+
+func (s *CASuite) TestCertificateAuthorityHandler(c *C) {
+	settings := snappy.NewConfigWatcher(snappy.Config{LocalCA: false})
+	handler := makeCertificateAuthorityHandler(settings)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/v2/certificate/ca", nil)
+	c.Assert(err, IsNil)
+	handler.ServeHTTP(rec, req)
+	c.Check(rec.Code, Equals, http.StatusNotFound)
+
+	handler = makeCertificateAuthorityHandler(snappy.NewConfigWatcher(snappy.Config{LocalCA: true}))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Check(rec.Header().Get("Content-Type"), Equals, "application/x-x509-ca-cert")
+
+	block, rest := pem.Decode(rec.Body.Bytes())
+	c.Assert(block, NotNil)
+	c.Check(block.Type, Equals, "CERTIFICATE")
+	c.Check(rest, HasLen, 0)
+
+	ca, err := readCertificate(caCertPath())
+	c.Assert(err, IsNil)
+	c.Check(block.Bytes, DeepEquals, ca.Raw)
+}
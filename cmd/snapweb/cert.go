@@ -18,104 +18,461 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"math/big"
 	"net"
 	"os"
-	"path/filepath"
+	"sync"
 	"time"
+
+	"github.com/snapcore/snapweb/snappy/app"
+)
+
+const (
+	// generated certificates are renewed this long before they expire
+	certRenewBefore = 30 * 24 * time.Hour
+	// organization of the certificates generated by snapweb, the only ones
+	// renewed automatically
+	certOrganization = "snapweb"
+)
+
+var (
+	// validity of the generated certificates
+	certValidity = 365 * 24 * time.Hour
+	// how often the certificate is checked for expiry and address changes
+	certCheckInterval = time.Minute
 )
 
-// DumpCertificate create the certificate & key files
-func DumpCertificate() {
-	certFilename := filepath.Join(os.Getenv("SNAP_DATA"), "cert.pem")
-	keyFilename := filepath.Join(os.Getenv("SNAP_DATA"), "key.pem")
+var (
+	osHostname     = os.Hostname
+	interfaceAddrs = net.InterfaceAddrs
+)
+
+// certificateNames lists the IP addresses and host names the device can be
+// reached at, to be used as subject alternative names
+func certificateNames() ([]net.IP, []string) {
+	ips := []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}
+	names := []string{"localhost"}
+
+	if addrs, err := interfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			// IPv6 link-local addresses can't be used without a zone
+			if !ok || ipnet.IP.IsLoopback() ||
+				(ipnet.IP.To4() == nil && ipnet.IP.IsLinkLocalUnicast()) {
+				continue
+			}
+			ips = append(ips, ipnet.IP)
+		}
+	} else {
+		log.Println("Unable to list the local addresses:", err)
+	}
+
+	if hostname, err := osHostname(); err == nil && hostname != "" && hostname != "localhost" {
+		names = append(names, hostname, hostname+".local")
+	}
+
+	return ips, names
+}
+
+// isGeneratedCertificate checks whether a certificate was generated by snapweb
+func isGeneratedCertificate(cert *x509.Certificate) bool {
+	return len(cert.Subject.Organization) == 1 && cert.Subject.Organization[0] == certOrganization
+}
+
+// needsRenewal checks whether a certificate expires soon or lacks some of
+// the given addresses and names
+func needsRenewal(cert *x509.Certificate, ips []net.IP, names []string) bool {
+	if time.Now().Add(certRenewBefore).After(cert.NotAfter) {
+		return true
+	}
+
+	for _, ip := range ips {
+		found := false
+		for _, certIP := range cert.IPAddresses {
+			if certIP.Equal(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return true
+		}
+	}
+
+	for _, name := range names {
+		if cert.VerifyHostname(name) != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+func readCertificate(certFilename string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(certFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found in %s", certFilename)
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// certSettings selects the certificate served over HTTPS
+type certSettings struct {
+	certFile string
+	keyFile  string
+	// whether the certificate is signed by the local certificate authority
+	localCA bool
+	// type of the generated keys, as in snappy.Config.KeyType
+	keyType string
+}
+
+func newCertSettings(config snappy.Config) certSettings {
+	return certSettings{
+		certFile: config.CertFile,
+		keyFile:  config.KeyFile,
+		localCA:  config.LocalCA,
+		keyType:  config.KeyType,
+	}
+}
+
+// DumpCertificate create the certificate & key files if they do not exist yet,
+// and renews the certificate generated by snapweb when it is about to expire or
+// when the addresses of the device changed
+func DumpCertificate(certFilename string, keyFilename string) error {
+	_, err := ensureCertificate(certFilename, keyFilename, "", nil)
+	return err
+}
 
+// ensureCertificate returns whether a new certificate was generated. The
+// certificate is signed by the given authority, or self-signed if nil.
+func ensureCertificate(certFilename string, keyFilename string, keyType string, ca *certAuthority) (bool, error) {
 	_, err1 := os.Stat(certFilename)
 	_, err2 := os.Stat(keyFilename)
 
-	// skip if both cert and key exist
-	if err1 == nil && err2 == nil {
-		return
+	// generate if either cert or key is missing
+	if err1 != nil || err2 != nil {
+		return true, generateCertificate(certFilename, keyFilename, keyType, ca)
+	}
+
+	cert, err := readCertificate(certFilename)
+	if err != nil {
+		// never overwrite what could be a certificate provided by the user
+		log.Printf("Keeping certificate %s as is: %v", certFilename, err)
+		return false, nil
+	}
+
+	if !isGeneratedCertificate(cert) {
+		return false, nil
+	}
+
+	ips, names := certificateNames()
+	if !needsRenewal(cert, ips, names) && ca.issued(cert) && publicKeyType(cert.PublicKey) == normalizeKeyType(keyType) {
+		return false, nil
+	}
+
+	log.Println("Renewing certificate", certFilename)
+	return true, generateCertificate(certFilename, keyFilename, keyType, ca)
+}
+
+// GenerateCertificate will generate a new self-signed certifiate for all the
+// addresses and host names of the device
+func GenerateCertificate(certFilename string, keyFilename string) error {
+	return generateCertificate(certFilename, keyFilename, "", nil)
+}
+
+// normalizeKeyType returns the key type to use, the default one if empty
+func normalizeKeyType(keyType string) string {
+	if keyType == "" {
+		return snappy.KeyTypeECDSA
+	}
+	return keyType
+}
+
+// generateKey creates a private key of the given type
+func generateKey(keyType string) (crypto.Signer, error) {
+	switch normalizeKeyType(keyType) {
+	case snappy.KeyTypeRSA:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case snappy.KeyTypeECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case snappy.KeyTypeEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
 	}
 
-	GenerateCertificate(certFilename, keyFilename)
+	return nil, fmt.Errorf("Unsupported key type %q", keyType)
+}
+
+// publicKeyType returns the key type of a public key
+func publicKeyType(pub crypto.PublicKey) string {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return snappy.KeyTypeRSA
+	case *ecdsa.PublicKey:
+		return snappy.KeyTypeECDSA
+	case ed25519.PublicKey:
+		return snappy.KeyTypeEd25519
+	}
+	return ""
 }
 
-// GenerateCertificate will generate a new self-signed certifiate at startup
-func GenerateCertificate(certFilename string, keyFilename string) {
+// generateCertificate generates a certificate for all the addresses and host
+// names of the device, signed by the given authority or self-signed if nil
+func generateCertificate(certFilename string, keyFilename string, keyType string, ca *certAuthority) error {
 	/* With help from https://golang.org/src/crypto/tls/generate_cert.go */
 
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	priv, err := generateKey(keyType)
 	if err != nil {
-		log.Fatalf("Failed to generate private key: %s", err)
-		return
+		return fmt.Errorf("Failed to generate private key: %s", err)
 	}
 
 	notBefore := time.Now()
-	validFor := 365 * 24 * time.Hour
-	notAfter := notBefore.Add(validFor)
+	notAfter := notBefore.Add(certValidity)
 
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
-		log.Fatalf("Failed to generate serial number: %s", err)
-		return
+		return fmt.Errorf("Failed to generate serial number: %s", err)
 	}
 
 	template := x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
-			Organization: []string{"snapweb"},
+			Organization: []string{certOrganization},
 		},
 		NotBefore:             notBefore,
 		NotAfter:              notAfter,
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 	}
 
-	// TODO: add other IP addresses and hostnames (check Avahi)
-	template.IPAddresses = append(template.IPAddresses, net.ParseIP("127.0.0.1"))
+	// only RSA keys are used for key encipherment
+	if _, ok := priv.(*rsa.PrivateKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	template.IPAddresses, template.DNSNames = certificateNames()
 	template.IsCA = false
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	parent, signer := &template, priv
+	var chain [][]byte
+	if ca != nil {
+		parent, signer = ca.cert, ca.key
+		// serve the authority along with the certificate
+		chain = append(chain, ca.cert.Raw)
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, parent, priv.Public(), signer)
 	if err != nil {
-		log.Fatalf("Failed to create certificate: %s", err)
-		return
+		return fmt.Errorf("Failed to create certificate: %s", err)
 	}
 
-	createPublicKeycertFile(certFilename, derBytes)
-	createPrivateKeyFile(keyFilename, priv)
+	if err := createPrivateKeyFile(keyFilename, priv); err != nil {
+		return err
+	}
+	return createPublicKeycertFile(certFilename, derBytes, chain...)
 }
 
-func createPublicKeycertFile(filename string, b []byte) error {
+func createPublicKeycertFile(filename string, b []byte, chain ...[]byte) error {
 	certOut, err := os.Create(filename)
 	if err != nil {
-		log.Fatalf("failed to open cert.pem for writing: %s", err)
+		log.Printf("failed to open %s for writing: %s", filename, err)
 		return err
 	}
 	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: b})
+	for _, c := range chain {
+		pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: c})
+	}
 	certOut.Close()
 	return nil
 }
 
-func createPrivateKeyFile(filename string, k *rsa.PrivateKey) error {
-	keyOut, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+// createPrivateKeyFile writes a private key in PKCS#8 format
+func createPrivateKeyFile(filename string, k crypto.Signer) error {
+	if k == nil {
+		return errors.New("Invalid private key context")
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(k)
 	if err != nil {
-		log.Fatal("failed to open key.pem for writing:", err)
 		return err
 	}
-	if k == nil {
-		return errors.New("Invalid private key context")
+	keyOut, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Printf("failed to open %s for writing: %s", filename, err)
+		return err
 	}
-	pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)})
+	pem.Encode(keyOut, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
 	keyOut.Close()
 	return nil
 }
+
+// writeFileAtomic replaces a file so that readers never see it half written
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmp := filename + ".new"
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// certManager serves the current certificate to the TLS listeners, and
+// swaps it without a restart when it is renewed or replaced
+type certManager struct {
+	sync.RWMutex
+	settings certSettings
+	modTime  time.Time
+	cert     *tls.Certificate
+}
+
+// certificates is shared by all the HTTPS listeners
+var certificates = &certManager{}
+
+// load makes the given files the current certificate and key, generating
+// them first if needed
+func (m *certManager) load(settings certSettings) error {
+	if _, err := ensureCertificateFor(settings); err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(settings.certFile, settings.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var modTime time.Time
+	if fi, err := os.Stat(settings.certFile); err == nil {
+		modTime = fi.ModTime()
+	}
+
+	m.Lock()
+	m.settings = settings
+	m.modTime = modTime
+	m.cert = &cert
+	m.Unlock()
+
+	return nil
+}
+
+// GetCertificate is meant for tls.Config
+func (m *certManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	if m.cert == nil {
+		return nil, errors.New("No certificate loaded")
+	}
+	return m.cert, nil
+}
+
+// check renews the certificate if needed, and reloads it when the files
+// were modified
+func (m *certManager) check() error {
+	m.RLock()
+	settings, modTime := m.settings, m.modTime
+	m.RUnlock()
+
+	if settings.certFile == "" {
+		return nil
+	}
+
+	renewed, err := ensureCertificateFor(settings)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(settings.certFile)
+	if err != nil {
+		return err
+	}
+
+	if renewed || !fi.ModTime().Equal(modTime) {
+		log.Println("Reloading certificate", settings.certFile)
+		return m.load(settings)
+	}
+
+	return nil
+}
+
+// watch periodically checks the certificate in the background
+func (m *certManager) watch() {
+	go func() {
+		for range time.Tick(certCheckInterval) {
+			if err := m.check(); err != nil {
+				log.Println("Error while checking the certificate:", err)
+			}
+		}
+	}()
+}
+
+// replace installs a certificate and key pair provided by the user
+func (m *certManager) replace(certPEM []byte, keyPEM []byte, settings certSettings) error {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("Invalid certificate or key: %s", err)
+	}
+
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("Invalid certificate: %s", err)
+	}
+
+	if now := time.Now(); now.After(leaf.NotAfter) || now.Before(leaf.NotBefore) {
+		return fmt.Errorf("Invalid certificate: only valid from %s to %s", leaf.NotBefore, leaf.NotAfter)
+	}
+
+	if err := writeFileAtomic(settings.keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(settings.certFile, certPEM, 0644); err != nil {
+		return err
+	}
+
+	return m.load(settings)
+}
+
+// certificateInfo describes the certificate in use
+type certificateInfo struct {
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	NotBefore   time.Time `json:"notBefore"`
+	NotAfter    time.Time `json:"notAfter"`
+	DNSNames    []string  `json:"dnsNames"`
+	IPAddresses []string  `json:"ipAddresses"`
+	Generated   bool      `json:"generated"`
+}
+
+func newCertificateInfo(cert *x509.Certificate) certificateInfo {
+	info := certificateInfo{
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		DNSNames:  cert.DNSNames,
+		Generated: isGeneratedCertificate(cert),
+	}
+	for _, ip := range cert.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+	return info
+}
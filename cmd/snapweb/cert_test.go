@@ -18,11 +18,26 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"time"
 
 	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapweb/snappy/app"
 )
 
 type CertSuite struct {
@@ -41,21 +56,27 @@ func (s *CertSuite) SetUpTest(c *C) {
 	s.keyFilename = filepath.Join(os.Getenv("SNAP_DATA"), "key.pem")
 }
 
+func (s *CertSuite) settings() certSettings {
+	return certSettings{certFile: s.certFilename, keyFile: s.keyFilename}
+}
+
 func (s *CertSuite) TearDownTest(c *C) {
 	os.RemoveAll(s.snapdata)
+	osHostname = os.Hostname
+	interfaceAddrs = net.InterfaceAddrs
 }
 
 func (s *CertSuite) TestDumpCertificate(c *C) {
 	c.Assert(ioutil.WriteFile(s.certFilename, nil, 0600), IsNil)
 	c.Assert(ioutil.WriteFile(s.keyFilename, nil, 0600), IsNil)
 
-	DumpCertificate()
+	DumpCertificate(s.certFilename, s.keyFilename)
 	certData, err := ioutil.ReadFile(s.certFilename)
 	c.Assert(err, IsNil)
 	keyData, err := ioutil.ReadFile(s.keyFilename)
 	c.Assert(err, IsNil)
 
-	DumpCertificate()
+	DumpCertificate(s.certFilename, s.keyFilename)
 	certData2, err := ioutil.ReadFile(s.certFilename)
 	c.Assert(err, IsNil)
 	keyData2, err := ioutil.ReadFile(s.keyFilename)
@@ -76,3 +97,328 @@ func (s *CertSuite) TestGenerateCertificate(c *C) {
 	c.Assert(createPublicKeycertFile(s.certFilename, nil), IsNil)
 	c.Assert(createPrivateKeyFile(s.keyFilename, nil), NotNil)
 }
+
+func (s *CertSuite) fakeNames(hostname string, cidrs ...string) {
+	osHostname = func() (string, error) { return hostname, nil }
+	interfaceAddrs = func() ([]net.Addr, error) {
+		var addrs []net.Addr
+		for _, cidr := range cidrs {
+			ip, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+			ipnet.IP = ip
+			addrs = append(addrs, ipnet)
+		}
+		return addrs, nil
+	}
+}
+
+func (s *CertSuite) TestCertificateNames(c *C) {
+	s.fakeNames("device", "127.0.0.1/8", "192.168.0.2/24", "fe80::1/64", "fd00::2/64")
+
+	c.Assert(GenerateCertificate(s.certFilename, s.keyFilename), IsNil)
+
+	cert, err := readCertificate(s.certFilename)
+	c.Assert(err, IsNil)
+	c.Check(cert.DNSNames, DeepEquals, []string{"localhost", "device", "device.local"})
+
+	var ips []string
+	for _, ip := range cert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	c.Check(ips, DeepEquals, []string{"127.0.0.1", "::1", "192.168.0.2", "fd00::2"})
+
+	c.Check(cert.NotAfter.Sub(cert.NotBefore), Equals, certValidity)
+	c.Check(isGeneratedCertificate(cert), Equals, true)
+}
+
+func (s *CertSuite) TestRenewOnAddressChange(c *C) {
+	s.fakeNames("device", "192.168.0.2/24")
+	c.Assert(DumpCertificate(s.certFilename, s.keyFilename), IsNil)
+	certData, err := ioutil.ReadFile(s.certFilename)
+	c.Assert(err, IsNil)
+
+	// nothing changed
+	renewed, err := ensureCertificate(s.certFilename, s.keyFilename, "", nil)
+	c.Assert(err, IsNil)
+	c.Check(renewed, Equals, false)
+
+	s.fakeNames("device", "192.168.1.2/24")
+	renewed, err = ensureCertificate(s.certFilename, s.keyFilename, "", nil)
+	c.Assert(err, IsNil)
+	c.Check(renewed, Equals, true)
+
+	certData2, err := ioutil.ReadFile(s.certFilename)
+	c.Assert(err, IsNil)
+	c.Check(certData2, Not(DeepEquals), certData)
+
+	cert, err := readCertificate(s.certFilename)
+	c.Assert(err, IsNil)
+	c.Check(cert.VerifyHostname("192.168.1.2"), IsNil)
+
+	// so does a new host name
+	s.fakeNames("other", "192.168.1.2/24")
+	renewed, err = ensureCertificate(s.certFilename, s.keyFilename, "", nil)
+	c.Assert(err, IsNil)
+	c.Check(renewed, Equals, true)
+}
+
+func (s *CertSuite) TestRenewBeforeExpiry(c *C) {
+	s.fakeNames("device")
+
+	certValidity = certRenewBefore + time.Hour
+	c.Assert(GenerateCertificate(s.certFilename, s.keyFilename), IsNil)
+	renewed, err := ensureCertificate(s.certFilename, s.keyFilename, "", nil)
+	c.Assert(err, IsNil)
+	c.Check(renewed, Equals, false)
+
+	certValidity = certRenewBefore - time.Hour
+	c.Assert(GenerateCertificate(s.certFilename, s.keyFilename), IsNil)
+	certValidity = 365 * 24 * time.Hour
+	renewed, err = ensureCertificate(s.certFilename, s.keyFilename, "", nil)
+	c.Assert(err, IsNil)
+	c.Check(renewed, Equals, true)
+
+	cert, err := readCertificate(s.certFilename)
+	c.Assert(err, IsNil)
+	c.Check(cert.NotAfter.After(time.Now().Add(300*24*time.Hour)), Equals, true)
+}
+
+// userCertificate creates a certificate pair as if it was provided by the user
+func userCertificate(c *C, notAfter time.Time) ([]byte, []byte) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"ACME"}, CommonName: "device.example.com"},
+		DNSNames:     []string{"device.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	c.Assert(err, IsNil)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	return certPEM, keyPEM
+}
+
+func (s *CertSuite) TestUserCertificateIsNotRenewed(c *C) {
+	s.fakeNames("device", "192.168.0.2/24")
+
+	// expiring soon, and without any of the device addresses
+	certPEM, keyPEM := userCertificate(c, time.Now().Add(24*time.Hour))
+	c.Assert(ioutil.WriteFile(s.certFilename, certPEM, 0644), IsNil)
+	c.Assert(ioutil.WriteFile(s.keyFilename, keyPEM, 0600), IsNil)
+
+	renewed, err := ensureCertificate(s.certFilename, s.keyFilename, "", nil)
+	c.Assert(err, IsNil)
+	c.Check(renewed, Equals, false)
+
+	data, err := ioutil.ReadFile(s.certFilename)
+	c.Assert(err, IsNil)
+	c.Check(data, DeepEquals, certPEM)
+}
+
+func (s *CertSuite) TestCertManagerHotSwap(c *C) {
+	s.fakeNames("device", "192.168.0.2/24")
+
+	m := &certManager{}
+	_, err := m.GetCertificate(nil)
+	c.Check(err, NotNil)
+
+	c.Assert(m.load(s.settings()), IsNil)
+	first, err := m.GetCertificate(nil)
+	c.Assert(err, IsNil)
+
+	// no change, same certificate
+	c.Assert(m.check(), IsNil)
+	same, err := m.GetCertificate(nil)
+	c.Assert(err, IsNil)
+	c.Check(same, Equals, first)
+
+	// the address changes, the certificate is renewed and swapped
+	s.fakeNames("device", "192.168.1.2/24")
+	c.Assert(m.check(), IsNil)
+	renewed, err := m.GetCertificate(nil)
+	c.Assert(err, IsNil)
+	c.Check(renewed, Not(Equals), first)
+
+	leaf, err := x509.ParseCertificate(renewed.Certificate[0])
+	c.Assert(err, IsNil)
+	c.Check(leaf.VerifyHostname("192.168.1.2"), IsNil)
+
+	// a valid user certificate replaces it
+	certPEM, keyPEM := userCertificate(c, time.Now().Add(24*time.Hour))
+	c.Assert(m.replace(certPEM, keyPEM, s.settings()), IsNil)
+	replaced, err := m.GetCertificate(nil)
+	c.Assert(err, IsNil)
+	leaf, err = x509.ParseCertificate(replaced.Certificate[0])
+	c.Assert(err, IsNil)
+	c.Check(leaf.Subject.CommonName, Equals, "device.example.com")
+
+	// mismatched or expired pairs are rejected, keeping the current one
+	_, otherKey := userCertificate(c, time.Now().Add(24*time.Hour))
+	c.Check(m.replace(certPEM, otherKey, s.settings()), ErrorMatches, "Invalid certificate or key: .*")
+	expiredCert, expiredKey := userCertificate(c, time.Now().Add(-time.Minute))
+	c.Check(m.replace(expiredCert, expiredKey, s.settings()), ErrorMatches, "Invalid certificate: only valid from .*")
+
+	current, err := m.GetCertificate(nil)
+	c.Assert(err, IsNil)
+	c.Check(current, Equals, replaced)
+}
+
+func (s *CertSuite) TestCertificateHandler(c *C) {
+	s.fakeNames("device", "192.168.0.2/24")
+
+	handler := makeCertificateHandler(snappy.NewConfigWatcher(snappy.Config{
+		CertFile: s.certFilename,
+		KeyFile:  s.keyFilename,
+	}))
+	c.Assert(DumpCertificate(s.certFilename, s.keyFilename), IsNil)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/v2/certificate", nil)
+	c.Assert(err, IsNil)
+	handler.ServeHTTP(rec, req)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	var info certificateInfo
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &info), IsNil)
+	c.Check(info.Generated, Equals, true)
+	c.Check(info.DNSNames, DeepEquals, []string{"localhost", "device", "device.local"})
+
+	certPEM, keyPEM := userCertificate(c, time.Now().Add(24*time.Hour))
+	body, err := json.Marshal(certificateUpload{Certificate: string(certPEM), Key: string(keyPEM)})
+	c.Assert(err, IsNil)
+
+	rec = httptest.NewRecorder()
+	req, err = http.NewRequest("PUT", "/api/v2/certificate", bytes.NewReader(body))
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "application/json")
+	handler.ServeHTTP(rec, req)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &info), IsNil)
+	c.Check(info.Generated, Equals, false)
+	c.Check(info.DNSNames, DeepEquals, []string{"device.example.com"})
+
+	data, err := ioutil.ReadFile(s.certFilename)
+	c.Assert(err, IsNil)
+	c.Check(data, DeepEquals, certPEM)
+
+	// an invalid pair is refused
+	body, err = json.Marshal(certificateUpload{Certificate: string(certPEM), Key: "garbage"})
+	c.Assert(err, IsNil)
+	rec = httptest.NewRecorder()
+	req, err = http.NewRequest("PUT", "/api/v2/certificate", bytes.NewReader(body))
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "application/json")
+	handler.ServeHTTP(rec, req)
+	c.Check(rec.Code, Equals, http.StatusBadRequest)
+
+	// and the generated certificate can be restored
+	rec = httptest.NewRecorder()
+	req, err = http.NewRequest("DELETE", "/api/v2/certificate", nil)
+	c.Assert(err, IsNil)
+	handler.ServeHTTP(rec, req)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &info), IsNil)
+	c.Check(info.Generated, Equals, true)
+}
+
+func (s *CertSuite) TestKeyTypes(c *C) {
+	s.fakeNames("device")
+
+	for _, keyType := range []string{snappy.KeyTypeRSA, snappy.KeyTypeECDSA, snappy.KeyTypeEd25519} {
+		c.Assert(generateCertificate(s.certFilename, s.keyFilename, keyType, nil), IsNil)
+
+		cert, err := readCertificate(s.certFilename)
+		c.Assert(err, IsNil)
+		c.Check(publicKeyType(cert.PublicKey), Equals, keyType)
+
+		// keys are written in PKCS#8 format
+		data, err := ioutil.ReadFile(s.keyFilename)
+		c.Assert(err, IsNil)
+		block, _ := pem.Decode(data)
+		c.Assert(block, NotNil)
+		c.Check(block.Type, Equals, "PRIVATE KEY")
+		_, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		c.Check(err, IsNil)
+
+		_, err = tls.LoadX509KeyPair(s.certFilename, s.keyFilename)
+		c.Check(err, IsNil, Commentf(keyType))
+	}
+
+	// the default is ECDSA
+	c.Assert(GenerateCertificate(s.certFilename, s.keyFilename), IsNil)
+	cert, err := readCertificate(s.certFilename)
+	c.Assert(err, IsNil)
+	c.Check(publicKeyType(cert.PublicKey), Equals, snappy.KeyTypeECDSA)
+
+	// changing the key type renews the certificate
+	renewed, err := ensureCertificate(s.certFilename, s.keyFilename, snappy.KeyTypeEd25519, nil)
+	c.Assert(err, IsNil)
+	c.Check(renewed, Equals, true)
+	renewed, err = ensureCertificate(s.certFilename, s.keyFilename, snappy.KeyTypeEd25519, nil)
+	c.Assert(err, IsNil)
+	c.Check(renewed, Equals, false)
+}
+
+func (s *CertSuite) TestTLSConfig(c *C) {
+	config, err := newTLSConfig(tlsSettings{minVersion: snappy.TLSVersion12})
+	c.Assert(err, IsNil)
+	c.Check(config.MinVersion, Equals, uint16(tls.VersionTLS12))
+	c.Check(config.CipherSuites, DeepEquals, tlsCipherSuites)
+	c.Check(config.GetCertificate, NotNil)
+
+	for _, id := range config.CipherSuites {
+		for _, insecure := range tls.InsecureCipherSuites() {
+			c.Check(id, Not(Equals), insecure.ID)
+		}
+	}
+
+	config, err = newTLSConfig(tlsSettings{minVersion: snappy.TLSVersion13})
+	c.Assert(err, IsNil)
+	c.Check(config.MinVersion, Equals, uint16(tls.VersionTLS13))
+}
+
+func (s *CertSuite) TestTLSHandshake(c *C) {
+	s.fakeNames("device")
+
+	m := &certManager{}
+	c.Assert(m.load(certSettings{certFile: s.certFilename, keyFile: s.keyFilename, keyType: snappy.KeyTypeEd25519}), IsNil)
+
+	config, err := newTLSConfig(tlsSettings{minVersion: snappy.TLSVersion12})
+	c.Assert(err, IsNil)
+	config.GetCertificate = m.GetCertificate
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	ca, err := readCertificate(s.certFilename)
+	c.Assert(err, IsNil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	// old protocol versions are refused
+	_, err = tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{
+		RootCAs:    roots,
+		ServerName: "localhost",
+		MaxVersion: tls.VersionTLS11,
+	})
+	c.Check(err, NotNil)
+
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{
+		RootCAs:    roots,
+		ServerName: "localhost",
+	})
+	c.Assert(err, IsNil)
+	conn.Close()
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/snapcore/snapweb/snappy/app"
+)
+
+// clientIdentity describes a client authenticated by a certificate
+type clientIdentity struct {
+	Subject string
+	Role    string
+}
+
+func (id clientIdentity) String() string {
+	return fmt.Sprintf("%q (role %s)", id.Subject, id.Role)
+}
+
+// loadClientCAs reads the bundle of authorities issuing client certificates
+func loadClientCAs(filename string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read the client certificate authorities: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificate found in %s", filename)
+	}
+
+	return pool, nil
+}
+
+// authenticatedClient returns the identity of the client when it presented a
+// verified certificate whose subject has a role. The TLS layer only
+// populates the verified chains when client certificates are enabled.
+func authenticatedClient(r *http.Request, config snappy.Config) (clientIdentity, bool) {
+	if config.ClientAuth == "" || config.ClientAuth == snappy.ClientAuthOff ||
+		r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return clientIdentity{}, false
+	}
+
+	leaf := r.TLS.VerifiedChains[0][0]
+	subject := leaf.Subject.String()
+
+	role, ok := config.ClientRoles[subject]
+	if !ok && leaf.Subject.CommonName != "" {
+		role, ok = config.ClientRoles[leaf.Subject.CommonName]
+	}
+	if !ok {
+		logger.Printf("Client certificate %q has no role, ignoring it", subject)
+		return clientIdentity{}, false
+	}
+
+	return clientIdentity{Subject: subject, Role: role}, true
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapweb/snappy/app"
+	"github.com/snapcore/snapweb/snappy/snapdclient"
+)
+
+type ClientAuthSuite struct {
+	caFilename string
+	ca         *certAuthority
+}
+
+var _ = Suite(&ClientAuthSuite{})
+
+func (s *ClientAuthSuite) SetUpTest(c *C) {
+	newSnapdClient = func() snapdclient.SnapdClient {
+		return &snapdclient.FakeSnapdClient{}
+	}
+
+	os.Setenv("SNAP_DATA", c.MkDir())
+	c.Assert(ioutil.WriteFile(tokenFilename(), []byte("1234"), 0600), IsNil)
+
+	s.caFilename = filepath.Join(os.Getenv("SNAP_DATA"), "clients.pem")
+	keyFilename := filepath.Join(os.Getenv("SNAP_DATA"), "clients.key")
+	c.Assert(generateCertificateAuthority(s.caFilename, keyFilename, snappy.KeyTypeECDSA), IsNil)
+
+	cert, err := readCertificate(s.caFilename)
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(keyFilename)
+	c.Assert(err, IsNil)
+	key, err := parsePrivateKey(data)
+	c.Assert(err, IsNil)
+	s.ca = &certAuthority{cert: cert, key: key}
+}
+
+func (s *ClientAuthSuite) TearDownTest(c *C) {
+	newSnapdClient = newSnapdClientImpl
+}
+
+// clientCertificate issues a client certificate for the given common name
+func (s *ClientAuthSuite) clientCertificate(c *C, commonName string) tls.Certificate {
+	priv, err := generateKey(snappy.KeyTypeECDSA)
+	c.Assert(err, IsNil)
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{Organization: []string{"operators"}, CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, s.ca.cert, priv.Public(), s.ca.key)
+	c.Assert(err, IsNil)
+	leaf, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv, Leaf: leaf}
+}
+
+func (s *ClientAuthSuite) TestLoadClientCAs(c *C) {
+	pool, err := loadClientCAs(s.caFilename)
+	c.Assert(err, IsNil)
+	c.Check(pool, NotNil)
+
+	_, err = loadClientCAs(filepath.Join(os.Getenv("SNAP_DATA"), "missing.pem"))
+	c.Check(err, ErrorMatches, "Cannot read the client certificate authorities: .*")
+
+	empty := filepath.Join(os.Getenv("SNAP_DATA"), "empty.pem")
+	c.Assert(ioutil.WriteFile(empty, []byte("nothing here"), 0600), IsNil)
+	_, err = loadClientCAs(empty)
+	c.Check(err, ErrorMatches, "No certificate found in .*")
+}
+
+func (s *ClientAuthSuite) TestTLSConfigClientAuth(c *C) {
+	tests := []struct {
+		mode     string
+		expected tls.ClientAuthType
+	}{
+		{snappy.ClientAuthOff, tls.NoClientCert},
+		{snappy.ClientAuthOptional, tls.VerifyClientCertIfGiven},
+		{snappy.ClientAuthRequired, tls.RequireAndVerifyClientCert},
+	}
+
+	for _, t := range tests {
+		config, err := newTLSConfig(tlsSettings{clientAuth: t.mode, clientCAFile: s.caFilename})
+		c.Assert(err, IsNil)
+		c.Check(config.ClientAuth, Equals, t.expected, Commentf("%s", t.mode))
+		c.Check(config.ClientCAs != nil, Equals, t.mode != snappy.ClientAuthOff)
+	}
+
+	_, err := newTLSConfig(tlsSettings{
+		clientAuth:   snappy.ClientAuthRequired,
+		clientCAFile: filepath.Join(os.Getenv("SNAP_DATA"), "missing.pem"),
+	})
+	c.Check(err, NotNil)
+}
+
+func (s *ClientAuthSuite) TestAuthenticatedClient(c *C) {
+	cert := s.clientCertificate(c, "alice")
+	config := snappy.Config{
+		ClientAuth:   snappy.ClientAuthOptional,
+		ClientCAFile: s.caFilename,
+		ClientRoles:  map[string]string{"alice": "admin"},
+	}
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	_, ok := authenticatedClient(r, config)
+	c.Check(ok, Equals, false)
+
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert.Leaf, s.ca.cert}}}
+	id, ok := authenticatedClient(r, config)
+	c.Check(ok, Equals, true)
+	c.Check(id, Equals, clientIdentity{Subject: "CN=alice,O=operators", Role: "admin"})
+
+	// the full subject takes precedence over the common name
+	config.ClientRoles["CN=alice,O=operators"] = "viewer"
+	id, ok = authenticatedClient(r, config)
+	c.Check(ok, Equals, true)
+	c.Check(id.Role, Equals, "viewer")
+
+	// unknown subjects have no role
+	config.ClientRoles = map[string]string{"bob": "admin"}
+	_, ok = authenticatedClient(r, config)
+	c.Check(ok, Equals, false)
+
+	// certificates are ignored when client authentication is off
+	config.ClientRoles = map[string]string{"alice": "admin"}
+	config.ClientAuth = snappy.ClientAuthOff
+	_, ok = authenticatedClient(r, config)
+	c.Check(ok, Equals, false)
+}
+
+func (s *ClientAuthSuite) TestClientCertificateBypassesToken(c *C) {
+	cert := s.clientCertificate(c, "alice")
+	settings := snappy.NewConfigWatcher(snappy.Config{
+		DisableIPFilter: true,
+		ClientAuth:      snappy.ClientAuthOptional,
+		ClientCAFile:    s.caFilename,
+		ClientRoles:     map[string]string{"alice": "admin"},
+	})
+	handler := initURLHandlers(log.New(ioutil.Discard, "", 0), settings)
+
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert.Leaf, s.ca.cert}}}
+
+	// without a token nor a certificate
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v2/validate-token", nil)
+	handler.ServeHTTP(rec, req)
+	c.Check(rec.Code, Equals, http.StatusUnauthorized)
+
+	// with a certificate mapped to a role
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v2/validate-token", nil)
+	req.TLS = verified
+	handler.ServeHTTP(rec, req)
+	c.Check(rec.Code, Equals, http.StatusOK)
+
+	// with a certificate without role, the token is still needed
+	other := s.clientCertificate(c, "mallory")
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v2/validate-token", nil)
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{other.Leaf, s.ca.cert}}}
+	handler.ServeHTTP(rec, req)
+	c.Check(rec.Code, Equals, http.StatusUnauthorized)
+
+	req.AddCookie(&http.Cookie{Name: SnapwebCookieName, Value: "1234"})
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	c.Check(rec.Code, Equals, http.StatusOK)
+}
+
+func (s *ClientAuthSuite) TestRequiredClientCertificateHandshake(c *C) {
+	config, err := newTLSConfig(tlsSettings{
+		minVersion:   snappy.TLSVersion12,
+		clientAuth:   snappy.ClientAuthRequired,
+		clientCAFile: s.caFilename,
+	})
+	c.Assert(err, IsNil)
+
+	serverCert := s.clientCertificate(c, "server")
+	config.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return &serverCert, nil
+	}
+
+	subjects := make(chan string, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subjects <- r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}))
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	// the server certificate is not verified, only the client one matters here
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		InsecureSkipVerify: true,
+	}}}
+	_, err = anonymous.Get(server.URL)
+	c.Check(err, NotNil)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{s.clientCertificate(c, "alice")},
+	}}}
+	resp, err := client.Get(server.URL)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Check(<-subjects, Equals, "alice")
+}
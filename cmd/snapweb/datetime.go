@@ -19,9 +19,10 @@ package main
 
 import (
 	"bufio"
-	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"strings"
 	"time"
@@ -32,6 +33,18 @@ import (
 
 var timesyncdConfigurationFilePath = "/etc/systemd/timesyncd.conf"
 
+const timedateInterface = "org.freedesktop.timedate1"
+
+// timedateManager returns timedated, which sets the time, the time zone and
+// turns the time synchronization on and off
+var timedateManager = func() (dbus.BusObject, error) {
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	return bus.Object("org.freedesktop.timedate1", "/org/freedesktop/timedate1"), nil
+}
+
 // Write back directly, rather than write-tmp(in same dir)+rename, as per the
 // internals of ini package, although better, write accessible locations may
 // not be on the same filesystem, removing the advantage.
@@ -53,148 +66,369 @@ func saveTimeSyncd(confFile *ini.File) error {
 	return nil
 }
 
-func writeNTPServer(ntpServer string) error {
+// ntpServers are the NTP servers timesyncd is configured with
+type ntpServers struct {
+	// NTP servers are tried first, then the fallback ones
+	NTP         []string
+	FallbackNTP []string
+}
+
+// readTimesyncd reads the timesyncd configuration, with an empty Time
+// section if it has none
+func readTimesyncd() (*ini.File, *ini.Section, error) {
 	timesyncd, err := ini.Load(timesyncdConfigurationFilePath)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	section, err := timesyncd.GetSection("Time")
+	if err != nil {
+		if section, err = timesyncd.NewSection("Time"); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return timesyncd, section, nil
+}
+
+func keyServers(section *ini.Section, name string) []string {
+	if !section.HasKey(name) {
+		return []string{}
+	}
+	return strings.Fields(section.Key(name).String())
+}
+
+func setKeyServers(section *ini.Section, name string, servers []string) {
+	if len(servers) == 0 {
+		section.DeleteKey(name)
+		return
+	}
+	section.Key(name).SetValue(strings.Join(servers, " "))
+}
+
+func readNTPServers() (ntpServers, error) {
+	_, section, err := readTimesyncd()
+	if err != nil {
+		return ntpServers{NTP: []string{}, FallbackNTP: []string{}}, err
+	}
+
+	return ntpServers{
+		NTP:         keyServers(section, "NTP"),
+		FallbackNTP: keyServers(section, "FallbackNTP"),
+	}, nil
+}
+
+// writeNTPServers replaces the NTP and fallback NTP servers, a nil list
+// leaving the servers as they are and an empty one going back to the
+// defaults
+func writeNTPServers(servers ntpServers) error {
+	timesyncd, section, err := readTimesyncd()
 	if err != nil {
 		return err
 	}
 
-	if section.HasKey("NTP") {
-		ntpKey := section.Key("NTP")
-		servers := ntpKey.Strings(" ")
-
-		if ntpServer == "" {
-			if len(servers) > 0 {
-				servers = servers[1:]
-			}
-			if len(servers) == 0 {
-				section.DeleteKey("NTP")
-			} else {
-				ntpKey.SetValue(strings.Join(servers, " "))
-			}
-		} else {
-			if len(servers) > 0 && servers[0] == ntpServer {
-				return nil
-			}
-			servers = append([]string{ntpServer}, servers...)
-			ntpKey.SetValue(strings.Join(servers, " "))
+	if servers.NTP != nil {
+		setKeyServers(section, "NTP", servers.NTP)
+	}
+	if servers.FallbackNTP != nil {
+		setKeyServers(section, "FallbackNTP", servers.FallbackNTP)
+	}
+
+	return saveTimeSyncd(timesyncd)
+}
+
+// withPrimaryServer returns the servers with the given one first, or without
+// the first one when it is empty
+func withPrimaryServer(servers []string, primary string) []string {
+	result := []string{}
+	if primary == "" {
+		if len(servers) > 0 {
+			result = append(result, servers[1:]...)
 		}
-	} else {
-		if ntpServer == "" {
-			return nil
+		return result
+	}
+
+	result = append(result, primary)
+	for _, server := range servers {
+		if server != primary {
+			result = append(result, server)
 		}
-		_, err = section.NewKey("NTP", ntpServer)
-		if err != nil {
+	}
+	return result
+}
+
+// validateNTPServer checks a server is given by its IP address or hostname
+func validateNTPServer(server string) error {
+	if net.ParseIP(server) != nil {
+		return nil
+	}
+	if err := validateHostname(server); err != nil {
+		return fmt.Errorf("Invalid NTP server %q: neither an IP address nor a valid hostname", server)
+	}
+	return nil
+}
+
+func validateNTPServers(servers []string) error {
+	for _, server := range servers {
+		if err := validateNTPServer(server); err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
-	return saveTimeSyncd(timesyncd)
+var callDbusEndpoint = func(o dbus.BusObject, target string, args ...interface{}) error {
+	return o.Call(target, 0, args...).Err
 }
 
-var callDbusEndpoint = func(o dbus.BusObject, target string, v interface{}) error {
-	return o.Call(target, 0, v, false, false).Err
+var readDbusProperty = func(o dbus.BusObject, property string) (dbus.Variant, error) {
+	return o.GetProperty(property)
 }
 
-func updateTimeDate(verb string, v interface{}) error {
-	bus, err := dbus.SystemBus()
+func updateTimeDate(verb string, args ...interface{}) error {
+	timedate, err := timedateManager()
 	if err != nil {
 		return err
 	}
-	timedatectl := bus.Object("org.freedesktop.timedate1", "/org/freedesktop/timedate1")
-	target := fmt.Sprintf("org.freedesktop.timedate1.%s", verb)
-	return callDbusEndpoint(timedatectl, target, v)
-}
-
-func setTimeInfo(patch map[string]interface{}) error {
-	for k, v := range patch {
-		if k == "ntp" {
-			var ntp, ok bool
-			if ntp, ok = v.(bool); !ok {
-				return errors.New("Invalid NTP flag value type")
-			}
-			return updateTimeDate("SetNTP", ntp)
-		} else if k == "ntpServer" {
-			if err := writeNTPServer(v.(string)); err != nil {
-				return err
-			}
-		} else if k == "dateTime" {
-			var dateTime float64
-			var ok bool
-			if dateTime, ok = v.(float64); !ok {
-				return errors.New("Invalid date time option value type")
-			}
-			dateTime *= 1000000
-			return updateTimeDate("SetTime", int64(dateTime))
-
-		} else if k == "timezone" {
-			var timezone string
-			var ok bool
-			if timezone, ok = v.(string); !ok {
-				return errors.New("Invalid timezone option value type")
-			}
-			return updateTimeDate("SetTimezone", timezone)
+	return callDbusEndpoint(timedate, timedateInterface+"."+verb, args...)
+}
+
+// timePatch lists the time settings to change
+type timePatch struct {
+	NTP         *bool     `json:"ntp"`
+	NTPServers  *[]string `json:"ntpServers"`
+	FallbackNTP *[]string `json:"fallbackNTP"`
+	// NTPServer changes the first NTP server only, or removes it when empty
+	NTPServer *string `json:"ntpServer"`
+	Timezone  *string `json:"timezone"`
+	// DateTime is in seconds since the epoch
+	DateTime *float64 `json:"dateTime"`
+}
+
+// timeFieldResult is the outcome of the change of one of the settings
+type timeFieldResult struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+	// code is the HTTP status the outcome maps to
+	code int
+}
+
+// timeFieldOK is the result of a successful change
+var timeFieldOK = timeFieldResult{Status: "ok", code: http.StatusOK}
+
+// timePatchResult reports the outcome of every changed setting
+type timePatchResult struct {
+	Results map[string]timeFieldResult `json:"results"`
+}
+
+// status is the HTTP status of the whole change, the most severe of the
+// outcomes
+func (r timePatchResult) status() int {
+	status := http.StatusOK
+	for _, result := range r.Results {
+		if result.code > status {
+			status = result.code
+		}
+	}
+	return status
+}
+
+// validate checks all the settings, returning the invalid ones
+func (p timePatch) validate() map[string]timeFieldResult {
+	invalid := make(map[string]timeFieldResult)
+	reject := func(field string, err error) {
+		invalid[field] = timeFieldResult{Status: "invalid", Message: err.Error(), code: http.StatusBadRequest}
+	}
+
+	if p.NTPServers != nil {
+		if err := validateNTPServers(*p.NTPServers); err != nil {
+			reject("ntpServers", err)
+		}
+		if p.NTPServer != nil {
+			reject("ntpServer", fmt.Errorf("Cannot change both ntpServer and ntpServers"))
+		}
+	}
+	if p.FallbackNTP != nil {
+		if err := validateNTPServers(*p.FallbackNTP); err != nil {
+			reject("fallbackNTP", err)
 		}
 	}
+	if p.NTPServer != nil && *p.NTPServer != "" {
+		if err := validateNTPServer(*p.NTPServer); err != nil {
+			reject("ntpServer", err)
+		}
+	}
+	if p.Timezone != nil {
+		if err := validateTimezone(*p.Timezone); err != nil {
+			reject("timezone", err)
+		}
+	}
+	if p.DateTime != nil && *p.DateTime < 0 {
+		reject("dateTime", fmt.Errorf("Invalid date time %v: before the epoch", *p.DateTime))
+	}
 
-	return nil
+	return invalid
 }
 
-func readNTPServer() string {
-	timesyncd, err := ini.Load(timesyncdConfigurationFilePath)
-	if err != nil {
-		log.Printf("readNTPServer: unable to read %s", timesyncdConfigurationFilePath)
-		return ""
+// writeServers writes the NTP servers to change
+func (p timePatch) writeServers() error {
+	var servers ntpServers
+	if p.NTPServers != nil {
+		servers.NTP = append([]string{}, *p.NTPServers...)
+	}
+	if p.FallbackNTP != nil {
+		servers.FallbackNTP = append([]string{}, *p.FallbackNTP...)
+	}
+	if p.NTPServer != nil {
+		current, err := readNTPServers()
+		if err != nil {
+			return err
+		}
+		servers.NTP = withPrimaryServer(current.NTP, *p.NTPServer)
 	}
 
-	section, err := timesyncd.GetSection("Time")
-	if err != nil || !section.HasKey("NTP") {
-		return ""
+	return writeNTPServers(servers)
+}
+
+// timeFieldError maps the error of a change to its result: timedated
+// refuses to set the time while it is synchronized
+func timeFieldError(err error) timeFieldResult {
+	result := timeFieldResult{Status: "error", Message: err.Error(), code: http.StatusInternalServerError}
+
+	if dbusErr, ok := err.(dbus.Error); ok {
+		switch dbusErr.Name {
+		case "org.freedesktop.timedate1.AutomaticTimeSyncEnabled", "org.freedesktop.timedate1.NoNTPSupport":
+			result.code = http.StatusConflict
+		case "org.freedesktop.DBus.Error.InvalidArgs":
+			result.code = http.StatusBadRequest
+		case "org.freedesktop.DBus.Error.AccessDenied", "org.freedesktop.DBus.Error.InteractiveAuthorizationRequired":
+			result.code = http.StatusForbidden
+		}
 	}
 
-	servers := section.Key("NTP").Strings(" ")
-	if len(servers) == 0 {
-		return ""
+	return result
+}
+
+// setTimeInfo applies the settings in order: the NTP servers, the time
+// zone, the synchronization and the time, which timedated only accepts once
+// the synchronization is off. The settings are all checked beforehand, and a
+// failed one does not prevent the others from being applied.
+func setTimeInfo(patch timePatch) timePatchResult {
+	result := timePatchResult{Results: patch.validate()}
+	if len(result.Results) > 0 {
+		return result
 	}
 
-	return servers[0]
+	apply := func(field string, f func() error) {
+		if err := f(); err != nil {
+			log.Printf("setTimeInfo: cannot change %s: %v", field, err)
+			result.Results[field] = timeFieldError(err)
+			return
+		}
+		result.Results[field] = timeFieldOK
+	}
+
+	var serverFields []string
+	if patch.NTPServers != nil {
+		serverFields = append(serverFields, "ntpServers")
+	}
+	if patch.FallbackNTP != nil {
+		serverFields = append(serverFields, "fallbackNTP")
+	}
+	if patch.NTPServer != nil {
+		serverFields = append(serverFields, "ntpServer")
+	}
+	if len(serverFields) > 0 {
+		// the servers are written together, and share their outcome
+		outcome := timeFieldOK
+		if err := patch.writeServers(); err != nil {
+			log.Printf("setTimeInfo: cannot change the NTP servers: %v", err)
+			outcome = timeFieldError(err)
+		}
+		for _, field := range serverFields {
+			result.Results[field] = outcome
+		}
+	}
+
+	if patch.Timezone != nil {
+		apply("timezone", func() error {
+			return updateTimeDate("SetTimezone", *patch.Timezone, false)
+		})
+	}
+
+	if patch.NTP != nil {
+		apply("ntp", func() error {
+			return updateTimeDate("SetNTP", *patch.NTP, false)
+		})
+	}
+
+	if patch.DateTime != nil {
+		apply("dateTime", func() error {
+			// in microseconds, not relative to the current time
+			return updateTimeDate("SetTime", int64(*patch.DateTime*1000000), false, false)
+		})
+	}
+
+	return result
 }
 
-func getTimeInfo() (map[string]interface{}, error) {
-	bus, err := dbus.SystemBus()
+// timeInfo is the time of the device and its settings
+type timeInfo struct {
+	DateTime    int64    `json:"dateTime"`
+	Timezone    string   `json:"timezone"`
+	Offset      int      `json:"offset"`
+	NTP         bool     `json:"ntp"`
+	NTPServer   string   `json:"ntpServer"`
+	NTPServers  []string `json:"ntpServers"`
+	FallbackNTP []string `json:"fallbackNTP"`
+	// Sync tells how the clock is synchronized
+	Sync timeSyncStatus `json:"sync"`
+}
+
+func getTimeInfo() (timeInfo, error) {
+	timedate, err := timedateManager()
 	if err != nil {
-		return map[string]interface{}{}, err
+		return timeInfo{}, err
 	}
 
-	timedatectl := bus.Object("org.freedesktop.timedate1", "/org/freedesktop/timedate1")
-	timezone, err := timedatectl.GetProperty("org.freedesktop.timedate1.Timezone")
+	timezone, err := readDbusProperty(timedate, timedateInterface+".Timezone")
 	if err != nil {
-		return map[string]interface{}{}, err
+		return timeInfo{}, err
 	}
-
-	ntp, err := timedatectl.GetProperty("org.freedesktop.timedate1.NTP")
+	ntp, err := readDbusProperty(timedate, timedateInterface+".NTP")
 	if err != nil {
-		return map[string]interface{}{}, err
+		return timeInfo{}, err
+	}
+
+	var info timeInfo
+	var ok bool
+	if info.Timezone, ok = timezone.Value().(string); !ok {
+		return timeInfo{}, fmt.Errorf("Unexpected Timezone value %s", timezone)
+	}
+	if info.NTP, ok = ntp.Value().(bool); !ok {
+		return timeInfo{}, fmt.Errorf("Unexpected NTP value %s", ntp)
 	}
 
-	location, err := time.LoadLocation(timezone.Value().(string))
+	location, err := time.LoadLocation(info.Timezone)
 	if err != nil {
-		return map[string]interface{}{}, err
+		return timeInfo{}, err
 	}
 
 	now := time.Now().In(location) // Pick up changes in timezone
-	_, offset := now.Zone()
-
-	return map[string]interface{}{
-		"DateTime":  now.Unix(),
-		"Timezone":  timezone.Value().(string),
-		"Offset":    offset,
-		"NTP":       ntp.Value().(bool),
-		"NTPServer": readNTPServer(),
-	}, nil
+	info.DateTime = now.Unix()
+	_, info.Offset = now.Zone()
+
+	servers, err := readNTPServers()
+	if err != nil {
+		log.Printf("getTimeInfo: unable to read %s: %v", timesyncdConfigurationFilePath, err)
+	}
+	info.NTPServers = servers.NTP
+	info.FallbackNTP = servers.FallbackNTP
+	if len(servers.NTP) > 0 {
+		info.NTPServer = servers.NTP[0]
+	}
+
+	info.Sync = getTimeSyncStatus(timedate)
+
+	return info, nil
 }
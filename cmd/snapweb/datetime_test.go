@@ -18,13 +18,22 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/godbus/dbus"
 	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapweb/snappy/app"
+	"github.com/snapcore/snapweb/snappy/snapdclient"
 )
 
 const timesyncFileName = "timesyncd.conf"
@@ -40,106 +49,335 @@ NTP=`, strings.Join(ntpServers, " "))
 }
 
 type ReadNtpSuite struct {
-	ntpFilePath string
+	ntpFilePath     string
+	timedate        *fakeBusObject
+	timedateManager func() (dbus.BusObject, error)
+	timesyncManager func() (dbus.BusObject, error)
 }
 
 var _ = Suite(&ReadNtpSuite{})
 
 func (s *ReadNtpSuite) SetUpTest(c *C) {
 	s.ntpFilePath = c.MkDir()
+	timesyncdConfigurationFilePath = filepath.Join(s.ntpFilePath, timesyncFileName)
+
+	s.timedate = newFakeBusObject()
+	s.timedate.replies["org.freedesktop.timedate1.ListTimezones"] = []interface{}{
+		[]string{"America/Toronto", "Europe/Paris", "UTC"},
+	}
+	s.timedateManager = timedateManager
+	s.timesyncManager = timesyncManager
+	timesyncManager = func() (dbus.BusObject, error) {
+		return nil, errNoBus
+	}
+	timedateManager = func() (dbus.BusObject, error) {
+		return s.timedate, nil
+	}
+
+	newSnapdClient = func() snapdclient.SnapdClient {
+		return &snapdclient.FakeSnapdClient{}
+	}
+}
+
+func (s *ReadNtpSuite) TearDownTest(c *C) {
+	timesyncdConfigurationFilePath = "/etc/systemd/timesyncd.conf"
+	timedateManager = s.timedateManager
+	timesyncManager = s.timesyncManager
+	newSnapdClient = newSnapdClientImpl
+}
+
+func serverList(v ...string) *[]string {
+	return &v
 }
 
 func (s *ReadNtpSuite) TestReadNonExistentNTP(c *C) {
-	timesyncdConfigurationFilePath = filepath.Join(s.ntpFilePath, timesyncFileName)
-	c.Check(readNTPServer(), Equals, "")
+	servers, err := readNTPServers()
+	c.Check(err, NotNil)
+	c.Check(servers.NTP, HasLen, 0)
+	c.Check(servers.FallbackNTP, HasLen, 0)
 }
 
 func (s *ReadNtpSuite) TestReadInvalidNTP(c *C) {
-	timesyncdConfigurationFilePath = filepath.Join(s.ntpFilePath, timesyncFileName)
-	mockNTPFileContent(c, timesyncdConfigurationFilePath, "")
-	c.Check(readNTPServer(), Equals, "")
+	for _, content := range []string{"", "[Time]\n", "[Time]\nNTP=\n"} {
+		mockNTPFileContent(c, timesyncdConfigurationFilePath, content)
+		servers, err := readNTPServers()
+		c.Assert(err, IsNil)
+		c.Check(servers.NTP, HasLen, 0, Commentf("%q", content))
+	}
+
 	mockNTPFileContent(c, timesyncdConfigurationFilePath, "invalid")
-	c.Check(readNTPServer(), Equals, "")
-	mockNTPFileContent(c, timesyncdConfigurationFilePath, "[Time]\n")
-	c.Check(readNTPServer(), Equals, "")
+	servers, _ := readNTPServers()
+	c.Check(servers.NTP, HasLen, 0)
 }
 
 func (s *ReadNtpSuite) TestReadValidNTP(c *C) {
-	timesyncdConfigurationFilePath = filepath.Join(s.ntpFilePath, timesyncFileName)
-	ntpServer := "1.1.1.1"
 	mockNTPFileContent(c,
 		timesyncdConfigurationFilePath,
-		formatNTPContent([]string{ntpServer}))
-	c.Check(readNTPServer(), Equals, ntpServer)
+		formatNTPContent([]string{"1.1.1.1", "ntp.ubuntu.com"})+"FallbackNTP=time.example.com\n")
 
-	mockNTPFileContent(c,
-		timesyncdConfigurationFilePath,
-		formatNTPContent([]string{""}))
-	c.Check(readNTPServer(), Equals, "")
+	servers, err := readNTPServers()
+	c.Assert(err, IsNil)
+	c.Check(servers, DeepEquals, ntpServers{
+		NTP:         []string{"1.1.1.1", "ntp.ubuntu.com"},
+		FallbackNTP: []string{"time.example.com"},
+	})
 }
 
 func (s *ReadNtpSuite) TestWriteValidNTP(c *C) {
-	timesyncdConfigurationFilePath = filepath.Join(s.ntpFilePath, timesyncFileName)
-	var ntpServer interface{} = "1.1.1.1 2.2.2.2"
 	mockNTPFileContent(c,
 		timesyncdConfigurationFilePath,
 		formatNTPContent([]string{""}))
 
-	c.Assert(setTimeInfo(map[string]interface{}{"ntpServer": ntpServer}), IsNil)
-	ntpServer = "2.2.2.2"
+	result := setTimeInfo(timePatch{NTPServers: serverList("1.1.1.1", "2.2.2.2")})
+	c.Assert(result.status(), Equals, http.StatusOK)
+	c.Check(result.Results, DeepEquals, map[string]timeFieldResult{"ntpServers": timeFieldOK})
 
-	c.Assert(setTimeInfo(map[string]interface{}{"ntpServer": ntpServer}), IsNil)
-	c.Check(readNTPServer(), Equals, ntpServer)
+	ntpServer := "2.2.2.2"
+	c.Assert(setTimeInfo(timePatch{NTPServer: &ntpServer}).status(), Equals, http.StatusOK)
+	servers, err := readNTPServers()
+	c.Assert(err, IsNil)
+	c.Check(servers.NTP, DeepEquals, []string{"2.2.2.2", "1.1.1.1"})
 
-	c.Assert(setTimeInfo(map[string]interface{}{"ntpServer": ""}), IsNil)
-	c.Check(readNTPServer(), Equals, "1.1.1.1")
+	ntpServer = ""
+	c.Assert(setTimeInfo(timePatch{NTPServer: &ntpServer}).status(), Equals, http.StatusOK)
+	servers, _ = readNTPServers()
+	c.Check(servers.NTP, DeepEquals, []string{"1.1.1.1"})
 
 	mockNTPFileContent(c,
 		timesyncdConfigurationFilePath,
-		"[Time]")
+		"")
 
-	c.Assert(setTimeInfo(map[string]interface{}{"ntpServer": ""}), IsNil)
-	c.Check(readNTPServer(), Equals, "")
+	c.Assert(setTimeInfo(timePatch{NTPServer: &ntpServer}).status(), Equals, http.StatusOK)
+	servers, _ = readNTPServers()
+	c.Check(servers.NTP, HasLen, 0)
 
-	c.Assert(setTimeInfo(map[string]interface{}{"ntpServer": "1.1.1.1"}), IsNil)
-	c.Check(readNTPServer(), Equals, "1.1.1.1")
+	ntpServer = "1.1.1.1"
+	c.Assert(setTimeInfo(timePatch{NTPServer: &ntpServer}).status(), Equals, http.StatusOK)
+	servers, _ = readNTPServers()
+	c.Check(servers.NTP, DeepEquals, []string{"1.1.1.1"})
 }
 
-func (s *ReadNtpSuite) TestUpdateTimeZone(c *C) {
-	oldCallDbusEndpoint := callDbusEndpoint
-	callDbusEndpoint = func(o dbus.BusObject, target string, v interface{}) error {
-		return nil
+func (s *ReadNtpSuite) TestWriteFallbackNTP(c *C) {
+	mockNTPFileContent(c,
+		timesyncdConfigurationFilePath,
+		"# timesyncd\n[Time]\nNTP=ntp.ubuntu.com\nRootDistanceMaxSec=5\n")
+
+	c.Assert(setTimeInfo(timePatch{FallbackNTP: serverList("fd00::123", "time.example.com")}).status(), Equals, http.StatusOK)
+
+	servers, err := readNTPServers()
+	c.Assert(err, IsNil)
+	c.Check(servers, DeepEquals, ntpServers{
+		NTP:         []string{"ntp.ubuntu.com"},
+		FallbackNTP: []string{"fd00::123", "time.example.com"},
+	})
+
+	// an empty list goes back to the defaults
+	c.Assert(setTimeInfo(timePatch{NTPServers: serverList(), FallbackNTP: serverList()}).status(), Equals, http.StatusOK)
+	content, err := ioutil.ReadFile(timesyncdConfigurationFilePath)
+	c.Assert(err, IsNil)
+	c.Check(string(content), Not(Matches), "(?s).*NTP.*")
+	c.Check(string(content), Matches, "(?s).*RootDistanceMaxSec.*")
+}
+
+func (s *ReadNtpSuite) TestWriteNTPMissingFile(c *C) {
+	result := setTimeInfo(timePatch{NTPServers: serverList("1.1.1.1"), FallbackNTP: serverList("2.2.2.2")})
+	c.Check(result.status(), Equals, http.StatusInternalServerError)
+	c.Check(result.Results["ntpServers"].Status, Equals, "error")
+	c.Check(result.Results["fallbackNTP"].Status, Equals, "error")
+}
+
+func (s *ReadNtpSuite) TestValidateNTPServers(c *C) {
+	mockNTPFileContent(c, timesyncdConfigurationFilePath, "")
+
+	for _, server := range []string{"", "ntp server", "-ntp.example.com", "ntp..example.com", "1.1.1.1:123"} {
+		result := setTimeInfo(timePatch{NTPServers: serverList("ntp.ubuntu.com", server)})
+		c.Check(result.status(), Equals, http.StatusBadRequest, Commentf("%q", server))
+		c.Check(result.Results["ntpServers"].Status, Equals, "invalid")
 	}
-	defer func() {
-		callDbusEndpoint = oldCallDbusEndpoint
-	}()
 
-	c.Assert(setTimeInfo(map[string]interface{}{"timezone": "America/Toronto"}), IsNil)
-	c.Assert(setTimeInfo(map[string]interface{}{"timezone": 1}), NotNil)
+	result := setTimeInfo(timePatch{FallbackNTP: serverList("bad/server")})
+	c.Check(result.Results["fallbackNTP"].Message, Matches, `Invalid NTP server "bad/server": .*`)
+
+	ntpServer := "1.1.1.1"
+	result = setTimeInfo(timePatch{NTPServer: &ntpServer, NTPServers: serverList("2.2.2.2")})
+	c.Check(result.Results["ntpServer"].Message, Equals, "Cannot change both ntpServer and ntpServers")
+
+	// nothing was written
+	content, err := ioutil.ReadFile(timesyncdConfigurationFilePath)
+	c.Assert(err, IsNil)
+	c.Check(string(content), Equals, "")
 }
 
-func (s *ReadNtpSuite) TestUpdateTime(c *C) {
-	oldCallDbusEndpoint := callDbusEndpoint
-	callDbusEndpoint = func(o dbus.BusObject, target string, v interface{}) error {
-		return nil
+func (s *ReadNtpSuite) TestUpdateTimeZone(c *C) {
+	timezone := "America/Toronto"
+	c.Assert(setTimeInfo(timePatch{Timezone: &timezone}).status(), Equals, http.StatusOK)
+	c.Check(s.timedate.calls, DeepEquals, []fakeCall{
+		{Method: "org.freedesktop.timedate1.ListTimezones"},
+		{Method: "org.freedesktop.timedate1.SetTimezone", Args: []interface{}{"America/Toronto", false}},
+	})
+
+	for timezone, message := range map[string]string{
+		"":                "Invalid timezone: empty",
+		"america/toronto": `Unknown timezone "america/toronto", did you mean "America/Toronto"\?`,
+		"Canada/Toronto":  `Unknown timezone "Canada/Toronto", did you mean "America/Toronto"\?`,
+		"Mars/Olympus":    `Unknown timezone "Mars/Olympus", see /api/v2/timezones for the known ones`,
+	} {
+		timezone := timezone
+		result := setTimeInfo(timePatch{Timezone: &timezone})
+		c.Check(result.status(), Equals, http.StatusBadRequest)
+		c.Check(result.Results["timezone"].Message, Matches, message)
 	}
-	defer func() {
-		callDbusEndpoint = oldCallDbusEndpoint
-	}()
+	// only the first time zone was set
+	for _, call := range s.timedate.calls[2:] {
+		c.Check(call.Method, Equals, "org.freedesktop.timedate1.ListTimezones")
+	}
+}
 
-	c.Assert(setTimeInfo(map[string]interface{}{"dateTime": 1555001.0}), IsNil)
-	c.Assert(setTimeInfo(map[string]interface{}{"dateTime": ""}), NotNil)
+func (s *ReadNtpSuite) TestUpdateTime(c *C) {
+	dateTime := 1555001.5
+	c.Assert(setTimeInfo(timePatch{DateTime: &dateTime}).status(), Equals, http.StatusOK)
+	c.Check(s.timedate.calls, DeepEquals, []fakeCall{
+		{Method: "org.freedesktop.timedate1.SetTime", Args: []interface{}{int64(1555001500000), false, false}},
+	})
+
+	dateTime = -1
+	c.Check(setTimeInfo(timePatch{DateTime: &dateTime}).status(), Equals, http.StatusBadRequest)
 }
 
 func (s *ReadNtpSuite) TestUpdateNtpFlag(c *C) {
-	oldCallDbusEndpoint := callDbusEndpoint
-	callDbusEndpoint = func(o dbus.BusObject, target string, v interface{}) error {
-		return nil
+	ntp := false
+	c.Assert(setTimeInfo(timePatch{NTP: &ntp}).status(), Equals, http.StatusOK)
+	c.Check(s.timedate.calls, DeepEquals, []fakeCall{
+		{Method: "org.freedesktop.timedate1.SetNTP", Args: []interface{}{false, false}},
+	})
+}
+
+func (s *ReadNtpSuite) TestUpdateAllInOrder(c *C) {
+	mockNTPFileContent(c, timesyncdConfigurationFilePath, "")
+
+	ntp := false
+	dateTime := 1555001.0
+	timezone := "Europe/Paris"
+	result := setTimeInfo(timePatch{
+		DateTime:   &dateTime,
+		NTP:        &ntp,
+		Timezone:   &timezone,
+		NTPServers: serverList("ntp.ubuntu.com"),
+	})
+	c.Assert(result.status(), Equals, http.StatusOK)
+	c.Check(result.Results, DeepEquals, map[string]timeFieldResult{
+		"ntpServers": timeFieldOK,
+		"timezone":   timeFieldOK,
+		"ntp":        timeFieldOK,
+		"dateTime":   timeFieldOK,
+	})
+
+	var methods []string
+	for _, call := range s.timedate.calls {
+		methods = append(methods, call.Method)
+	}
+	c.Check(methods, DeepEquals, []string{
+		"org.freedesktop.timedate1.ListTimezones",
+		"org.freedesktop.timedate1.SetTimezone",
+		"org.freedesktop.timedate1.SetNTP",
+		"org.freedesktop.timedate1.SetTime",
+	})
+}
+
+func (s *ReadNtpSuite) TestUpdateFailures(c *C) {
+	s.timedate.errors["org.freedesktop.timedate1.SetTime"] = dbus.Error{
+		Name: "org.freedesktop.timedate1.AutomaticTimeSyncEnabled",
+		Body: []interface{}{"Automatic time synchronization is enabled"},
 	}
-	defer func() {
-		callDbusEndpoint = oldCallDbusEndpoint
-	}()
 
-	c.Assert(setTimeInfo(map[string]interface{}{"ntp": false}), IsNil)
-	c.Assert(setTimeInfo(map[string]interface{}{"ntp": ""}), NotNil)
+	ntp := true
+	dateTime := 1555001.0
+	timezone := "Europe/Paris"
+	result := setTimeInfo(timePatch{DateTime: &dateTime, NTP: &ntp, Timezone: &timezone})
+	c.Check(result.status(), Equals, http.StatusConflict)
+	c.Check(result.Results["timezone"], Equals, timeFieldOK)
+	c.Check(result.Results["ntp"], Equals, timeFieldOK)
+	c.Check(result.Results["dateTime"].Status, Equals, "error")
+	c.Check(result.Results["dateTime"].Message, Equals, "Automatic time synchronization is enabled")
+
+	// other failures are the daemon's
+	s.timedate.errors["org.freedesktop.timedate1.SetTimezone"] = fmt.Errorf("Timed out")
+	result = setTimeInfo(timePatch{DateTime: &dateTime, Timezone: &timezone})
+	c.Check(result.status(), Equals, http.StatusInternalServerError)
+
+	timedateManager = func() (dbus.BusObject, error) {
+		return nil, errNoBus
+	}
+	result = setTimeInfo(timePatch{NTP: &ntp})
+	c.Check(result.status(), Equals, http.StatusInternalServerError)
+	c.Check(result.Results["ntp"].Message, Equals, "No system bus")
+}
+
+func (s *ReadNtpSuite) TestGetTimeInfo(c *C) {
+	mockNTPFileContent(c, timesyncdConfigurationFilePath, "[Time]\nNTP=ntp.ubuntu.com 1.1.1.1\n")
+	s.timedate.properties["org.freedesktop.timedate1.Timezone"] = "UTC"
+	s.timedate.properties["org.freedesktop.timedate1.NTP"] = false
+
+	info, err := getTimeInfo()
+	c.Assert(err, IsNil)
+	c.Check(info.Timezone, Equals, "UTC")
+	c.Check(info.Offset, Equals, 0)
+	c.Check(info.NTP, Equals, false)
+	c.Check(info.NTPServer, Equals, "ntp.ubuntu.com")
+	c.Check(info.NTPServers, DeepEquals, []string{"ntp.ubuntu.com", "1.1.1.1"})
+	c.Check(info.FallbackNTP, DeepEquals, []string{})
+
+	s.timedate.properties["org.freedesktop.timedate1.NTP"] = "yes"
+	_, err = getTimeInfo()
+	c.Check(err, ErrorMatches, "Unexpected NTP value .*")
+}
+
+func (s *ReadNtpSuite) patchTimeInfo(c *C, body string) *httptest.ResponseRecorder {
+	os.Setenv("SNAP_DATA", c.MkDir())
+	c.Assert(ioutil.WriteFile(tokenFilename(), []byte("1234"), 0600), IsNil)
+
+	handler := initURLHandlers(log.New(ioutil.Discard, "", 0), snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
+
+	req, err := http.NewRequest("PATCH", "/api/v2/time-info", bytes.NewBufferString(body))
+	c.Assert(err, IsNil)
+	req.AddCookie(&http.Cookie{Name: SnapwebCookieName, Value: "1234"})
+	req.Header.Set("Content-Type", "application/json")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func (s *ReadNtpSuite) TestPatchTimeInfo(c *C) {
+	mockNTPFileContent(c, timesyncdConfigurationFilePath, "")
+
+	rec := s.patchTimeInfo(c, `{"ntp":false,"timezone":"UTC","ntpServers":["ntp.ubuntu.com"]}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	var result map[string]map[string]map[string]string
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &result), IsNil)
+	c.Check(result, DeepEquals, map[string]map[string]map[string]string{
+		"results": {
+			"ntp":        {"status": "ok"},
+			"timezone":   {"status": "ok"},
+			"ntpServers": {"status": "ok"},
+		},
+	})
+}
+
+func (s *ReadNtpSuite) TestPatchTimeInfoInvalid(c *C) {
+	rec := s.patchTimeInfo(c, `{"ntp":false,"ntpServers":["not a server"]}`)
+	c.Check(rec.Code, Equals, http.StatusBadRequest)
+	c.Check(s.timedate.calls, HasLen, 0)
+
+	var result timePatchResult
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &result), IsNil)
+	c.Check(result.Results, HasLen, 1)
+	c.Check(result.Results["ntpServers"].Status, Equals, "invalid")
+
+	// the types are checked when decoding
+	for _, body := range []string{`{"ntp":""}`, `{"dateTime":""}`, `{"timezone":1}`, `{"ntpServers":"1.1.1.1"}`} {
+		rec = s.patchTimeInfo(c, body)
+		c.Check(rec.Code, Equals, http.StatusBadRequest, Commentf(body))
+	}
 }
@@ -0,0 +1,129 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/snapcore/snapweb/snappy/app"
+)
+
+// eventBacklog is how many events a slow client may lag behind before
+// missing some
+const eventBacklog = 16
+
+var eventKeepAlive = 30 * time.Second
+
+// event is a message streamed to the clients of /api/v2/events
+type event struct {
+	Type string
+	Data []byte
+}
+
+// eventHub dispatches the published events to the connected clients
+type eventHub struct {
+	sync.Mutex
+	clients map[chan event]bool
+}
+
+var events = newEventHub()
+
+func newEventHub() *eventHub {
+	return &eventHub{clients: make(map[chan event]bool)}
+}
+
+func (h *eventHub) subscribe() chan event {
+	h.Lock()
+	defer h.Unlock()
+
+	ch := make(chan event, eventBacklog)
+	h.clients[ch] = true
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan event) {
+	h.Lock()
+	defer h.Unlock()
+
+	delete(h.clients, ch)
+}
+
+// publish sends an event, serialized as JSON, to all the clients; clients
+// too slow to keep up miss it rather than blocking the publisher
+func (h *eventHub) publish(eventType string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Cannot serialize the %s event: %v", eventType, err)
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	for ch := range h.clients {
+		select {
+		case ch <- event{Type: eventType, Data: data}:
+		default:
+		}
+	}
+}
+
+// handleEvents streams the events as server-sent events
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		log.Printf("handleEvents: invalid method %s", r.Method)
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Printf("handleEvents: streaming unsupported")
+		snappy.WriteErrorf(w, http.StatusInternalServerError, "Streaming unsupported")
+		return
+	}
+
+	ch := events.subscribe()
+	defer events.unsubscribe(ch)
+
+	hdr := w.Header()
+	hdr.Set("Content-Type", "text/event-stream")
+	hdr.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case e := <-ch:
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, e.Data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
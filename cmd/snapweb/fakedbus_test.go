@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/godbus/dbus"
+)
+
+// fakeCall records a method call on a fakeBusObject
+type fakeCall struct {
+	Method string
+	Args   []interface{}
+}
+
+// fakeBusObject stands for a D-Bus object in tests: it records the method
+// calls and answers them, and the property reads, from its maps
+type fakeBusObject struct {
+	calls []fakeCall
+	// replies to the method calls, by method name
+	replies map[string][]interface{}
+	// errors of the method calls, by method name
+	errors     map[string]error
+	properties map[string]interface{}
+}
+
+func newFakeBusObject() *fakeBusObject {
+	return &fakeBusObject{
+		replies:    make(map[string][]interface{}),
+		errors:     make(map[string]error),
+		properties: make(map[string]interface{}),
+	}
+}
+
+func (o *fakeBusObject) Call(method string, flags dbus.Flags, args ...interface{}) *dbus.Call {
+	o.calls = append(o.calls, fakeCall{Method: method, Args: args})
+	return &dbus.Call{
+		Method: method,
+		Args:   args,
+		Body:   o.replies[method],
+		Err:    o.errors[method],
+	}
+}
+
+func (o *fakeBusObject) Go(method string, flags dbus.Flags, ch chan *dbus.Call, args ...interface{}) *dbus.Call {
+	call := o.Call(method, flags, args...)
+	if ch != nil {
+		ch <- call
+	}
+	return call
+}
+
+func (o *fakeBusObject) GetProperty(p string) (dbus.Variant, error) {
+	v, ok := o.properties[p]
+	if !ok {
+		return dbus.Variant{}, fmt.Errorf("No such property %s", p)
+	}
+	return dbus.MakeVariant(v), nil
+}
+
+func (o *fakeBusObject) Destination() string {
+	return "fake"
+}
+
+func (o *fakeBusObject) Path() dbus.ObjectPath {
+	return "/fake"
+}
+
+var errNoBus = errors.New("No system bus")
@@ -18,19 +18,28 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 
+	"github.com/gorilla/mux"
+
+	"github.com/snapcore/snapweb/avahi"
 	"github.com/snapcore/snapweb/snappy/app"
 	"github.com/snapcore/snapweb/snappy/snapdclient"
 )
@@ -43,6 +52,8 @@ type branding struct {
 type templateData struct {
 	Branding     branding
 	SnapdVersion string
+	// nonce allowing the inline script of the templates
+	Nonce string
 }
 
 var newSnapdClient = newSnapdClientImpl
@@ -59,7 +70,7 @@ func unixDialer(socketPath string) func(string, string) (net.Conn, error) {
 }
 
 func newSnapdClientImpl() snapdclient.SnapdClient {
-	return snapdclient.NewClientAdapter()
+	return snappy.NewCachingClient(snapdclient.NewClientAdapter())
 }
 
 func getSnappyVersion() string {
@@ -73,100 +84,213 @@ func getSnappyVersion() string {
 	return fmt.Sprintf("snapd %s (series %s)", verInfo.Version, verInfo.Series)
 }
 
-type timeInfoResponse struct {
-	DateTime  int64  `json:"dateTime,omitempty"`
-	Timezone  string `json:"timezone,omitempty"`
-	Offset    int    `json:"offset,omitempty"`
-	NTP       bool   `json:"ntp,omitempty"`
-	NTPServer string `json:"ntpServer,omitempty"`
-}
-
 func handleTimeInfo(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "GET" {
-		values, err := getTimeInfo()
+	switch r.Method {
+	case "GET":
+		info, err := getTimeInfo()
 		if err != nil {
 			log.Printf("Error fetching time related information: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			snappy.WriteError(w, http.StatusInternalServerError, err)
 			return
 		}
 
-		info := timeInfoResponse{
-			DateTime:  values["DateTime"].(int64),
-			Timezone:  values["Timezone"].(string),
-			Offset:    values["Offset"].(int),
-			NTP:       values["NTP"].(bool),
-			NTPServer: values["NTPServer"].(string),
-		}
-
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(info); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
 			log.Printf("Error encoding time informaiton: %v", err)
 		}
-	} else if r.Method == "PATCH" {
-		contentType := r.Header.Get("Content-Type")
-		if contentType != "application/json" {
-			log.Printf("handleTimeInfo(POST): invalid content")
-			w.WriteHeader(http.StatusUnsupportedMediaType)
+	case "PATCH":
+		if r.Header.Get("Content-Type") != "application/json" {
+			log.Printf("handleTimeInfo(PATCH): invalid content")
+			writeUnsupportedMediaType(w, r, "application/json")
 			return
 		}
 
-		data, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.Println("Error decoding time patch", err)
+		var patch timePatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			log.Printf("handleTimeInfo(PATCH): Error decoding time data: %v", err)
+			snappy.WriteErrorf(w, http.StatusBadRequest, "Invalid time data: %s", err)
 			return
 		}
 
-		var timePatch map[string]interface{}
-		err = json.Unmarshal(data, &timePatch)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			log.Printf("handleTimeInfo(POST): Error decoding time data: %v", err)
+		result := setTimeInfo(patch)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(result.status())
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			log.Printf("handleTimeInfo(PATCH): error serializing json: %s", err)
+		}
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+func handleTimezones(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		log.Printf("handleTimezones: invalid method %s", r.Method)
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	zones, err := getTimezones()
+	if err != nil {
+		log.Printf("handleTimezones: error listing the time zones: %v", err)
+		snappy.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(zones); err != nil {
+		log.Printf("handleTimezones: error serializing json: %s", err)
+	}
+}
+
+func handleLocale(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PATCH":
+		if r.Header.Get("Content-Type") != "application/json" {
+			log.Printf("handleLocale: invalid content")
+			writeUnsupportedMediaType(w, r, "application/json")
 			return
 		}
 
-		err = setTimeInfo(timePatch)
+		var patch localePatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			log.Printf("handleLocale: failed to decode json: %v", err)
+			snappy.WriteErrorf(w, http.StatusBadRequest, "Invalid locale settings: %s", err)
+			return
+		}
+
+		current, err := getLocaleSettings()
 		if err != nil {
-			log.Printf("handleTimeInfo: failed to set time information; %v", err)
+			log.Printf("handleLocale: error retrieving the locale settings: %v", err)
+			snappy.WriteError(w, http.StatusInternalServerError, err)
+			return
 		}
-	} else {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+
+		if err := patch.validate(current.Available); err != nil {
+			log.Printf("handleLocale: %v", err)
+			snappy.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := setLocaleSettings(current, patch); err != nil {
+			log.Printf("handleLocale: failed to change the locale settings: %v", err)
+			snappy.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+	default:
+		log.Printf("handleLocale: invalid method %s", r.Method)
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	settings, err := getLocaleSettings()
+	if err != nil {
+		log.Printf("handleLocale: error retrieving the locale settings: %v", err)
+		snappy.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(settings); err != nil {
+		log.Printf("handleLocale: error serializing json: %s", err)
 	}
 }
 
 type deviceInfoResponse struct {
-	DeviceName string   `json:"deviceName"`
-	Brand      string   `json:"brand"`
-	Model      string   `json:"model"`
-	Serial     string   `json:"serial"`
-	OS         string   `json:"operatingSystem"`
-	Interfaces []string `json:"interfaces"`
-	Uptime     string   `json:"uptime"`
+	DeviceName string `json:"deviceName"`
+	Hostname   string `json:"hostname"`
+	*snapdclient.DeviceInfo
+	Uptime string `json:"uptime"`
 }
 
 func handleDeviceInfo(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		getDeviceInfo(w, r)
+	case "PATCH":
+		patchDeviceInfo(w, r)
+	default:
+		log.Printf("handleDeviceInfo: invalid method")
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+func getDeviceInfo(w http.ResponseWriter, r *http.Request) {
 	c := newSnapdClient()
 
-	modelInfo, err := snapdclient.GetModelInfo(c)
+	deviceInfo, err := snapdclient.GetDeviceInfo(c)
 	if err != nil {
-		log.Println(fmt.Sprintf("handleDeviceInfo: error retrieving model info: %s", err))
-		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(fmt.Sprintf("handleDeviceInfo: error retrieving device info: %s", err))
+		snappy.WriteError(w, snappy.ErrorStatus(err), err)
 		return
 	}
 
-	var info deviceInfoResponse
-	info.Brand = modelInfo["Brand"].(string)
-	info.Model = modelInfo["Model"].(string)
-	info.Serial = modelInfo["Serial"].(string)
-	info.OS = modelInfo["OS"].(string)
-	info.Interfaces = modelInfo["Interfaces"].([]string)
-	info.Uptime = modelInfo["Uptime"].(string)
+	info := deviceInfoResponse{
+		DeviceInfo: deviceInfo,
+		Uptime:     deviceInfo.Uptime.String(),
+	}
+
+	if names, err := getDeviceNames(); err == nil {
+		info.Hostname = names.Hostname
+		info.DeviceName = names.DeviceName
+	} else {
+		log.Printf("handleDeviceInfo: error retrieving the device names: %s", err)
+		info.Hostname, _ = os.Hostname()
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(info); err != nil {
 		log.Println(fmt.Sprintf("handleDeviceInfo: error serializing json: %s", err))
-		w.WriteHeader(http.StatusInternalServerError)
+		snappy.WriteError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func patchDeviceInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/json" {
+		log.Printf("handleDeviceInfo: invalid content")
+		writeUnsupportedMediaType(w, r, "application/json")
+		return
+	}
+
+	var patch deviceNamesPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		log.Printf("handleDeviceInfo: failed to decode json: %v", err)
+		snappy.WriteErrorf(w, http.StatusBadRequest, "Invalid device names: %s", err)
+		return
+	}
+
+	if err := patch.validate(); err != nil {
+		log.Printf("handleDeviceInfo: %v", err)
+		snappy.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := setDeviceNames(patch); err != nil {
+		log.Printf("handleDeviceInfo: failed to change the device names: %v", err)
+		snappy.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// the mDNS name follows the hostname; this would otherwise be noticed
+	// by the next poll
+	if patch.Hostname != nil {
+		if err := avahi.UpdateHostname(); err != nil {
+			log.Printf("handleDeviceInfo: failed to register the new hostname: %v", err)
+		}
+	}
+
+	names, err := getDeviceNames()
+	if err != nil {
+		log.Printf("handleDeviceInfo: error retrieving the device names: %s", err)
+		snappy.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(names); err != nil {
+		log.Printf("handleDeviceInfo: error serializing json: %s", err)
 	}
 }
 
@@ -176,32 +300,150 @@ func handleSections(w http.ResponseWriter, r *http.Request) {
 	sections, err := c.Sections()
 	if err != nil {
 		log.Println(fmt.Sprintf("handleSections: error retrieving sections info: %s", err))
-		w.WriteHeader(http.StatusInternalServerError)
+		snappy.WriteError(w, snappy.ErrorStatus(err), err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(sections); err != nil {
+	if err := snappy.WriteJSONWithETag(w, r, sections); err != nil {
 		log.Println(fmt.Sprintf("handleSections: error serializing json: %s", err))
-		w.WriteHeader(http.StatusInternalServerError)
+		snappy.WriteError(w, http.StatusInternalServerError, err)
 	}
 }
 
-type deviceAction struct {
-	ActionType string `json:"actionType"`
+// writeMethodNotAllowed answers requests made with a method the handler
+// does not support
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	snappy.WriteErrorf(w, http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
 }
 
-func handleDeviceAction(w http.ResponseWriter, r *http.Request) {
+// writeUnsupportedMediaType answers requests whose content is not of the
+// expected type
+func writeUnsupportedMediaType(w http.ResponseWriter, r *http.Request, expected string) {
+	snappy.WriteErrorf(w, http.StatusUnsupportedMediaType, "Invalid content type %q, expected %s",
+		r.Header.Get("Content-Type"), expected)
+}
+
+// assertionContentType is the media type of assertions, as snapd uses it
+const assertionContentType = "application/x.ubuntu.assertion"
+
+// maxAssertionSize limits the size of an uploaded assertion, with its
+// prerequisites
+const maxAssertionSize = 1 << 20
+
+// handleAssertions adds an uploaded assertion to the system assertion
+// database
+func handleAssertions(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		log.Printf("handleDeviceAction: invalid method")
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		log.Printf("handleAssertions: invalid method %s", r.Method)
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	if r.Header.Get("Content-Type") != assertionContentType {
+		log.Printf("handleAssertions: invalid content")
+		writeUnsupportedMediaType(w, r, assertionContentType)
+		return
+	}
+
+	// one byte more than allowed, to tell the assertions too large
+	assertion, err := ioutil.ReadAll(io.LimitReader(r.Body, maxAssertionSize+1))
+	if err != nil {
+		log.Printf("handleAssertions: cannot read the assertion: %v", err)
+		snappy.WriteErrorf(w, http.StatusBadRequest, "Cannot read the assertion: %s", err)
+		return
+	}
+	if len(assertion) > maxAssertionSize {
+		log.Printf("handleAssertions: assertion too large")
+		snappy.WriteErrorf(w, http.StatusRequestEntityTooLarge, "Assertion larger than %d bytes", maxAssertionSize)
+		return
+	}
+	if len(assertion) == 0 {
+		log.Printf("handleAssertions: empty assertion")
+		snappy.WriteErrorf(w, http.StatusBadRequest, "Empty assertion")
+		return
+	}
+
+	if err := newSnapdClient().Ack(assertion); err != nil {
+		log.Printf("handleAssertions: %v", err)
+		snappy.WriteError(w, snappy.ErrorStatus(err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "{}")
+}
+
+// handleAssertionType lists the known assertions of a type, the query
+// parameters filtering them by header
+func handleAssertionType(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		log.Printf("handleAssertionType: invalid method %s", r.Method)
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	headers := make(map[string]string)
+	for name, values := range r.URL.Query() {
+		headers[name] = values[0]
+	}
+
+	assertions, err := snapdclient.GetAssertions(newSnapdClient(), mux.Vars(r)["type"], headers)
+	if err == snapdclient.ErrUnknownAssertionType {
+		log.Printf("handleAssertionType: %v %q", err, mux.Vars(r)["type"])
+		snappy.WriteErrorf(w, http.StatusNotFound, "%s %q", err, mux.Vars(r)["type"])
+		return
+	} else if err != nil {
+		log.Printf("handleAssertionType: error retrieving assertions: %v", err)
+		snappy.WriteError(w, snappy.ErrorStatus(err), err)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(assertions); err != nil {
+		log.Printf("handleAssertionType: error serializing json: %s", err)
+	}
+}
+
+func handleDeviceAction(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		action, err := pendingDeviceAction()
+		if err != nil {
+			log.Printf("handleDeviceAction: failed to get the pending action: %v", err)
+			snappy.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(action); err != nil {
+			log.Printf("handleDeviceAction: error serializing json: %s", err)
+		}
+	case "DELETE":
+		cancelled, err := cancelDeviceAction()
+		if err != nil {
+			log.Printf("handleDeviceAction: failed to cancel the pending action: %v", err)
+			snappy.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		if !cancelled {
+			snappy.WriteErrorf(w, http.StatusNotFound, "No device action is pending")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "POST":
+		postDeviceAction(w, r)
+	default:
+		log.Printf("handleDeviceAction: invalid method")
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+func postDeviceAction(w http.ResponseWriter, r *http.Request) {
 	contentType := r.Header.Get("Content-Type")
 	if contentType != "application/json" {
 		log.Printf("handleDeviceAction: invalid content")
-		w.WriteHeader(http.StatusUnsupportedMediaType)
+		writeUnsupportedMediaType(w, r, "application/json")
 		return
 	}
 
@@ -209,35 +451,268 @@ func handleDeviceAction(w http.ResponseWriter, r *http.Request) {
 	dec := json.NewDecoder(r.Body)
 	if err := dec.Decode(&action); err != nil {
 		log.Printf("handleDeviceAction: failed to decode json: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
+		snappy.WriteErrorf(w, http.StatusBadRequest, "Invalid device action: %s", err)
+		return
+	}
+
+	at, err := action.scheduledTime(time.Now())
+	if err != nil {
+		log.Printf("handleDeviceAction: %v", err)
+		snappy.WriteError(w, http.StatusBadRequest, err)
+		return
 	}
 
-	// XXX: user valid and user has permission
-	if action.ActionType == "restart" {
-		cmd := exec.Command("reboot")
-		if err := cmd.Run(); err != nil {
-			log.Printf("handleDeviceAction: failed to reboot: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+	// the API handler already authenticated the user
+	if at.IsZero() {
+		if err := runDeviceAction(action.ActionType); err != nil {
+			log.Printf("handleDeviceAction: failed to %s: %v", action.ActionType, err)
+			snappy.WriteError(w, http.StatusInternalServerError, err)
 		}
-	} else if action.ActionType == "power-off" {
-		cmd := exec.Command("poweroff")
-		if err := cmd.Run(); err != nil {
-			log.Printf("handleDeviceAction: failed to reboot: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := scheduleDeviceAction(action.ActionType, at); err != nil {
+		log.Printf("handleDeviceAction: failed to schedule %s: %v", action.ActionType, err)
+		snappy.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(deviceAction{ActionType: action.ActionType, At: &at}); err != nil {
+		log.Printf("handleDeviceAction: error serializing json: %s", err)
+	}
+}
+
+// networkInfo is the state and the configuration of the network
+type networkInfo struct {
+	networkStatus
+	Config  []interfaceConfig     `json:"config"`
+	Pending *pendingNetworkChange `json:"pending,omitempty"`
+}
+
+func makeNetworkHandler(settings *snappy.ConfigWatcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			status, err := getNetworkStatus()
+			if err != nil {
+				log.Printf("handleNetwork: error retrieving the network status: %v", err)
+				snappy.WriteError(w, http.StatusInternalServerError, err)
+				return
+			}
+
+			config, err := readNetplan()
+			if err != nil {
+				log.Printf("handleNetwork: error reading the network configuration: %v", err)
+				snappy.WriteError(w, http.StatusInternalServerError, err)
+				return
+			}
+
+			info := networkInfo{
+				networkStatus: status,
+				Config:        config,
+				Pending:       networkChanges.pending(),
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(info); err != nil {
+				log.Printf("handleNetwork: error serializing json: %s", err)
+			}
+		case "PUT":
+			if r.Header.Get("Content-Type") != "application/json" {
+				log.Printf("handleNetwork: invalid content")
+				writeUnsupportedMediaType(w, r, "application/json")
+				return
+			}
+
+			var change networkChange
+			if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+				log.Printf("handleNetwork: failed to decode json: %v", err)
+				snappy.WriteErrorf(w, http.StatusBadRequest, "Invalid network change: %s", err)
+				return
+			}
+
+			if _, err := change.rollbackTimeout(); err != nil {
+				log.Printf("handleNetwork: %v", err)
+				snappy.WriteError(w, http.StatusBadRequest, err)
+				return
+			}
+
+			deadline, err := networkChanges.apply(change, settings)
+			if err == errNetworkChangePending {
+				log.Printf("handleNetwork: %v", err)
+				snappy.WriteError(w, http.StatusConflict, err)
+				return
+			} else if err != nil {
+				log.Printf("handleNetwork: failed to apply the network configuration: %v", err)
+				snappy.WriteError(w, http.StatusInternalServerError, err)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			if err := json.NewEncoder(w).Encode(pendingNetworkChange{Deadline: deadline}); err != nil {
+				log.Printf("handleNetwork: error serializing json: %s", err)
+			}
+		default:
+			writeMethodNotAllowed(w, r)
 		}
-	} else {
-		log.Printf("handleDeviceAction: invalid device action type: %s", action.ActionType)
-		w.WriteHeader(http.StatusBadRequest)
+	})
+}
+
+// makeNetworkChangeHandler confirms or reverts the pending network change
+func makeNetworkChangeHandler(action func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeMethodNotAllowed(w, r)
+			return
+		}
+
+		if err := action(); err == errNoNetworkChange {
+			snappy.WriteError(w, http.StatusNotFound, err)
+		} else if err != nil {
+			log.Printf("handleNetwork: %v", err)
+			snappy.WriteError(w, http.StatusInternalServerError, err)
+		}
+	})
+}
+
+// handleSystemStats returns the resource usage samples taken after the
+// optional since parameter
+func handleSystemStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		log.Printf("handleSystemStats: invalid method %s", r.Method)
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	since, err := parseSince(r.URL.Query().Get("since"))
+	if err != nil {
+		log.Printf("handleSystemStats: %v", err)
+		snappy.WriteError(w, http.StatusBadRequest, err)
+		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(systemStats.Since(since)); err != nil {
+		log.Printf("handleSystemStats: error serializing json: %s", err)
+	}
+}
+
+func makeSettingsHandler(settings *snappy.ConfigWatcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeMethodNotAllowed(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(settings.Config()); err != nil {
+			log.Printf("handleSettings: error serializing json: %s", err)
+			snappy.WriteError(w, http.StatusInternalServerError, err)
+		}
+	})
 }
 
-func initURLHandlers(log *log.Logger, config snappy.Config) http.Handler {
+type certificateUpload struct {
+	Certificate string `json:"certificate"`
+	Key         string `json:"key"`
+}
+
+func makeCertificateHandler(settings *snappy.ConfigWatcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := settings.Config()
+
+		switch r.Method {
+		case "GET":
+		case "PUT":
+			if r.Header.Get("Content-Type") != "application/json" {
+				log.Printf("handleCertificate: invalid content")
+				writeUnsupportedMediaType(w, r, "application/json")
+				return
+			}
+
+			var upload certificateUpload
+			if err := json.NewDecoder(r.Body).Decode(&upload); err != nil {
+				log.Printf("handleCertificate: failed to decode json: %v", err)
+				snappy.WriteErrorf(w, http.StatusBadRequest, "Invalid certificate upload: %s", err)
+				return
+			}
+
+			if err := certificates.replace([]byte(upload.Certificate), []byte(upload.Key),
+				newCertSettings(config)); err != nil {
+				log.Printf("handleCertificate: %v", err)
+				snappy.WriteError(w, http.StatusBadRequest, err)
+				return
+			}
+			log.Println("handleCertificate: certificate replaced")
+		case "DELETE":
+			// go back to a generated certificate
+			err := os.Remove(config.CertFile)
+			if err == nil || os.IsNotExist(err) {
+				err = certificates.load(newCertSettings(config))
+			}
+			if err != nil {
+				log.Printf("handleCertificate: %v", err)
+				snappy.WriteError(w, http.StatusInternalServerError, err)
+				return
+			}
+		default:
+			writeMethodNotAllowed(w, r)
+			return
+		}
+
+		cert, err := readCertificate(config.CertFile)
+		if err != nil {
+			log.Printf("handleCertificate: %v", err)
+			snappy.WriteError(w, http.StatusNotFound, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(newCertificateInfo(cert)); err != nil {
+			log.Printf("handleCertificate: error serializing json: %s", err)
+			snappy.WriteError(w, http.StatusInternalServerError, err)
+		}
+	})
+}
+
+// makeCertificateAuthorityHandler lets browsers download the local
+// certificate authority, to trust it once for all the devices it signed
+func makeCertificateAuthorityHandler(settings *snappy.ConfigWatcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeMethodNotAllowed(w, r)
+			return
+		}
+
+		if !settings.Config().LocalCA {
+			snappy.WriteErrorf(w, http.StatusNotFound, "The local certificate authority is disabled")
+			return
+		}
+
+		ca, err := loadCertificateAuthority(settings.Config().KeyType)
+		if err != nil {
+			log.Printf("handleCertificateAuthority: %v", err)
+			snappy.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+		w.Header().Set("Content-Disposition", `attachment; filename="snapweb-ca.crt"`)
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	})
+}
+
+// makeURLHandlers sets up all the handlers, without any IP filtering
+func makeURLHandlers(log *log.Logger, settings *snappy.ConfigWatcher) http.Handler {
 	log.Println("Initializing HTTP handlers...")
 
 	handler := http.NewServeMux()
 
 	// API
-	handler.Handle("/api/", makeAPIHandler("/api/", config))
+	handler.Handle("/api/", makeAPIHandler("/api/", settings))
 
 	// Resources
 	handler.Handle("/public/", loggingHandler(http.FileServer(http.Dir(filepath.Join(os.Getenv("SNAP"), "www")))))
@@ -250,7 +725,11 @@ func initURLHandlers(log *log.Logger, config snappy.Config) http.Handler {
 
 	handler.HandleFunc("/", makeMainPageHandler())
 
-	return NewFilterHandlerFromConfig(handler, config)
+	return securityHeadersHandler(handler, settings)
+}
+
+func initURLHandlers(log *log.Logger, settings *snappy.ConfigWatcher) http.Handler {
+	return NewFilterHandlerFromSettings(makeURLHandlers(log, settings), settings)
 }
 
 // Name of the cookie transporting the access token
@@ -301,16 +780,63 @@ func getBranding() branding {
 	}
 }
 
+// contentSecurityPolicy of the pages rendered from the templates, %s being
+// replaced by the nonce of their inline script. Snap screenshots come from
+// the store.
+const contentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self' 'nonce-%s'; " +
+	"style-src 'self' 'unsafe-inline'; " +
+	"img-src 'self' data: https:; " +
+	"object-src 'none'; " +
+	"base-uri 'self'; " +
+	"frame-ancestors 'none'"
+
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("Cannot generate a nonce: %s", err)
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// securityHeadersHandler adds the security related HTTP headers to all the
+// responses
+func securityHeadersHandler(handler http.Handler, settings *snappy.ConfigWatcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", "same-origin")
+
+		// only meaningful, and allowed, over HTTPS
+		if r.TLS != nil && !settings.Config().DisableHTTPS {
+			h.Set("Strict-Transport-Security", "max-age=31536000")
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
 func makeMainPageHandler() http.HandlerFunc {
 	b := getBranding()
 	v := getSnappyVersion()
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		nonce, err := newNonce()
+		if err != nil {
+			log.Println(err)
+			snappy.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
 		data := templateData{
 			Branding:     b,
 			SnapdVersion: v,
+			Nonce:        nonce,
 		}
 
+		w.Header().Set("Content-Security-Policy", fmt.Sprintf(contentSecurityPolicy, nonce))
+
 		if err := renderLayout("index.html", &data, w); err != nil {
 			log.Println(err)
 		}
@@ -320,28 +846,62 @@ func makeMainPageHandler() http.HandlerFunc {
 func renderLayout(html string, data *templateData, w http.ResponseWriter) error {
 	htmlPath := filepath.Join(os.Getenv("SNAP"), "www", "templates", html)
 	if _, err := os.Stat(htmlPath); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		snappy.WriteError(w, http.StatusInternalServerError, err)
 		return err
 	}
 
 	layoutPath := filepath.Join(os.Getenv("SNAP"), "www", "templates", "base.html")
 	t, err := template.ParseFiles(layoutPath, htmlPath)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		snappy.WriteError(w, http.StatusInternalServerError, err)
 		return err
 	}
 
 	return t.Execute(w, *data)
 }
 
-func redirHandler(config snappy.Config) http.Handler {
+// httpsRedirectHost picks the HTTPS end-point to redirect a request for host to
+func httpsRedirectHost(config snappy.Config, host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		// an IPv6 address without a port
+		host = host[1 : len(host)-1]
+	}
+
+	addrs, err := config.HTTPSListenAddresses()
+	if err != nil || len(addrs) == 0 {
+		return net.JoinHostPort(host, strconv.Itoa(config.HTTPSPort))
+	}
+
+	// prefer the end-point matching the host the client used, then any
+	// end-point listening on all addresses
+	var wildcard string
+	for _, addr := range addrs {
+		h, port, _ := net.SplitHostPort(addr)
+		if h == host {
+			return addr
+		}
+		if ip := net.ParseIP(h); wildcard == "" && (h == "" || ip.IsUnspecified()) {
+			wildcard = net.JoinHostPort(host, port)
+		}
+	}
+
+	if wildcard != "" {
+		return wildcard
+	}
+
+	return addrs[0]
+}
+
+func redirHandler(settings *snappy.ConfigWatcher) http.Handler {
 	redir := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		http.Redirect(w, req,
-			"https://"+strings.Replace(req.Host, httpAddr, httpsAddr, -1),
+			"https://"+httpsRedirectHost(settings.Config(), req.Host)+req.URL.RequestURI(),
 			http.StatusSeeOther)
 	})
 
-	return NewFilterHandlerFromConfig(redir, config)
+	return NewFilterHandlerFromSettings(redir, settings)
 }
 
 // NewFilterHandlerFromConfig creates a new http.Handler with an integrated NetFilter
@@ -351,6 +911,20 @@ func NewFilterHandlerFromConfig(handler http.Handler, config snappy.Config) http
 	}
 
 	f := snappy.NewFilter()
+	f.SetPrefixPolicy(config.PrefixPolicy())
+
+	// explicit rules come first, so that they can deny part of the
+	// networks allowed afterwards
+	allowRules := false
+	for _, rule := range config.FilterRules {
+		if err := f.AddRule(rule); err != nil {
+			logger.Println(err)
+			continue
+		}
+		if allow, _, _ := snappy.ParseFilterRule(rule); allow {
+			allowRules = true
+		}
+	}
 
 	for _, net := range config.AllowNetworks {
 		f.AllowNetwork(net)
@@ -360,12 +934,39 @@ func NewFilterHandlerFromConfig(handler http.Handler, config snappy.Config) http
 		f.AddLocalNetworkForInterface(ifname)
 	}
 
-	// if nothing was specified, default to allowing all local networks
+	// if nothing was allowed, default to allowing all local networks
 	if (len(config.AllowNetworks) == 0) &&
-		(len(config.AllowInterfaces) == 0) {
+		(len(config.AllowInterfaces) == 0) && !allowRules {
 		logger.Println("Allowing local network access by default")
 		f.AddLocalNetworks()
 	}
 
+	for _, network := range config.TrustedProxies {
+		f.TrustProxy(network)
+	}
+
 	return f.FilterHandler(handler)
 }
+
+// NewFilterHandlerFromSettings creates a new http.Handler with an integrated
+// NetFilter that gets rebuilt every time the configuration is reloaded
+func NewFilterHandlerFromSettings(handler http.Handler, settings *snappy.ConfigWatcher) http.Handler {
+	var mu sync.RWMutex
+	filtered := NewFilterHandlerFromConfig(handler, settings.Config())
+
+	settings.OnChange(func(config snappy.Config) {
+		h := NewFilterHandlerFromConfig(handler, config)
+
+		mu.Lock()
+		filtered = h
+		mu.Unlock()
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.RLock()
+		h := filtered
+		mu.RUnlock()
+
+		h.ServeHTTP(w, r)
+	})
+}
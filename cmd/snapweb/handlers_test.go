@@ -19,6 +19,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
@@ -27,9 +28,12 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
 
+	"github.com/godbus/dbus"
+	"github.com/snapcore/snapd/client"
 	. "gopkg.in/check.v1"
 
 	"github.com/snapcore/snapweb/snappy/app"
@@ -39,7 +43,9 @@ import (
 func Test(t *testing.T) { TestingT(t) }
 
 type HandlersSuite struct {
-	c *snapdclient.FakeSnapdClient
+	c               *snapdclient.FakeSnapdClient
+	timedateManager func() (dbus.BusObject, error)
+	timesyncManager func() (dbus.BusObject, error)
 }
 
 var _ = Suite(&HandlersSuite{})
@@ -65,10 +71,24 @@ func (s *HandlersSuite) SetUpTest(c *C) {
 	s.c.Err = nil
 
 	s.createAndSaveTestToken(c)
+
+	timedate := newFakeBusObject()
+	timedate.properties["org.freedesktop.timedate1.Timezone"] = "UTC"
+	timedate.properties["org.freedesktop.timedate1.NTP"] = true
+	s.timedateManager = timedateManager
+	s.timesyncManager = timesyncManager
+	timesyncManager = func() (dbus.BusObject, error) {
+		return nil, errNoBus
+	}
+	timedateManager = func() (dbus.BusObject, error) {
+		return timedate, nil
+	}
 }
 
 func (s *HandlersSuite) TearDownTest(c *C) {
 	newSnapdClient = newSnapdClientImpl
+	timedateManager = s.timedateManager
+	timesyncManager = s.timesyncManager
 }
 
 func (s *HandlersSuite) TestGetSnappyVersionError(c *C) {
@@ -112,7 +132,7 @@ func (s *HandlersSuite) TestServesIcons(c *C) {
 	c.Assert(os.Mkdir(icons, os.ModePerm), IsNil)
 	c.Assert(ioutil.WriteFile(iconPath, []byte{}, os.ModePerm), IsNil)
 
-	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.Config{DisableIPFilter: true})
+	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
 
 	// icon exists
 	rec := httptest.NewRecorder()
@@ -136,7 +156,7 @@ func (s *HandlersSuite) TestMakeMainPageHandler(c *C) {
 	c.Assert(err, IsNil)
 	os.Setenv("SNAP", filepath.Join(cwd, "..", ".."))
 
-	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.Config{DisableIPFilter: true})
+	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/", nil)
@@ -156,8 +176,12 @@ func (s *HandlersSuite) TestRenderLayoutNoTemplateDir(c *C) {
 
 	rec := httptest.NewRecorder()
 	renderLayout("foo.html", &templateData{}, rec)
-	c.Assert(rec.Body.String(), Matches, ".*no such file or directory\n")
 	c.Assert(rec.Code, Equals, http.StatusInternalServerError)
+
+	var resp snappy.ErrorResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), IsNil)
+	c.Check(resp.Kind, Equals, "internal-error")
+	c.Check(resp.Message, Matches, ".*no such file or directory")
 }
 
 func (s *HandlersSuite) TestRenderLayoutParseError(c *C) {
@@ -174,8 +198,12 @@ func (s *HandlersSuite) TestRenderLayoutParseError(c *C) {
 
 	rec := httptest.NewRecorder()
 	renderLayout("foo.html", &templateData{}, rec)
-	c.Assert(strings.HasPrefix(rec.Body.String(), "template:"), Equals, true)
 	c.Assert(rec.Code, Equals, http.StatusInternalServerError)
+
+	var resp snappy.ErrorResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), IsNil)
+	c.Check(resp.Kind, Equals, "internal-error")
+	c.Check(strings.HasPrefix(resp.Message, "template:"), Equals, true)
 }
 
 func (s *HandlersSuite) TestRenderLayout(c *C) {
@@ -201,7 +229,7 @@ func (s *HandlersSuite) TestModelInfoHandler(c *C) {
 
 	os.Setenv("SNAP", filepath.Join(cwd, "..", ".."))
 
-	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.Config{DisableIPFilter: true})
+	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/api/v2/device-info", nil)
@@ -240,10 +268,10 @@ func (s *HandlersSuite) TestDeviceActionInvalidMethod(c *C) {
 
 	os.Setenv("SNAP", filepath.Join(cwd, "..", ".."))
 
-	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.Config{DisableIPFilter: true})
+	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
 
 	rec := httptest.NewRecorder()
-	req, err := http.NewRequest("GET", "/api/v2/device-action", nil)
+	req, err := http.NewRequest("PUT", "/api/v2/device-action", nil)
 	c.Assert(err, IsNil)
 
 	req.AddCookie(&http.Cookie{Name: SnapwebCookieName, Value: "1234"})
@@ -257,7 +285,7 @@ func (s *HandlersSuite) TestDeviceActionInvalidContentType(c *C) {
 
 	os.Setenv("SNAP", filepath.Join(cwd, "..", ".."))
 
-	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.Config{DisableIPFilter: true})
+	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("POST", "/api/v2/device-action", nil)
@@ -274,7 +302,7 @@ func (s *HandlersSuite) TestDeviceActionInvalidJSON(c *C) {
 
 	os.Setenv("SNAP", filepath.Join(cwd, "..", ".."))
 
-	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.Config{DisableIPFilter: true})
+	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
 
 	rec := httptest.NewRecorder()
 	var patchJSON = []byte("{]")
@@ -294,7 +322,7 @@ func (s *HandlersSuite) TestDeviceActionInvalidAction(c *C) {
 
 	os.Setenv("SNAP", filepath.Join(cwd, "..", ".."))
 
-	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.Config{DisableIPFilter: true})
+	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
 
 	rec := httptest.NewRecorder()
 	var patchJSON = []byte("{\"actionType\", \"dance\"}")
@@ -313,7 +341,7 @@ func (s *HandlersSuite) TestTimeInfoInvalidMethod(c *C) {
 
 	os.Setenv("SNAP", filepath.Join(cwd, "..", ".."))
 
-	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.Config{DisableIPFilter: true})
+	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("POST", "/api/v2/time-info", nil)
@@ -330,7 +358,7 @@ func (s *HandlersSuite) TestTimeInfoGET(c *C) {
 
 	os.Setenv("SNAP", filepath.Join(cwd, "..", ".."))
 
-	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.Config{DisableIPFilter: true})
+	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/api/v2/time-info", nil)
@@ -358,7 +386,7 @@ func (s *HandlersSuite) TestTimeInfoInvalidContentType(c *C) {
 
 	os.Setenv("SNAP", filepath.Join(cwd, "..", ".."))
 
-	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.Config{DisableIPFilter: true})
+	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("PATCH", "/api/v2/time-info", nil)
@@ -375,7 +403,7 @@ func (s *HandlersSuite) TestTimeInfoInvalidJSON(c *C) {
 
 	os.Setenv("SNAP", filepath.Join(cwd, "..", ".."))
 
-	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.Config{DisableIPFilter: true})
+	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
 
 	rec := httptest.NewRecorder()
 	var patchJSON = []byte("{]")
@@ -394,7 +422,7 @@ func (s *HandlersSuite) TestEmptyTimeInfoUpdate(c *C) {
 
 	os.Setenv("SNAP", filepath.Join(cwd, "..", ".."))
 
-	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.Config{DisableIPFilter: true})
+	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
 
 	rec := httptest.NewRecorder()
 	var patchJSON = []byte("{}")
@@ -411,7 +439,7 @@ func (s *HandlersSuite) TestEmptyTimeInfoUpdate(c *C) {
 func (s *HandlersSuite) TestHandleSections(c *C) {
 	s.c.SnapSections = []string{"foo", "bar"}
 
-	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.Config{DisableIPFilter: true})
+	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/api/v2/sections", nil)
@@ -433,11 +461,43 @@ func (s *HandlersSuite) TestHandleSections(c *C) {
 	c.Assert(sections, DeepEquals, s.c.SnapSections)
 }
 
+func (s *HandlersSuite) TestHandleSectionsNotModified(c *C) {
+	s.c.SnapSections = []string{"foo", "bar"}
+
+	handler := initURLHandlers(log.New(ioutil.Discard, "", 0), snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/api/v2/sections", nil)
+		c.Assert(err, IsNil)
+		req.AddCookie(&http.Cookie{Name: SnapwebCookieName, Value: "1234"})
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	etag := rec.Header().Get("ETag")
+	c.Assert(etag, Not(Equals), "")
+
+	rec = get(etag)
+	c.Check(rec.Code, Equals, http.StatusNotModified)
+	c.Check(rec.Body.Len(), Equals, 0)
+
+	s.c.SnapSections = []string{"foo"}
+	rec = get(etag)
+	c.Check(rec.Code, Equals, http.StatusOK)
+	c.Check(rec.Header().Get("ETag"), Not(Equals), etag)
+}
+
 func (s *HandlersSuite) TestHandleSectionsError(c *C) {
 	s.c.SnapSections = nil
 	s.c.Err = errors.New("foo")
 
-	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.Config{DisableIPFilter: true})
+	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/api/v2/sections", nil)
@@ -448,10 +508,41 @@ func (s *HandlersSuite) TestHandleSectionsError(c *C) {
 	handler.ServeHTTP(rec, req)
 
 	c.Assert(rec.Code, Equals, http.StatusInternalServerError)
+
+	var resp snappy.ErrorResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), IsNil)
+	c.Check(resp, DeepEquals, snappy.ErrorResponse{Kind: "internal-error", Message: "foo"})
+}
+
+func (s *HandlersSuite) TestHandleSectionsSnapdUnavailable(c *C) {
+	s.c.SnapSections = nil
+	// the error of the snapd client when snapd cannot be reached
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	_, s.c.Err = client.New(&client.Config{BaseURL: server.URL}).ServerVersion()
+	c.Assert(s.c.Err, FitsTypeOf, client.ConnectionError{})
+
+	handler := initURLHandlers(log.New(ioutil.Discard, "", 0), snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/v2/sections", nil)
+	c.Assert(err, IsNil)
+
+	req.AddCookie(&http.Cookie{Name: SnapwebCookieName, Value: "1234"})
+
+	handler.ServeHTTP(rec, req)
+
+	c.Assert(rec.Code, Equals, http.StatusServiceUnavailable)
+
+	var resp snappy.ErrorResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), IsNil)
+	c.Check(resp.Kind, Equals, "unavailable")
+	c.Check(resp.Message, Matches, "cannot communicate with server: .*")
+	c.Check(resp.Snapd, IsNil)
 }
 
 func (s *HandlersSuite) TestRedirHandler(c *C) {
-	handler := redirHandler(snappy.Config{DisableIPFilter: true})
+	handler := redirHandler(snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/", nil)
@@ -463,7 +554,7 @@ func (s *HandlersSuite) TestRedirHandler(c *C) {
 }
 
 func (s *HandlersSuite) TestFilterHandler(c *C) {
-	handler := redirHandler(snappy.Config{DisableIPFilter: false})
+	handler := redirHandler(snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: false}))
 
 	rec := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/", nil)
@@ -473,10 +564,184 @@ func (s *HandlersSuite) TestFilterHandler(c *C) {
 	c.Assert(rec.Code, Equals, http.StatusForbidden)
 
 	networks := []string{"192.168.0.0/24"}
-	handler2 := redirHandler(snappy.Config{AllowNetworks: networks})
+	handler2 := redirHandler(snappy.NewConfigWatcher(snappy.Config{AllowNetworks: networks}))
 	rec2 := httptest.NewRecorder()
 	req.RemoteAddr = "192.168.0.1:4200"
 
 	handler2.ServeHTTP(rec2, req)
 	c.Assert(rec2.Code, Equals, http.StatusSeeOther)
 }
+
+func (s *HandlersSuite) TestSettingsHandler(c *C) {
+	config := snappy.Config{DisableIPFilter: true, AllowNetworks: []string{"192.168.0.0/24"}}
+	handler := initURLHandlers(log.New(os.Stdout, "", 0), snappy.NewConfigWatcher(config))
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/v2/settings", nil)
+	c.Assert(err, IsNil)
+
+	req.AddCookie(&http.Cookie{Name: SnapwebCookieName, Value: "1234"})
+
+	handler.ServeHTTP(rec, req)
+
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Type"), Equals, "application/json")
+
+	var effective snappy.Config
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &effective), IsNil)
+	c.Assert(effective, DeepEquals, config)
+}
+
+func (s *HandlersSuite) TestFilterHandlerReload(c *C) {
+	snapCommon := c.MkDir()
+	os.Setenv("SNAP_COMMON", snapCommon)
+
+	settings := snappy.NewConfigWatcher(snappy.Config{AllowNetworks: []string{"10.0.0.0/8"}})
+	handler := redirHandler(settings)
+
+	req, err := http.NewRequest("GET", "/", nil)
+	c.Assert(err, IsNil)
+	req.RemoteAddr = "192.168.0.1:4200"
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	c.Assert(rec.Code, Equals, http.StatusForbidden)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(snapCommon, "settings.json"),
+		[]byte(`{"allowNetworks": ["192.168.0.0/24"]}`), 0644), IsNil)
+	c.Assert(settings.Reload(), IsNil)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	c.Assert(rec.Code, Equals, http.StatusSeeOther)
+}
+
+func (s *HandlersSuite) TestRedirHandlerLocation(c *C) {
+	tests := []struct {
+		addresses []string
+		host      string
+		location  string
+	}{
+		// default, listening on all addresses
+		{nil, "192.168.0.1:4200", "https://192.168.0.1:4201/apps?q=1"},
+		{nil, "device.local:4200", "https://device.local:4201/apps?q=1"},
+		{nil, "[fe80::1]:4200", "https://[fe80::1]:4201/apps?q=1"},
+		{nil, "[::1]", "https://[::1]:4201/apps?q=1"},
+		{nil, "device.local", "https://device.local:4201/apps?q=1"},
+		// end-point matching the host used by the client
+		{[]string{"10.0.0.1:8443", "192.168.0.1:9443"}, "192.168.0.1:4200", "https://192.168.0.1:9443/apps?q=1"},
+		{[]string{"10.0.0.1:8443", "[::1]:9443"}, "[::1]", "https://[::1]:9443/apps?q=1"},
+		// otherwise the first end-point
+		{[]string{"10.0.0.1:8443"}, "device.local:4200", "https://10.0.0.1:8443/apps?q=1"},
+	}
+
+	for _, t := range tests {
+		settings := snappy.NewConfigWatcher(snappy.Config{
+			DisableIPFilter: true,
+			HTTPPort:        4200,
+			HTTPSPort:       4201,
+			HTTPSAddresses:  t.addresses,
+		})
+		handler := redirHandler(settings)
+
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/apps?q=1", nil)
+		c.Assert(err, IsNil)
+		req.Host = t.host
+
+		handler.ServeHTTP(rec, req)
+
+		c.Check(rec.Code, Equals, http.StatusSeeOther)
+		c.Check(rec.Header().Get("Location"), Equals, t.location, Commentf("%v %s", t.addresses, t.host))
+	}
+}
+
+func (s *HandlersSuite) TestFilterRules(c *C) {
+	handler := redirHandler(snappy.NewConfigWatcher(snappy.Config{
+		FilterRules:    []string{"deny 192.168.0.128/25"},
+		AllowNetworks:  []string{"192.168.0.0/24"},
+		TrustedProxies: []string{"10.0.0.1/32"},
+	}))
+
+	for remote, code := range map[string]int{
+		"192.168.0.1:4200":   http.StatusSeeOther,
+		"192.168.0.200:4200": http.StatusForbidden,
+		"10.0.0.1:4200":      http.StatusSeeOther,
+	} {
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/", nil)
+		c.Assert(err, IsNil)
+		req.RemoteAddr = remote
+		req.Header.Set("X-Forwarded-For", "192.168.0.2")
+
+		handler.ServeHTTP(rec, req)
+		c.Check(rec.Code, Equals, code, Commentf(remote))
+	}
+}
+
+func (s *HandlersSuite) TestSecurityHeaders(c *C) {
+	cwd, err := os.Getwd()
+	c.Assert(err, IsNil)
+	os.Setenv("SNAP", filepath.Join(cwd, "..", ".."))
+
+	settings := snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true})
+	handler := initURLHandlers(log.New(os.Stdout, "", 0), settings)
+
+	req, err := http.NewRequest("GET", "/", nil)
+	c.Assert(err, IsNil)
+	req.AddCookie(&http.Cookie{Name: SnapwebCookieName, Value: "1234"})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	c.Check(rec.Header().Get("X-Frame-Options"), Equals, "DENY")
+	c.Check(rec.Header().Get("X-Content-Type-Options"), Equals, "nosniff")
+	// not over plain HTTP
+	c.Check(rec.Header().Get("Strict-Transport-Security"), Equals, "")
+
+	// the inline script of the template is allowed by its nonce
+	csp := rec.Header().Get("Content-Security-Policy")
+	c.Assert(csp, Matches, ".*script-src 'self' 'nonce-[^']+'.*")
+	nonce := strings.SplitN(strings.SplitN(csp, "'nonce-", 2)[1], "'", 2)[0]
+	c.Check(strings.Contains(rec.Body.String(), `<script nonce="`+nonce+`">`), Equals, true)
+
+	// a new nonce for every page
+	rec2 := httptest.NewRecorder()
+	handler.ServeHTTP(rec2, req)
+	c.Check(rec2.Header().Get("Content-Security-Policy"), Not(Equals), csp)
+
+	// HSTS over HTTPS
+	req.TLS = &tls.ConnectionState{}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	c.Check(rec.Header().Get("Strict-Transport-Security"), Equals, "max-age=31536000")
+
+	// API responses have the headers too, but no CSP
+	req, err = http.NewRequest("GET", "/api/v2/settings", nil)
+	c.Assert(err, IsNil)
+	req.AddCookie(&http.Cookie{Name: SnapwebCookieName, Value: "1234"})
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	c.Check(rec.Header().Get("X-Frame-Options"), Equals, "DENY")
+	c.Check(rec.Header().Get("Content-Security-Policy"), Equals, "")
+}
+
+func (s *HandlersSuite) TestUIAllowedByContentSecurityPolicy(c *C) {
+	// without 'unsafe-eval', the UI cannot compile code at runtime: its
+	// templates are precompiled by hbsfy
+	evaluating := regexp.MustCompile(`\beval\(|\bnew Function\(|_\.template\(`)
+
+	err := filepath.Walk(filepath.Join("..", "..", "www", "src", "js"), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(path) != ".js" {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		c.Check(evaluating.FindString(string(content)), Equals, "", Commentf("%s", path))
+		return nil
+	})
+	c.Assert(err, IsNil)
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/godbus/dbus"
+)
+
+const hostnameInterface = "org.freedesktop.hostname1"
+
+// maximum length of a hostname, HOST_NAME_MAX on Linux
+const maxHostnameLength = 64
+
+// maximum length of the pretty name, which hostnamed keeps in a file
+const maxDeviceNameLength = 255
+
+// hostnameManager returns hostnamed, which changes the hostname and the
+// pretty name of the device
+var hostnameManager = func() (dbus.BusObject, error) {
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	return bus.Object("org.freedesktop.hostname1", "/org/freedesktop/hostname1"), nil
+}
+
+// deviceNames are the hostname and the descriptive name of the device
+type deviceNames struct {
+	Hostname   string `json:"hostname"`
+	DeviceName string `json:"deviceName"`
+}
+
+// deviceNamesPatch lists the names to change
+type deviceNamesPatch struct {
+	Hostname   *string `json:"hostname"`
+	DeviceName *string `json:"deviceName"`
+}
+
+// validateHostname checks the hostname is made of RFC 1123 labels
+func validateHostname(hostname string) error {
+	if hostname == "" {
+		return fmt.Errorf("Invalid hostname: empty")
+	}
+	if len(hostname) > maxHostnameLength {
+		return fmt.Errorf("Invalid hostname %q: longer than %d characters", hostname, maxHostnameLength)
+	}
+
+	for _, label := range strings.Split(hostname, ".") {
+		if label == "" {
+			return fmt.Errorf("Invalid hostname %q: empty label", hostname)
+		}
+		if len(label) > 63 {
+			return fmt.Errorf("Invalid hostname %q: label %q longer than 63 characters", hostname, label)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("Invalid hostname %q: label %q starts or ends with a hyphen", hostname, label)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Errorf("Invalid hostname %q: invalid character %q", hostname, c)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateDeviceName checks the pretty name, which is free form text
+func validateDeviceName(name string) error {
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("Invalid device name: not UTF-8")
+	}
+	if len(name) > maxDeviceNameLength {
+		return fmt.Errorf("Invalid device name: longer than %d bytes", maxDeviceNameLength)
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) {
+			return fmt.Errorf("Invalid device name %q: control character", name)
+		}
+	}
+
+	return nil
+}
+
+// validate checks the names to change, at least one being needed
+func (p deviceNamesPatch) validate() error {
+	if p.Hostname == nil && p.DeviceName == nil {
+		return fmt.Errorf("Nothing to change, hostname or deviceName expected")
+	}
+	if p.Hostname != nil {
+		if err := validateHostname(*p.Hostname); err != nil {
+			return err
+		}
+	}
+	if p.DeviceName != nil {
+		if err := validateDeviceName(*p.DeviceName); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getDeviceNames reads the names of the device from hostnamed
+func getDeviceNames() (deviceNames, error) {
+	manager, err := hostnameManager()
+	if err != nil {
+		return deviceNames{}, err
+	}
+
+	var names deviceNames
+	for prop, value := range map[string]*string{
+		"Hostname":       &names.Hostname,
+		"PrettyHostname": &names.DeviceName,
+	} {
+		v, err := manager.GetProperty(hostnameInterface + "." + prop)
+		if err != nil {
+			return deviceNames{}, err
+		}
+		s, ok := v.Value().(string)
+		if !ok {
+			return deviceNames{}, fmt.Errorf("Unexpected %s value %s", prop, v)
+		}
+		*value = s
+	}
+
+	return names, nil
+}
+
+// setDeviceNames changes the names of the device through hostnamed; the
+// hostname is changed both persistently and for the running system
+func setDeviceNames(patch deviceNamesPatch) error {
+	manager, err := hostnameManager()
+	if err != nil {
+		return err
+	}
+
+	// not interactive, there is nobody to ask for authorization
+	if patch.Hostname != nil {
+		for _, method := range []string{"SetStaticHostname", "SetHostname"} {
+			if err := manager.Call(hostnameInterface+"."+method, 0, *patch.Hostname, false).Err; err != nil {
+				return err
+			}
+		}
+	}
+
+	if patch.DeviceName != nil {
+		if err := manager.Call(hostnameInterface+".SetPrettyHostname", 0, *patch.DeviceName, false).Err; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
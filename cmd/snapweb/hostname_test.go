@@ -0,0 +1,189 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	"github.com/godbus/dbus"
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapweb/snappy/app"
+	"github.com/snapcore/snapweb/snappy/snapdclient"
+)
+
+type HostnameSuite struct {
+	manager         *fakeBusObject
+	handler         http.Handler
+	hostnameManager func() (dbus.BusObject, error)
+}
+
+var _ = Suite(&HostnameSuite{})
+
+func (s *HostnameSuite) SetUpTest(c *C) {
+	newSnapdClient = func() snapdclient.SnapdClient {
+		return &snapdclient.FakeSnapdClient{}
+	}
+
+	os.Setenv("SNAP_DATA", c.MkDir())
+	c.Assert(ioutil.WriteFile(tokenFilename(), []byte("1234"), 0600), IsNil)
+
+	s.hostnameManager = hostnameManager
+	s.manager = newFakeBusObject()
+	s.manager.properties[hostnameInterface+".Hostname"] = "device"
+	s.manager.properties[hostnameInterface+".PrettyHostname"] = "Kitchen device"
+	hostnameManager = func() (dbus.BusObject, error) {
+		return s.manager, nil
+	}
+
+	s.handler = initURLHandlers(log.New(ioutil.Discard, "", 0), snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
+}
+
+func (s *HostnameSuite) TearDownTest(c *C) {
+	newSnapdClient = newSnapdClientImpl
+	hostnameManager = s.hostnameManager
+}
+
+func (s *HostnameSuite) request(c *C, method string, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, "/api/v2/device-info", bytes.NewBufferString(body))
+	c.Assert(err, IsNil)
+	req.AddCookie(&http.Cookie{Name: SnapwebCookieName, Value: "1234"})
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func (s *HostnameSuite) TestValidateHostname(c *C) {
+	for _, hostname := range []string{
+		"device",
+		"Device-2",
+		"0device",
+		"kitchen.example.com",
+		strings.Repeat("a", 63),
+	} {
+		c.Check(validateHostname(hostname), IsNil, Commentf(hostname))
+	}
+
+	for _, hostname := range []string{
+		"",
+		"-device",
+		"device-",
+		"my_device",
+		"kitchen..example",
+		"device.",
+		"dévice",
+		"two words",
+		strings.Repeat("a", 64),
+		strings.Repeat("abcd.", 13),
+	} {
+		c.Check(validateHostname(hostname), NotNil, Commentf(hostname))
+	}
+}
+
+func (s *HostnameSuite) TestValidateDeviceName(c *C) {
+	c.Check(validateDeviceName("Kitchen’s device"), IsNil)
+	c.Check(validateDeviceName(""), IsNil)
+	c.Check(validateDeviceName("two\nlines"), NotNil)
+	c.Check(validateDeviceName("\xff"), NotNil)
+	c.Check(validateDeviceName(strings.Repeat("a", 256)), NotNil)
+}
+
+func (s *HostnameSuite) TestGetDeviceInfo(c *C) {
+	rec := s.request(c, "GET", "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	var info deviceInfoResponse
+	c.Assert(json.NewDecoder(rec.Body).Decode(&info), IsNil)
+	c.Check(info.Hostname, Equals, "device")
+	c.Check(info.DeviceName, Equals, "Kitchen device")
+}
+
+func (s *HostnameSuite) TestGetDeviceInfoWithoutHostnamed(c *C) {
+	hostnameManager = func() (dbus.BusObject, error) {
+		return nil, errNoBus
+	}
+
+	rec := s.request(c, "GET", "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	hostname, _ := os.Hostname()
+	var info deviceInfoResponse
+	c.Assert(json.NewDecoder(rec.Body).Decode(&info), IsNil)
+	c.Check(info.Hostname, Equals, hostname)
+	c.Check(info.DeviceName, Equals, "")
+}
+
+func (s *HostnameSuite) TestPatchHostname(c *C) {
+	rec := s.request(c, "PATCH", `{"hostname": "kitchen"}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Check(s.manager.calls, DeepEquals, []fakeCall{
+		{Method: "org.freedesktop.hostname1.SetStaticHostname", Args: []interface{}{"kitchen", false}},
+		{Method: "org.freedesktop.hostname1.SetHostname", Args: []interface{}{"kitchen", false}},
+	})
+
+	var names deviceNames
+	c.Assert(json.NewDecoder(rec.Body).Decode(&names), IsNil)
+	c.Check(names, Equals, deviceNames{Hostname: "device", DeviceName: "Kitchen device"})
+}
+
+func (s *HostnameSuite) TestPatchDeviceName(c *C) {
+	rec := s.request(c, "PATCH", `{"deviceName": "Living room"}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Check(s.manager.calls, DeepEquals, []fakeCall{
+		{Method: "org.freedesktop.hostname1.SetPrettyHostname", Args: []interface{}{"Living room", false}},
+	})
+}
+
+func (s *HostnameSuite) TestPatchInvalid(c *C) {
+	for _, body := range []string{
+		`{}`,
+		`{"hostname": "-kitchen"}`,
+		`{"hostname": ""}`,
+		`{"deviceName": "a\u0007b"}`,
+		`{"hostname": 42}`,
+	} {
+		rec := s.request(c, "PATCH", body)
+		c.Check(rec.Code, Equals, http.StatusBadRequest, Commentf(body))
+	}
+	c.Check(s.manager.calls, HasLen, 0)
+
+	req, err := http.NewRequest("PATCH", "/api/v2/device-info", bytes.NewBufferString(`{"hostname": "kitchen"}`))
+	c.Assert(err, IsNil)
+	req.AddCookie(&http.Cookie{Name: SnapwebCookieName, Value: "1234"})
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	c.Check(rec.Code, Equals, http.StatusUnsupportedMediaType)
+}
+
+func (s *HostnameSuite) TestPatchFailure(c *C) {
+	s.manager.errors[hostnameInterface+".SetStaticHostname"] = dbus.ErrMsgNoObject
+
+	rec := s.request(c, "PATCH", `{"hostname": "kitchen"}`)
+	c.Check(rec.Code, Equals, http.StatusInternalServerError)
+}
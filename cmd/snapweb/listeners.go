@@ -0,0 +1,260 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/snapcore/snapweb/snappy/app"
+)
+
+// endpoint describes an address snapweb listens on
+type endpoint struct {
+	network string
+	address string
+	// certificate and TLS settings, for HTTPS end-points
+	cert certSettings
+	tls  tlsSettings
+}
+
+// tlsSettings are the TLS parameters of the HTTPS end-points
+type tlsSettings struct {
+	minVersion string
+	// client certificate authentication mode and authorities
+	clientAuth   string
+	clientCAFile string
+}
+
+func (e endpoint) isTLS() bool {
+	return e.cert.certFile != ""
+}
+
+func (e endpoint) String() string {
+	scheme := "http"
+	if e.isTLS() {
+		scheme = "https"
+	}
+	if e.network == "unix" {
+		scheme += "+unix"
+	}
+	return fmt.Sprintf("%s://%s", scheme, e.address)
+}
+
+// tlsCipherSuites only lists forward secret AEAD suites, for TLS 1.2;
+// the TLS 1.3 ones are all fine and not configurable
+var tlsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// newTLSConfig returns the TLS configuration of the HTTPS end-points,
+// serving the current certificate
+func newTLSConfig(settings tlsSettings) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CipherSuites:     tlsCipherSuites,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		GetCertificate:   certificates.GetCertificate,
+	}
+
+	if settings.minVersion == snappy.TLSVersion13 {
+		config.MinVersion = tls.VersionTLS13
+	}
+
+	switch settings.clientAuth {
+	case snappy.ClientAuthOptional:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case snappy.ClientAuthRequired:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return config, nil
+	}
+
+	pool, err := loadClientCAs(settings.clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = pool
+
+	return config, nil
+}
+
+// listenerSet keeps the running servers in line with the configured end-points
+type listenerSet struct {
+	sync.Mutex
+	// handler for the plain HTTP end-points
+	httpHandler http.Handler
+	// handler for the HTTPS end-points
+	httpsHandler http.Handler
+	// handler for the unix socket, which is not subject to IP filtering
+	unixHandler http.Handler
+
+	servers map[endpoint]*http.Server
+}
+
+func newListenerSet(httpHandler, httpsHandler, unixHandler http.Handler) *listenerSet {
+	return &listenerSet{
+		httpHandler:  httpHandler,
+		httpsHandler: httpsHandler,
+		unixHandler:  unixHandler,
+		servers:      make(map[endpoint]*http.Server),
+	}
+}
+
+// endpoints lists the end-points the configuration asks for
+func endpoints(config snappy.Config) ([]endpoint, error) {
+	var eps []endpoint
+
+	addrs, err := config.HTTPListenAddresses()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		eps = append(eps, endpoint{network: "tcp", address: addr})
+	}
+
+	if !config.DisableHTTPS {
+		addrs, err := config.HTTPSListenAddresses()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			eps = append(eps, endpoint{
+				network: "tcp",
+				address: addr,
+				cert:    newCertSettings(config),
+				tls: tlsSettings{
+					minVersion:   config.TLSMinVersion,
+					clientAuth:   config.ClientAuth,
+					clientCAFile: config.ClientCAFile,
+				},
+			})
+		}
+	}
+
+	if config.UnixSocket != "" {
+		eps = append(eps, endpoint{network: "unix", address: config.UnixSocket})
+	}
+
+	return eps, nil
+}
+
+// update starts the servers for new end-points and stops the ones that are
+// no longer configured. It returns the first error met, while still trying
+// to start the remaining end-points.
+func (l *listenerSet) update(config snappy.Config) error {
+	wanted, err := endpoints(config)
+	if err != nil {
+		return err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	keep := make(map[endpoint]bool)
+	for _, ep := range wanted {
+		keep[ep] = true
+	}
+
+	for ep, server := range l.servers {
+		if !keep[ep] {
+			logger.Println("Stopping listener on", ep)
+			server.Close()
+			delete(l.servers, ep)
+		}
+	}
+
+	var firstErr error
+	for _, ep := range wanted {
+		if _, running := l.servers[ep]; running {
+			continue
+		}
+		if err := l.start(ep); err != nil {
+			logger.Printf("Cannot listen on %s: %v", ep, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
+}
+
+func (l *listenerSet) start(ep endpoint) error {
+	handler := l.httpHandler
+	var tlsConfig *tls.Config
+
+	switch {
+	case ep.network == "unix":
+		handler = l.unixHandler
+		// remove a socket left behind by a previous run
+		if fi, err := os.Lstat(ep.address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(ep.address)
+		}
+	case ep.isTLS():
+		handler = l.httpsHandler
+		if err := certificates.load(ep.cert); err != nil {
+			return err
+		}
+		var err error
+		if tlsConfig, err = newTLSConfig(ep.tls); err != nil {
+			return err
+		}
+	}
+
+	listener, err := net.Listen(ep.network, ep.address)
+	if err != nil {
+		return err
+	}
+
+	if ep.network == "unix" {
+		if err := os.Chmod(ep.address, 0600); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	server := &http.Server{Handler: handler, TLSConfig: tlsConfig}
+	l.servers[ep] = server
+
+	logger.Println("Listening on", ep)
+
+	go func() {
+		var err error
+		if ep.isTLS() {
+			// the certificate comes from GetCertificate
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logger.Printf("Listener on %s failed with %v", ep, err)
+		}
+	}()
+
+	return nil
+}
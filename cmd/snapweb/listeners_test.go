@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapweb/snappy/app"
+)
+
+type ListenersSuite struct{}
+
+var _ = Suite(&ListenersSuite{})
+
+func (s *ListenersSuite) TestEndpoints(c *C) {
+	config := snappy.Config{
+		HTTPPort:       4200,
+		HTTPSPort:      4201,
+		HTTPAddresses:  []string{"127.0.0.1"},
+		HTTPSAddresses: []string{"[::1]"},
+		CertFile:       "/cert.pem",
+		KeyFile:        "/key.pem",
+		UnixSocket:     "/run/snapweb.socket",
+	}
+
+	eps, err := endpoints(config)
+	c.Assert(err, IsNil)
+	c.Check(eps, DeepEquals, []endpoint{
+		{network: "tcp", address: "127.0.0.1:4200"},
+		{network: "tcp", address: "[::1]:4201", cert: certSettings{certFile: "/cert.pem", keyFile: "/key.pem"}},
+		{network: "unix", address: "/run/snapweb.socket"},
+	})
+
+	config.DisableHTTPS = true
+	eps, err = endpoints(config)
+	c.Assert(err, IsNil)
+	c.Check(eps, DeepEquals, []endpoint{
+		{network: "tcp", address: "127.0.0.1:4200"},
+		{network: "unix", address: "/run/snapweb.socket"},
+	})
+}
+
+func (s *ListenersSuite) TestUnixSocket(c *C) {
+	socket := filepath.Join(c.MkDir(), "snapweb.socket")
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("unix"))
+	})
+	listeners := newListenerSet(http.NotFoundHandler(), http.NotFoundHandler(), handler)
+
+	config := snappy.Config{
+		DisableHTTPS:  true,
+		HTTPAddresses: []string{"127.0.0.1"},
+		UnixSocket:    socket,
+	}
+	c.Assert(listeners.update(config), IsNil)
+	c.Check(listeners.servers, HasLen, 2)
+
+	fi, err := os.Stat(socket)
+	c.Assert(err, IsNil)
+	c.Check(fi.Mode().Perm(), Equals, os.FileMode(0600))
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://snapweb/")
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(err, IsNil)
+	c.Check(string(body), Equals, "unix")
+
+	// dropping the unix socket from the configuration stops its server
+	config.UnixSocket = ""
+	c.Assert(listeners.update(config), IsNil)
+	c.Check(listeners.servers, HasLen, 1)
+	_, err = client.Get("http://snapweb/")
+	c.Check(err, NotNil)
+
+	for _, server := range listeners.servers {
+		server.Close()
+	}
+}
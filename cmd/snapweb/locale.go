@@ -0,0 +1,368 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/godbus/dbus"
+)
+
+const localeInterface = "org.freedesktop.locale1"
+
+// localeManager returns localed, which sets the system locale and keyboard
+// layout
+var localeManager = func() (dbus.BusObject, error) {
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	return bus.Object("org.freedesktop.locale1", "/org/freedesktop/locale1"), nil
+}
+
+// localeDir holds the compiled locales, in locale-archive or in directories
+var localeDir = "/usr/lib/locale"
+
+// localeVariables are the variables of the system locale
+var localeVariables = []string{
+	"LANG", "LANGUAGE", "LC_CTYPE", "LC_NUMERIC", "LC_TIME", "LC_COLLATE",
+	"LC_MONETARY", "LC_MESSAGES", "LC_PAPER", "LC_NAME", "LC_ADDRESS",
+	"LC_TELEPHONE", "LC_MEASUREMENT", "LC_IDENTIFICATION",
+}
+
+// keymapPattern matches the names of keymaps, keyboard layouts, models,
+// variants and options, which may be comma separated lists
+var keymapPattern = regexp.MustCompile(`^[a-zA-Z0-9_.:+,()-]{0,255}$`)
+
+// keyboardSettings are the console and X11 keyboard layouts
+type keyboardSettings struct {
+	VConsoleKeymap       string `json:"vconsoleKeymap"`
+	VConsoleKeymapToggle string `json:"vconsoleKeymapToggle"`
+	X11Layout            string `json:"x11Layout"`
+	X11Model             string `json:"x11Model"`
+	X11Variant           string `json:"x11Variant"`
+	X11Options           string `json:"x11Options"`
+}
+
+// localeSettings are the system locale, by variable, and keyboard layouts
+type localeSettings struct {
+	Locale   map[string]string `json:"locale"`
+	Keyboard keyboardSettings  `json:"keyboard"`
+	// Available lists the locales that can be used
+	Available []string `json:"available"`
+}
+
+// localePatch lists the settings to change: the locale variables to set,
+// or to unset when empty, and the keyboard layouts
+type localePatch struct {
+	Locale               map[string]string `json:"locale"`
+	VConsoleKeymap       *string           `json:"vconsoleKeymap"`
+	VConsoleKeymapToggle *string           `json:"vconsoleKeymapToggle"`
+	X11Layout            *string           `json:"x11Layout"`
+	X11Model             *string           `json:"x11Model"`
+	X11Variant           *string           `json:"x11Variant"`
+	X11Options           *string           `json:"x11Options"`
+}
+
+func (p localePatch) changesVConsole() bool {
+	return p.VConsoleKeymap != nil || p.VConsoleKeymapToggle != nil
+}
+
+func (p localePatch) changesX11() bool {
+	return p.X11Layout != nil || p.X11Model != nil || p.X11Variant != nil || p.X11Options != nil
+}
+
+// normalizeLocale writes the codeset the way localectl lists it, e.g.
+// en_US.utf8 as en_US.UTF-8
+func normalizeLocale(name string) string {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		codeset := name[i+1:]
+		modifier := ""
+		if j := strings.IndexByte(codeset, '@'); j >= 0 {
+			codeset, modifier = codeset[:j], codeset[j:]
+		}
+		if strings.EqualFold(codeset, "utf8") || strings.EqualFold(codeset, "utf-8") {
+			return name[:i] + ".UTF-8" + modifier
+		}
+	}
+	return name
+}
+
+// locale-archive format, from glibc locarchive.h
+const (
+	localeArchiveMagic = 0xde020109
+	localeArchiveHead  = 9 * 4
+)
+
+// readLocaleArchive returns the names of the locales of locale-archive
+func readLocaleArchive(filename string) ([]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < localeArchiveHead {
+		return nil, fmt.Errorf("Invalid locale archive %s: truncated", filename)
+	}
+
+	// in the byte order of the system which generated it
+	var order binary.ByteOrder = binary.LittleEndian
+	if order.Uint32(data) != localeArchiveMagic {
+		order = binary.BigEndian
+		if order.Uint32(data) != localeArchiveMagic {
+			return nil, fmt.Errorf("Invalid locale archive %s: bad magic", filename)
+		}
+	}
+
+	// magic, serial, then the offset and size of the name hash table
+	offset := int(order.Uint32(data[8:]))
+	size := int(order.Uint32(data[16:]))
+
+	var names []string
+	for i := 0; i < size; i++ {
+		// hash value, name offset and locale record offset
+		entry := offset + i*12
+		if entry < 0 || entry+12 > len(data) {
+			return nil, fmt.Errorf("Invalid locale archive %s: truncated", filename)
+		}
+		nameOffset := int(order.Uint32(data[entry+4:]))
+		if order.Uint32(data[entry+8:]) == 0 {
+			// unused entry
+			continue
+		}
+		if nameOffset >= len(data) {
+			return nil, fmt.Errorf("Invalid locale archive %s: truncated", filename)
+		}
+		end := bytes.IndexByte(data[nameOffset:], 0)
+		if end < 0 {
+			return nil, fmt.Errorf("Invalid locale archive %s: truncated", filename)
+		}
+		names = append(names, string(data[nameOffset:nameOffset+end]))
+	}
+
+	return names, nil
+}
+
+// availableLocales lists the compiled locales, as localectl does: C.UTF-8,
+// the ones of locale-archive and the ones in their own directory
+func availableLocales() ([]string, error) {
+	found := map[string]bool{"C.UTF-8": true}
+
+	names, err := readLocaleArchive(filepath.Join(localeDir, "locale-archive"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, name := range names {
+		found[normalizeLocale(name)] = true
+	}
+
+	entries, err := ioutil.ReadDir(localeDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if _, err := os.Stat(filepath.Join(localeDir, entry.Name(), "LC_IDENTIFICATION")); err == nil {
+			found[normalizeLocale(entry.Name())] = true
+		}
+	}
+
+	locales := make([]string, 0, len(found))
+	for name := range found {
+		locales = append(locales, name)
+	}
+	sort.Strings(locales)
+
+	return locales, nil
+}
+
+// validate checks the locale variables and their values, as well as the
+// keyboard layout names
+func (p localePatch) validate(available []string) error {
+	if p.Locale == nil && !p.changesVConsole() && !p.changesX11() {
+		return fmt.Errorf("Nothing to change, locale or keyboard layouts expected")
+	}
+
+	known := make(map[string]bool, len(available))
+	for _, name := range available {
+		known[name] = true
+	}
+
+	for name, value := range p.Locale {
+		if !contains(localeVariables, name) {
+			return fmt.Errorf("Invalid locale variable %s, expected one of %s", name, strings.Join(localeVariables, ", "))
+		}
+		// LANGUAGE is a list of languages, not a locale
+		if value == "" || name == "LANGUAGE" {
+			continue
+		}
+		if !known[normalizeLocale(value)] {
+			return fmt.Errorf("Unknown locale %q for %s, see the available locales", value, name)
+		}
+	}
+
+	for name, value := range map[string]*string{
+		"vconsoleKeymap":       p.VConsoleKeymap,
+		"vconsoleKeymapToggle": p.VConsoleKeymapToggle,
+		"x11Layout":            p.X11Layout,
+		"x11Model":             p.X11Model,
+		"x11Variant":           p.X11Variant,
+		"x11Options":           p.X11Options,
+	} {
+		if value != nil && !keymapPattern.MatchString(*value) {
+			return fmt.Errorf("Invalid %s %q", name, *value)
+		}
+	}
+
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// readLocaleProperty reads a string property of localed
+func readLocaleProperty(locale dbus.BusObject, name string) (string, error) {
+	v, err := readDbusProperty(locale, localeInterface+"."+name)
+	if err != nil {
+		return "", err
+	}
+	s, ok := v.Value().(string)
+	if !ok {
+		return "", fmt.Errorf("Unexpected %s value %s", name, v)
+	}
+	return s, nil
+}
+
+// getLocaleSettings reads the locale and keyboard layouts from localed
+func getLocaleSettings() (localeSettings, error) {
+	locale, err := localeManager()
+	if err != nil {
+		return localeSettings{}, err
+	}
+
+	v, err := readDbusProperty(locale, localeInterface+".Locale")
+	if err != nil {
+		return localeSettings{}, err
+	}
+	assignments, ok := v.Value().([]string)
+	if !ok {
+		return localeSettings{}, fmt.Errorf("Unexpected Locale value %s", v)
+	}
+
+	settings := localeSettings{Locale: make(map[string]string)}
+	for _, assignment := range assignments {
+		if parts := strings.SplitN(assignment, "=", 2); len(parts) == 2 {
+			settings.Locale[parts[0]] = parts[1]
+		}
+	}
+
+	for name, value := range map[string]*string{
+		"VConsoleKeymap":       &settings.Keyboard.VConsoleKeymap,
+		"VConsoleKeymapToggle": &settings.Keyboard.VConsoleKeymapToggle,
+		"X11Layout":            &settings.Keyboard.X11Layout,
+		"X11Model":             &settings.Keyboard.X11Model,
+		"X11Variant":           &settings.Keyboard.X11Variant,
+		"X11Options":           &settings.Keyboard.X11Options,
+	} {
+		if *value, err = readLocaleProperty(locale, name); err != nil {
+			return localeSettings{}, err
+		}
+	}
+
+	if settings.Available, err = availableLocales(); err != nil {
+		return localeSettings{}, err
+	}
+
+	return settings, nil
+}
+
+func stringOr(value *string, current string) string {
+	if value != nil {
+		return *value
+	}
+	return current
+}
+
+// setLocaleSettings applies the changes on top of the current settings;
+// when only one of the console and X11 keyboard layouts is given, localed
+// converts it to the other
+func setLocaleSettings(current localeSettings, patch localePatch) error {
+	locale, err := localeManager()
+	if err != nil {
+		return err
+	}
+
+	if patch.Locale != nil {
+		merged := make(map[string]string)
+		for name, value := range current.Locale {
+			merged[name] = value
+		}
+		for name, value := range patch.Locale {
+			merged[name] = value
+		}
+
+		assignments := []string{}
+		for _, name := range localeVariables {
+			if merged[name] != "" {
+				assignments = append(assignments, name+"="+merged[name])
+			}
+		}
+
+		// not interactive, there is nobody to ask for authorization
+		if err := callDbusEndpoint(locale, localeInterface+".SetLocale", assignments, false); err != nil {
+			return err
+		}
+	}
+
+	keyboard := current.Keyboard
+	convert := patch.changesVConsole() != patch.changesX11()
+
+	if patch.changesVConsole() {
+		if err := callDbusEndpoint(locale, localeInterface+".SetVConsoleKeymap",
+			stringOr(patch.VConsoleKeymap, keyboard.VConsoleKeymap),
+			stringOr(patch.VConsoleKeymapToggle, keyboard.VConsoleKeymapToggle),
+			convert, false); err != nil {
+			return err
+		}
+	}
+
+	if patch.changesX11() {
+		if err := callDbusEndpoint(locale, localeInterface+".SetX11Keyboard",
+			stringOr(patch.X11Layout, keyboard.X11Layout),
+			stringOr(patch.X11Model, keyboard.X11Model),
+			stringOr(patch.X11Variant, keyboard.X11Variant),
+			stringOr(patch.X11Options, keyboard.X11Options),
+			convert, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
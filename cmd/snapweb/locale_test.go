@@ -0,0 +1,335 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/godbus/dbus"
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapweb/snappy/app"
+	"github.com/snapcore/snapweb/snappy/snapdclient"
+)
+
+type LocaleSuite struct {
+	locale        *fakeBusObject
+	localeManager func() (dbus.BusObject, error)
+	handler       http.Handler
+}
+
+var _ = Suite(&LocaleSuite{})
+
+// writeLocaleArchive writes a locale-archive with the given locales, and
+// an unused entry after the first one
+func writeLocaleArchive(c *C, filename string, order binary.ByteOrder, names ...string) {
+	const headSize = 9 * 4
+	size := len(names) + 1
+	stringOffset := headSize + size*12
+
+	var strs bytes.Buffer
+	var hash bytes.Buffer
+	for i, name := range names {
+		binary.Write(&hash, order, [3]uint32{uint32(i + 1), uint32(stringOffset + strs.Len()), 4096})
+		if i == 0 {
+			binary.Write(&hash, order, [3]uint32{0, 0, 0})
+		}
+		strs.WriteString(name)
+		strs.WriteByte(0)
+	}
+
+	var data bytes.Buffer
+	binary.Write(&data, order, [9]uint32{
+		localeArchiveMagic, 1, headSize, uint32(len(names)), uint32(size),
+		uint32(stringOffset), uint32(strs.Len()), uint32(strs.Len()), 0,
+	})
+	data.Write(hash.Bytes())
+	data.Write(strs.Bytes())
+
+	c.Assert(ioutil.WriteFile(filename, data.Bytes(), 0644), IsNil)
+}
+
+func (s *LocaleSuite) SetUpTest(c *C) {
+	s.locale = newFakeBusObject()
+	s.locale.properties["org.freedesktop.locale1.Locale"] = []string{"LANG=en_US.UTF-8", "LC_TIME=en_GB.UTF-8"}
+	s.locale.properties["org.freedesktop.locale1.VConsoleKeymap"] = "us"
+	s.locale.properties["org.freedesktop.locale1.VConsoleKeymapToggle"] = ""
+	s.locale.properties["org.freedesktop.locale1.X11Layout"] = "us"
+	s.locale.properties["org.freedesktop.locale1.X11Model"] = "pc105"
+	s.locale.properties["org.freedesktop.locale1.X11Variant"] = ""
+	s.locale.properties["org.freedesktop.locale1.X11Options"] = ""
+
+	s.localeManager = localeManager
+	localeManager = func() (dbus.BusObject, error) {
+		return s.locale, nil
+	}
+
+	localeDir = c.MkDir()
+	writeLocaleArchive(c, filepath.Join(localeDir, "locale-archive"), binary.LittleEndian, "en_US.utf8", "fr_FR.utf8", "de_DE@euro")
+	c.Assert(os.MkdirAll(filepath.Join(localeDir, "en_GB.utf8"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(localeDir, "en_GB.utf8", "LC_IDENTIFICATION"), nil, 0644), IsNil)
+	// not a locale
+	c.Assert(os.MkdirAll(filepath.Join(localeDir, "empty"), 0755), IsNil)
+
+	newSnapdClient = func() snapdclient.SnapdClient {
+		return &snapdclient.FakeSnapdClient{}
+	}
+	os.Setenv("SNAP_DATA", c.MkDir())
+	c.Assert(ioutil.WriteFile(tokenFilename(), []byte("1234"), 0600), IsNil)
+
+	s.handler = initURLHandlers(log.New(ioutil.Discard, "", 0), snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
+}
+
+func (s *LocaleSuite) TearDownTest(c *C) {
+	localeManager = s.localeManager
+	localeDir = "/usr/lib/locale"
+	newSnapdClient = newSnapdClientImpl
+}
+
+func (s *LocaleSuite) TestNormalizeLocale(c *C) {
+	for name, normalized := range map[string]string{
+		"en_US.utf8":          "en_US.UTF-8",
+		"en_US.UTF-8":         "en_US.UTF-8",
+		"ca_ES.utf8@valencia": "ca_ES.UTF-8@valencia",
+		"de_DE@euro":          "de_DE@euro",
+		"ja_JP.eucjp":         "ja_JP.eucjp",
+		"C":                   "C",
+	} {
+		c.Check(normalizeLocale(name), Equals, normalized)
+	}
+}
+
+func (s *LocaleSuite) TestAvailableLocales(c *C) {
+	locales, err := availableLocales()
+	c.Assert(err, IsNil)
+	c.Check(locales, DeepEquals, []string{"C.UTF-8", "de_DE@euro", "en_GB.UTF-8", "en_US.UTF-8", "fr_FR.UTF-8"})
+}
+
+func (s *LocaleSuite) TestAvailableLocalesBigEndian(c *C) {
+	writeLocaleArchive(c, filepath.Join(localeDir, "locale-archive"), binary.BigEndian, "pt_BR.utf8")
+
+	locales, err := availableLocales()
+	c.Assert(err, IsNil)
+	c.Check(locales, DeepEquals, []string{"C.UTF-8", "en_GB.UTF-8", "pt_BR.UTF-8"})
+}
+
+func (s *LocaleSuite) TestAvailableLocalesWithoutArchive(c *C) {
+	c.Assert(os.Remove(filepath.Join(localeDir, "locale-archive")), IsNil)
+
+	locales, err := availableLocales()
+	c.Assert(err, IsNil)
+	c.Check(locales, DeepEquals, []string{"C.UTF-8", "en_GB.UTF-8"})
+
+	localeDir = filepath.Join(localeDir, "missing")
+	locales, err = availableLocales()
+	c.Assert(err, IsNil)
+	c.Check(locales, DeepEquals, []string{"C.UTF-8"})
+}
+
+func (s *LocaleSuite) TestInvalidLocaleArchive(c *C) {
+	archive := filepath.Join(localeDir, "locale-archive")
+	for _, data := range [][]byte{
+		[]byte("short"),
+		bytes.Repeat([]byte{0xff}, 64),
+	} {
+		c.Assert(ioutil.WriteFile(archive, data, 0644), IsNil)
+		_, err := availableLocales()
+		c.Check(err, ErrorMatches, "Invalid locale archive .*")
+	}
+
+	// names past the end
+	writeLocaleArchive(c, archive, binary.LittleEndian, "en_US.utf8")
+	data, err := ioutil.ReadFile(archive)
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(archive, data[:len(data)-4], 0644), IsNil)
+	_, err = availableLocales()
+	c.Check(err, ErrorMatches, "Invalid locale archive .*: truncated")
+}
+
+func (s *LocaleSuite) TestGetLocaleSettings(c *C) {
+	settings, err := getLocaleSettings()
+	c.Assert(err, IsNil)
+	c.Check(settings, DeepEquals, localeSettings{
+		Locale: map[string]string{"LANG": "en_US.UTF-8", "LC_TIME": "en_GB.UTF-8"},
+		Keyboard: keyboardSettings{
+			VConsoleKeymap: "us",
+			X11Layout:      "us",
+			X11Model:       "pc105",
+		},
+		Available: []string{"C.UTF-8", "de_DE@euro", "en_GB.UTF-8", "en_US.UTF-8", "fr_FR.UTF-8"},
+	})
+}
+
+func (s *LocaleSuite) TestGetLocaleSettingsErrors(c *C) {
+	s.locale.properties["org.freedesktop.locale1.X11Layout"] = 1
+	_, err := getLocaleSettings()
+	c.Check(err, ErrorMatches, "Unexpected X11Layout value .*")
+
+	s.locale.properties["org.freedesktop.locale1.Locale"] = "LANG=C"
+	_, err = getLocaleSettings()
+	c.Check(err, ErrorMatches, "Unexpected Locale value .*")
+
+	localeManager = func() (dbus.BusObject, error) {
+		return nil, errNoBus
+	}
+	_, err = getLocaleSettings()
+	c.Check(err, Equals, errNoBus)
+}
+
+func (s *LocaleSuite) TestValidatePatch(c *C) {
+	available := []string{"C.UTF-8", "en_US.UTF-8", "fr_FR.UTF-8"}
+	layout := "de"
+	badLayout := "de; rm -rf"
+
+	for _, t := range []struct {
+		patch localePatch
+		err   string
+	}{
+		{localePatch{}, "Nothing to change, .*"},
+		{localePatch{Locale: map[string]string{"LANG": "fr_FR.utf8"}}, ""},
+		{localePatch{Locale: map[string]string{"LC_TIME": ""}}, ""},
+		{localePatch{Locale: map[string]string{"LANGUAGE": "fr:en"}}, ""},
+		{localePatch{Locale: map[string]string{"LANG": "xx_XX.UTF-8"}}, `Unknown locale "xx_XX.UTF-8" for LANG, .*`},
+		{localePatch{Locale: map[string]string{"LC_ALL": "C.UTF-8"}}, "Invalid locale variable LC_ALL, .*"},
+		{localePatch{X11Layout: &layout}, ""},
+		{localePatch{VConsoleKeymap: &badLayout}, `Invalid vconsoleKeymap "de; rm -rf"`},
+	} {
+		err := t.patch.validate(available)
+		if t.err == "" {
+			c.Check(err, IsNil, Commentf("%+v", t.patch))
+		} else {
+			c.Check(err, ErrorMatches, t.err, Commentf("%+v", t.patch))
+		}
+	}
+}
+
+func (s *LocaleSuite) TestSetLocale(c *C) {
+	current, err := getLocaleSettings()
+	c.Assert(err, IsNil)
+
+	patch := localePatch{Locale: map[string]string{"LANG": "fr_FR.UTF-8", "LC_TIME": "", "LC_PAPER": "en_US.UTF-8"}}
+	c.Assert(setLocaleSettings(current, patch), IsNil)
+	c.Check(s.locale.calls, DeepEquals, []fakeCall{{
+		Method: "org.freedesktop.locale1.SetLocale",
+		Args:   []interface{}{[]string{"LANG=fr_FR.UTF-8", "LC_PAPER=en_US.UTF-8"}, false},
+	}})
+}
+
+func (s *LocaleSuite) TestSetKeyboard(c *C) {
+	current, err := getLocaleSettings()
+	c.Assert(err, IsNil)
+
+	// localed converts a single layout to the other
+	layout := "de"
+	c.Assert(setLocaleSettings(current, localePatch{X11Layout: &layout}), IsNil)
+	c.Check(s.locale.calls, DeepEquals, []fakeCall{{
+		Method: "org.freedesktop.locale1.SetX11Keyboard",
+		Args:   []interface{}{"de", "pc105", "", "", true, false},
+	}})
+
+	s.locale.calls = nil
+	keymap := "de-latin1"
+	c.Assert(setLocaleSettings(current, localePatch{X11Layout: &layout, VConsoleKeymap: &keymap}), IsNil)
+	c.Check(s.locale.calls, DeepEquals, []fakeCall{{
+		Method: "org.freedesktop.locale1.SetVConsoleKeymap",
+		Args:   []interface{}{"de-latin1", "", false, false},
+	}, {
+		Method: "org.freedesktop.locale1.SetX11Keyboard",
+		Args:   []interface{}{"de", "pc105", "", "", false, false},
+	}})
+}
+
+func (s *LocaleSuite) TestSetLocaleFailure(c *C) {
+	s.locale.errors["org.freedesktop.locale1.SetLocale"] = dbus.Error{Name: "org.freedesktop.DBus.Error.AccessDenied"}
+
+	err := setLocaleSettings(localeSettings{}, localePatch{Locale: map[string]string{"LANG": "C.UTF-8"}})
+	c.Check(err, NotNil)
+}
+
+func (s *LocaleSuite) request(c *C, method, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, "/api/v2/locale", bytes.NewBufferString(body))
+	c.Assert(err, IsNil)
+	req.AddCookie(&http.Cookie{Name: SnapwebCookieName, Value: "1234"})
+	req.Header.Set("Content-Type", "application/json")
+
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func (s *LocaleSuite) TestHandleLocaleGET(c *C) {
+	rec := s.request(c, "GET", "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Check(rec.Header().Get("Content-Type"), Equals, "application/json")
+
+	var settings localeSettings
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &settings), IsNil)
+	c.Check(settings.Locale["LANG"], Equals, "en_US.UTF-8")
+	c.Check(settings.Keyboard.X11Model, Equals, "pc105")
+	c.Check(settings.Available, HasLen, 5)
+}
+
+func (s *LocaleSuite) TestHandleLocalePATCH(c *C) {
+	rec := s.request(c, "PATCH", `{"locale":{"LANG":"fr_FR.UTF-8"},"x11Layout":"fr"}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Check(s.locale.calls, HasLen, 2)
+
+	var settings localeSettings
+	c.Check(json.Unmarshal(rec.Body.Bytes(), &settings), IsNil)
+}
+
+func (s *LocaleSuite) TestHandleLocaleInvalid(c *C) {
+	rec := s.request(c, "PATCH", `{"locale":{"LANG":"tlh_QO.UTF-8"}}`)
+	c.Check(rec.Code, Equals, http.StatusBadRequest)
+
+	var resp snappy.ErrorResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), IsNil)
+	c.Check(resp.Kind, Equals, "bad-request")
+	c.Check(resp.Message, Matches, `Unknown locale "tlh_QO.UTF-8" for LANG, .*`)
+
+	rec = s.request(c, "PATCH", `{"locale":"fr_FR.UTF-8"}`)
+	c.Check(rec.Code, Equals, http.StatusBadRequest)
+
+	c.Check(s.locale.calls, HasLen, 0)
+}
+
+func (s *LocaleSuite) TestHandleLocaleFailure(c *C) {
+	s.locale.errors["org.freedesktop.locale1.SetLocale"] = dbus.Error{Name: "org.freedesktop.DBus.Error.AccessDenied"}
+
+	rec := s.request(c, "PATCH", `{"locale":{"LANG":"fr_FR.UTF-8"}}`)
+	c.Check(rec.Code, Equals, http.StatusInternalServerError)
+
+	localeManager = func() (dbus.BusObject, error) {
+		return nil, errNoBus
+	}
+	rec = s.request(c, "GET", "")
+	c.Check(rec.Code, Equals, http.StatusInternalServerError)
+}
+
+func (s *LocaleSuite) TestHandleLocaleInvalidMethod(c *C) {
+	rec := s.request(c, "PUT", "{}")
+	c.Check(rec.Code, Equals, http.StatusMethodNotAllowed)
+}
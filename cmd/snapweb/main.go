@@ -21,7 +21,6 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
 
 	"github.com/snapcore/snapweb/avahi"
 	"github.com/snapcore/snapweb/snappy/app"
@@ -40,32 +39,45 @@ func main() {
 		logger.Fatal("Configuration error", err)
 	}
 
-	mainHandler := initURLHandlers(logger, config)
-	baseHandler := redirHandler(config)
+	settings := snappy.NewConfigWatcher(config)
+
+	// a network change left unconfirmed may have cut off remote access
+	if err := networkChanges.recover(settings); err != nil {
+		logger.Println("Cannot revert the network configuration:", err)
+	}
+
+	urlHandlers := makeURLHandlers(logger, settings)
+	mainHandler := NewFilterHandlerFromSettings(urlHandlers, settings)
+	redir := redirHandler(settings)
+
+	// redirect to HTTPS if enabled, otherwise serve with the main HTTP handler
+	baseHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if settings.Config().DisableHTTPS {
+			mainHandler.ServeHTTP(w, r)
+		} else {
+			redir.ServeHTTP(w, r)
+		}
+	})
 
 	go avahi.InitMDNS(logger)
 
 	logger.Println("Snapweb starting...")
 
-	if !config.DisableHTTPS {
-		DumpCertificate()
+	listeners := newListenerSet(baseHandler, mainHandler, urlHandlers)
+	if err := listeners.update(config); err != nil {
+		logger.Fatalf("Cannot start listening: %v", err)
+	}
 
-		go func() {
-			certFile := filepath.Join(os.Getenv("SNAP_DATA"), "cert.pem")
-			keyFile := filepath.Join(os.Getenv("SNAP_DATA"), "key.pem")
-			if err := http.ListenAndServeTLS(httpsAddr, certFile, keyFile, mainHandler); err != nil {
-				logger.Fatalf("http.ListendAndServerTLS() failed with %v", err)
-			}
-		}()
+	settings.OnChange(func(config snappy.Config) {
+		if err := listeners.update(config); err != nil {
+			logger.Println("Error while updating listeners:", err)
+		}
+	})
 
-	} else {
-		// don't redirect, just serve with the main HTTP handler
-		baseHandler = mainHandler
-	}
+	startSystemStats(settings)
 
-	// open a plain HTTP end-point on the "usual" 4200 port
-	// redirect to HTTPS if enabled, otherwise serve on HTTP
-	if err := http.ListenAndServe(httpAddr, baseHandler); err != nil {
-		logger.Fatalf("ListenAndServe failed with: %v", err)
-	}
+	settings.Watch()
+	certificates.watch()
+
+	select {}
 }
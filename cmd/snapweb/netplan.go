@@ -0,0 +1,487 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/snapcore/snapweb/snappy/app"
+)
+
+var netplanDir = "/etc/netplan"
+
+// the file snapweb writes; it comes late so that its settings take
+// precedence over the ones of the image
+const netplanFilename = "90-snapweb.yaml"
+
+const netplanHeader = "# Written by snapweb, changes made here are overwritten from the web interface\n"
+
+// netplanApply makes netplan render and apply its configuration
+var netplanApply = func() error {
+	if out, err := exec.Command("netplan", "apply").CombinedOutput(); err != nil {
+		return fmt.Errorf("netplan apply failed: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+const (
+	defaultRollbackTimeout = 2 * time.Minute
+	minRollbackTimeout     = 10 * time.Second
+	maxRollbackTimeout     = time.Hour
+)
+
+var (
+	errNetworkChangePending = errors.New("A network change is already waiting for confirmation")
+	errNoNetworkChange      = errors.New("No network change is waiting for confirmation")
+)
+
+var interfaceNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.:-]{1,15}$`)
+
+func netplanPath() string {
+	return filepath.Join(netplanDir, netplanFilename)
+}
+
+func networkRollbackPath() string {
+	return filepath.Join(os.Getenv("SNAP_DATA"), "network-rollback.json")
+}
+
+// netplanConfig is the part of the netplan format snapweb understands
+type netplanConfig struct {
+	Network struct {
+		Version   int                         `yaml:"version"`
+		Renderer  string                      `yaml:"renderer,omitempty"`
+		Ethernets map[string]netplanInterface `yaml:"ethernets,omitempty"`
+	} `yaml:"network"`
+}
+
+type netplanInterface struct {
+	DHCP4       *bool               `yaml:"dhcp4,omitempty"`
+	DHCP6       *bool               `yaml:"dhcp6,omitempty"`
+	Addresses   []string            `yaml:"addresses,omitempty"`
+	Gateway4    string              `yaml:"gateway4,omitempty"`
+	Gateway6    string              `yaml:"gateway6,omitempty"`
+	Nameservers *netplanNameservers `yaml:"nameservers,omitempty"`
+}
+
+type netplanNameservers struct {
+	Addresses []string `yaml:"addresses,omitempty"`
+}
+
+// interfaceConfig is the static or DHCP configuration of an interface
+type interfaceConfig struct {
+	Name        string   `json:"name"`
+	DHCP4       bool     `json:"dhcp4"`
+	DHCP6       bool     `json:"dhcp6"`
+	Addresses   []string `json:"addresses,omitempty"`
+	Gateway4    string   `json:"gateway4,omitempty"`
+	Gateway6    string   `json:"gateway6,omitempty"`
+	Nameservers []string `json:"nameservers,omitempty"`
+}
+
+// networkChange is a new configuration to try, reverted unless confirmed
+// before the rollback timeout
+type networkChange struct {
+	Interfaces []interfaceConfig `json:"interfaces"`
+	// RollbackTimeout is a duration like "2m"
+	RollbackTimeout string `json:"rollbackTimeout,omitempty"`
+}
+
+func validateIP(ip string, ipv4 bool) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || (parsed.To4() != nil) != ipv4 {
+		family := "IPv6"
+		if ipv4 {
+			family = "IPv4"
+		}
+		return fmt.Errorf("Invalid %s address %q", family, ip)
+	}
+	return nil
+}
+
+func (c interfaceConfig) validate() error {
+	if !interfaceNamePattern.MatchString(c.Name) {
+		return fmt.Errorf("Invalid interface name %q", c.Name)
+	}
+
+	if !c.DHCP4 && !c.DHCP6 && len(c.Addresses) == 0 {
+		return fmt.Errorf("Interface %s needs DHCP or static addresses", c.Name)
+	}
+
+	for _, addr := range c.Addresses {
+		if _, _, err := net.ParseCIDR(addr); err != nil {
+			return fmt.Errorf("Invalid address %q for %s, expected address/prefix", addr, c.Name)
+		}
+	}
+
+	if c.Gateway4 != "" {
+		if err := validateIP(c.Gateway4, true); err != nil {
+			return err
+		}
+	}
+
+	if c.Gateway6 != "" {
+		if err := validateIP(c.Gateway6, false); err != nil {
+			return err
+		}
+	}
+
+	for _, ns := range c.Nameservers {
+		if net.ParseIP(ns) == nil {
+			return fmt.Errorf("Invalid name server %q", ns)
+		}
+	}
+
+	return nil
+}
+
+// rollbackTimeout validates the change and returns the time left to
+// confirm it
+func (c networkChange) rollbackTimeout() (time.Duration, error) {
+	if len(c.Interfaces) == 0 {
+		return 0, errors.New("No interface to configure")
+	}
+
+	seen := make(map[string]bool)
+	for _, iface := range c.Interfaces {
+		if err := iface.validate(); err != nil {
+			return 0, err
+		}
+		if seen[iface.Name] {
+			return 0, fmt.Errorf("Interface %s is configured twice", iface.Name)
+		}
+		seen[iface.Name] = true
+	}
+
+	if c.RollbackTimeout == "" {
+		return defaultRollbackTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(c.RollbackTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid rollback timeout %q", c.RollbackTimeout)
+	}
+	if timeout < minRollbackTimeout || timeout > maxRollbackTimeout {
+		return 0, fmt.Errorf("Invalid rollback timeout %q: not between %s and %s", c.RollbackTimeout, minRollbackTimeout, maxRollbackTimeout)
+	}
+
+	return timeout, nil
+}
+
+// renderNetplan writes the configuration of the interfaces in the netplan
+// format; the DHCP settings are always explicit to override the ones of
+// the other files
+func renderNetplan(interfaces []interfaceConfig) ([]byte, error) {
+	var config netplanConfig
+	config.Network.Version = 2
+	config.Network.Ethernets = make(map[string]netplanInterface)
+
+	for _, iface := range interfaces {
+		dhcp4, dhcp6 := iface.DHCP4, iface.DHCP6
+		ni := netplanInterface{
+			DHCP4:     &dhcp4,
+			DHCP6:     &dhcp6,
+			Addresses: iface.Addresses,
+			Gateway4:  iface.Gateway4,
+			Gateway6:  iface.Gateway6,
+		}
+		if len(iface.Nameservers) > 0 {
+			ni.Nameservers = &netplanNameservers{Addresses: iface.Nameservers}
+		}
+		config.Network.Ethernets[iface.Name] = ni
+	}
+
+	data, err := yaml.Marshal(&config)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(netplanHeader), data...), nil
+}
+
+// readNetplan returns the configuration of the ethernet interfaces, merged
+// from all the netplan files in order
+func readNetplan() ([]interfaceConfig, error) {
+	files, err := filepath.Glob(filepath.Join(netplanDir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	merged := make(map[string]*netplanInterface)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		var config netplanConfig
+		if err := yaml.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("Invalid netplan file %s: %s", file, err)
+		}
+
+		for name, iface := range config.Network.Ethernets {
+			m, ok := merged[name]
+			if !ok {
+				m = &netplanInterface{}
+				merged[name] = m
+			}
+			if iface.DHCP4 != nil {
+				m.DHCP4 = iface.DHCP4
+			}
+			if iface.DHCP6 != nil {
+				m.DHCP6 = iface.DHCP6
+			}
+			if iface.Addresses != nil {
+				m.Addresses = iface.Addresses
+			}
+			if iface.Gateway4 != "" {
+				m.Gateway4 = iface.Gateway4
+			}
+			if iface.Gateway6 != "" {
+				m.Gateway6 = iface.Gateway6
+			}
+			if iface.Nameservers != nil {
+				m.Nameservers = iface.Nameservers
+			}
+		}
+	}
+
+	result := make([]interfaceConfig, 0, len(merged))
+	for name, iface := range merged {
+		config := interfaceConfig{
+			Name:      name,
+			DHCP4:     iface.DHCP4 != nil && *iface.DHCP4,
+			DHCP6:     iface.DHCP6 != nil && *iface.DHCP6,
+			Addresses: iface.Addresses,
+			Gateway4:  iface.Gateway4,
+			Gateway6:  iface.Gateway6,
+		}
+		if iface.Nameservers != nil {
+			config.Nameservers = iface.Nameservers.Addresses
+		}
+		result = append(result, config)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+
+	return result, nil
+}
+
+// networkRollback is what is needed to revert a change, kept on disk so that
+// a change is reverted even if snapweb restarts meanwhile
+type networkRollback struct {
+	// Previous is the former content of the snapweb netplan file, if any
+	Previous *string   `json:"previous"`
+	Deadline time.Time `json:"deadline"`
+}
+
+// pendingNetworkChange describes the change waiting for confirmation
+type pendingNetworkChange struct {
+	Deadline time.Time `json:"deadline"`
+}
+
+// networkManager applies the network changes, reverting them unless they
+// are confirmed in time so that a mistake cannot cut off remote access
+type networkManager struct {
+	sync.Mutex
+	timer    *time.Timer
+	deadline time.Time
+	// settings are refreshed after every change, to rebuild the network
+	// filters and listeners for the new addresses
+	settings *snappy.ConfigWatcher
+}
+
+var networkChanges = &networkManager{}
+
+// pending returns the change waiting for confirmation, if any
+func (m *networkManager) pending() *pendingNetworkChange {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.timer == nil {
+		return nil
+	}
+	return &pendingNetworkChange{Deadline: m.deadline}
+}
+
+// apply writes and applies the new configuration, starting the rollback
+// timer
+func (m *networkManager) apply(change networkChange, settings *snappy.ConfigWatcher) (time.Time, error) {
+	timeout, err := change.rollbackTimeout()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	data, err := renderNetplan(change.Interfaces)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if m.timer != nil {
+		return time.Time{}, errNetworkChangePending
+	}
+
+	rollback := networkRollback{Deadline: time.Now().Add(timeout)}
+	if previous, err := ioutil.ReadFile(netplanPath()); err == nil {
+		s := string(previous)
+		rollback.Previous = &s
+	} else if !os.IsNotExist(err) {
+		return time.Time{}, err
+	}
+
+	rollbackData, err := json.Marshal(rollback)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := writeFileAtomic(networkRollbackPath(), rollbackData, 0600); err != nil {
+		return time.Time{}, err
+	}
+
+	m.settings = settings
+	err = writeFileAtomic(netplanPath(), data, 0600)
+	if err == nil {
+		err = netplanApply()
+	}
+	if err != nil {
+		if rerr := m.restore(); rerr != nil {
+			logger.Println("Cannot revert the network configuration:", rerr)
+		}
+		return time.Time{}, err
+	}
+
+	logger.Printf("Network configuration applied, reverting it at %s unless confirmed", rollback.Deadline.Format(time.RFC3339))
+	m.deadline = rollback.Deadline
+	m.timer = time.AfterFunc(timeout, m.expire)
+	m.refresh()
+
+	return rollback.Deadline, nil
+}
+
+// confirm keeps the pending change
+func (m *networkManager) confirm() error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.timer == nil {
+		return errNoNetworkChange
+	}
+
+	m.timer.Stop()
+	m.timer = nil
+	logger.Println("Network configuration confirmed")
+
+	return os.Remove(networkRollbackPath())
+}
+
+// revert goes back to the configuration before the pending change
+func (m *networkManager) revert() error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.timer == nil {
+		return errNoNetworkChange
+	}
+
+	m.timer.Stop()
+	m.timer = nil
+	logger.Println("Reverting the network configuration")
+
+	return m.restore()
+}
+
+func (m *networkManager) expire() {
+	m.Lock()
+	defer m.Unlock()
+
+	// confirmed or reverted meanwhile
+	if m.timer == nil {
+		return
+	}
+	m.timer = nil
+
+	logger.Println("Network configuration not confirmed in time, reverting it")
+	if err := m.restore(); err != nil {
+		logger.Println("Cannot revert the network configuration:", err)
+	}
+}
+
+// recover reverts a change left unconfirmed when snapweb stopped
+func (m *networkManager) recover(settings *snappy.ConfigWatcher) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, err := os.Stat(networkRollbackPath()); os.IsNotExist(err) {
+		return nil
+	}
+
+	logger.Println("Reverting the network configuration left unconfirmed")
+	m.settings = settings
+	return m.restore()
+}
+
+// restore puts back the previous netplan file recorded in the rollback file
+// and applies it; the caller holds the lock
+func (m *networkManager) restore() error {
+	data, err := ioutil.ReadFile(networkRollbackPath())
+	if err != nil {
+		return err
+	}
+
+	var rollback networkRollback
+	if err := json.Unmarshal(data, &rollback); err != nil {
+		return fmt.Errorf("Invalid network rollback file: %s", err)
+	}
+
+	if rollback.Previous != nil {
+		err = writeFileAtomic(netplanPath(), []byte(*rollback.Previous), 0600)
+	} else if err = os.Remove(netplanPath()); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := netplanApply(); err != nil {
+		return err
+	}
+
+	m.refresh()
+	return os.Remove(networkRollbackPath())
+}
+
+func (m *networkManager) refresh() {
+	if m.settings != nil {
+		m.settings.Refresh()
+	}
+}
@@ -0,0 +1,276 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	procNetRoute     = "/proc/net/route"
+	procNetIPv6Route = "/proc/net/ipv6_route"
+	sysClassNet      = "/sys/class/net"
+	// the first readable file gives the DNS servers; systemd-resolved
+	// lists the real servers in the first one, the second one only pointing
+	// to its local stub resolver
+	resolvConfPaths = []string{"/run/systemd/resolve/resolv.conf", "/etc/resolv.conf"}
+)
+
+var netInterfaces = net.Interfaces
+
+// route flag of usable routes, RTF_UP
+const routeUp = 0x1
+
+// networkInterface describes the state of a network interface
+type networkInterface struct {
+	Name string `json:"name"`
+	MAC  string `json:"mac,omitempty"`
+	// State is the operational state of the link, like "up" or "down"
+	State     string   `json:"state"`
+	MTU       int      `json:"mtu"`
+	Addresses []string `json:"addresses"`
+}
+
+// networkRoute is an entry of the routing tables
+type networkRoute struct {
+	Destination string `json:"destination"`
+	Gateway     string `json:"gateway,omitempty"`
+	Interface   string `json:"interface"`
+	Metric      int    `json:"metric"`
+}
+
+// networkStatus is the current state of the network
+type networkStatus struct {
+	Interfaces []networkInterface `json:"interfaces"`
+	Routes     []networkRoute     `json:"routes"`
+	DNS        []string           `json:"dns"`
+}
+
+func getNetworkStatus() (networkStatus, error) {
+	var status networkStatus
+	var err error
+
+	if status.Interfaces, err = interfaceStatus(); err != nil {
+		return networkStatus{}, err
+	}
+
+	if status.Routes, err = routes(); err != nil {
+		return networkStatus{}, err
+	}
+
+	status.DNS = dnsServers()
+
+	return status, nil
+}
+
+func interfaceStatus() ([]networkInterface, error) {
+	ifaces, err := netInterfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]networkInterface, 0, len(ifaces))
+	for _, iface := range ifaces {
+		ni := networkInterface{
+			Name:      iface.Name,
+			MAC:       iface.HardwareAddr.String(),
+			State:     linkState(iface),
+			MTU:       iface.MTU,
+			Addresses: []string{},
+		}
+
+		// the interface may have gone meanwhile
+		if addrs, err := iface.Addrs(); err == nil {
+			for _, addr := range addrs {
+				ni.Addresses = append(ni.Addresses, addr.String())
+			}
+		}
+
+		result = append(result, ni)
+	}
+
+	return result, nil
+}
+
+// linkState reads the operational state from sysfs, which tells whether a
+// cable is plugged, falling back to the administrative state
+func linkState(iface net.Interface) string {
+	data, err := ioutil.ReadFile(filepath.Join(sysClassNet, iface.Name, "operstate"))
+	if err == nil {
+		if state := strings.TrimSpace(string(data)); state != "unknown" {
+			return state
+		}
+	}
+
+	if iface.Flags&net.FlagUp != 0 {
+		return "up"
+	}
+	return "down"
+}
+
+// routes lists the IPv4 and IPv6 routes, leaving out the loopback ones
+func routes() ([]networkRoute, error) {
+	v4, err := ipv4Routes(procNetRoute)
+	if err != nil {
+		return nil, err
+	}
+
+	v6, err := ipv6Routes(procNetIPv6Route)
+	if err != nil && !os.IsNotExist(err) {
+		// IPv6 can be disabled
+		return nil, err
+	}
+
+	return append(v4, v6...), nil
+}
+
+// parseRouteAddress decodes the IPv4 addresses of /proc/net/route, which
+// are in host order
+func parseRouteAddress(s string) (net.IP, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 4 {
+		return nil, fmt.Errorf("Invalid address %q", s)
+	}
+
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(b))
+	return ip, nil
+}
+
+func ipv4Routes(filename string) ([]networkRoute, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var result []networkRoute
+	scanner := bufio.NewScanner(f)
+	// skip the header line
+	scanner.Scan()
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask MTU Window IRTT
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[0] == "lo" {
+			continue
+		}
+
+		flags, err := strconv.ParseUint(fields[3], 16, 32)
+		if err != nil || flags&routeUp == 0 {
+			continue
+		}
+
+		dest, err1 := parseRouteAddress(fields[1])
+		gateway, err2 := parseRouteAddress(fields[2])
+		mask, err3 := parseRouteAddress(fields[7])
+		metric, err4 := strconv.Atoi(fields[6])
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+			return nil, fmt.Errorf("Invalid route in %s: %q", filename, scanner.Text())
+		}
+
+		route := networkRoute{
+			Destination: (&net.IPNet{IP: dest, Mask: net.IPMask(mask)}).String(),
+			Interface:   fields[0],
+			Metric:      metric,
+		}
+		if !gateway.IsUnspecified() {
+			route.Gateway = gateway.String()
+		}
+
+		result = append(result, route)
+	}
+
+	return result, scanner.Err()
+}
+
+func ipv6Routes(filename string) ([]networkRoute, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var result []networkRoute
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// destination, prefix, source, prefix, next hop, metric, refcount,
+		// use, flags, interface
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[9] == "lo" {
+			continue
+		}
+
+		flags, err := strconv.ParseUint(fields[8], 16, 32)
+		if err != nil || flags&routeUp == 0 {
+			continue
+		}
+
+		dest, err1 := hex.DecodeString(fields[0])
+		prefix, err2 := strconv.ParseUint(fields[1], 16, 8)
+		gateway, err3 := hex.DecodeString(fields[4])
+		metric, err4 := strconv.ParseUint(fields[5], 16, 32)
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil ||
+			len(dest) != net.IPv6len || len(gateway) != net.IPv6len || prefix > 128 {
+			return nil, fmt.Errorf("Invalid route in %s: %q", filename, scanner.Text())
+		}
+
+		route := networkRoute{
+			Destination: (&net.IPNet{IP: net.IP(dest), Mask: net.CIDRMask(int(prefix), 128)}).String(),
+			Interface:   fields[9],
+			Metric:      int(metric),
+		}
+		if !net.IP(gateway).IsUnspecified() {
+			route.Gateway = net.IP(gateway).String()
+		}
+
+		result = append(result, route)
+	}
+
+	return result, scanner.Err()
+}
+
+// dnsServers returns the name servers the device uses
+func dnsServers() []string {
+	servers := []string{}
+
+	for _, path := range resolvConfPaths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				servers = append(servers, fields[1])
+			}
+		}
+		break
+	}
+
+	return servers
+}
@@ -0,0 +1,398 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapweb/snappy/app"
+	"github.com/snapcore/snapweb/snappy/snapdclient"
+)
+
+const procNetRouteFixture = `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	00000000	0101A8C0	0003	0	0	100	00000000	0	0	0
+eth0	0001A8C0	00000000	0001	0	0	100	00FFFFFF	0	0	0
+eth1	0000000A	00000000	0000	0	0	0	000000FF	0	0	0
+`
+
+const procNetIPv6RouteFixture = `fd000000000000010000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001     eth0
+00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000001 00000000 00000003     eth0
+00000000000000000000000000000001 80 00000000000000000000000000000000 00 00000000000000000000000000000000 00000000 00000002 00000000 80200001       lo
+`
+
+const cloudInitNetplan = `network:
+  version: 2
+  ethernets:
+    eth0:
+      dhcp4: true
+    eth1:
+      addresses: [10.0.0.2/24]
+`
+
+type NetworkSuite struct {
+	dir     string
+	applied int
+	fail    error
+	handler http.Handler
+}
+
+var _ = Suite(&NetworkSuite{})
+
+func (s *NetworkSuite) SetUpTest(c *C) {
+	newSnapdClient = func() snapdclient.SnapdClient {
+		return &snapdclient.FakeSnapdClient{}
+	}
+
+	os.Setenv("SNAP_DATA", c.MkDir())
+	c.Assert(ioutil.WriteFile(tokenFilename(), []byte("1234"), 0600), IsNil)
+
+	s.dir = c.MkDir()
+	procNetRoute = filepath.Join(s.dir, "route")
+	procNetIPv6Route = filepath.Join(s.dir, "ipv6_route")
+	resolvConfPaths = []string{filepath.Join(s.dir, "missing.conf"), filepath.Join(s.dir, "resolv.conf")}
+	c.Assert(ioutil.WriteFile(procNetRoute, []byte(procNetRouteFixture), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(procNetIPv6Route, []byte(procNetIPv6RouteFixture), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(resolvConfPaths[1], []byte("# comment\nnameserver 192.168.1.1\nsearch lan\nnameserver fd00::1\n"), 0644), IsNil)
+
+	netplanDir = filepath.Join(s.dir, "netplan")
+	c.Assert(os.Mkdir(netplanDir, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(netplanDir, "50-cloud-init.yaml"), []byte(cloudInitNetplan), 0644), IsNil)
+
+	s.applied = 0
+	s.fail = nil
+	netplanApply = func() error {
+		s.applied++
+		return s.fail
+	}
+
+	networkChanges = &networkManager{}
+
+	s.handler = initURLHandlers(log.New(ioutil.Discard, "", 0), snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
+}
+
+func (s *NetworkSuite) TearDownTest(c *C) {
+	newSnapdClient = newSnapdClientImpl
+	procNetRoute = "/proc/net/route"
+	procNetIPv6Route = "/proc/net/ipv6_route"
+	resolvConfPaths = []string{"/run/systemd/resolve/resolv.conf", "/etc/resolv.conf"}
+	netplanDir = "/etc/netplan"
+
+	networkChanges.Lock()
+	if networkChanges.timer != nil {
+		networkChanges.timer.Stop()
+	}
+	networkChanges.Unlock()
+	networkChanges = &networkManager{}
+}
+
+func (s *NetworkSuite) request(c *C, method, path, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+	c.Assert(err, IsNil)
+	req.AddCookie(&http.Cookie{Name: SnapwebCookieName, Value: "1234"})
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func (s *NetworkSuite) TestRoutes(c *C) {
+	r, err := routes()
+	c.Assert(err, IsNil)
+	c.Check(r, DeepEquals, []networkRoute{
+		{Destination: "0.0.0.0/0", Gateway: "192.168.1.1", Interface: "eth0", Metric: 100},
+		{Destination: "192.168.1.0/24", Interface: "eth0", Metric: 100},
+		{Destination: "fd00:0:0:1::/64", Interface: "eth0", Metric: 256},
+		{Destination: "::/0", Gateway: "fe80::1", Interface: "eth0", Metric: 1024},
+	})
+
+	// without IPv6
+	c.Assert(os.Remove(procNetIPv6Route), IsNil)
+	r, err = routes()
+	c.Assert(err, IsNil)
+	c.Check(r, HasLen, 2)
+
+	c.Assert(ioutil.WriteFile(procNetRoute, []byte("header\neth0 zz 00000000 0001 0 0 0 00000000 0 0 0\n"), 0644), IsNil)
+	_, err = routes()
+	c.Check(err, ErrorMatches, "Invalid route in .*")
+}
+
+func (s *NetworkSuite) TestDNSServers(c *C) {
+	c.Check(dnsServers(), DeepEquals, []string{"192.168.1.1", "fd00::1"})
+
+	resolvConfPaths = []string{filepath.Join(s.dir, "missing.conf")}
+	c.Check(dnsServers(), DeepEquals, []string{})
+}
+
+func (s *NetworkSuite) TestInterfaceStatus(c *C) {
+	netInterfaces = func() ([]net.Interface, error) {
+		return []net.Interface{
+			{Index: 0, Name: "eth0", MTU: 1500, HardwareAddr: net.HardwareAddr{0x52, 0x54, 0, 0x12, 0x34, 0x56}, Flags: net.FlagUp},
+			{Index: 0, Name: "wlan0", MTU: 1500, HardwareAddr: net.HardwareAddr{0x52, 0x54, 0, 0x12, 0x34, 0x57}},
+		}, nil
+	}
+	defer func() { netInterfaces = net.Interfaces }()
+
+	sysClassNet = filepath.Join(s.dir, "sys")
+	defer func() { sysClassNet = "/sys/class/net" }()
+	c.Assert(os.MkdirAll(filepath.Join(sysClassNet, "eth0"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(sysClassNet, "eth0", "operstate"), []byte("lowerlayerdown\n"), 0644), IsNil)
+
+	ifaces, err := interfaceStatus()
+	c.Assert(err, IsNil)
+	c.Assert(ifaces, HasLen, 2)
+	c.Check(ifaces[0].Name, Equals, "eth0")
+	c.Check(ifaces[0].MAC, Equals, "52:54:00:12:34:56")
+	c.Check(ifaces[0].State, Equals, "lowerlayerdown")
+	c.Check(ifaces[1].State, Equals, "down")
+}
+
+func (s *NetworkSuite) TestReadNetplan(c *C) {
+	c.Assert(ioutil.WriteFile(filepath.Join(netplanDir, "60-other.yaml"), []byte(`network:
+  version: 2
+  ethernets:
+    eth0:
+      nameservers:
+        addresses: [1.1.1.1]
+`), 0644), IsNil)
+
+	config, err := readNetplan()
+	c.Assert(err, IsNil)
+	c.Check(config, DeepEquals, []interfaceConfig{
+		{Name: "eth0", DHCP4: true, Nameservers: []string{"1.1.1.1"}},
+		{Name: "eth1", Addresses: []string{"10.0.0.2/24"}},
+	})
+
+	c.Assert(ioutil.WriteFile(filepath.Join(netplanDir, "70-broken.yaml"), []byte("network: [\n"), 0644), IsNil)
+	_, err = readNetplan()
+	c.Check(err, ErrorMatches, "Invalid netplan file .*70-broken.yaml: .*")
+}
+
+func (s *NetworkSuite) TestRenderNetplan(c *C) {
+	data, err := renderNetplan([]interfaceConfig{
+		{Name: "eth0", Addresses: []string{"192.168.1.10/24"}, Gateway4: "192.168.1.1", Nameservers: []string{"192.168.1.1"}},
+	})
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, netplanHeader+`network:
+  version: 2
+  ethernets:
+    eth0:
+      dhcp4: false
+      dhcp6: false
+      addresses:
+      - 192.168.1.10/24
+      gateway4: 192.168.1.1
+      nameservers:
+        addresses:
+        - 192.168.1.1
+`)
+
+	// what is written is read back
+	c.Assert(ioutil.WriteFile(netplanPath(), data, 0600), IsNil)
+	config, err := readNetplan()
+	c.Assert(err, IsNil)
+	c.Check(config[0], DeepEquals, interfaceConfig{
+		Name:        "eth0",
+		Addresses:   []string{"192.168.1.10/24"},
+		Gateway4:    "192.168.1.1",
+		Nameservers: []string{"192.168.1.1"},
+	})
+}
+
+func (s *NetworkSuite) TestValidateChange(c *C) {
+	valid := interfaceConfig{Name: "eth0", DHCP4: true}
+
+	timeout, err := networkChange{Interfaces: []interfaceConfig{valid}}.rollbackTimeout()
+	c.Assert(err, IsNil)
+	c.Check(timeout, Equals, defaultRollbackTimeout)
+
+	timeout, err = networkChange{Interfaces: []interfaceConfig{valid}, RollbackTimeout: "30s"}.rollbackTimeout()
+	c.Assert(err, IsNil)
+	c.Check(timeout, Equals, 30*time.Second)
+
+	tests := []struct {
+		change networkChange
+		err    string
+	}{
+		{networkChange{}, "No interface to configure"},
+		{networkChange{Interfaces: []interfaceConfig{valid, valid}}, "Interface eth0 is configured twice"},
+		{networkChange{Interfaces: []interfaceConfig{{Name: "eth0/1", DHCP4: true}}}, `Invalid interface name "eth0/1"`},
+		{networkChange{Interfaces: []interfaceConfig{{Name: "eth0"}}}, "Interface eth0 needs DHCP or static addresses"},
+		{networkChange{Interfaces: []interfaceConfig{{Name: "eth0", Addresses: []string{"192.168.1.10"}}}}, `Invalid address "192.168.1.10" for eth0, expected address/prefix`},
+		{networkChange{Interfaces: []interfaceConfig{{Name: "eth0", DHCP4: true, Gateway4: "fe80::1"}}}, `Invalid IPv4 address "fe80::1"`},
+		{networkChange{Interfaces: []interfaceConfig{{Name: "eth0", DHCP6: true, Gateway6: "10.0.0.1"}}}, `Invalid IPv6 address "10.0.0.1"`},
+		{networkChange{Interfaces: []interfaceConfig{{Name: "eth0", DHCP4: true, Nameservers: []string{"dns"}}}}, `Invalid name server "dns"`},
+		{networkChange{Interfaces: []interfaceConfig{valid}, RollbackTimeout: "soon"}, `Invalid rollback timeout "soon"`},
+		{networkChange{Interfaces: []interfaceConfig{valid}, RollbackTimeout: "1s"}, `Invalid rollback timeout "1s": not between 10s and 1h0m0s`},
+	}
+
+	for _, t := range tests {
+		_, err := t.change.rollbackTimeout()
+		c.Check(err, ErrorMatches, t.err)
+	}
+}
+
+func (s *NetworkSuite) TestGetNetwork(c *C) {
+	rec := s.request(c, "GET", "/api/v2/network", "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	var info struct {
+		Interfaces []networkInterface    `json:"interfaces"`
+		Routes     []networkRoute        `json:"routes"`
+		DNS        []string              `json:"dns"`
+		Config     []interfaceConfig     `json:"config"`
+		Pending    *pendingNetworkChange `json:"pending"`
+	}
+	c.Assert(json.NewDecoder(rec.Body).Decode(&info), IsNil)
+	c.Check(info.Interfaces, Not(HasLen), 0)
+	c.Check(info.Routes, HasLen, 4)
+	c.Check(info.DNS, DeepEquals, []string{"192.168.1.1", "fd00::1"})
+	c.Check(info.Config, HasLen, 2)
+	c.Check(info.Pending, IsNil)
+}
+
+func (s *NetworkSuite) TestApplyAndConfirm(c *C) {
+	rec := s.request(c, "PUT", "/api/v2/network", `{"interfaces": [{"name": "eth0", "addresses": ["192.168.1.10/24"]}]}`)
+	c.Assert(rec.Code, Equals, http.StatusAccepted)
+	c.Check(s.applied, Equals, 1)
+
+	var pending pendingNetworkChange
+	c.Assert(json.NewDecoder(rec.Body).Decode(&pending), IsNil)
+	c.Check(pending.Deadline.After(time.Now().Add(time.Minute)), Equals, true)
+
+	data, err := ioutil.ReadFile(netplanPath())
+	c.Assert(err, IsNil)
+	c.Check(string(data), Matches, "(?s).*192.168.1.10/24.*")
+	c.Check(networkChanges.pending(), NotNil)
+
+	// one change at a time
+	rec = s.request(c, "PUT", "/api/v2/network", `{"interfaces": [{"name": "eth0", "dhcp4": true}]}`)
+	c.Check(rec.Code, Equals, http.StatusConflict)
+
+	rec = s.request(c, "POST", "/api/v2/network/confirm", "")
+	c.Check(rec.Code, Equals, http.StatusOK)
+	c.Check(networkChanges.pending(), IsNil)
+	_, err = os.Stat(networkRollbackPath())
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	// the configuration stays
+	_, err = os.Stat(netplanPath())
+	c.Check(err, IsNil)
+	c.Check(s.applied, Equals, 1)
+
+	rec = s.request(c, "POST", "/api/v2/network/confirm", "")
+	c.Check(rec.Code, Equals, http.StatusNotFound)
+}
+
+func (s *NetworkSuite) TestRevert(c *C) {
+	previous := netplanHeader + "network:\n  version: 2\n"
+	c.Assert(ioutil.WriteFile(netplanPath(), []byte(previous), 0600), IsNil)
+
+	rec := s.request(c, "PUT", "/api/v2/network", `{"interfaces": [{"name": "eth0", "dhcp4": true}]}`)
+	c.Assert(rec.Code, Equals, http.StatusAccepted)
+
+	rec = s.request(c, "POST", "/api/v2/network/revert", "")
+	c.Check(rec.Code, Equals, http.StatusOK)
+	c.Check(s.applied, Equals, 2)
+
+	data, err := ioutil.ReadFile(netplanPath())
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, previous)
+	c.Check(networkChanges.pending(), IsNil)
+
+	rec = s.request(c, "POST", "/api/v2/network/revert", "")
+	c.Check(rec.Code, Equals, http.StatusNotFound)
+}
+
+func (s *NetworkSuite) TestRollbackTimer(c *C) {
+	refreshed := make(chan bool, 2)
+	settings := snappy.NewConfigWatcher(snappy.Config{})
+	settings.OnChange(func(snappy.Config) {
+		refreshed <- true
+	})
+
+	change := networkChange{Interfaces: []interfaceConfig{{Name: "eth0", DHCP4: true}}, RollbackTimeout: "10s"}
+	_, err := networkChanges.apply(change, settings)
+	c.Assert(err, IsNil)
+	c.Check(<-refreshed, Equals, true)
+
+	// the timer fires
+	networkChanges.expire()
+	c.Check(<-refreshed, Equals, true)
+	c.Check(s.applied, Equals, 2)
+	c.Check(networkChanges.pending(), IsNil)
+
+	// the file did not exist before the change
+	_, err = os.Stat(netplanPath())
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *NetworkSuite) TestApplyFailure(c *C) {
+	s.fail = errNoBus
+
+	rec := s.request(c, "PUT", "/api/v2/network", `{"interfaces": [{"name": "eth0", "dhcp4": true}]}`)
+	c.Check(rec.Code, Equals, http.StatusInternalServerError)
+
+	// the previous configuration is applied again
+	c.Check(s.applied, Equals, 2)
+	c.Check(networkChanges.pending(), IsNil)
+	_, err := os.Stat(netplanPath())
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *NetworkSuite) TestInvalidChange(c *C) {
+	rec := s.request(c, "PUT", "/api/v2/network", `{"interfaces": [{"name": "eth0"}]}`)
+	c.Check(rec.Code, Equals, http.StatusBadRequest)
+
+	rec = s.request(c, "PUT", "/api/v2/network", `{"interfaces": `)
+	c.Check(rec.Code, Equals, http.StatusBadRequest)
+
+	c.Check(s.applied, Equals, 0)
+}
+
+func (s *NetworkSuite) TestRecoverAfterRestart(c *C) {
+	change := networkChange{Interfaces: []interfaceConfig{{Name: "eth0", DHCP4: true}}}
+	_, err := networkChanges.apply(change, nil)
+	c.Assert(err, IsNil)
+
+	// snapweb restarts before the change is confirmed
+	networkChanges.timer.Stop()
+	networkChanges = &networkManager{}
+
+	c.Assert(networkChanges.recover(nil), IsNil)
+	c.Check(s.applied, Equals, 2)
+	_, err = os.Stat(netplanPath())
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	// nothing to do on the next start
+	c.Assert(networkChanges.recover(nil), IsNil)
+	c.Check(s.applied, Equals, 2)
+}
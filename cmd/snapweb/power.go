@@ -0,0 +1,168 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/godbus/dbus"
+)
+
+const loginManagerInterface = "org.freedesktop.login1.Manager"
+
+// loginManager returns the logind manager, which restarts and powers off the
+// device and keeps track of the scheduled actions
+var loginManager = func() (dbus.BusObject, error) {
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	return bus.Object("org.freedesktop.login1", "/org/freedesktop/login1"), nil
+}
+
+// logind shutdown types of the device actions
+var shutdownTypes = map[string]string{
+	"restart":   "reboot",
+	"power-off": "poweroff",
+}
+
+// logind methods running the device actions right away
+var shutdownMethods = map[string]string{
+	"restart":   "Reboot",
+	"power-off": "PowerOff",
+}
+
+// deviceAction is a request to restart or power off the device, now or
+// later. It also describes the pending action.
+type deviceAction struct {
+	ActionType string `json:"actionType,omitempty"`
+	// Delay before the action, like "5m"
+	Delay string `json:"delay,omitempty"`
+	// At is the time of the action
+	At *time.Time `json:"at,omitempty"`
+}
+
+// scheduledTime returns when the action should happen, the zero time
+// meaning right away
+func (a deviceAction) scheduledTime(now time.Time) (time.Time, error) {
+	if _, ok := shutdownTypes[a.ActionType]; !ok {
+		return time.Time{}, fmt.Errorf("Invalid device action type: %q", a.ActionType)
+	}
+
+	switch {
+	case a.Delay != "" && a.At != nil:
+		return time.Time{}, errors.New("Only one of delay and at can be given")
+	case a.Delay != "":
+		delay, err := time.ParseDuration(a.Delay)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Invalid delay %q", a.Delay)
+		}
+		if delay < 0 {
+			return time.Time{}, fmt.Errorf("Invalid delay %q: negative", a.Delay)
+		}
+		return now.Add(delay), nil
+	case a.At != nil:
+		if a.At.Before(now) {
+			return time.Time{}, fmt.Errorf("Invalid time %s: in the past", a.At.Format(time.RFC3339))
+		}
+		return *a.At, nil
+	}
+
+	return time.Time{}, nil
+}
+
+// runDeviceAction restarts or powers off the device right away
+func runDeviceAction(actionType string) error {
+	manager, err := loginManager()
+	if err != nil {
+		return err
+	}
+
+	// not interactive, there is nobody to ask for authorization
+	return manager.Call(loginManagerInterface+"."+shutdownMethods[actionType], 0, false).Err
+}
+
+// scheduleDeviceAction asks logind to restart or power off the device at the
+// given time, replacing any pending action
+func scheduleDeviceAction(actionType string, at time.Time) error {
+	manager, err := loginManager()
+	if err != nil {
+		return err
+	}
+
+	usec := uint64(at.UnixNano() / int64(time.Microsecond))
+	return manager.Call(loginManagerInterface+".ScheduleShutdown", 0, shutdownTypes[actionType], usec).Err
+}
+
+// pendingDeviceAction returns the scheduled action, with an empty action type
+// if there is none
+func pendingDeviceAction() (deviceAction, error) {
+	manager, err := loginManager()
+	if err != nil {
+		return deviceAction{}, err
+	}
+
+	prop, err := manager.GetProperty(loginManagerInterface + ".ScheduledShutdown")
+	if err != nil {
+		return deviceAction{}, err
+	}
+
+	// the property is a (type, microseconds since the epoch) structure
+	fields, ok := prop.Value().([]interface{})
+	if !ok || len(fields) != 2 {
+		return deviceAction{}, fmt.Errorf("Unexpected scheduled shutdown value %s", prop)
+	}
+	shutdownType, ok1 := fields[0].(string)
+	usec, ok2 := fields[1].(uint64)
+	if !ok1 || !ok2 {
+		return deviceAction{}, fmt.Errorf("Unexpected scheduled shutdown value %s", prop)
+	}
+
+	if shutdownType == "" || usec == 0 {
+		return deviceAction{}, nil
+	}
+
+	action := deviceAction{ActionType: shutdownType}
+	for actionType, t := range shutdownTypes {
+		if t == shutdownType {
+			action.ActionType = actionType
+		}
+	}
+	at := time.Unix(0, int64(usec)*int64(time.Microsecond)).UTC()
+	action.At = &at
+
+	return action, nil
+}
+
+// cancelDeviceAction cancels the scheduled action, returning whether there
+// was one
+func cancelDeviceAction() (bool, error) {
+	manager, err := loginManager()
+	if err != nil {
+		return false, err
+	}
+
+	var cancelled bool
+	if err := manager.Call(loginManagerInterface+".CancelScheduledShutdown", 0).Store(&cancelled); err != nil {
+		return false, err
+	}
+
+	return cancelled, nil
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"github.com/godbus/dbus"
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapweb/snappy/app"
+	"github.com/snapcore/snapweb/snappy/snapdclient"
+)
+
+type PowerSuite struct {
+	manager      *fakeBusObject
+	handler      http.Handler
+	loginManager func() (dbus.BusObject, error)
+}
+
+var _ = Suite(&PowerSuite{})
+
+func (s *PowerSuite) SetUpTest(c *C) {
+	newSnapdClient = func() snapdclient.SnapdClient {
+		return &snapdclient.FakeSnapdClient{}
+	}
+
+	os.Setenv("SNAP_DATA", c.MkDir())
+	c.Assert(ioutil.WriteFile(tokenFilename(), []byte("1234"), 0600), IsNil)
+
+	s.loginManager = loginManager
+	s.manager = newFakeBusObject()
+	s.manager.properties[loginManagerInterface+".ScheduledShutdown"] = []interface{}{"", uint64(0)}
+	loginManager = func() (dbus.BusObject, error) {
+		return s.manager, nil
+	}
+
+	s.handler = initURLHandlers(log.New(ioutil.Discard, "", 0), snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
+}
+
+func (s *PowerSuite) TearDownTest(c *C) {
+	newSnapdClient = newSnapdClientImpl
+	loginManager = s.loginManager
+}
+
+func (s *PowerSuite) request(c *C, method string, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, "/api/v2/device-action", bytes.NewBufferString(body))
+	c.Assert(err, IsNil)
+	req.AddCookie(&http.Cookie{Name: SnapwebCookieName, Value: "1234"})
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func (s *PowerSuite) TestScheduledTime(c *C) {
+	now := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Hour)
+
+	tests := []struct {
+		action   deviceAction
+		expected time.Time
+		err      string
+	}{
+		{deviceAction{ActionType: "restart"}, time.Time{}, ""},
+		{deviceAction{ActionType: "power-off", Delay: "5m"}, now.Add(5 * time.Minute), ""},
+		{deviceAction{ActionType: "restart", At: &future}, future, ""},
+		{deviceAction{ActionType: "dance"}, time.Time{}, `Invalid device action type: "dance"`},
+		{deviceAction{ActionType: "restart", Delay: "soon"}, time.Time{}, `Invalid delay "soon"`},
+		{deviceAction{ActionType: "restart", Delay: "-1m"}, time.Time{}, `Invalid delay "-1m": negative`},
+		{deviceAction{ActionType: "restart", At: &past}, time.Time{}, "Invalid time .*: in the past"},
+		{deviceAction{ActionType: "restart", Delay: "1m", At: &future}, time.Time{}, "Only one of delay and at can be given"},
+	}
+
+	for _, t := range tests {
+		at, err := t.action.scheduledTime(now)
+		if t.err != "" {
+			c.Check(err, ErrorMatches, t.err)
+			continue
+		}
+		c.Check(err, IsNil)
+		c.Check(at.Equal(t.expected), Equals, true, Commentf("%v", t.action))
+	}
+}
+
+func (s *PowerSuite) TestImmediateAction(c *C) {
+	rec := s.request(c, "POST", `{"actionType": "restart"}`)
+	c.Check(rec.Code, Equals, http.StatusOK)
+	c.Check(s.manager.calls, DeepEquals, []fakeCall{
+		{Method: "org.freedesktop.login1.Manager.Reboot", Args: []interface{}{false}},
+	})
+
+	s.manager.calls = nil
+	rec = s.request(c, "POST", `{"actionType": "power-off"}`)
+	c.Check(rec.Code, Equals, http.StatusOK)
+	c.Check(s.manager.calls, DeepEquals, []fakeCall{
+		{Method: "org.freedesktop.login1.Manager.PowerOff", Args: []interface{}{false}},
+	})
+}
+
+func (s *PowerSuite) TestDelayedAction(c *C) {
+	before := time.Now()
+	rec := s.request(c, "POST", `{"actionType": "power-off", "delay": "5m"}`)
+	c.Assert(rec.Code, Equals, http.StatusAccepted)
+
+	var action deviceAction
+	c.Assert(json.NewDecoder(rec.Body).Decode(&action), IsNil)
+	c.Check(action.ActionType, Equals, "power-off")
+	c.Assert(action.At, NotNil)
+	c.Check(action.At.Sub(before) >= 5*time.Minute, Equals, true)
+
+	c.Assert(s.manager.calls, HasLen, 1)
+	call := s.manager.calls[0]
+	c.Check(call.Method, Equals, "org.freedesktop.login1.Manager.ScheduleShutdown")
+	c.Check(call.Args[0], Equals, "poweroff")
+	c.Check(call.Args[1], Equals, uint64(action.At.UnixNano()/1000))
+}
+
+func (s *PowerSuite) TestScheduledAction(c *C) {
+	at := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	rec := s.request(c, "POST", `{"actionType": "restart", "at": "`+at.Format(time.RFC3339)+`"}`)
+	c.Assert(rec.Code, Equals, http.StatusAccepted)
+
+	c.Assert(s.manager.calls, HasLen, 1)
+	c.Check(s.manager.calls[0].Args, DeepEquals, []interface{}{"reboot", uint64(at.Unix() * 1000000)})
+}
+
+func (s *PowerSuite) TestInvalidActions(c *C) {
+	for _, body := range []string{
+		`{"actionType": "dance"}`,
+		`{"actionType": "restart", "delay": "later"}`,
+		`{"actionType": "restart", "at": "2001-01-01T00:00:00Z"}`,
+		`{"actionType": "restart", "at": "tomorrow"}`,
+	} {
+		rec := s.request(c, "POST", body)
+		c.Check(rec.Code, Equals, http.StatusBadRequest, Commentf(body))
+	}
+	c.Check(s.manager.calls, HasLen, 0)
+}
+
+func (s *PowerSuite) TestPendingAction(c *C) {
+	rec := s.request(c, "GET", "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Check(rec.Body.String(), Equals, "{}\n")
+
+	at := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	s.manager.properties[loginManagerInterface+".ScheduledShutdown"] = []interface{}{"reboot", uint64(at.Unix() * 1000000)}
+
+	rec = s.request(c, "GET", "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	var action deviceAction
+	c.Assert(json.NewDecoder(rec.Body).Decode(&action), IsNil)
+	c.Check(action.ActionType, Equals, "restart")
+	c.Assert(action.At, NotNil)
+	c.Check(action.At.Equal(at), Equals, true)
+}
+
+func (s *PowerSuite) TestCancelAction(c *C) {
+	s.manager.replies[loginManagerInterface+".CancelScheduledShutdown"] = []interface{}{true}
+	rec := s.request(c, "DELETE", "")
+	c.Check(rec.Code, Equals, http.StatusNoContent)
+	c.Check(s.manager.calls, DeepEquals, []fakeCall{
+		{Method: "org.freedesktop.login1.Manager.CancelScheduledShutdown"},
+	})
+
+	s.manager.replies[loginManagerInterface+".CancelScheduledShutdown"] = []interface{}{false}
+	rec = s.request(c, "DELETE", "")
+	c.Check(rec.Code, Equals, http.StatusNotFound)
+}
+
+func (s *PowerSuite) TestBusErrors(c *C) {
+	s.manager.errors[loginManagerInterface+".Reboot"] = dbus.ErrMsgNoObject
+	rec := s.request(c, "POST", `{"actionType": "restart"}`)
+	c.Check(rec.Code, Equals, http.StatusInternalServerError)
+
+	loginManager = func() (dbus.BusObject, error) {
+		return nil, errNoBus
+	}
+	rec = s.request(c, "GET", "")
+	c.Check(rec.Code, Equals, http.StatusInternalServerError)
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/snapcore/snapweb/snappy/app"
+	"github.com/snapcore/snapweb/sysstats"
+)
+
+// systemStats samples the resource usage, as configured by statsInterval
+// and statsRetention
+var systemStats = sysstats.New(snappy.DefaultConfig().StatsSampling())
+
+// startSystemStats samples the resource usage in the background, streaming
+// every sample as a stats event
+func startSystemStats(settings *snappy.ConfigWatcher) {
+	systemStats.Configure(settings.Config().StatsSampling())
+	systemStats.OnSample(func(sample sysstats.Sample) {
+		events.publish("stats", sample)
+	})
+
+	settings.OnChange(func(config snappy.Config) {
+		systemStats.Configure(config.StatsSampling())
+	})
+
+	systemStats.Start()
+}
+
+// parseSince reads the since parameter of /system/stats, either a RFC 3339
+// time or a number of seconds since the epoch; none means all the samples
+func parseSince(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	if secs, err := strconv.ParseFloat(s, 64); err == nil && secs >= 0 {
+		return time.Unix(0, int64(secs*float64(time.Second))), nil
+	}
+
+	return time.Time{}, fmt.Errorf("Invalid time %q", s)
+}
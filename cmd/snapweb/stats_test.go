@@ -0,0 +1,197 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapweb/snappy/app"
+	"github.com/snapcore/snapweb/snappy/snapdclient"
+	"github.com/snapcore/snapweb/sysstats"
+)
+
+type StatsSuite struct {
+	handler http.Handler
+}
+
+var _ = Suite(&StatsSuite{})
+
+func (s *StatsSuite) SetUpTest(c *C) {
+	newSnapdClient = func() snapdclient.SnapdClient {
+		return &snapdclient.FakeSnapdClient{}
+	}
+
+	os.Setenv("SNAP_DATA", c.MkDir())
+	c.Assert(ioutil.WriteFile(tokenFilename(), []byte("1234"), 0600), IsNil)
+
+	systemStats = sysstats.New(time.Second, time.Minute)
+	events = newEventHub()
+
+	s.handler = initURLHandlers(log.New(ioutil.Discard, "", 0), snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
+}
+
+func (s *StatsSuite) TearDownTest(c *C) {
+	newSnapdClient = newSnapdClientImpl
+	systemStats.Stop()
+	systemStats = sysstats.New(snappy.DefaultConfig().StatsSampling())
+	events = newEventHub()
+	eventKeepAlive = 30 * time.Second
+}
+
+func (s *StatsSuite) TestParseSince(c *C) {
+	t, err := parseSince("")
+	c.Assert(err, IsNil)
+	c.Check(t.IsZero(), Equals, true)
+
+	t, err = parseSince("2017-01-02T03:04:05Z")
+	c.Assert(err, IsNil)
+	c.Check(t.Equal(time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)), Equals, true)
+
+	t, err = parseSince("1483326245.5")
+	c.Assert(err, IsNil)
+	c.Check(t.Equal(time.Date(2017, 1, 2, 3, 4, 5, 500000000, time.UTC)), Equals, true)
+
+	for _, invalid := range []string{"yesterday", "-1", "2017-01-02"} {
+		_, err = parseSince(invalid)
+		c.Check(err, ErrorMatches, "Invalid time .*", Commentf(invalid))
+	}
+}
+
+func (s *StatsSuite) get(c *C, url string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", url, nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Cookie", "SM=1234")
+
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func (s *StatsSuite) TestSystemStats(c *C) {
+	first := systemStats.Sample()
+	second := systemStats.Sample()
+
+	rec := s.get(c, "/api/v2/system/stats")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Check(rec.Header().Get("Content-Type"), Equals, "application/json")
+
+	var samples []sysstats.Sample
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &samples), IsNil)
+	c.Assert(samples, HasLen, 2)
+	c.Check(samples[0].Time.Equal(first.Time), Equals, true)
+
+	rec = s.get(c, "/api/v2/system/stats?since="+first.Time.Format(time.RFC3339Nano))
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &samples), IsNil)
+	c.Assert(samples, HasLen, 1)
+	c.Check(samples[0].Time.Equal(second.Time), Equals, true)
+}
+
+func (s *StatsSuite) TestSystemStatsNone(c *C) {
+	rec := s.get(c, "/api/v2/system/stats")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Check(strings.TrimSpace(rec.Body.String()), Equals, "[]")
+}
+
+func (s *StatsSuite) TestSystemStatsInvalidSince(c *C) {
+	rec := s.get(c, "/api/v2/system/stats?since=yesterday")
+	c.Check(rec.Code, Equals, http.StatusBadRequest)
+}
+
+func (s *StatsSuite) TestSystemStatsInvalidMethod(c *C) {
+	req, err := http.NewRequest("POST", "/api/v2/system/stats", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Cookie", "SM=1234")
+
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	c.Check(rec.Code, Equals, http.StatusMethodNotAllowed)
+}
+
+func (s *StatsSuite) TestEventHubDropsForSlowClients(c *C) {
+	ch := events.subscribe()
+	defer events.unsubscribe(ch)
+
+	for i := 0; i < eventBacklog+5; i++ {
+		events.publish("stats", i)
+	}
+	c.Check(ch, HasLen, eventBacklog)
+
+	e := <-ch
+	c.Check(e.Type, Equals, "stats")
+	c.Check(string(e.Data), Equals, "0")
+}
+
+func (s *StatsSuite) TestEventsStream(c *C) {
+	eventKeepAlive = 10 * time.Millisecond
+	server := httptest.NewServer(s.handler)
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/api/v2/events", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Cookie", "SM=1234")
+
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(resp.Header.Get("Content-Type"), Equals, "text/event-stream")
+
+	// the headers are only sent once the client is subscribed
+	systemStats.OnSample(func(sample sysstats.Sample) {
+		events.publish("stats", sample)
+	})
+	systemStats.Sample()
+
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 2 {
+		line, err := reader.ReadString('\n')
+		c.Assert(err, IsNil)
+		// skip the keep-alive comments and the blank separators
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, ":") {
+			lines = append(lines, line)
+		}
+	}
+
+	c.Check(lines[0], Equals, "event: stats")
+	c.Assert(strings.HasPrefix(lines[1], "data: "), Equals, true)
+
+	var sample sysstats.Sample
+	c.Check(json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &sample), IsNil)
+}
+
+func (s *StatsSuite) TestEventsUnauthorized(c *C) {
+	req, err := http.NewRequest("GET", "/api/v2/events", nil)
+	c.Assert(err, IsNil)
+
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	c.Check(rec.Code, Equals, http.StatusUnauthorized)
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/godbus/dbus"
+)
+
+const timesyncInterface = "org.freedesktop.timesync1.Manager"
+
+// timesyncManager returns timesyncd, which knows how the clock is
+// synchronized
+var timesyncManager = func() (dbus.BusObject, error) {
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	return bus.Object("org.freedesktop.timesync1", "/org/freedesktop/timesync1"), nil
+}
+
+// kernelClockSynchronized tells whether the kernel considers the clock
+// synchronized, as timedated does
+var kernelClockSynchronized = func() (bool, error) {
+	var timex syscall.Timex
+	state, err := syscall.Adjtimex(&timex)
+	if err != nil {
+		return false, err
+	}
+	// TIME_ERROR
+	return state != 5, nil
+}
+
+// timeSyncStatus tells whether and how the clock is synchronized; only
+// Synchronized is known without timesyncd
+type timeSyncStatus struct {
+	Synchronized  bool       `json:"synchronized"`
+	Server        string     `json:"server,omitempty"`
+	ServerAddress string     `json:"serverAddress,omitempty"`
+	LastSync      *time.Time `json:"lastSync,omitempty"`
+	// Offset of the clock to the server, in seconds
+	Offset float64 `json:"offset,omitempty"`
+	// PollInterval between synchronizations, in seconds
+	PollInterval int64 `json:"pollInterval,omitempty"`
+}
+
+// ntpMessage holds the fields of the last NTP response of timesyncd that
+// matter here, all in microseconds
+type ntpMessage struct {
+	originate   uint64
+	receive     uint64
+	transmit    uint64
+	destination uint64
+}
+
+// parseNTPMessage reads the NTPMessage property of timesyncd, a
+// (uuuuittayttttbtt) structure
+func parseNTPMessage(v dbus.Variant) (ntpMessage, error) {
+	fields, ok := v.Value().([]interface{})
+	if !ok || len(fields) != 15 {
+		return ntpMessage{}, fmt.Errorf("Unexpected NTPMessage value %s", v)
+	}
+
+	var timestamps [4]uint64
+	for i := range timestamps {
+		if timestamps[i], ok = fields[8+i].(uint64); !ok {
+			return ntpMessage{}, fmt.Errorf("Unexpected NTPMessage value %s", v)
+		}
+	}
+
+	return ntpMessage{
+		originate:   timestamps[0],
+		receive:     timestamps[1],
+		transmit:    timestamps[2],
+		destination: timestamps[3],
+	}, nil
+}
+
+// offset is the clock offset the message gives, in microseconds
+func (m ntpMessage) offset() int64 {
+	return (int64(m.receive-m.originate) + int64(m.transmit-m.destination)) / 2
+}
+
+// parseServerAddress reads the ServerAddress property of timesyncd, an
+// (iay) structure of the address family and bytes
+func parseServerAddress(v dbus.Variant) (string, error) {
+	fields, ok := v.Value().([]interface{})
+	if !ok || len(fields) != 2 {
+		return "", fmt.Errorf("Unexpected ServerAddress value %s", v)
+	}
+	address, ok := fields[1].([]byte)
+	if !ok {
+		return "", fmt.Errorf("Unexpected ServerAddress value %s", v)
+	}
+	if len(address) == 0 {
+		return "", nil
+	}
+	return net.IP(address).String(), nil
+}
+
+// timesyncdStatus completes the status with the details of timesyncd
+func timesyncdStatus(status *timeSyncStatus) error {
+	timesync, err := timesyncManager()
+	if err != nil {
+		return err
+	}
+
+	name, err := readDbusProperty(timesync, timesyncInterface+".ServerName")
+	if err != nil {
+		return err
+	}
+	var ok bool
+	if status.Server, ok = name.Value().(string); !ok {
+		return fmt.Errorf("Unexpected ServerName value %s", name)
+	}
+
+	address, err := readDbusProperty(timesync, timesyncInterface+".ServerAddress")
+	if err != nil {
+		return err
+	}
+	if status.ServerAddress, err = parseServerAddress(address); err != nil {
+		return err
+	}
+
+	poll, err := readDbusProperty(timesync, timesyncInterface+".PollIntervalUSec")
+	if err != nil {
+		return err
+	}
+	usec, ok := poll.Value().(uint64)
+	if !ok {
+		return fmt.Errorf("Unexpected PollIntervalUSec value %s", poll)
+	}
+	status.PollInterval = int64(usec / 1000000)
+
+	message, err := readDbusProperty(timesync, timesyncInterface+".NTPMessage")
+	if err != nil {
+		return err
+	}
+	m, err := parseNTPMessage(message)
+	if err != nil {
+		return err
+	}
+	// no response yet
+	if m.destination != 0 {
+		lastSync := time.Unix(0, int64(m.destination)*1000).UTC()
+		status.LastSync = &lastSync
+		status.Offset = float64(m.offset()) / 1000000
+	}
+
+	return nil
+}
+
+// getTimeSyncStatus tells whether the clock is synchronized, with the
+// details of timesyncd when it runs
+func getTimeSyncStatus(timedate dbus.BusObject) timeSyncStatus {
+	var status timeSyncStatus
+
+	// timedated before systemd 239 does not tell
+	if synchronized, err := readDbusProperty(timedate, timedateInterface+".NTPSynchronized"); err == nil {
+		status.Synchronized, _ = synchronized.Value().(bool)
+	} else if synchronized, err := kernelClockSynchronized(); err == nil {
+		status.Synchronized = synchronized
+	} else {
+		log.Printf("getTimeSyncStatus: cannot tell whether the clock is synchronized: %v", err)
+	}
+
+	// another NTP client may be used, leaving only the above
+	details := status
+	if err := timesyncdStatus(&details); err != nil {
+		log.Printf("getTimeSyncStatus: no timesyncd details: %v", err)
+		return status
+	}
+
+	return details
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/godbus/dbus"
+	. "gopkg.in/check.v1"
+)
+
+type TimesyncSuite struct {
+	timedate *fakeBusObject
+	timesync *fakeBusObject
+	kernel   error
+
+	timedateManager         func() (dbus.BusObject, error)
+	timesyncManager         func() (dbus.BusObject, error)
+	kernelClockSynchronized func() (bool, error)
+	readDbusProperty        func(dbus.BusObject, string) (dbus.Variant, error)
+}
+
+var _ = Suite(&TimesyncSuite{})
+
+// ntpMessageProperty returns a NTPMessage with the given originate,
+// receive, transmit and destination timestamps
+func ntpMessageProperty(t1, t2, t3, t4 uint64) []interface{} {
+	return []interface{}{
+		uint32(0), uint32(4), uint32(4), uint32(2), int32(-23),
+		uint64(1000), uint64(2000), []byte{1, 2, 3, 4},
+		t1, t2, t3, t4,
+		false, uint64(12), uint64(150),
+	}
+}
+
+func (s *TimesyncSuite) SetUpTest(c *C) {
+	s.timedate = newFakeBusObject()
+	s.timedate.properties["org.freedesktop.timedate1.NTPSynchronized"] = true
+
+	s.timesync = newFakeBusObject()
+	s.timesync.properties["org.freedesktop.timesync1.Manager.ServerName"] = "ntp.ubuntu.com"
+	s.timesync.properties["org.freedesktop.timesync1.Manager.ServerAddress"] = []interface{}{int32(2), []byte{91, 189, 89, 198}}
+	s.timesync.properties["org.freedesktop.timesync1.Manager.PollIntervalUSec"] = uint64(2048000000)
+	// 1.5ms ahead of the server
+	s.timesync.properties["org.freedesktop.timesync1.Manager.NTPMessage"] = ntpMessageProperty(
+		1500000000000000, 1500000000010000, 1500000000010500, 1500000000023500)
+
+	s.timedateManager = timedateManager
+	s.timesyncManager = timesyncManager
+	s.kernelClockSynchronized = kernelClockSynchronized
+	s.readDbusProperty = readDbusProperty
+
+	timedateManager = func() (dbus.BusObject, error) {
+		return s.timedate, nil
+	}
+	timesyncManager = func() (dbus.BusObject, error) {
+		return s.timesync, nil
+	}
+	s.kernel = nil
+	kernelClockSynchronized = func() (bool, error) {
+		return false, s.kernel
+	}
+}
+
+func (s *TimesyncSuite) TearDownTest(c *C) {
+	timedateManager = s.timedateManager
+	timesyncManager = s.timesyncManager
+	kernelClockSynchronized = s.kernelClockSynchronized
+	readDbusProperty = s.readDbusProperty
+}
+
+func (s *TimesyncSuite) TestStatus(c *C) {
+	lastSync := time.Unix(1500000000, 23500000).UTC()
+
+	c.Check(getTimeSyncStatus(s.timedate), DeepEquals, timeSyncStatus{
+		Synchronized:  true,
+		Server:        "ntp.ubuntu.com",
+		ServerAddress: "91.189.89.198",
+		LastSync:      &lastSync,
+		Offset:        -0.0015,
+		PollInterval:  2048,
+	})
+}
+
+func (s *TimesyncSuite) TestStatusNotSynchronizedYet(c *C) {
+	s.timedate.properties["org.freedesktop.timedate1.NTPSynchronized"] = false
+	s.timesync.properties["org.freedesktop.timesync1.Manager.ServerName"] = ""
+	s.timesync.properties["org.freedesktop.timesync1.Manager.ServerAddress"] = []interface{}{int32(0), []byte{}}
+	s.timesync.properties["org.freedesktop.timesync1.Manager.NTPMessage"] = ntpMessageProperty(0, 0, 0, 0)
+
+	c.Check(getTimeSyncStatus(s.timedate), DeepEquals, timeSyncStatus{PollInterval: 2048})
+}
+
+func (s *TimesyncSuite) TestStatusWithoutTimesyncd(c *C) {
+	timesyncManager = func() (dbus.BusObject, error) {
+		return nil, errNoBus
+	}
+	c.Check(getTimeSyncStatus(s.timedate), DeepEquals, timeSyncStatus{Synchronized: true})
+
+	// the service is missing, but not the bus
+	timesyncManager = func() (dbus.BusObject, error) {
+		return s.timesync, nil
+	}
+	readDbusProperty = func(o dbus.BusObject, property string) (dbus.Variant, error) {
+		if o == s.timesync {
+			return dbus.Variant{}, dbus.Error{Name: "org.freedesktop.DBus.Error.ServiceUnknown"}
+		}
+		return o.GetProperty(property)
+	}
+	c.Check(getTimeSyncStatus(s.timedate), DeepEquals, timeSyncStatus{Synchronized: true})
+}
+
+func (s *TimesyncSuite) TestStatusKernelFallback(c *C) {
+	delete(s.timedate.properties, "org.freedesktop.timedate1.NTPSynchronized")
+	kernelClockSynchronized = func() (bool, error) {
+		return true, nil
+	}
+	c.Check(getTimeSyncStatus(s.timedate).Synchronized, Equals, true)
+
+	kernelClockSynchronized = func() (bool, error) {
+		return true, errors.New("Operation not permitted")
+	}
+	c.Check(getTimeSyncStatus(s.timedate).Synchronized, Equals, false)
+}
+
+func (s *TimesyncSuite) TestStatusMalformed(c *C) {
+	for property, value := range map[string]interface{}{
+		"ServerName":       42,
+		"ServerAddress":    []interface{}{int32(2)},
+		"PollIntervalUSec": "2048",
+		"NTPMessage":       []interface{}{uint32(0)},
+	} {
+		name := "org.freedesktop.timesync1.Manager." + property
+		valid := s.timesync.properties[name]
+		s.timesync.properties[name] = value
+
+		c.Check(getTimeSyncStatus(s.timedate), DeepEquals, timeSyncStatus{Synchronized: true}, Commentf(property))
+		s.timesync.properties[name] = valid
+	}
+}
+
+func (s *TimesyncSuite) TestTimeInfo(c *C) {
+	s.timedate.properties["org.freedesktop.timedate1.Timezone"] = "UTC"
+	s.timedate.properties["org.freedesktop.timedate1.NTP"] = true
+
+	info, err := getTimeInfo()
+	c.Assert(err, IsNil)
+	c.Check(info.Sync.Synchronized, Equals, true)
+	c.Check(info.Sync.Server, Equals, "ntp.ubuntu.com")
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var zoneinfoDir = "/usr/share/zoneinfo"
+
+// timezone is a time zone with its current offset to UTC, in seconds
+type timezone struct {
+	Name   string `json:"name"`
+	Offset int    `json:"offset"`
+	DST    bool   `json:"dst"`
+}
+
+// listTimezones returns the names of the time zones known to timedated,
+// or listed in the zoneinfo tables without it
+func listTimezones() ([]string, error) {
+	var names []string
+
+	timedate, err := timedateManager()
+	if err == nil {
+		err = timedate.Call(timedateInterface+".ListTimezones", 0).Store(&names)
+	}
+	if err != nil {
+		log.Printf("listTimezones: falling back to %s: %v", zoneinfoDir, err)
+		if names, err = readZoneTables(); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// readZoneTables reads the time zones from zone1970.tab, or the older
+// zone.tab, as timedated does, with UTC added
+func readZoneTables() ([]string, error) {
+	f, err := os.Open(filepath.Join(zoneinfoDir, "zone1970.tab"))
+	if os.IsNotExist(err) {
+		f, err = os.Open(filepath.Join(zoneinfoDir, "zone.tab"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names := []string{"UTC"}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		// country codes, coordinates, time zone, comments
+		if fields := strings.Split(line, "\t"); len(fields) >= 3 {
+			names = append(names, fields[2])
+		}
+	}
+
+	return names, scanner.Err()
+}
+
+// isDST tells whether daylight saving time is in effect at t, in its
+// location: the standard time being the earlier of the January and July
+// ones, whatever the hemisphere
+func isDST(t time.Time) bool {
+	_, offset := t.Zone()
+	_, january := time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, t.Location()).Zone()
+	_, july := time.Date(t.Year(), time.July, 1, 0, 0, 0, 0, t.Location()).Zone()
+
+	standard := january
+	if july < standard {
+		standard = july
+	}
+	return january != july && offset > standard
+}
+
+// getTimezones returns the known time zones with their current offset,
+// leaving out the ones this system cannot load
+func getTimezones() ([]timezone, error) {
+	names, err := listTimezones()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	zones := make([]timezone, 0, len(names))
+	for _, name := range names {
+		location, err := time.LoadLocation(name)
+		if err != nil {
+			log.Printf("getTimezones: %v", err)
+			continue
+		}
+
+		t := now.In(location)
+		_, offset := t.Zone()
+		zones = append(zones, timezone{Name: name, Offset: offset, DST: isDST(t)})
+	}
+
+	return zones, nil
+}
+
+// validateTimezone checks the time zone is a known one, suggesting the one
+// with the same name but for the case, or the same city
+func validateTimezone(name string) error {
+	if name == "" {
+		return fmt.Errorf("Invalid timezone: empty")
+	}
+
+	names, err := listTimezones()
+	if err != nil {
+		// still catch the obvious mistakes
+		if _, err := time.LoadLocation(name); err != nil || name == "Local" {
+			return fmt.Errorf("Unknown timezone %q", name)
+		}
+		return nil
+	}
+
+	var suggestion string
+	for _, known := range names {
+		if known == name {
+			return nil
+		}
+		if strings.EqualFold(known, name) || suggestion == "" && strings.EqualFold(filepath.Base(known), filepath.Base(name)) {
+			suggestion = known
+		}
+	}
+
+	if suggestion != "" {
+		return fmt.Errorf("Unknown timezone %q, did you mean %q?", name, suggestion)
+	}
+	return fmt.Errorf("Unknown timezone %q, see /api/v2/timezones for the known ones", name)
+}
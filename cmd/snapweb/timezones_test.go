@@ -0,0 +1,196 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/godbus/dbus"
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapweb/snappy/app"
+	"github.com/snapcore/snapweb/snappy/snapdclient"
+)
+
+const zone1970TabFixture = `# tzdb timezone descriptions
+#
+#codes	coordinates	TZ	comments
+CA	+4339-07923	America/Toronto	Eastern - ON, QC (most areas)
+FR,MC	+4852+00220	Europe/Paris
+NZ	-3652+17446	Pacific/Auckland	New Zealand time
+`
+
+type TimezonesSuite struct {
+	timedate        *fakeBusObject
+	timedateManager func() (dbus.BusObject, error)
+	handler         http.Handler
+}
+
+var _ = Suite(&TimezonesSuite{})
+
+func (s *TimezonesSuite) SetUpTest(c *C) {
+	s.timedate = newFakeBusObject()
+	s.timedate.replies["org.freedesktop.timedate1.ListTimezones"] = []interface{}{
+		[]string{"UTC", "Europe/Paris", "Asia/Kolkata", "Nowhere/Atlantis"},
+	}
+	s.timedateManager = timedateManager
+	timedateManager = func() (dbus.BusObject, error) {
+		return s.timedate, nil
+	}
+
+	zoneinfoDir = c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(zoneinfoDir, "zone1970.tab"), []byte(zone1970TabFixture), 0644), IsNil)
+
+	newSnapdClient = func() snapdclient.SnapdClient {
+		return &snapdclient.FakeSnapdClient{}
+	}
+	os.Setenv("SNAP_DATA", c.MkDir())
+	c.Assert(ioutil.WriteFile(tokenFilename(), []byte("1234"), 0600), IsNil)
+
+	s.handler = initURLHandlers(log.New(ioutil.Discard, "", 0), snappy.NewConfigWatcher(snappy.Config{DisableIPFilter: true}))
+}
+
+func (s *TimezonesSuite) TearDownTest(c *C) {
+	timedateManager = s.timedateManager
+	zoneinfoDir = "/usr/share/zoneinfo"
+	newSnapdClient = newSnapdClientImpl
+}
+
+func (s *TimezonesSuite) TestListTimezones(c *C) {
+	names, err := listTimezones()
+	c.Assert(err, IsNil)
+	c.Check(names, DeepEquals, []string{"Asia/Kolkata", "Europe/Paris", "Nowhere/Atlantis", "UTC"})
+}
+
+func (s *TimezonesSuite) TestListTimezonesFallback(c *C) {
+	timedateManager = func() (dbus.BusObject, error) {
+		return nil, errNoBus
+	}
+
+	names, err := listTimezones()
+	c.Assert(err, IsNil)
+	c.Check(names, DeepEquals, []string{"America/Toronto", "Europe/Paris", "Pacific/Auckland", "UTC"})
+
+	// older systems only have zone.tab
+	c.Assert(os.Rename(filepath.Join(zoneinfoDir, "zone1970.tab"), filepath.Join(zoneinfoDir, "zone.tab")), IsNil)
+	names, err = listTimezones()
+	c.Assert(err, IsNil)
+	c.Check(names, HasLen, 4)
+
+	c.Assert(os.Remove(filepath.Join(zoneinfoDir, "zone.tab")), IsNil)
+	_, err = listTimezones()
+	c.Check(err, NotNil)
+}
+
+func (s *TimezonesSuite) TestGetTimezones(c *C) {
+	zones, err := getTimezones()
+	c.Assert(err, IsNil)
+
+	// the unknown zone is left out
+	c.Assert(zones, HasLen, 3)
+	c.Check(zones[0], Equals, timezone{Name: "Asia/Kolkata", Offset: 19800, DST: false})
+	c.Check(zones[1].Name, Equals, "Europe/Paris")
+	if zones[1].DST {
+		c.Check(zones[1].Offset, Equals, 7200)
+	} else {
+		c.Check(zones[1].Offset, Equals, 3600)
+	}
+	c.Check(zones[2], Equals, timezone{Name: "UTC", Offset: 0, DST: false})
+}
+
+func (s *TimezonesSuite) TestIsDST(c *C) {
+	tests := []struct {
+		zone  string
+		month time.Month
+		dst   bool
+	}{
+		{"Europe/Paris", time.January, false},
+		{"Europe/Paris", time.July, true},
+		{"Australia/Sydney", time.January, true},
+		{"Australia/Sydney", time.July, false},
+		{"Asia/Kolkata", time.July, false},
+		{"UTC", time.July, false},
+	}
+
+	for _, tt := range tests {
+		location, err := time.LoadLocation(tt.zone)
+		c.Assert(err, IsNil)
+		t := time.Date(2017, tt.month, 15, 12, 0, 0, 0, location)
+		c.Check(isDST(t), Equals, tt.dst, Commentf("%s in %s", tt.zone, tt.month))
+	}
+}
+
+func (s *TimezonesSuite) TestValidateTimezoneFallback(c *C) {
+	timedateManager = func() (dbus.BusObject, error) {
+		return nil, errNoBus
+	}
+	zoneinfoDir = filepath.Join(c.MkDir(), "missing")
+
+	c.Check(validateTimezone("Europe/Paris"), IsNil)
+	c.Check(validateTimezone("Local"), ErrorMatches, `Unknown timezone "Local"`)
+	c.Check(validateTimezone("Mars/Olympus"), ErrorMatches, `Unknown timezone "Mars/Olympus"`)
+}
+
+func (s *TimezonesSuite) TestHandleTimezones(c *C) {
+	req, err := http.NewRequest("GET", "/api/v2/timezones", nil)
+	c.Assert(err, IsNil)
+	req.AddCookie(&http.Cookie{Name: SnapwebCookieName, Value: "1234"})
+
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Check(rec.Header().Get("Content-Type"), Equals, "application/json")
+
+	var zones []map[string]interface{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &zones), IsNil)
+	c.Assert(zones, HasLen, 3)
+	c.Check(zones[0], DeepEquals, map[string]interface{}{"name": "Asia/Kolkata", "offset": 19800.0, "dst": false})
+}
+
+func (s *TimezonesSuite) TestHandleTimezonesInvalidMethod(c *C) {
+	req, err := http.NewRequest("POST", "/api/v2/timezones", nil)
+	c.Assert(err, IsNil)
+	req.AddCookie(&http.Cookie{Name: SnapwebCookieName, Value: "1234"})
+
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	c.Check(rec.Code, Equals, http.StatusMethodNotAllowed)
+}
+
+func (s *TimezonesSuite) TestPatchUnknownTimezone(c *C) {
+	req, err := http.NewRequest("PATCH", "/api/v2/time-info", bytes.NewBufferString(`{"timezone":"Europe/Pariss"}`))
+	c.Assert(err, IsNil)
+	req.AddCookie(&http.Cookie{Name: SnapwebCookieName, Value: "1234"})
+	req.Header.Set("Content-Type", "application/json")
+
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	c.Assert(rec.Code, Equals, http.StatusBadRequest)
+
+	var result timePatchResult
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &result), IsNil)
+	c.Check(result.Results["timezone"].Message, Equals, `Unknown timezone "Europe/Pariss", see /api/v2/timezones for the known ones`)
+}
@@ -0,0 +1,15 @@
+#!/bin/sh
+#
+# Install the Go toolchain snapweb is built with in /usr/local/go, as the
+# golang-go of the archive is too old.
+
+set -e
+
+GO_VERSION=1.13
+
+if /usr/local/go/bin/go version 2>/dev/null | grep -q "go${GO_VERSION} "; then
+    exit 0
+fi
+
+rm -rf /usr/local/go
+wget -q -O - "https://dl.google.com/go/go${GO_VERSION}.linux-amd64.tar.gz" | tar -C /usr/local -xz
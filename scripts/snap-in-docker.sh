@@ -4,7 +4,9 @@
 
 set -ev
 
-docker run -v $GOPATH:/go dbarth/snapweb-builder sh -c 'cd /go/src/github.com/snapcore/snapweb && export GOPATH=/go PATH=/go/bin:$PATH && ./scripts/snap.sh'
+# build the builder image here, so that it has the Go toolchain of this tree
+docker build -t snapweb-builder .
+docker run -v $GOPATH:/go snapweb-builder sh -c 'cd /go/src/github.com/snapcore/snapweb && export GOPATH=/go PATH=/go/bin:$PATH && ./scripts/snap.sh'
 
 #change the permissions to user travis
 echo "Fixing the permissions of files generated by the docker daemon"
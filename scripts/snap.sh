@@ -9,8 +9,10 @@ set -ev
 
 dpkg --add-architecture i386
 apt update
-apt install -y bzr gcc-5-multilib gcc-5-aarch64-linux-gnu gcc-5-arm-linux-gnueabihf gcc-aarch64-linux-gnu gcc-arm-linux-gnueabihf git golang-go libc6-dev:i386 nodejs-legacy wget apt-transport-https npm
+apt install -y bzr gcc-5-multilib gcc-5-aarch64-linux-gnu gcc-5-arm-linux-gnueabihf gcc-aarch64-linux-gnu gcc-arm-linux-gnueabihf git libc6-dev:i386 nodejs-legacy wget apt-transport-https npm
 apt upgrade -y
+./scripts/install-go.sh
+export PATH=/usr/local/go/bin:$PATH
 # copy node_modules cached in the docker image to speed things up and avoid ECONNRESET errors from npm
 if [ -d /build ]; then
   cp -a /build .
@@ -0,0 +1,415 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snappy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// values obtained with "snapctl get" by the configure hook
+	snapctlConfigFilename string = "snapctl.json"
+)
+
+// configOption describes a Config field that can be set with "snap set" or
+// overridden through the environment
+type configOption struct {
+	// key used with "snap set snapweb <key>=<value>"
+	key string
+	// environment variable overriding the value
+	env string
+	// set parses and validates the value before storing it in the config
+	set func(config *Config, value string) error
+}
+
+var configOptions = []configOption{
+	{"disableaccesstoken", "SNAPWEB_DISABLE_ACCESS_TOKEN", func(c *Config, v string) error {
+		return parseBool(v, &c.DisableAccessToken)
+	}},
+	{"disablehttps", "SNAPWEB_DISABLE_HTTPS", func(c *Config, v string) error {
+		return parseBool(v, &c.DisableHTTPS)
+	}},
+	{"disableipfilter", "SNAPWEB_DISABLE_IP_FILTER", func(c *Config, v string) error {
+		return parseBool(v, &c.DisableIPFilter)
+	}},
+	{"allownetworks", "SNAPWEB_ALLOW_NETWORKS", func(c *Config, v string) error {
+		return parseNetworks(v, &c.AllowNetworks)
+	}},
+	{"allowinterfaces", "SNAPWEB_ALLOW_INTERFACES", func(c *Config, v string) error {
+		ifnames, err := parseList(v)
+		if err != nil {
+			return err
+		}
+		c.AllowInterfaces = ifnames
+		return nil
+	}},
+	{"httpport", "SNAPWEB_HTTP_PORT", func(c *Config, v string) error {
+		return parsePort(v, &c.HTTPPort)
+	}},
+	{"httpsport", "SNAPWEB_HTTPS_PORT", func(c *Config, v string) error {
+		return parsePort(v, &c.HTTPSPort)
+	}},
+	{"certfile", "SNAPWEB_CERT_FILE", func(c *Config, v string) error {
+		return parsePath(v, &c.CertFile)
+	}},
+	{"keyfile", "SNAPWEB_KEY_FILE", func(c *Config, v string) error {
+		return parsePath(v, &c.KeyFile)
+	}},
+	{"httpaddresses", "SNAPWEB_HTTP_ADDRESSES", func(c *Config, v string) error {
+		return parseListenAddresses(v, &c.HTTPAddresses)
+	}},
+	{"httpsaddresses", "SNAPWEB_HTTPS_ADDRESSES", func(c *Config, v string) error {
+		return parseListenAddresses(v, &c.HTTPSAddresses)
+	}},
+	{"bindinterfaces", "SNAPWEB_BIND_INTERFACES", func(c *Config, v string) error {
+		ifnames, err := parseList(v)
+		if err != nil {
+			return err
+		}
+		c.BindInterfaces = ifnames
+		return nil
+	}},
+	{"unixsocket", "SNAPWEB_UNIX_SOCKET", func(c *Config, v string) error {
+		return parsePath(v, &c.UnixSocket)
+	}},
+	{"minipv4prefix", "SNAPWEB_MIN_IPV4_PREFIX", func(c *Config, v string) error {
+		return parsePrefix(v, 32, &c.MinIPv4Prefix)
+	}},
+	{"minipv6prefix", "SNAPWEB_MIN_IPV6_PREFIX", func(c *Config, v string) error {
+		return parsePrefix(v, 128, &c.MinIPv6Prefix)
+	}},
+	{"filterrules", "SNAPWEB_FILTER_RULES", func(c *Config, v string) error {
+		rules, err := parseList(v)
+		if err != nil {
+			return err
+		}
+		for _, rule := range rules {
+			if _, _, err := ParseFilterRule(rule); err != nil {
+				return err
+			}
+		}
+		c.FilterRules = rules
+		return nil
+	}},
+	{"trustedproxies", "SNAPWEB_TRUSTED_PROXIES", func(c *Config, v string) error {
+		return parseNetworks(v, &c.TrustedProxies)
+	}},
+	{"localca", "SNAPWEB_LOCAL_CA", func(c *Config, v string) error {
+		return parseBool(v, &c.LocalCA)
+	}},
+	{"keytype", "SNAPWEB_KEY_TYPE", func(c *Config, v string) error {
+		if err := validateKeyType(v); err != nil {
+			return err
+		}
+		c.KeyType = v
+		return nil
+	}},
+	{"tlsminversion", "SNAPWEB_TLS_MIN_VERSION", func(c *Config, v string) error {
+		if err := validateTLSVersion(v); err != nil {
+			return err
+		}
+		c.TLSMinVersion = v
+		return nil
+	}},
+	{"clientauth", "SNAPWEB_CLIENT_AUTH", func(c *Config, v string) error {
+		if err := validateClientAuth(v); err != nil {
+			return err
+		}
+		c.ClientAuth = v
+		return nil
+	}},
+	{"clientcafile", "SNAPWEB_CLIENT_CA_FILE", func(c *Config, v string) error {
+		return parsePath(v, &c.ClientCAFile)
+	}},
+	{"clientroles", "SNAPWEB_CLIENT_ROLES", func(c *Config, v string) error {
+		var roles map[string]string
+		if err := json.Unmarshal([]byte(v), &roles); err != nil {
+			return errors.New("expected a JSON object mapping subjects to roles")
+		}
+		c.ClientRoles = roles
+		return nil
+	}},
+	{"statsinterval", "SNAPWEB_STATS_INTERVAL", func(c *Config, v string) error {
+		return parseSeconds(v, &c.StatsInterval)
+	}},
+	{"statsretention", "SNAPWEB_STATS_RETENTION", func(c *Config, v string) error {
+		return parseSeconds(v, &c.StatsRetention)
+	}},
+	{"currency", "SNAPWEB_CURRENCY", func(c *Config, v string) error {
+		if err := validateCurrency(v); err != nil {
+			return err
+		}
+		c.Currency = v
+		return nil
+	}},
+}
+
+func parseBool(value string, b *bool) error {
+	switch value {
+	case "true":
+		*b = true
+	case "false":
+		*b = false
+	default:
+		return errors.New("expected true or false")
+	}
+	return nil
+}
+
+// parseList accepts either a JSON array of strings, as returned by snapctl
+// for lists, or a comma separated list
+func parseList(value string) ([]string, error) {
+	var list []string
+
+	if strings.HasPrefix(strings.TrimSpace(value), "[") {
+		if err := json.Unmarshal([]byte(value), &list); err != nil {
+			return nil, errors.New("expected a list of strings")
+		}
+	} else {
+		list = strings.Split(value, ",")
+	}
+
+	items := make([]string, 0, len(list))
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			return nil, errors.New("empty item in list")
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+func parseNetworks(value string, networks *[]string) error {
+	list, err := parseList(value)
+	if err != nil {
+		return err
+	}
+	for _, network := range list {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			return fmt.Errorf("%q is not a network in CIDR notation", network)
+		}
+	}
+	*networks = list
+	return nil
+}
+
+func parseListenAddresses(value string, addresses *[]string) error {
+	list, err := parseList(value)
+	if err != nil {
+		return err
+	}
+	for _, addr := range list {
+		if _, _, err := splitListenAddress(addr); err != nil {
+			return err
+		}
+	}
+	*addresses = list
+	return nil
+}
+
+func parsePort(value string, port *int) error {
+	p, err := strconv.Atoi(value)
+	if err != nil {
+		return errors.New("expected a port number between 1 and 65535")
+	}
+	if err := validatePort(p); err != nil {
+		return err
+	}
+	*port = p
+	return nil
+}
+
+func parsePrefix(value string, bits int, prefix *int) error {
+	p, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("expected a prefix length between 0 and %d", bits)
+	}
+	if err := validatePrefix(p, bits); err != nil {
+		return err
+	}
+	*prefix = p
+	return nil
+}
+
+func parseSeconds(value string, seconds *int) error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return errors.New("expected a positive number of seconds")
+	}
+	*seconds = n
+	return nil
+}
+
+func parsePath(value string, path *string) error {
+	if !filepath.IsAbs(value) {
+		return errors.New("expected an absolute path")
+	}
+	*path = filepath.Clean(value)
+	return nil
+}
+
+// applyOptions sets the given raw values, indexed by option key, on the config
+func applyOptions(config *Config, values map[string]string, source string) error {
+	for _, opt := range configOptions {
+		value, ok := values[opt.key]
+		if !ok {
+			continue
+		}
+		if err := opt.set(config, value); err != nil {
+			return fmt.Errorf("Invalid value %q for %s (%s): %s", value, opt.key, source, err)
+		}
+	}
+
+	return nil
+}
+
+// applyEnvironment applies the environment overrides on the config
+func applyEnvironment(config *Config) error {
+	for _, opt := range configOptions {
+		value, ok := os.LookupEnv(opt.env)
+		if !ok {
+			continue
+		}
+		if err := opt.set(config, value); err != nil {
+			return fmt.Errorf("Invalid value %q for %s: %s", value, opt.env, err)
+		}
+	}
+
+	return nil
+}
+
+func snapctlConfigPath() string {
+	return filepath.Join(os.Getenv("SNAP_COMMON"), snapctlConfigFilename)
+}
+
+// readSnapctlConfig returns the values stored by the configure hook
+func readSnapctlConfig() (map[string]string, error) {
+	path := snapctlConfigPath()
+	if _, err := os.Stat(path); err != nil {
+		return nil, nil
+	}
+
+	content, err := readFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read %s: %s", path, err)
+	}
+
+	var values map[string]string
+	if err := json.Unmarshal(content, &values); err != nil {
+		return nil, fmt.Errorf("Invalid snap configuration file %s: %s", path, err)
+	}
+
+	return values, nil
+}
+
+var snapctlGet = func(key string) (string, error) {
+	out, err := exec.Command("snapctl", "get", key).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// hookSettings are the settings the former configure hook copied from
+// "snap set" into the configuration file, on every run
+var hookSettings = []string{"disableAccessToken", "disableHttps"}
+
+// migrateHookSettings removes the settings written by the former configure
+// hook from the configuration file, where they would otherwise prevail over
+// the values set with "snap set". It only runs on the first import, as the
+// settings may afterwards have been written there on purpose.
+func migrateHookSettings() error {
+	if _, err := os.Stat(snapctlConfigPath()); err == nil {
+		return nil
+	}
+
+	path := configPath()
+	content, err := readFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Cannot read configuration file %s: %s", path, err)
+	}
+
+	var settings map[string]*json.RawMessage
+	if err := json.Unmarshal(content, &settings); err != nil {
+		return fmt.Errorf("Invalid configuration file %s: %s", path, err)
+	}
+
+	migrated := false
+	for key := range settings {
+		for _, setting := range hookSettings {
+			// the keys of the configuration file are not case sensitive
+			if strings.EqualFold(key, setting) {
+				delete(settings, key)
+				migrated = true
+			}
+		}
+	}
+	if !migrated {
+		return nil
+	}
+
+	content, err = json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, content, 0644)
+}
+
+// ImportSnapctlConfig reads the values set with "snap set snapweb ...",
+// validates them and stores them where ReadConfig picks them up.
+// It is meant to be run by the configure hook: an error rejects the change.
+func ImportSnapctlConfig() error {
+	if err := migrateHookSettings(); err != nil {
+		return err
+	}
+
+	values := make(map[string]string)
+	for _, opt := range configOptions {
+		value, err := snapctlGet(opt.key)
+		if err != nil || value == "" {
+			continue
+		}
+		values[opt.key] = value
+	}
+
+	// reject values that would make the effective configuration invalid
+	if _, err := mergeConfig(values); err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(snapctlConfigPath(), content, 0644)
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snappy
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	. "gopkg.in/check.v1"
+)
+
+type ConfigSourceSuite struct {
+	snapCommonEnv string
+	snapctl       map[string]string
+}
+
+var _ = Suite(&ConfigSourceSuite{})
+
+func (s *ConfigSourceSuite) SetUpTest(c *C) {
+	s.snapCommonEnv = c.MkDir()
+	os.Setenv("SNAP_COMMON", s.snapCommonEnv)
+	os.Setenv("SNAP_DATA", "/var/snap/snapweb/x1")
+
+	s.snapctl = make(map[string]string)
+	snapctlGet = func(key string) (string, error) {
+		if v, ok := s.snapctl[key]; ok {
+			return v, nil
+		}
+		return "", errors.New("no such option")
+	}
+}
+
+func (s *ConfigSourceSuite) TearDownTest(c *C) {
+	for _, opt := range configOptions {
+		os.Unsetenv(opt.env)
+	}
+}
+
+func (s *ConfigSourceSuite) TestOptionsCoverEveryField(c *C) {
+	// every Config field must be settable with snap set and the environment
+	c.Check(configOptions, HasLen, reflect.TypeOf(Config{}).NumField())
+}
+
+func (s *ConfigSourceSuite) TestDefaults(c *C) {
+	config, err := ReadConfig()
+	c.Assert(err, IsNil)
+	c.Check(config, DeepEquals, Config{
+		HTTPPort:  defaultHTTPPort,
+		HTTPSPort: defaultHTTPSPort,
+		CertFile:  "/var/snap/snapweb/x1/cert.pem",
+		KeyFile:   "/var/snap/snapweb/x1/key.pem",
+
+		MinIPv4Prefix: DefaultIPv4Prefix,
+		MinIPv6Prefix: DefaultIPv6Prefix,
+
+		KeyType:       KeyTypeECDSA,
+		TLSMinVersion: TLSVersion12,
+		ClientAuth:    ClientAuthOff,
+
+		StatsInterval:  DefaultStatsInterval,
+		StatsRetention: DefaultStatsRetention,
+	})
+}
+
+func (s *ConfigSourceSuite) TestImportSnapctlConfig(c *C) {
+	s.snapctl["disableaccesstoken"] = "true"
+	s.snapctl["allownetworks"] = `["10.0.0.0/8", "192.168.1.0/24"]`
+	s.snapctl["allowinterfaces"] = "eth0, wlan0"
+	s.snapctl["httpport"] = "8080"
+	s.snapctl["keyfile"] = "/etc/ssl/private/snapweb.key"
+
+	c.Assert(ImportSnapctlConfig(), IsNil)
+
+	config, err := ReadConfig()
+	c.Assert(err, IsNil)
+
+	expected := DefaultConfig()
+	expected.DisableAccessToken = true
+	expected.AllowNetworks = []string{"10.0.0.0/8", "192.168.1.0/24"}
+	expected.AllowInterfaces = []string{"eth0", "wlan0"}
+	expected.HTTPPort = 8080
+	expected.KeyFile = "/etc/ssl/private/snapweb.key"
+	c.Check(config, DeepEquals, expected)
+}
+
+func (s *ConfigSourceSuite) TestImportSnapctlConfigRejectsInvalidValues(c *C) {
+	tests := []struct {
+		key   string
+		value string
+		err   string
+	}{
+		{"disablehttps", "yes", `Invalid value "yes" for disablehttps \(snap set\): expected true or false`},
+		{"allownetworks", "10.0.0.0/8,foo", `Invalid value "10.0.0.0/8,foo" for allownetworks \(snap set\): "foo" is not a network in CIDR notation`},
+		{"allowinterfaces", "eth0,,wlan0", `Invalid value "eth0,,wlan0" for allowinterfaces \(snap set\): empty item in list`},
+		{"httpsport", "https", `Invalid value "https" for httpsport \(snap set\): expected a port number between 1 and 65535`},
+		{"httpsport", "0", `Invalid value "0" for httpsport \(snap set\): 0 is not a port number between 1 and 65535`},
+		{"minipv4prefix", "33", `Invalid value "33" for minipv4prefix \(snap set\): 33 is not a prefix length between 0 and 32`},
+		{"minipv6prefix", "/64", `Invalid value "/64" for minipv6prefix \(snap set\): expected a prefix length between 0 and 128`},
+		{"filterrules", `["deny eth1", "block 10.0.0.0/8"]`, `Invalid value .* for filterrules \(snap set\): Invalid filter rule "block 10.0.0.0/8", unknown action "block"`},
+		{"trustedproxies", "10.0.0.1", `Invalid value "10.0.0.1" for trustedproxies \(snap set\): "10.0.0.1" is not a network in CIDR notation`},
+		{"keytype", "dsa", `Invalid value "dsa" for keytype \(snap set\): "dsa" is not one of rsa, ecdsa or ed25519`},
+		{"tlsminversion", "1.0", `Invalid value "1.0" for tlsminversion \(snap set\): "1.0" is not one of 1.2 or 1.3`},
+		{"clientauth", "on", `Invalid value "on" for clientauth \(snap set\): "on" is not one of off, optional or required`},
+		{"clientroles", "CN=robot:admin", `Invalid value "CN=robot:admin" for clientroles \(snap set\): expected a JSON object mapping subjects to roles`},
+		{"statsinterval", "0", `Invalid value "0" for statsinterval \(snap set\): expected a positive number of seconds`},
+		{"statsretention", "1h", `Invalid value "1h" for statsretention \(snap set\): expected a positive number of seconds`},
+		{"currency", "eur", `Invalid value "eur" for currency \(snap set\): "eur" is not a currency code such as USD or EUR`},
+		// valid on its own, but longer than the retention
+		{"statsinterval", "7200", `Invalid configuration: Invalid statsInterval 7200: not between 1 and 3600 seconds`},
+		{"statsretention", "5", `Invalid configuration: Invalid statsRetention 5: shorter than statsInterval`},
+		// valid on its own, but needing a client CA
+		{"clientauth", "required", `Invalid configuration: clientCAFile is needed with clientAuth required`},
+		{"certfile", "cert.pem", `Invalid value "cert.pem" for certfile \(snap set\): expected an absolute path`},
+		// valid on its own, but conflicting with the default HTTP port
+		{"httpsport", "4200", `Invalid configuration: httpPort and httpsPort must differ, both are 4200`},
+	}
+
+	for _, t := range tests {
+		s.snapctl = map[string]string{t.key: t.value}
+		c.Check(ImportSnapctlConfig(), ErrorMatches, t.err)
+
+		_, err := os.Stat(filepath.Join(s.snapCommonEnv, snapctlConfigFilename))
+		c.Check(os.IsNotExist(err), Equals, true)
+	}
+}
+
+func (s *ConfigSourceSuite) TestPrecedence(c *C) {
+	s.snapctl["httpport"] = "8080"
+	s.snapctl["httpsport"] = "8443"
+	s.snapctl["disablehttps"] = "true"
+	c.Assert(ImportSnapctlConfig(), IsNil)
+
+	// the configuration file has precedence over snap set
+	setupConfigWithContent(c, s.snapCommonEnv, []byte(`{"httpsPort": 9443}`))
+	// and the environment has precedence over everything else
+	os.Setenv("SNAPWEB_DISABLE_HTTPS", "false")
+
+	config, err := ReadConfig()
+	c.Assert(err, IsNil)
+	c.Check(config.HTTPPort, Equals, 8080)
+	c.Check(config.HTTPSPort, Equals, 9443)
+	c.Check(config.DisableHTTPS, Equals, false)
+}
+
+func (s *ConfigSourceSuite) TestImportMigratesHookSettings(c *C) {
+	// as left by the configure hook of the previous versions
+	setupConfigWithContent(c, s.snapCommonEnv,
+		[]byte(`{"disableAccessToken": false, "disableHttps": false, "httpPort": 8080}`))
+
+	s.snapctl["disablehttps"] = "true"
+	s.snapctl["disableaccesstoken"] = "true"
+	c.Assert(ImportSnapctlConfig(), IsNil)
+
+	config, err := ReadConfig()
+	c.Assert(err, IsNil)
+	c.Check(config.DisableHTTPS, Equals, true)
+	c.Check(config.DisableAccessToken, Equals, true)
+	c.Check(config.HTTPPort, Equals, 8080)
+
+	content, err := ioutil.ReadFile(filepath.Join(s.snapCommonEnv, configFilename))
+	c.Assert(err, IsNil)
+	var settings map[string]interface{}
+	c.Assert(json.Unmarshal(content, &settings), IsNil)
+	c.Check(settings, DeepEquals, map[string]interface{}{"httpPort": 8080.0})
+
+	// the settings written afterwards are kept
+	setupConfigWithContent(c, s.snapCommonEnv, []byte(`{"disableHttps": false}`))
+	c.Assert(ImportSnapctlConfig(), IsNil)
+
+	config, err = ReadConfig()
+	c.Assert(err, IsNil)
+	c.Check(config.DisableHTTPS, Equals, false)
+}
+
+func (s *ConfigSourceSuite) TestInvalidEnvironment(c *C) {
+	os.Setenv("SNAPWEB_HTTP_PORT", "eighty")
+
+	_, err := ReadConfig()
+	c.Check(err, ErrorMatches, `Invalid value "eighty" for SNAPWEB_HTTP_PORT: expected a port number between 1 and 65535`)
+}
+
+func (s *ConfigSourceSuite) TestInvalidSnapctlFile(c *C) {
+	c.Assert(ioutil.WriteFile(filepath.Join(s.snapCommonEnv, snapctlConfigFilename),
+		[]byte(`{"httpport": "-1"}`), 0644), IsNil)
+
+	_, err := ReadConfig()
+	c.Check(err, ErrorMatches, `Invalid value "-1" for httpport \(snap set\): .*`)
+}
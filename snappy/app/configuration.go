@@ -19,47 +19,344 @@ package snappy
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 const (
 	configFilename string = "settings.json"
 )
 
+// Types of the keys generated for the certificates
+const (
+	KeyTypeRSA     = "rsa"
+	KeyTypeECDSA   = "ecdsa"
+	KeyTypeEd25519 = "ed25519"
+)
+
+// Client certificate authentication modes
+const (
+	ClientAuthOff      = "off"
+	ClientAuthOptional = "optional"
+	ClientAuthRequired = "required"
+)
+
+// Minimum TLS versions accepted by the HTTPS end-points
+const (
+	TLSVersion12 = "1.2"
+	TLSVersion13 = "1.3"
+)
+
+// Default sampling of the system statistics, in seconds
+const (
+	DefaultStatsInterval  = 10
+	DefaultStatsRetention = 3600
+)
+
+// most samples kept in memory
+const maxStatsSamples = 100000
+
 // Config described the runtime configuration
 type Config struct {
-	DisableAccessToken bool     `json:"disableAccessToken,omitempty"`
-	DisableHTTPS       bool     `json:"disableHttps,omitempty"`
-	DisableIPFilter    bool     `json:"disableIPFilter,omitempty"`
-	AllowNetworks      []string `json:"allowNetworks,omitempty"`
-	AllowInterfaces    []string `json:"allowInterfaces,omitempty"`
+	DisableAccessToken bool              `json:"disableAccessToken,omitempty"`
+	DisableHTTPS       bool              `json:"disableHttps,omitempty"`
+	DisableIPFilter    bool              `json:"disableIPFilter,omitempty"`
+	AllowNetworks      []string          `json:"allowNetworks,omitempty"`
+	AllowInterfaces    []string          `json:"allowInterfaces,omitempty"`
+	HTTPPort           int               `json:"httpPort,omitempty"`
+	HTTPSPort          int               `json:"httpsPort,omitempty"`
+	CertFile           string            `json:"certFile,omitempty"`
+	KeyFile            string            `json:"keyFile,omitempty"`
+	HTTPAddresses      []string          `json:"httpAddresses,omitempty"`
+	HTTPSAddresses     []string          `json:"httpsAddresses,omitempty"`
+	BindInterfaces     []string          `json:"bindInterfaces,omitempty"`
+	UnixSocket         string            `json:"unixSocket,omitempty"`
+	MinIPv4Prefix      int               `json:"minIPv4Prefix,omitempty"`
+	MinIPv6Prefix      int               `json:"minIPv6Prefix,omitempty"`
+	FilterRules        []string          `json:"filterRules,omitempty"`
+	TrustedProxies     []string          `json:"trustedProxies,omitempty"`
+	LocalCA            bool              `json:"localCA,omitempty"`
+	KeyType            string            `json:"keyType,omitempty"`
+	TLSMinVersion      string            `json:"tlsMinVersion,omitempty"`
+	ClientAuth         string            `json:"clientAuth,omitempty"`
+	ClientCAFile       string            `json:"clientCAFile,omitempty"`
+	ClientRoles        map[string]string `json:"clientRoles,omitempty"`
+	StatsInterval      int               `json:"statsInterval,omitempty"`
+	StatsRetention     int               `json:"statsRetention,omitempty"`
+	Currency           string            `json:"currency,omitempty"`
 }
 
 var readFile = ioutil.ReadFile
 
-// ReadConfig loads the configuration from disk
-func ReadConfig() (Config, error) {
-	configFilepath := filepath.Join(os.Getenv("SNAP_COMMON"), configFilename)
-	if _, err := os.Stat(configFilepath); err != nil {
-		return Config{}, nil
+// DefaultConfig returns the configuration used when nothing else is specified
+func DefaultConfig() Config {
+	return Config{
+		HTTPPort:  defaultHTTPPort,
+		HTTPSPort: defaultHTTPSPort,
+		CertFile:  filepath.Join(os.Getenv("SNAP_DATA"), "cert.pem"),
+		KeyFile:   filepath.Join(os.Getenv("SNAP_DATA"), "key.pem"),
+
+		MinIPv4Prefix: DefaultIPv4Prefix,
+		MinIPv6Prefix: DefaultIPv6Prefix,
+
+		KeyType:       KeyTypeECDSA,
+		TLSMinVersion: TLSVersion12,
+		ClientAuth:    ClientAuthOff,
+
+		StatsInterval:  DefaultStatsInterval,
+		StatsRetention: DefaultStatsRetention,
+	}
+}
+
+// Validate checks that the configuration values can be used as-is
+func (c Config) Validate() error {
+	for _, network := range c.AllowNetworks {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			return fmt.Errorf("Invalid network CIDR %q in allowNetworks", network)
+		}
+	}
+
+	for _, ifname := range c.AllowInterfaces {
+		if ifname == "" {
+			return errors.New("Empty interface name in allowInterfaces")
+		}
 	}
 
-	var err error
-	var content []byte
-	if content, err = readFile(configFilepath); err != nil {
-		return Config{}, nil
+	for _, rule := range c.FilterRules {
+		if _, _, err := ParseFilterRule(rule); err != nil {
+			return err
+		}
 	}
 
-	var config Config
-	err = json.Unmarshal(content, &config)
+	for _, network := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			return fmt.Errorf("Invalid network CIDR %q in trustedProxies", network)
+		}
+	}
+
+	if err := validatePort(c.HTTPPort); err != nil {
+		return fmt.Errorf("Invalid httpPort: %s", err)
+	}
+
+	if err := validatePort(c.HTTPSPort); err != nil {
+		return fmt.Errorf("Invalid httpsPort: %s", err)
+	}
+
+	if c.HTTPPort == c.HTTPSPort {
+		return fmt.Errorf("httpPort and httpsPort must differ, both are %d", c.HTTPPort)
+	}
+
+	if !filepath.IsAbs(c.CertFile) {
+		return fmt.Errorf("certFile must be an absolute path, got %q", c.CertFile)
+	}
+
+	if !filepath.IsAbs(c.KeyFile) {
+		return fmt.Errorf("keyFile must be an absolute path, got %q", c.KeyFile)
+	}
+
+	for _, addresses := range [][]string{c.HTTPAddresses, c.HTTPSAddresses} {
+		for _, addr := range addresses {
+			if _, _, err := splitListenAddress(addr); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, ifname := range c.BindInterfaces {
+		if ifname == "" {
+			return errors.New("Empty interface name in bindInterfaces")
+		}
+	}
+
+	if c.UnixSocket != "" && !filepath.IsAbs(c.UnixSocket) {
+		return fmt.Errorf("unixSocket must be an absolute path, got %q", c.UnixSocket)
+	}
+
+	if err := validateKeyType(c.KeyType); err != nil {
+		return fmt.Errorf("Invalid keyType: %s", err)
+	}
+
+	if err := validateTLSVersion(c.TLSMinVersion); err != nil {
+		return fmt.Errorf("Invalid tlsMinVersion: %s", err)
+	}
+
+	if err := validateClientAuth(c.ClientAuth); err != nil {
+		return fmt.Errorf("Invalid clientAuth: %s", err)
+	}
+
+	if c.ClientAuth != ClientAuthOff && c.ClientCAFile == "" {
+		return fmt.Errorf("clientCAFile is needed with clientAuth %s", c.ClientAuth)
+	}
+
+	if c.ClientCAFile != "" && !filepath.IsAbs(c.ClientCAFile) {
+		return fmt.Errorf("clientCAFile must be an absolute path, got %q", c.ClientCAFile)
+	}
+
+	for subject, role := range c.ClientRoles {
+		if subject == "" || role == "" {
+			return fmt.Errorf("Invalid clientRoles entry %q: %q", subject, role)
+		}
+	}
+
+	if err := validatePrefix(c.MinIPv4Prefix, 32); err != nil {
+		return fmt.Errorf("Invalid minIPv4Prefix: %s", err)
+	}
+
+	if err := validatePrefix(c.MinIPv6Prefix, 128); err != nil {
+		return fmt.Errorf("Invalid minIPv6Prefix: %s", err)
+	}
+
+	interval, retention := c.StatsSampling()
+	if c.StatsInterval < 0 || interval > time.Hour {
+		return fmt.Errorf("Invalid statsInterval %d: not between 1 and 3600 seconds", c.StatsInterval)
+	}
+	if c.StatsRetention < 0 || retention < interval {
+		return fmt.Errorf("Invalid statsRetention %d: shorter than statsInterval", c.StatsRetention)
+	}
+	if retention/interval > maxStatsSamples {
+		return fmt.Errorf("Invalid statsRetention %d: more than %d samples", c.StatsRetention, maxStatsSamples)
+	}
+
+	if c.Currency != "" {
+		if err := validateCurrency(c.Currency); err != nil {
+			return fmt.Errorf("Invalid currency: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// StatsSampling returns how often the system statistics are sampled and
+// how long they are kept, zero values meaning DefaultStatsInterval and
+// DefaultStatsRetention
+func (c Config) StatsSampling() (interval time.Duration, retention time.Duration) {
+	interval = time.Duration(c.StatsInterval) * time.Second
+	if c.StatsInterval == 0 {
+		interval = DefaultStatsInterval * time.Second
+	}
+
+	retention = time.Duration(c.StatsRetention) * time.Second
+	if c.StatsRetention == 0 {
+		retention = DefaultStatsRetention * time.Second
+	}
+
+	return interval, retention
+}
+
+// PrefixPolicy returns the smallest prefix lengths of the local networks to
+// allow, zero meaning DefaultIPv4Prefix and DefaultIPv6Prefix
+func (c Config) PrefixPolicy() PrefixPolicy {
+	return PrefixPolicy{IPv4: c.MinIPv4Prefix, IPv6: c.MinIPv6Prefix}
+}
+
+func validatePrefix(prefix int, bits int) error {
+	if prefix < 0 || prefix > bits {
+		return fmt.Errorf("%d is not a prefix length between 0 and %d", prefix, bits)
+	}
+	return nil
+}
+
+func validateKeyType(keyType string) error {
+	switch keyType {
+	case KeyTypeRSA, KeyTypeECDSA, KeyTypeEd25519:
+		return nil
+	}
+	return fmt.Errorf("%q is not one of %s, %s or %s", keyType, KeyTypeRSA, KeyTypeECDSA, KeyTypeEd25519)
+}
+
+func validateTLSVersion(version string) error {
+	switch version {
+	case TLSVersion12, TLSVersion13:
+		return nil
+	}
+	return fmt.Errorf("%q is not one of %s or %s", version, TLSVersion12, TLSVersion13)
+}
+
+func validateClientAuth(mode string) error {
+	switch mode {
+	case ClientAuthOff, ClientAuthOptional, ClientAuthRequired:
+		return nil
+	}
+	return fmt.Errorf("%q is not one of %s, %s or %s", mode, ClientAuthOff, ClientAuthOptional, ClientAuthRequired)
+}
+
+func validateCurrency(currency string) error {
+	if !currencyPattern.MatchString(currency) {
+		return fmt.Errorf("%q is not a currency code such as USD or EUR", currency)
+	}
+	return nil
+}
+
+func validatePort(port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("%d is not a port number between 1 and 65535", port)
+	}
+	return nil
+}
+
+func configPath() string {
+	return filepath.Join(os.Getenv("SNAP_COMMON"), configFilename)
+}
+
+// readConfigFile applies the settings found in the configuration file on top
+// of the given configuration
+func readConfigFile(config *Config) error {
+	configFilepath := configPath()
+	if _, err := os.Stat(configFilepath); err != nil {
+		return nil
+	}
+
+	content, err := readFile(configFilepath)
 	if err != nil {
-		return Config{}, fmt.Errorf("Invalid configuration file %s: %s",
+		return fmt.Errorf("Cannot read configuration file %s: %s",
 			configFilepath,
 			err.Error())
 	}
 
+	if err = json.Unmarshal(content, config); err != nil {
+		return fmt.Errorf("Invalid configuration file %s: %s",
+			configFilepath,
+			err.Error())
+	}
+
+	return nil
+}
+
+// ReadConfig loads the effective configuration, merging in order: the
+// defaults, the values set with "snap set", the configuration file and the
+// environment overrides
+func ReadConfig() (Config, error) {
+	snapctlValues, err := readSnapctlConfig()
+	if err != nil {
+		return Config{}, err
+	}
+
+	return mergeConfig(snapctlValues)
+}
+
+func mergeConfig(snapctlValues map[string]string) (Config, error) {
+	config := DefaultConfig()
+
+	if err := applyOptions(&config, snapctlValues, "snap set"); err != nil {
+		return Config{}, err
+	}
+
+	if err := readConfigFile(&config); err != nil {
+		return Config{}, err
+	}
+
+	if err := applyEnvironment(&config); err != nil {
+		return Config{}, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return Config{}, fmt.Errorf("Invalid configuration: %s", err)
+	}
+
 	return config, nil
 }
@@ -23,6 +23,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
 	. "gopkg.in/check.v1"
 )
@@ -51,7 +52,7 @@ func (s *ConfigurationSuite) SetUpTest(c *C) {
 
 func (s *ConfigurationSuite) TestNonExistentConfigurationFile(c *C) {
 	config, _ := ReadConfig()
-	c.Check(config, DeepEquals, Config{DisableAccessToken: false, DisableHTTPS: false})
+	c.Check(config, DeepEquals, DefaultConfig())
 }
 
 func (s *ConfigurationSuite) TestExistingInvalidSetupFile(c *C) {
@@ -64,7 +65,10 @@ func (s *ConfigurationSuite) TestExistingValidSetupFile(c *C) {
 	conf := Config{DisableAccessToken: true, DisableHTTPS: true}
 	setupConfig(c, s.snapCommonEnv, conf)
 	config, _ := ReadConfig()
-	c.Check(config, DeepEquals, Config{DisableAccessToken: true, DisableHTTPS: true})
+	expected := DefaultConfig()
+	expected.DisableAccessToken = true
+	expected.DisableHTTPS = true
+	c.Check(config, DeepEquals, expected)
 }
 
 func (s *ConfigurationSuite) TestErrorWhileReadingFile(c *C) {
@@ -77,3 +81,68 @@ func (s *ConfigurationSuite) TestErrorWhileReadingFile(c *C) {
 	c.Check(config, DeepEquals, Config{})
 	readFile = ioutil.ReadFile
 }
+
+func (s *ConfigurationSuite) TestInvalidNetworkInSetupFile(c *C) {
+	setupConfig(c, s.snapCommonEnv, Config{AllowNetworks: []string{"192.168.0.0/24", "not-a-network"}})
+	config, err := ReadConfig()
+	c.Check(err, ErrorMatches, `Invalid configuration: Invalid network CIDR "not-a-network" in allowNetworks`)
+	c.Check(config, DeepEquals, Config{})
+}
+
+func (s *ConfigurationSuite) TestValidate(c *C) {
+	config := DefaultConfig()
+	c.Check(config.Validate(), IsNil)
+
+	config.AllowNetworks = []string{"10.0.0.0/8", "fd12:3456:789a:1::/64"}
+	c.Check(config.Validate(), IsNil)
+
+	config = DefaultConfig()
+	config.AllowNetworks = []string{"10.0.0.0"}
+	c.Check(config.Validate(), ErrorMatches, `Invalid network CIDR "10.0.0.0" in allowNetworks`)
+
+	config = DefaultConfig()
+	config.AllowInterfaces = []string{"eth0", ""}
+	c.Check(config.Validate(), ErrorMatches, "Empty interface name in allowInterfaces")
+
+	config = DefaultConfig()
+	config.HTTPPort = 0
+	c.Check(config.Validate(), ErrorMatches, "Invalid httpPort: 0 is not a port number between 1 and 65535")
+
+	config = DefaultConfig()
+	config.HTTPSPort = config.HTTPPort
+	c.Check(config.Validate(), ErrorMatches, "httpPort and httpsPort must differ, both are .*")
+
+	config = DefaultConfig()
+	config.CertFile = "cert.pem"
+	c.Check(config.Validate(), ErrorMatches, `certFile must be an absolute path, got "cert.pem"`)
+
+	config = DefaultConfig()
+	config.MinIPv4Prefix = 33
+	c.Check(config.Validate(), ErrorMatches, "Invalid minIPv4Prefix: 33 is not a prefix length between 0 and 32")
+
+	config = DefaultConfig()
+	config.MinIPv6Prefix = -1
+	c.Check(config.Validate(), ErrorMatches, "Invalid minIPv6Prefix: -1 is not a prefix length between 0 and 128")
+
+	config = DefaultConfig()
+	config.StatsInterval = 1
+	config.StatsRetention = 7 * 24 * 3600
+	c.Check(config.Validate(), ErrorMatches, "Invalid statsRetention 604800: more than 100000 samples")
+
+	config = DefaultConfig()
+	config.Currency = "GBP"
+	c.Check(config.Validate(), IsNil)
+
+	config.Currency = "Euro"
+	c.Check(config.Validate(), ErrorMatches, `Invalid currency: "Euro" is not a currency code such as USD or EUR`)
+}
+
+func (s *ConfigurationSuite) TestStatsSampling(c *C) {
+	interval, retention := Config{}.StatsSampling()
+	c.Check(interval, Equals, DefaultStatsInterval*time.Second)
+	c.Check(retention, Equals, DefaultStatsRetention*time.Second)
+
+	interval, retention = Config{StatsInterval: 5, StatsRetention: 60}.StatsSampling()
+	c.Check(interval, Equals, 5*time.Second)
+	c.Check(retention, Equals, time.Minute)
+}
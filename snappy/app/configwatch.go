@@ -0,0 +1,161 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snappy
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// how often the configuration files are checked for modifications
+var configPollInterval = 5 * time.Second
+
+// ConfigWatcher holds the effective runtime configuration and reloads it
+// when the configuration files change or when SIGHUP is received
+type ConfigWatcher struct {
+	sync.RWMutex
+	config    Config
+	modTime   string
+	listeners []func(Config)
+}
+
+// NewConfigWatcher creates a new ConfigWatcher starting with the given configuration
+func NewConfigWatcher(config Config) *ConfigWatcher {
+	return &ConfigWatcher{
+		config:  config,
+		modTime: configModTime(),
+	}
+}
+
+// Config returns the configuration currently in effect
+func (w *ConfigWatcher) Config() Config {
+	w.RLock()
+	defer w.RUnlock()
+
+	return w.config
+}
+
+// OnChange registers a function to be called with the new configuration
+// every time it is successfully reloaded
+func (w *ConfigWatcher) OnChange(f func(Config)) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.listeners = append(w.listeners, f)
+}
+
+// Reload reads and validates the configuration from disk, and makes it the
+// effective one. If the configuration is invalid, the previous one is kept.
+func (w *ConfigWatcher) Reload() error {
+	config, err := ReadConfig()
+	if err != nil {
+		return err
+	}
+
+	w.Lock()
+	w.config = config
+	w.Unlock()
+
+	w.notify(config)
+
+	return nil
+}
+
+// Refresh calls the listeners again with the current configuration, so that
+// they pick up changes made outside of it, like new network addresses
+func (w *ConfigWatcher) Refresh() {
+	w.notify(w.Config())
+}
+
+func (w *ConfigWatcher) notify(config Config) {
+	w.RLock()
+	listeners := make([]func(Config), len(w.listeners))
+	copy(listeners, w.listeners)
+	w.RUnlock()
+
+	for _, f := range listeners {
+		f(config)
+	}
+}
+
+// reloadIfModified reloads the configuration if the files changed since the
+// last time they were looked at
+func (w *ConfigWatcher) reloadIfModified() (bool, error) {
+	modTime := configModTime()
+
+	w.Lock()
+	modified := modTime != w.modTime
+	w.modTime = modTime
+	w.Unlock()
+
+	if !modified {
+		return false, nil
+	}
+
+	return true, w.Reload()
+}
+
+// Watch monitors the configuration file and the SIGHUP signal in the
+// background, reloading the configuration when needed
+func (w *ConfigWatcher) Watch() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	go func() {
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+
+		for {
+			var err error
+
+			select {
+			case <-sighup:
+				log.Println("SIGHUP received, reloading configuration")
+				err = w.Reload()
+			case <-ticker.C:
+				var reloaded bool
+				if reloaded, err = w.reloadIfModified(); reloaded && err == nil {
+					log.Println("Configuration file changed, configuration reloaded")
+				}
+			}
+
+			if err != nil {
+				log.Println("Keeping the previous configuration:", err)
+			}
+		}
+	}()
+}
+
+// configModTime summarizes the modification times of the configuration files
+func configModTime() string {
+	var stamps []string
+	for _, path := range []string{snapctlConfigPath(), configPath()} {
+		var stamp int64
+		if fi, err := os.Stat(path); err == nil {
+			stamp = fi.ModTime().UnixNano()
+		}
+		stamps = append(stamps, strconv.FormatInt(stamp, 10))
+	}
+	return strings.Join(stamps, ":")
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snappy
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type ConfigWatcherSuite struct {
+	snapCommonEnv string
+}
+
+var _ = Suite(&ConfigWatcherSuite{})
+
+func (s *ConfigWatcherSuite) SetUpTest(c *C) {
+	s.snapCommonEnv = c.MkDir()
+	os.Setenv("SNAP_COMMON", s.snapCommonEnv)
+}
+
+func (s *ConfigWatcherSuite) TestReload(c *C) {
+	w := NewConfigWatcher(Config{})
+
+	var notified []Config
+	w.OnChange(func(config Config) {
+		notified = append(notified, config)
+	})
+
+	setupConfig(c, s.snapCommonEnv, Config{DisableAccessToken: true})
+	c.Assert(w.Reload(), IsNil)
+
+	expected := DefaultConfig()
+	expected.DisableAccessToken = true
+	c.Check(w.Config(), DeepEquals, expected)
+	c.Check(notified, DeepEquals, []Config{expected})
+}
+
+func (s *ConfigWatcherSuite) TestReloadInvalidKeepsPrevious(c *C) {
+	previous := Config{AllowNetworks: []string{"192.168.0.0/24"}}
+	w := NewConfigWatcher(previous)
+
+	notified := false
+	w.OnChange(func(config Config) {
+		notified = true
+	})
+
+	setupConfigWithContent(c, s.snapCommonEnv, []byte("Invalid json"))
+	c.Check(w.Reload(), NotNil)
+	c.Check(w.Config(), DeepEquals, previous)
+
+	setupConfig(c, s.snapCommonEnv, Config{AllowNetworks: []string{"192.168.0.300/24"}})
+	c.Check(w.Reload(), NotNil)
+	c.Check(w.Config(), DeepEquals, previous)
+
+	c.Check(notified, Equals, false)
+}
+
+func (s *ConfigWatcherSuite) TestReloadIfModified(c *C) {
+	w := NewConfigWatcher(Config{})
+
+	reloaded, err := w.reloadIfModified()
+	c.Assert(err, IsNil)
+	c.Check(reloaded, Equals, false)
+
+	setupConfig(c, s.snapCommonEnv, Config{DisableHTTPS: true})
+	reloaded, err = w.reloadIfModified()
+	c.Assert(err, IsNil)
+	c.Check(reloaded, Equals, true)
+	c.Check(w.Config().DisableHTTPS, Equals, true)
+
+	reloaded, err = w.reloadIfModified()
+	c.Assert(err, IsNil)
+	c.Check(reloaded, Equals, false)
+
+	// make sure the modification time differs from the previous write
+	setupConfig(c, s.snapCommonEnv, Config{DisableIPFilter: true})
+	later := time.Now().Add(time.Minute)
+	c.Assert(os.Chtimes(filepath.Join(s.snapCommonEnv, configFilename), later, later), IsNil)
+	reloaded, err = w.reloadIfModified()
+	c.Assert(err, IsNil)
+	c.Check(reloaded, Equals, true)
+	c.Check(w.Config().DisableHTTPS, Equals, false)
+	c.Check(w.Config().DisableIPFilter, Equals, true)
+}
+
+func (s *ConfigWatcherSuite) TestRefresh(c *C) {
+	current := Config{AllowNetworks: []string{"192.168.0.0/24"}}
+	w := NewConfigWatcher(current)
+
+	var notified []Config
+	w.OnChange(func(config Config) {
+		notified = append(notified, config)
+	})
+
+	w.Refresh()
+	c.Check(notified, DeepEquals, []Config{current})
+}
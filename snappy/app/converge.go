@@ -18,12 +18,10 @@
 package snappy
 
 import (
-	"errors"
-	"fmt"
+	"net/http"
 	"net/url"
 	"regexp"
-	"sort"
-	"strconv"
+	"sync"
 	"time"
 
 	"log"
@@ -39,6 +37,9 @@ const (
 	availableSnaps
 )
 
+// payloadWorkers is the number of snaps whose payload is built at once
+var payloadWorkers = 8
+
 // SnapState wraps the current state of a snap
 type SnapState struct {
 	Status      string `json:"status"`
@@ -47,22 +48,24 @@ type SnapState struct {
 }
 
 type snapPkg struct {
-	ID            string    `json:"id"`
-	Name          string    `json:"name"`
-	Developer     string    `json:"developer"`
-	Version       string    `json:"version"`
-	Description   string    `json:"description"`
-	Icon          string    `json:"icon"`
-	State         SnapState `json:"state"`
-	Price         string    `json:"price,omitempty"`
-	Message       string    `json:"message,omitempty"`
-	Progress      float64   `json:"progress,omitempty"`
-	InstalledSize int64     `json:"installed_size,omitempty"`
-	DownloadSize  int64     `json:"download_size,omitempty"`
-	Type          snap.Type `json:"type,omitempty"`
-	Private       bool      `json:"private"`
-	Channel       string    `json:"channel"`
-	InstallDate   string    `json:"install_date"`
+	ID            string     `json:"id"`
+	Name          string     `json:"name"`
+	Developer     string     `json:"developer"`
+	Version       string     `json:"version"`
+	Description   string     `json:"description"`
+	Icon          string     `json:"icon"`
+	State         SnapState  `json:"state"`
+	Price         string     `json:"price,omitempty"`
+	Prices        snapPrices `json:"prices,omitempty"`
+	Currency      string     `json:"currency,omitempty"`
+	Message       string     `json:"message,omitempty"`
+	Progress      float64    `json:"progress,omitempty"`
+	InstalledSize int64      `json:"installed_size,omitempty"`
+	DownloadSize  int64      `json:"download_size,omitempty"`
+	Type          snap.Type  `json:"type,omitempty"`
+	Private       bool       `json:"private"`
+	Channel       string     `json:"channel"`
+	InstallDate   string     `json:"install_date"`
 }
 
 type response struct {
@@ -83,22 +86,13 @@ func (h *Handler) getSnap(name string) (*client.Snap, error) {
 	}
 
 	if snap == nil {
-		return nil, errors.New("snap could not be retrieved")
+		return nil, statusErrorf(http.StatusNotFound, "Snap %s could not be retrieved", name)
 	}
 
 	return snap, nil
 }
 
-func (h *Handler) packagePayload(name string) (snapPkg, error) {
-	snap, err := h.getSnap(name)
-	if err != nil {
-		return snapPkg{}, err
-	}
-
-	return h.snapToPayload(snap), nil
-}
-
-func (h *Handler) allPackages(snapCondition int, query string, private bool, section string) ([]snapPkg, error) {
+func (h *Handler) findSnaps(snapCondition int, query string, private bool, section string) ([]*client.Snap, error) {
 	var snaps []*client.Snap
 	var err error
 
@@ -117,14 +111,39 @@ func (h *Handler) allPackages(snapCondition int, query string, private bool, sec
 		return nil, err
 	}
 
-	snapPkgs := make([]snapPkg, 0, len(snaps))
-	for _, snap := range snaps {
-		snapPkgs = append(
-			snapPkgs,
-			h.snapToPayload(snap))
+	return snaps, nil
+}
+
+// snapsToPayloads converts the snaps, resolving their icons only if asked
+// to as this can take a round-trip to snapd for each installed snap. The
+// payloads are built concurrently by up to payloadWorkers goroutines.
+func (h *Handler) snapsToPayloads(snaps []*client.Snap, withIcons bool) []snapPkg {
+	snapPkgs := make([]snapPkg, len(snaps))
+
+	workers := payloadWorkers
+	if workers > len(snaps) {
+		workers = len(snaps)
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				snapPkgs[i] = h.snapToPayloadWithIcon(snaps[i], withIcons)
+			}
+		}()
 	}
 
-	return snapPkgs, nil
+	for i := range snaps {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return snapPkgs
 }
 
 func (h *Handler) removePackage(name string) error {
@@ -148,6 +167,10 @@ func (h *Handler) installPackage(name string) error {
 		return err
 	}
 
+	if !isOwned(snap) {
+		return statusErrorf(http.StatusPaymentRequired, "Snap %s must be bought first", name)
+	}
+
 	var changeID string
 
 	changeID, err = h.snapdClient.Install(name, nil)
@@ -163,12 +186,12 @@ func (h *Handler) abortRunningOperation(name string) error {
 		return err
 	}
 	if snap == nil {
-		return errors.New("Invalid snap name")
+		return statusErrorf(http.StatusNotFound, "Invalid snap name")
 	}
 
 	tracked, changeID := h.stateTracker.IsTrackedForRunningOperation(snap)
 	if !tracked {
-		return fmt.Errorf("No operation to abort for snap %s", name)
+		return statusErrorf(http.StatusConflict, "No operation to abort for snap %s", name)
 	}
 
 	_, err = h.snapdClient.Abort(changeID)
@@ -185,11 +208,11 @@ func (h *Handler) enable(name string) error {
 		return err
 	}
 	if snap == nil {
-		return fmt.Errorf("Snap not found %s", name)
+		return statusErrorf(http.StatusNotFound, "Snap not found %s", name)
 	}
 
 	if snap.Status != statetracker.StatusInstalled {
-		return errors.New("Snap not installed and disabled")
+		return statusErrorf(http.StatusConflict, "Snap not installed and disabled")
 	}
 
 	var changeID string
@@ -208,11 +231,11 @@ func (h *Handler) disable(name string) error {
 		return err
 	}
 	if snap == nil {
-		return fmt.Errorf("Snap not found %s", name)
+		return statusErrorf(http.StatusNotFound, "Snap not found %s", name)
 	}
 
 	if snap.Status != statetracker.StatusActive {
-		return errors.New("Snap not installed and enabled")
+		return statusErrorf(http.StatusConflict, "Snap not installed and enabled")
 	}
 
 	var changeID string
@@ -235,23 +258,6 @@ func formatInstallData(d time.Time) string {
 	return d.Format(time.UnixDate)
 }
 
-type snapPrices map[string]float64
-
-func priceStringFromSnapPrice(p snapPrices) string {
-	// picks up the "first" listed price for now
-	var currencies []string
-	for k := range p {
-		currencies = append(currencies, k)
-	}
-	if len(currencies) == 0 {
-		return ""
-	}
-	// TODO: "USD" might prevail? not sure
-	sort.Strings(currencies)
-	currency := currencies[0]
-	return fmt.Sprintf("%s %s", strconv.FormatFloat(p[currency], 'f', -1, 32), currency)
-}
-
 func stateFromTrackerState(ts *statetracker.SnapState) SnapState {
 	return SnapState{
 		Status:      ts.Status,
@@ -261,7 +267,10 @@ func stateFromTrackerState(ts *statetracker.SnapState) SnapState {
 }
 
 func (h *Handler) snapToPayload(snapQ *client.Snap) snapPkg {
+	return h.snapToPayloadWithIcon(snapQ, true)
+}
 
+func (h *Handler) snapToPayloadWithIcon(snapQ *client.Snap, withIcon bool) snapPkg {
 	snap := snapPkg{
 		ID:          snapQ.Name,
 		Name:        snapQ.Name,
@@ -270,17 +279,28 @@ func (h *Handler) snapToPayload(snapQ *client.Snap) snapPkg {
 		Description: snapQ.Description,
 		Type:        snap.Type(snapQ.Type),
 		State:       stateFromTrackerState(h.stateTracker.State(h.snapdClient, snapQ)),
-		Price:       priceStringFromSnapPrice(snapQ.Prices),
+		Prices:      snapQ.Prices,
 		Private:     snapQ.Private,
 		Channel:     snapQ.Channel,
 		InstallDate: formatInstallData(snapQ.InstallDate),
 	}
 
-	isInstalled := snapQ.Status == client.StatusInstalled ||
-		snapQ.Status == client.StatusActive
+	snap.selectCurrency([]string{defaultCurrency})
+
+	isInstalled := isInstalledSnap(snapQ)
 
 	if isInstalled {
-		iconPath, err := localIconPath(h.snapdClient, snap.Name)
+		snap.InstalledSize = snapQ.InstalledSize
+	} else {
+		snap.DownloadSize = snapQ.DownloadSize
+	}
+
+	if !withIcon {
+		return snap
+	}
+
+	if isInstalled {
+		iconPath, err := h.icons.path(h.snapdClient, snap.Name, snapQ.Revision)
 		if err != nil {
 			if err == ErrIconNotExist {
 				// We have an installed snap, but no icon found,
@@ -299,7 +319,6 @@ func (h *Handler) snapToPayload(snapQ *client.Snap) snapPkg {
 		}
 
 		snap.Icon = iconPath
-		snap.InstalledSize = snapQ.InstalledSize
 	} else {
 		// quick fix for the icon problem (LP:#1668193)
 		r := regexp.MustCompile("^/v2/icons/(.*)")
@@ -313,7 +332,6 @@ func (h *Handler) snapToPayload(snapQ *client.Snap) snapPkg {
 		} else {
 			snap.Icon = snapQ.Icon
 		}
-		snap.DownloadSize = snapQ.DownloadSize
 	}
 
 	return snap
@@ -19,6 +19,8 @@ package snappy
 
 import (
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"testing"
 	"time"
@@ -108,16 +110,16 @@ func (s *PackagePayloadSuite) SetUpTest(c *C) {
 func (s *PackagePayloadSuite) TestPackageNotFound(c *C) {
 	s.c.Err = errors.New("the snap could not be retrieved")
 
-	_, err := s.h.packagePayload("chatroom")
+	_, err := s.h.packageDetail("chatroom")
 	c.Assert(err, NotNil)
 }
 
 func (s *PackagePayloadSuite) TestPackage(c *C) {
 	s.c.Snaps = []*client.Snap{common.NewDefaultSnap()}
 
-	pkg, err := s.h.packagePayload("chatroom")
+	pkg, err := s.h.packageDetail("chatroom")
 	c.Assert(err, IsNil)
-	c.Assert(pkg, DeepEquals, snapPkg{
+	c.Assert(pkg.snapPkg, DeepEquals, snapPkg{
 		ID:            "chatroom",
 		Description:   "WebRTC Video chat server for Snappy",
 		DownloadSize:  0,
@@ -133,6 +135,192 @@ func (s *PackagePayloadSuite) TestPackage(c *C) {
 	})
 }
 
+type DetailSuite struct {
+	h Handler
+	c *snapdclient.FakeSnapdClient
+
+	previousTimeNow func() time.Time
+}
+
+var _ = Suite(&DetailSuite{})
+
+func (s *DetailSuite) SetUpTest(c *C) {
+	os.Setenv("SNAP_DATA", c.MkDir())
+	s.c = &snapdclient.FakeSnapdClient{}
+	s.h = Handler{stateTracker: statetracker.New()}
+	s.h.setClient(s.c)
+
+	s.previousTimeNow = timeNow
+	timeNow = func() time.Time {
+		return time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)
+	}
+}
+
+func (s *DetailSuite) TearDownTest(c *C) {
+	timeNow = s.previousTimeNow
+}
+
+func storeDetailSnap() *client.Snap {
+	fakeSnap := common.NewDefaultSnap()
+	fakeSnap.Status = client.StatusAvailable
+	fakeSnap.Summary = "Video chat"
+	fakeSnap.Confinement = "strict"
+	fakeSnap.Revision = snap.R(12)
+	fakeSnap.Screenshots = []client.Screenshot{{URL: "https://example.com/1.png"}}
+	fakeSnap.Tracks = []string{"latest", "2.0"}
+	released := time.Date(2017, 7, 1, 0, 0, 0, 0, time.UTC)
+	fakeSnap.Channels = map[string]*client.ChannelSnapInfo{
+		"2.0/stable":    {Revision: snap.R(14), Version: "2.0", Confinement: "strict", Size: 7000000, ReleasedAt: released},
+		"latest/edge":   {Revision: snap.R(13), Version: "0.1-9", Confinement: "devmode", Size: 6930950, ReleasedAt: released},
+		"latest/stable": {Revision: snap.R(12), Version: "0.1-8", Confinement: "strict", Size: 6930947, ReleasedAt: released},
+	}
+	return fakeSnap
+}
+
+func storeDetails() *snapdclient.SnapDetails {
+	return &snapdclient.SnapDetails{
+		Title:   "Chat Room",
+		License: "GPL-3.0",
+		Contact: "mailto:ogra@example.com",
+		Website: "https://example.com/chatroom",
+		Base:    "core18",
+		Publisher: &snapdclient.Publisher{
+			ID:          "ogra-id",
+			Username:    "ogra",
+			DisplayName: "Oliver Grawert",
+			Validation:  "verified",
+		},
+		Media: []snapdclient.Media{
+			{Type: "icon", URL: "https://example.com/icon.png"},
+			{Type: "screenshot", URL: "https://example.com/1.png", Width: 640, Height: 480},
+		},
+	}
+}
+
+func (s *DetailSuite) TestStoreSnap(c *C) {
+	s.c.Err = errors.New("not installed")
+	s.c.StoreSnaps = []*client.Snap{storeDetailSnap()}
+	s.c.StoreDetails = map[string]*snapdclient.SnapDetails{"chatroom": storeDetails()}
+
+	detail, err := s.h.packageDetail("chatroom")
+	c.Assert(err, IsNil)
+
+	c.Check(detail.Name, Equals, "chatroom")
+	c.Check(detail.DownloadSize, Equals, int64(6930947))
+	c.Check(detail.Title, Equals, "Chat Room")
+	c.Check(detail.Summary, Equals, "Video chat")
+	c.Check(detail.License, Equals, "GPL-3.0")
+	c.Check(detail.Contact, Equals, "mailto:ogra@example.com")
+	c.Check(detail.Website, Equals, "https://example.com/chatroom")
+	c.Check(detail.Confinement, Equals, "strict")
+	c.Check(detail.Base, Equals, "core18")
+	c.Check(detail.Revision, Equals, "12")
+	c.Check(detail.TrackingChannel, Equals, "")
+	c.Check(detail.Publisher, DeepEquals, &snapPublisher{
+		ID:          "ogra-id",
+		Username:    "ogra",
+		DisplayName: "Oliver Grawert",
+		Validation:  "verified",
+	})
+	c.Check(detail.Media, DeepEquals, []snapMedia{
+		{Type: "icon", URL: "https://example.com/icon.png"},
+		{Type: "screenshot", URL: "https://example.com/1.png", Width: 640, Height: 480},
+	})
+
+	var names []string
+	for _, channel := range detail.Channels {
+		names = append(names, channel.Name)
+	}
+	c.Check(names, DeepEquals, []string{"latest/stable", "latest/edge", "2.0/stable"})
+	c.Check(detail.Channels[0], DeepEquals, snapChannel{
+		Name:        "latest/stable",
+		Version:     "0.1-8",
+		Revision:    "12",
+		Confinement: "strict",
+		Size:        6930947,
+		ReleasedAt:  time.Date(2017, 7, 1, 0, 0, 0, 0, time.UTC),
+	})
+
+	c.Check(detail.Apps, HasLen, 0)
+	c.Check(detail.DevMode, Equals, false)
+	c.Check(detail.HeldTill, IsNil)
+}
+
+func (s *DetailSuite) TestStoreSnapScreenshots(c *C) {
+	// as given by older snapd, without the details
+	s.c.Err = errors.New("not installed")
+	s.c.StoreSnaps = []*client.Snap{storeDetailSnap()}
+
+	detail, err := s.h.packageDetail("chatroom")
+	c.Assert(err, IsNil)
+
+	c.Check(detail.Publisher, IsNil)
+	c.Check(detail.License, Equals, "")
+	c.Check(detail.Media, DeepEquals, []snapMedia{{Type: "screenshot", URL: "https://example.com/1.png"}})
+}
+
+func (s *DetailSuite) TestInstalledSnap(c *C) {
+	hold := time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC)
+
+	installed := common.NewDefaultSnap()
+	installed.Revision = snap.R(12)
+	installed.Channel = "stable"
+	installed.Confinement = "devmode"
+	installed.DevMode = true
+	installed.Apps = []client.AppInfo{
+		{Snap: "chatroom", Name: "chatroom"},
+		{Snap: "chatroom", Name: "server", Daemon: "simple", Enabled: true, Active: true},
+	}
+	s.c.Snaps = []*client.Snap{installed}
+	s.c.StoreSnaps = []*client.Snap{storeDetailSnap()}
+	s.c.Details = map[string]*snapdclient.SnapDetails{"chatroom": {
+		TrackingChannel: "latest/stable",
+		Hold:            &hold,
+		Media:           []snapdclient.Media{{Type: "icon", URL: "https://example.com/icon.png"}},
+	}}
+	s.c.StoreDetails = map[string]*snapdclient.SnapDetails{"chatroom": storeDetails()}
+
+	detail, err := s.h.packageDetail("chatroom")
+	c.Assert(err, IsNil)
+
+	c.Check(detail.InstalledSize, Equals, int64(18976651))
+	c.Check(detail.Confinement, Equals, "devmode")
+	c.Check(detail.TrackingChannel, Equals, "latest/stable")
+	c.Check(detail.Apps, DeepEquals, []snapApp{
+		{Name: "chatroom"},
+		{Name: "server", Daemon: "simple", Enabled: true, Active: true},
+	})
+	c.Check(detail.DevMode, Equals, true)
+	c.Check(detail.JailMode, Equals, false)
+	c.Check(detail.HeldTill, DeepEquals, &hold)
+	c.Check(detail.Media, DeepEquals, []snapMedia{{Type: "icon", URL: "https://example.com/icon.png"}})
+
+	// completed by the store
+	c.Check(s.c.Name, Equals, "chatroom")
+	c.Check(detail.Publisher.Validation, Equals, "verified")
+	c.Check(detail.License, Equals, "GPL-3.0")
+	c.Check(detail.Channels, HasLen, 3)
+}
+
+func (s *DetailSuite) TestInstalledSnapStoreUnreachable(c *C) {
+	installed := common.NewDefaultSnap()
+	installed.Channel = "stable"
+	s.c.Snaps = []*client.Snap{installed}
+	past := time.Date(2017, 7, 1, 0, 0, 0, 0, time.UTC)
+	s.c.Details = map[string]*snapdclient.SnapDetails{"chatroom": {Hold: &past}}
+	s.c.StoreErr = errors.New("offline")
+
+	detail, err := s.h.packageDetail("chatroom")
+	c.Assert(err, IsNil)
+
+	c.Check(detail.Name, Equals, "chatroom")
+	c.Check(detail.TrackingChannel, Equals, "stable")
+	c.Check(detail.Publisher, IsNil)
+	c.Check(detail.Media, HasLen, 0)
+	c.Check(detail.Channels, HasLen, 0)
+	c.Check(detail.HeldTill, IsNil)
+}
+
 type PayloadSuite struct {
 	h Handler
 }
@@ -141,7 +329,7 @@ var _ = Suite(&PayloadSuite{})
 
 func (s *PayloadSuite) SetUpTest(c *C) {
 	os.Setenv("SNAP_DATA", c.MkDir())
-	s.h.stateTracker = statetracker.New()
+	s.h = Handler{stateTracker: statetracker.New()}
 	s.h.setClient(&snapdclient.FakeSnapdClient{})
 }
 
@@ -247,6 +435,31 @@ func (s *PayloadSuite) TestPayloadInstalledSnapBeingRemoved(c *C) {
 	c.Check(q.Icon, Equals, "myicon")
 }
 
+func (s *PayloadSuite) TestPayloadsKeepOrder(c *C) {
+	previousPayloadWorkers := payloadWorkers
+	defer func() {
+		payloadWorkers = previousPayloadWorkers
+	}()
+
+	var snaps []*client.Snap
+	for i := 0; i < 50; i++ {
+		snaps = append(snaps, common.NewSnap(fmt.Sprintf("snap%d", i)))
+	}
+
+	for _, workers := range []int{1, 3, 8, 100} {
+		payloadWorkers = workers
+
+		payloads := s.h.snapsToPayloads(snaps, true)
+		c.Assert(payloads, HasLen, len(snaps))
+		for i, payload := range payloads {
+			c.Check(payload.Name, Equals, snaps[i].Name)
+			c.Check(payload.Icon, Equals, fmt.Sprintf("/icons/%s_icon.png", snaps[i].Name))
+		}
+	}
+
+	c.Check(s.h.snapsToPayloads(nil, true), HasLen, 0)
+}
+
 type AllPackagesSuite struct {
 	c *snapdclient.FakeSnapdClient
 	h Handler
@@ -264,7 +477,7 @@ func (s *AllPackagesSuite) SetUpTest(c *C) {
 func (s *AllPackagesSuite) TestNoSnaps(c *C) {
 	s.c.StoreErr = errors.New("snaps could not be filtered")
 
-	snaps, err := s.h.allPackages(availableSnaps, "", false, "")
+	snaps, err := s.h.findSnaps(availableSnaps, "", false, "")
 	c.Assert(snaps, IsNil)
 	c.Assert(err, NotNil)
 }
@@ -272,7 +485,7 @@ func (s *AllPackagesSuite) TestNoSnaps(c *C) {
 func (s *AllPackagesSuite) TestPrivateSnaps(c *C) {
 	s.c.StoreSnaps = []*client.Snap{}
 
-	_, err := s.h.allPackages(availableSnaps, "", true, "")
+	_, err := s.h.findSnaps(availableSnaps, "", true, "")
 	c.Assert(err, IsNil)
 	c.Check(s.c.FindOptions.Private, Equals, true)
 }
@@ -280,7 +493,7 @@ func (s *AllPackagesSuite) TestPrivateSnaps(c *C) {
 func (s *AllPackagesSuite) TestQueryStringEscaped(c *C) {
 	s.c.StoreSnaps = []*client.Snap{}
 
-	_, err := s.h.allPackages(availableSnaps, "de$%**??", true, "")
+	_, err := s.h.findSnaps(availableSnaps, "de$%**??", true, "")
 	c.Assert(err, IsNil)
 	c.Check(s.c.FindOptions.Query, Equals, "de%24%25%2A%2A%3F%3F")
 }
@@ -291,8 +504,10 @@ func (s *AllPackagesSuite) TestHasSnaps(c *C) {
 		common.NewSnap("app1"),
 	}
 
-	snaps, err := s.h.allPackages(availableSnaps, "", false, "")
+	found, err := s.h.findSnaps(availableSnaps, "", false, "")
 	c.Assert(err, IsNil)
+
+	snaps := s.h.snapsToPayloads(found, true)
 	c.Assert(snaps, HasLen, 2)
 	// Not sorted, presented as is
 	c.Assert(snaps[0].Name, Equals, "app2")
@@ -313,8 +528,40 @@ func (s *AllPackagesSuite) TestSnapPrices(c *C) {
 		"EUR": 0.1,
 	}
 
-	c.Assert(priceStringFromSnapPrice(snapPrices{}), Equals, "")
-	c.Assert(priceStringFromSnapPrice(prices), Equals, "0.1 EUR")
+	c.Assert(snapPrices{}.currency(nil), Equals, "")
+	c.Assert(prices.currency(nil), Equals, "EUR")
+	c.Assert(prices.currency([]string{"GBP", "USD"}), Equals, "USD")
+	c.Assert(formatPrice(prices["EUR"], "EUR"), Equals, "0.1 EUR")
+
+	pkg := snapPkg{Prices: prices}
+	pkg.selectCurrency([]string{defaultCurrency})
+	c.Check(pkg.Price, Equals, "1.2 USD")
+	c.Check(pkg.Currency, Equals, "USD")
+
+	pkg = snapPkg{}
+	pkg.selectCurrency([]string{defaultCurrency})
+	c.Check(pkg.Price, Equals, "")
+	c.Check(pkg.Currency, Equals, "")
+}
+
+func (s *AllPackagesSuite) TestAcceptedCurrencies(c *C) {
+	tests := []struct {
+		acceptLanguage string
+		currencies     []string
+	}{
+		{"", nil},
+		{"fr", nil},
+		{"fr-CH", []string{"CHF"}},
+		{"en-gb", []string{"GBP"}},
+		{"zh-Hant-TW", []string{"TWD"}},
+		{"de-AT;q=0.5, en-US, fr-FR;q=0.8, de-DE;q=0.2", []string{"USD", "EUR"}},
+		{"en-US;q=0, ja-JP", []string{"JPY"}},
+		{"es-419, en-XX", nil},
+	}
+
+	for _, tt := range tests {
+		c.Check(acceptedCurrencies(tt.acceptLanguage), DeepEquals, tt.currencies, Commentf(tt.acceptLanguage))
+	}
 }
 
 type SnapOperationTrackingSuite struct {
@@ -410,3 +657,70 @@ func (s *SnapOperationTrackingSuite) TestAbortOperationWithErr(c *C) {
 	c.Assert(err, NotNil)
 	c.Assert(s.c.AbortedChangeID, Equals, "")
 }
+
+// slowSnapdClient takes as long as a snapd round-trip to return icons
+type slowSnapdClient struct {
+	*snapdclient.FakeSnapdClient
+}
+
+func (c slowSnapdClient) Icon(name string) (*client.Icon, error) {
+	time.Sleep(time.Millisecond)
+	return c.FakeSnapdClient.Icon(name)
+}
+
+func benchmarkSnapsToPayloads(b *testing.B, workers int, warm bool) {
+	dataPath, err := ioutil.TempDir("", "snapweb-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dataPath)
+
+	previousDataPath, wasSet := os.LookupEnv("SNAP_DATA")
+	defer func() {
+		if wasSet {
+			os.Setenv("SNAP_DATA", previousDataPath)
+		} else {
+			os.Unsetenv("SNAP_DATA")
+		}
+	}()
+	os.Setenv("SNAP_DATA", dataPath)
+
+	previousPayloadWorkers := payloadWorkers
+	defer func() {
+		payloadWorkers = previousPayloadWorkers
+	}()
+	payloadWorkers = workers
+
+	var snaps []*client.Snap
+	for i := 0; i < 200; i++ {
+		snaps = append(snaps, common.NewSnap(fmt.Sprintf("snap%d", i)))
+	}
+
+	h := &Handler{stateTracker: statetracker.New()}
+	h.setClient(slowSnapdClient{&snapdclient.FakeSnapdClient{}})
+	if warm {
+		h.snapsToPayloads(snaps, true)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !warm {
+			h.icons = iconCache{}
+		}
+		h.snapsToPayloads(snaps, true)
+	}
+}
+
+// BenchmarkSnapsToPayloadsSerial builds the payloads one after the other,
+// asking snapd for every icon, as was done before the pool and the cache
+func BenchmarkSnapsToPayloadsSerial(b *testing.B) {
+	benchmarkSnapsToPayloads(b, 1, false)
+}
+
+func BenchmarkSnapsToPayloadsPool(b *testing.B) {
+	benchmarkSnapsToPayloads(b, 8, false)
+}
+
+func BenchmarkSnapsToPayloadsPoolCached(b *testing.B) {
+	benchmarkSnapsToPayloads(b, 8, true)
+}
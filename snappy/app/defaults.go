@@ -1,7 +1,7 @@
 // +build !ubuntu_personal_store
 
 /*
- * Copyright (C) 2014-2017 Canonical Ltd
+ * Copyright (C) 2017 Canonical Ltd
  *
  * This program is free software: you can redistribute it and/or modify
  * it under the terms of the GNU General Public License version 3 as
@@ -17,9 +17,11 @@
  *
  */
 
-package main
+package snappy
 
 const (
-	httpAddr  string = ":4200"
-	httpsAddr string = ":4201"
+	// host listened on when no address or interface is configured
+	defaultListenHost string = ""
+	defaultHTTPPort   int    = 4200
+	defaultHTTPSPort  int    = 4201
 )
@@ -0,0 +1,272 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snappy
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/snapcore/snapd/client"
+
+	"github.com/snapcore/snapweb/snappy/snapdclient"
+)
+
+// the risk levels of the channels of a track, from the most stable
+var channelRisks = []string{"stable", "candidate", "beta", "edge"}
+
+type snapPublisher struct {
+	ID          string `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+	// Validation is "verified" for publishers whose identity was checked
+	Validation string `json:"validation,omitempty"`
+}
+
+type snapMedia struct {
+	// Type is "screenshot", "icon", "banner" or "video"
+	Type   string `json:"type"`
+	URL    string `json:"url"`
+	Width  int64  `json:"width,omitempty"`
+	Height int64  `json:"height,omitempty"`
+}
+
+type snapChannel struct {
+	Name        string    `json:"name"`
+	Version     string    `json:"version"`
+	Revision    string    `json:"revision"`
+	Confinement string    `json:"confinement"`
+	Size        int64     `json:"size,omitempty"`
+	ReleasedAt  time.Time `json:"released_at"`
+}
+
+type snapApp struct {
+	Name    string `json:"name"`
+	Daemon  string `json:"daemon,omitempty"`
+	Enabled bool   `json:"enabled,omitempty"`
+	Active  bool   `json:"active,omitempty"`
+}
+
+// snapDetail is the payload of a single snap, for its detail page
+type snapDetail struct {
+	snapPkg
+	Title           string         `json:"title,omitempty"`
+	Summary         string         `json:"summary"`
+	Publisher       *snapPublisher `json:"publisher,omitempty"`
+	License         string         `json:"license,omitempty"`
+	Contact         string         `json:"contact,omitempty"`
+	Website         string         `json:"website,omitempty"`
+	Media           []snapMedia    `json:"media"`
+	Confinement     string         `json:"confinement"`
+	Base            string         `json:"base,omitempty"`
+	Revision        string         `json:"revision"`
+	TrackingChannel string         `json:"tracking_channel,omitempty"`
+	Channels        []snapChannel  `json:"channels"`
+
+	// installed snaps only
+	Apps     []snapApp  `json:"apps,omitempty"`
+	DevMode  bool       `json:"devmode,omitempty"`
+	JailMode bool       `json:"jailmode,omitempty"`
+	HeldTill *time.Time `json:"held_till,omitempty"`
+}
+
+func (h *Handler) packageDetail(name string) (snapDetail, error) {
+	snap, err := h.getSnap(name)
+	if err != nil {
+		return snapDetail{}, err
+	}
+
+	detail := h.snapToDetail(snap)
+
+	// the snapd client does not decode all the details snapd gives, the
+	// snap detail page does well without those when snapd cannot tell
+	if isInstalledSnap(snap) {
+		if details, err := h.snapdClient.SnapDetails(name); err == nil {
+			detail.addInstalledDetails(details)
+		}
+	}
+	if details, err := h.snapdClient.FindOneDetails(name); err == nil {
+		detail.addDetails(details)
+	}
+
+	detail.addStoreDetails(snap)
+
+	// only the store knows of the channels an installed snap could track,
+	// the snap detail page does well without them when it is unreachable
+	if isInstalledSnap(snap) {
+		if storeSnap, _, err := h.snapdClient.FindOne(name); err == nil && storeSnap != nil {
+			detail.addStoreDetails(storeSnap)
+		}
+	}
+
+	return detail, nil
+}
+
+func isInstalledSnap(snap *client.Snap) bool {
+	return snap.Status == client.StatusInstalled || snap.Status == client.StatusActive
+}
+
+func (h *Handler) snapToDetail(snapQ *client.Snap) snapDetail {
+	detail := snapDetail{
+		snapPkg:     h.snapToPayload(snapQ),
+		Summary:     snapQ.Summary,
+		Confinement: snapQ.Confinement,
+		Revision:    snapQ.Revision.String(),
+		Media:       []snapMedia{},
+		Channels:    []snapChannel{},
+	}
+
+	if isInstalledSnap(snapQ) {
+		// as given by older snapd
+		detail.TrackingChannel = snapQ.Channel
+	}
+
+	if isInstalledSnap(snapQ) {
+		for _, app := range snapQ.Apps {
+			detail.Apps = append(detail.Apps, snapApp{
+				Name:    app.Name,
+				Daemon:  app.Daemon,
+				Enabled: app.Enabled,
+				Active:  app.Active,
+			})
+		}
+		detail.DevMode = snapQ.DevMode
+		detail.JailMode = snapQ.JailMode
+	}
+
+	return detail
+}
+
+// addInstalledDetails completes the detail with what snapd tells of the
+// installed snap
+func (d *snapDetail) addInstalledDetails(details *snapdclient.SnapDetails) {
+	if details.TrackingChannel != "" {
+		d.TrackingChannel = details.TrackingChannel
+	}
+	if details.Hold != nil && details.Hold.After(timeNow()) {
+		d.HeldTill = details.Hold
+	}
+
+	d.addDetails(details)
+}
+
+// addDetails completes the detail with what the snapd client does not decode
+func (d *snapDetail) addDetails(details *snapdclient.SnapDetails) {
+	if d.Title == "" {
+		d.Title = details.Title
+	}
+	if d.Publisher == nil && details.Publisher != nil {
+		d.Publisher = &snapPublisher{
+			ID:          details.Publisher.ID,
+			Username:    details.Publisher.Username,
+			DisplayName: details.Publisher.DisplayName,
+			Validation:  details.Publisher.Validation,
+		}
+	}
+	if d.License == "" {
+		d.License = details.License
+	}
+	if d.Contact == "" {
+		d.Contact = details.Contact
+	}
+	if d.Website == "" {
+		d.Website = details.Website
+	}
+	if d.Base == "" {
+		d.Base = details.Base
+	}
+
+	if len(d.Media) == 0 {
+		for _, media := range details.Media {
+			d.Media = append(d.Media, snapMedia{
+				Type:   media.Type,
+				URL:    media.URL,
+				Width:  media.Width,
+				Height: media.Height,
+			})
+		}
+	}
+}
+
+// addStoreDetails completes the detail with what the store tells of the snap
+func (d *snapDetail) addStoreDetails(snapQ *client.Snap) {
+	if len(d.Media) == 0 {
+		// as given by older snapd
+		for _, screenshot := range snapQ.Screenshots {
+			d.Media = append(d.Media, snapMedia{
+				Type:   "screenshot",
+				URL:    screenshot.URL,
+				Width:  screenshot.Width,
+				Height: screenshot.Height,
+			})
+		}
+	}
+
+	if len(d.Channels) == 0 {
+		d.Channels = storeChannels(snapQ)
+	}
+}
+
+// storeChannels lists the channels of the snap, track by track in the
+// order of the store and from the most stable in each track
+func storeChannels(snapQ *client.Snap) []snapChannel {
+	channels := make([]snapChannel, 0, len(snapQ.Channels))
+	for name, info := range snapQ.Channels {
+		if info == nil {
+			continue
+		}
+		channels = append(channels, snapChannel{
+			Name:        name,
+			Version:     info.Version,
+			Revision:    info.Revision.String(),
+			Confinement: info.Confinement,
+			Size:        info.Size,
+			ReleasedAt:  info.ReleasedAt,
+		})
+	}
+
+	index := func(list []string, s string) int {
+		for i, e := range list {
+			if e == s {
+				return i
+			}
+		}
+		return len(list)
+	}
+	order := func(name string) (int, int, string) {
+		track, risk := "latest", name
+		if i := strings.Index(name, "/"); i >= 0 {
+			track, risk = name[:i], name[i+1:]
+		}
+		return index(snapQ.Tracks, track), index(channelRisks, risk), name
+	}
+
+	sort.Slice(channels, func(i, j int) bool {
+		ti, ri, ni := order(channels[i].Name)
+		tj, rj, nj := order(channels[j].Name)
+		if ti != tj {
+			return ti < tj
+		}
+		if ri != rj {
+			return ri < rj
+		}
+		return ni < nj
+	})
+
+	return channels
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snappy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/snapcore/snapd/client"
+)
+
+// errorKinds are the machine-readable kinds of the error responses, by
+// HTTP status
+var errorKinds = map[int]string{
+	http.StatusBadRequest:            "bad-request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusPaymentRequired:       "payment-required",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not-found",
+	http.StatusMethodNotAllowed:      "method-not-allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "too-large",
+	http.StatusUnsupportedMediaType:  "unsupported-media-type",
+	http.StatusInternalServerError:   "internal-error",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+// snapdErrorStatuses map the kinds of the snapd errors to the HTTP status
+// of the responses telling of them
+var snapdErrorStatuses = map[client.ErrorKind]int{
+	client.ErrorKindSnapNotFound:          http.StatusNotFound,
+	client.ErrorKindAppNotFound:           http.StatusNotFound,
+	client.ErrorKindConfigNoSuchOption:    http.StatusNotFound,
+	client.ErrorKindSnapAlreadyInstalled:  http.StatusConflict,
+	client.ErrorKindSnapNoUpdateAvailable: http.StatusConflict,
+	client.ErrorKindInterfacesUnchanged:   http.StatusConflict,
+	client.ErrorKindBadQuery:              http.StatusBadRequest,
+	client.ErrorKindSnapLocal:             http.StatusBadRequest,
+	client.ErrorKindSnapNeedsDevMode:      http.StatusBadRequest,
+	client.ErrorKindSnapNeedsClassic:      http.StatusBadRequest,
+	client.ErrorKindNotSnap:               http.StatusBadRequest,
+	client.ErrorKindPasswordPolicy:        http.StatusBadRequest,
+	client.ErrorKindLoginRequired:         http.StatusForbidden,
+	client.ErrorKindTwoFactorRequired:     http.StatusForbidden,
+	client.ErrorKindTwoFactorFailed:       http.StatusForbidden,
+	client.ErrorKindTermsNotAccepted:      http.StatusForbidden,
+	client.ErrorKindNoPaymentMethods:      http.StatusForbidden,
+	client.ErrorKindPaymentDeclined:       http.StatusPaymentRequired,
+}
+
+// ErrorResponse is the body of all the error responses of the API
+type ErrorResponse struct {
+	// Kind tells the error apart from the others of the same status
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+	// Snapd is the error of snapd the response comes from, if any
+	Snapd *SnapdError `json:"snapd,omitempty"`
+}
+
+// SnapdError is the kind and value of an error of snapd
+type SnapdError struct {
+	Kind  string      `json:"kind"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// StatusError is an error to answer with the given HTTP status
+type StatusError struct {
+	Status int
+	Err    error
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+func statusErrorf(status int, format string, args ...interface{}) error {
+	return &StatusError{Status: status, Err: fmt.Errorf(format, args...)}
+}
+
+// ErrorStatus returns the HTTP status of the response telling of err: its
+// own for a StatusError, the one mapped from the kind of a snapd error,
+// 503 Service Unavailable when snapd could not be reached and 500 Internal
+// Server Error otherwise
+func ErrorStatus(err error) int {
+	switch e := err.(type) {
+	case *StatusError:
+		return e.Status
+	case *client.Error:
+		if status, ok := snapdErrorStatuses[e.Kind]; ok {
+			return status
+		}
+	case client.ConnectionError:
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusInternalServerError
+}
+
+func errorKind(status int) string {
+	if kind, ok := errorKinds[status]; ok {
+		return kind
+	}
+	return "error"
+}
+
+// WriteError answers with status and the ErrorResponse telling of err
+func WriteError(w http.ResponseWriter, status int, err error) {
+	resp := ErrorResponse{
+		Kind:    errorKind(status),
+		Message: err.Error(),
+	}
+
+	if e, ok := err.(*StatusError); ok {
+		err = e.Err
+	}
+	if e, ok := err.(*client.Error); ok {
+		resp.Snapd = &SnapdError{Kind: string(e.Kind), Value: e.Value}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("WriteError: error serializing json: %s", err)
+	}
+}
+
+// WriteErrorf answers with status and an ErrorResponse with the formatted
+// message
+func WriteErrorf(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	WriteError(w, status, fmt.Errorf(format, args...))
+}
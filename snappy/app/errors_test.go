@@ -0,0 +1,98 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snappy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/snapcore/snapd/client"
+
+	. "gopkg.in/check.v1"
+)
+
+// snapdConnectionError returns the error of the snapd client when snapd
+// cannot be reached
+func snapdConnectionError(c *C) error {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	_, err := client.New(&client.Config{BaseURL: server.URL}).ServerVersion()
+	c.Assert(err, FitsTypeOf, client.ConnectionError{})
+	return err
+}
+
+type ErrorsSuite struct{}
+
+var _ = Suite(&ErrorsSuite{})
+
+func (s *ErrorsSuite) TestErrorStatus(c *C) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{errors.New("fail"), http.StatusInternalServerError},
+		{statusErrorf(http.StatusConflict, "busy"), http.StatusConflict},
+		{&client.Error{Kind: client.ErrorKindSnapNotFound}, http.StatusNotFound},
+		{&client.Error{Kind: client.ErrorKindSnapAlreadyInstalled}, http.StatusConflict},
+		{&client.Error{Kind: client.ErrorKindSnapNoUpdateAvailable}, http.StatusConflict},
+		{&client.Error{Kind: client.ErrorKindBadQuery}, http.StatusBadRequest},
+		{&client.Error{Kind: client.ErrorKindSnapNeedsClassic}, http.StatusBadRequest},
+		{&client.Error{Kind: client.ErrorKindLoginRequired}, http.StatusForbidden},
+		{&client.Error{Kind: client.ErrorKindPaymentDeclined}, http.StatusPaymentRequired},
+		{&client.Error{Kind: "unknown-kind"}, http.StatusInternalServerError},
+		// snapd cannot be reached
+		{snapdConnectionError(c), http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		c.Check(ErrorStatus(tt.err), Equals, tt.status, Commentf("%#v", tt.err))
+	}
+}
+
+func (s *ErrorsSuite) TestWriteError(c *C) {
+	rec := httptest.NewRecorder()
+	WriteErrorf(rec, http.StatusMethodNotAllowed, "Method %s not allowed", "PUT")
+
+	c.Assert(rec.Code, Equals, http.StatusMethodNotAllowed)
+	c.Check(rec.Header().Get("Content-Type"), Equals, "application/json")
+	c.Check(rec.Body.String(), Equals, `{"kind":"method-not-allowed","message":"Method PUT not allowed"}`+"\n")
+}
+
+func (s *ErrorsSuite) TestWriteSnapdError(c *C) {
+	err := &client.Error{
+		Kind:    client.ErrorKindSnapAlreadyInstalled,
+		Value:   "foo",
+		Message: `snap "foo" is already installed`,
+	}
+
+	rec := httptest.NewRecorder()
+	WriteError(rec, ErrorStatus(err), &StatusError{Status: http.StatusConflict, Err: err})
+
+	c.Assert(rec.Code, Equals, http.StatusConflict)
+
+	var resp ErrorResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), IsNil)
+	c.Check(resp, DeepEquals, ErrorResponse{
+		Kind:    "conflict",
+		Message: `snap "foo" is already installed`,
+		Snapd:   &SnapdError{Kind: "snap-already-installed", Value: "foo"},
+	})
+}
@@ -19,7 +19,6 @@ package snappy
 
 import (
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -34,13 +33,16 @@ import (
 type Handler struct {
 	stateTracker *statetracker.StateTracker
 	snapdClient  snapdclient.SnapdClient
+	icons        iconCache
+	settings     *ConfigWatcher
 }
 
 // NewHandler creates an instance that implements snappy's packages api.
-func NewHandler() *Handler {
+func NewHandler(settings *ConfigWatcher) *Handler {
 	return &Handler{
 		stateTracker: statetracker.New(),
-		snapdClient:  snapdclient.NewClientAdapter(),
+		snapdClient:  NewCachingClient(snapdclient.NewClientAdapter()),
+		settings:     settings,
 	}
 }
 
@@ -53,24 +55,21 @@ func (h *Handler) jsonResponseOrError(v interface{}, w http.ResponseWriter) {
 	enc := json.NewEncoder(w)
 
 	if err := enc.Encode(v); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Error: %s", err)
 		log.Print(err)
+		WriteError(w, http.StatusInternalServerError, err)
 	}
 }
 
 func (h *Handler) snapOperationResponse(name string, err error, w http.ResponseWriter) {
-	msg := "Accepted"
-	status := http.StatusAccepted
-
 	if err != nil {
-		msg = "Processing error"
-		status = http.StatusInternalServerError
+		log.Printf("Cannot operate on snap %s: %s", name, err)
+		WriteError(w, ErrorStatus(err), err)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	h.jsonResponseOrError(response{Message: msg, Package: name}, w)
+	w.WriteHeader(http.StatusAccepted)
+	h.jsonResponseOrError(response{Message: "Accepted", Package: name}, w)
 }
 
 func (h *Handler) getAll(w http.ResponseWriter, r *http.Request) {
@@ -95,24 +94,46 @@ func (h *Handler) getAll(w http.ResponseWriter, r *http.Request) {
 		query = "."
 	}
 
-	payload, err := h.allPackages(snapCondition, query, privateSnaps, section)
+	opts, err := parseListOptions(r)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Error: %s", err)
+		WriteError(w, http.StatusBadRequest, err)
 		return
 	}
-	h.jsonResponseOrError(payload, w)
+
+	snaps, err := h.findSnaps(snapCondition, query, privateSnaps, section)
+	if err != nil {
+		WriteError(w, ErrorStatus(err), err)
+		return
+	}
+
+	opts.sortSnaps(snaps)
+	opts.setPageHeaders(w, r.URL, len(snaps))
+
+	pkgs := h.snapsToPayloads(opts.page(snaps), opts.wants("icon"))
+	currencies := h.preferredCurrencies(r)
+	for i := range pkgs {
+		pkgs[i].selectCurrency(currencies)
+	}
+
+	payload, err := opts.project(pkgs)
+	if err == nil {
+		err = WriteJSONWithETag(w, r, payload)
+	}
+	if err != nil {
+		log.Print(err)
+		WriteError(w, http.StatusInternalServerError, err)
+	}
 }
 
 func (h *Handler) get(w http.ResponseWriter, r *http.Request) {
 	name := mux.Vars(r)["name"]
 
-	payload, err := h.packagePayload(name)
+	payload, err := h.packageDetail(name)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintln(w, err, name)
+		WriteError(w, ErrorStatus(err), err)
 		return
 	}
+	payload.selectCurrency(h.preferredCurrencies(r))
 
 	h.jsonResponseOrError(payload, w)
 }
@@ -136,45 +157,50 @@ func (h *Handler) remove(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) update(w http.ResponseWriter, r *http.Request) {
 	snapName := mux.Vars(r)["name"]
 	if snapName == "" {
-		w.WriteHeader(http.StatusBadRequest)
+		WriteErrorf(w, http.StatusBadRequest, "Missing snap name")
 		return
 	}
 
 	body, err := ioutil.ReadAll(r.Body)
 	defer r.Body.Close()
+	if err != nil {
+		WriteErrorf(w, http.StatusBadRequest, "Cannot read the update: %s", err)
+		return
+	}
 
 	var snap map[string]*json.RawMessage
 	err = json.Unmarshal(body, &snap)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteErrorf(w, http.StatusBadRequest, "Invalid update: %s", err)
 		return
 	}
 
 	// For now only deal with enable/disable updates
-	if _, ok := snap["status"]; !ok {
-		w.WriteHeader(http.StatusInternalServerError)
+	if snap["status"] == nil {
+		WriteErrorf(w, http.StatusBadRequest, "Invalid update: missing status")
 		return
 	}
 
 	var status string
 	err = json.Unmarshal(*snap["status"], &status)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteErrorf(w, http.StatusBadRequest, "Invalid status: %s", err)
 		return
 	}
 
-	if status == statetracker.StatusEnabling {
+	switch status {
+	case statetracker.StatusEnabling:
 		err = h.enable(snapName)
-	} else if status == statetracker.StatusDisabling {
+	case statetracker.StatusDisabling:
 		err = h.disable(snapName)
-	} else if status == "cancel" {
+	case "cancel":
 		err = h.abortRunningOperation(snapName)
-	}
-
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	default:
+		WriteErrorf(w, http.StatusBadRequest, "Invalid status %q, expected %s, %s or cancel",
+			status, statetracker.StatusEnabling, statetracker.StatusDisabling)
 		return
 	}
+
 	h.snapOperationResponse(snapName, err, w)
 }
 
@@ -189,6 +215,12 @@ func (h *Handler) MakeMuxer(prefix string, parentRouter *mux.Router) http.Handle
 	// get specific package
 	m.HandleFunc("/{name}", h.get).Methods("GET")
 
+	// Whether a package is owned, or can be bought
+	m.HandleFunc("/{name}/purchase", h.getPurchase).Methods("GET")
+
+	// Buy a package
+	m.HandleFunc("/{name}/purchase", h.purchase).Methods("POST")
+
 	// Add a package
 	m.HandleFunc("/{name}", h.add).Methods("PUT")
 
@@ -53,8 +53,8 @@ func (s *HandlersSuite) SetUpTest(c *C) {
 
 func (s *HandlersSuite) resetFakeSnapdClient() {
 	s.c = &snapdclient.FakeSnapdClient{}
+	s.h = Handler{stateTracker: statetracker.New()}
 	s.h.setClient(s.c)
-	s.h.stateTracker = statetracker.New()
 }
 
 func (s *HandlersSuite) createAndSaveTestToken(c *C) string {
@@ -102,6 +102,146 @@ func (s *HandlersSuite) TestGetAll(c *C) {
 	}
 }
 
+func (s *HandlersSuite) listing(c *C, url string) (*httptest.ResponseRecorder, []map[string]interface{}) {
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", url, nil)
+	c.Assert(err, IsNil)
+
+	s.h.getAll(rec, req)
+
+	var pkgs []map[string]interface{}
+	if rec.Code == http.StatusOK {
+		c.Assert(json.Unmarshal(rec.Body.Bytes(), &pkgs), IsNil)
+	}
+	return rec, pkgs
+}
+
+func listedNames(pkgs []map[string]interface{}) []string {
+	names := make([]string, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		names = append(names, pkg["name"].(string))
+	}
+	return names
+}
+
+func (s *HandlersSuite) TestGetAllSorted(c *C) {
+	for i, name := range []string{"bravo", "alpha", "charlie"} {
+		snap := common.NewSnap(name)
+		snap.Status = "available"
+		snap.DownloadSize = int64(10 - i)
+		snap.Developer = []string{"zed", "zed", "abe"}[i]
+		s.c.StoreSnaps = append(s.c.StoreSnaps, snap)
+	}
+
+	tests := []struct {
+		Sort  string
+		Names []string
+	}{
+		{"", []string{"bravo", "alpha", "charlie"}},
+		{"name", []string{"alpha", "bravo", "charlie"}},
+		{"-name", []string{"charlie", "bravo", "alpha"}},
+		{"size", []string{"charlie", "alpha", "bravo"}},
+		{"-size", []string{"bravo", "alpha", "charlie"}},
+		{"developer", []string{"charlie", "alpha", "bravo"}},
+		{"-developer", []string{"bravo", "alpha", "charlie"}},
+	}
+
+	for _, tt := range tests {
+		rec, pkgs := s.listing(c, "/?sort="+tt.Sort)
+		c.Assert(rec.Code, Equals, http.StatusOK, Commentf(tt.Sort))
+		c.Check(listedNames(pkgs), DeepEquals, tt.Names, Commentf(tt.Sort))
+	}
+}
+
+func (s *HandlersSuite) TestGetAllPaginated(c *C) {
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		s.c.StoreSnaps = append(s.c.StoreSnaps, common.NewSnap(name))
+	}
+
+	rec, pkgs := s.listing(c, "/?q=x&limit=2&offset=2")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Check(listedNames(pkgs), DeepEquals, []string{"c", "d"})
+	c.Check(rec.Header().Get("X-Total-Count"), Equals, "5")
+	c.Check(rec.Header().Get("Link"), Equals,
+		`</?limit=2&offset=0&q=x>; rel="first", `+
+			`</?limit=2&offset=0&q=x>; rel="prev", `+
+			`</?limit=2&offset=4&q=x>; rel="next", `+
+			`</?limit=2&offset=4&q=x>; rel="last"`)
+
+	rec, pkgs = s.listing(c, "/?limit=2&offset=4")
+	c.Check(listedNames(pkgs), DeepEquals, []string{"e"})
+	c.Check(rec.Header().Get("Link"), Not(Matches), `.*rel="next".*`)
+
+	rec, pkgs = s.listing(c, "/?offset=10")
+	c.Check(pkgs, HasLen, 0)
+	c.Check(rec.Body.String(), Equals, "[]\n")
+	c.Check(rec.Header().Get("X-Total-Count"), Equals, "5")
+	c.Check(rec.Header().Get("Link"), Equals, "")
+}
+
+func (s *HandlersSuite) TestGetAllFields(c *C) {
+	s.c.StoreSnaps = []*client.Snap{common.NewSnap("a"), common.NewSnap("b")}
+
+	rec, pkgs := s.listing(c, "/?fields=name,version")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Check(pkgs, DeepEquals, []map[string]interface{}{
+		{"name": "a", "version": "0.1-8"},
+		{"name": "b", "version": "0.1-8"},
+	})
+	c.Check(s.c.IconRequests, HasLen, 0)
+
+	rec, pkgs = s.listing(c, "/?fields=name,icon")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Check(pkgs, HasLen, 2)
+	c.Check(s.c.IconRequests, DeepEquals, []string{"a", "b"})
+}
+
+func (s *HandlersSuite) TestGetAllIconsOnlyForPage(c *C) {
+	s.c.StoreSnaps = []*client.Snap{common.NewSnap("a"), common.NewSnap("b")}
+
+	rec, _ := s.listing(c, "/?limit=1&offset=1")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Check(s.c.IconRequests, DeepEquals, []string{"b"})
+}
+
+func (s *HandlersSuite) TestGetAllInvalidOptions(c *C) {
+	for _, url := range []string{
+		"/?limit=0",
+		"/?limit=x",
+		"/?offset=-1",
+		"/?sort=price",
+		"/?fields=name,bogus",
+	} {
+		rec, _ := s.listing(c, url)
+		c.Check(rec.Code, Equals, http.StatusBadRequest, Commentf(url))
+	}
+	c.Check(s.c.Query, Equals, "")
+}
+
+func (s *HandlersSuite) TestGetAllNotModified(c *C) {
+	s.c.StoreSnaps = []*client.Snap{common.NewSnap("a")}
+
+	rec, _ := s.listing(c, "/")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	etag := rec.Header().Get("ETag")
+	c.Assert(etag, Matches, `"[0-9a-f]{64}"`)
+
+	req, err := http.NewRequest("GET", "/", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("If-None-Match", `"other", W/`+etag)
+	rec = httptest.NewRecorder()
+	s.h.getAll(rec, req)
+	c.Check(rec.Code, Equals, http.StatusNotModified)
+	c.Check(rec.Body.Len(), Equals, 0)
+	c.Check(rec.Header().Get("ETag"), Equals, etag)
+
+	s.c.StoreSnaps = append(s.c.StoreSnaps, common.NewSnap("b"))
+	rec = httptest.NewRecorder()
+	s.h.getAll(rec, req)
+	c.Check(rec.Code, Equals, http.StatusOK)
+	c.Check(rec.Header().Get("ETag"), Not(Equals), etag)
+}
+
 func (s *HandlersSuite) TestGetError(c *C) {
 	s.c.Err = errors.New("fail")
 	s.c.StoreErr = errors.New("fail")
@@ -110,8 +250,32 @@ func (s *HandlersSuite) TestGetError(c *C) {
 	req, err := http.NewRequest("GET", "/foo", nil)
 	c.Assert(err, IsNil)
 
+	s.h.MakeMuxer("", mux.NewRouter()).ServeHTTP(rec, req)
+	c.Assert(rec.Code, Equals, http.StatusInternalServerError)
+
+	var resp ErrorResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), IsNil)
+	c.Check(resp, DeepEquals, ErrorResponse{Kind: "internal-error", Message: "fail"})
+}
+
+func (s *HandlersSuite) TestGetNotFound(c *C) {
+	s.c.Err = &client.Error{Kind: client.ErrorKindSnapNotFound, Message: "snap not found"}
+	s.c.StoreErr = &client.Error{Kind: client.ErrorKindSnapNotFound, Value: "foo", Message: "snap not found"}
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/foo", nil)
+	c.Assert(err, IsNil)
+
 	s.h.MakeMuxer("", mux.NewRouter()).ServeHTTP(rec, req)
 	c.Assert(rec.Code, Equals, http.StatusNotFound)
+
+	var resp ErrorResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), IsNil)
+	c.Check(resp, DeepEquals, ErrorResponse{
+		Kind:    "not-found",
+		Message: "snap not found",
+		Snapd:   &SnapdError{Kind: "snap-not-found", Value: "foo"},
+	})
 }
 
 func (s *HandlersSuite) TestGet(c *C) {
@@ -128,6 +292,11 @@ func (s *HandlersSuite) TestGet(c *C) {
 	err = json.Unmarshal(rec.Body.Bytes(), &sp)
 	c.Assert(err, IsNil)
 	c.Assert(sp.Name, Equals, "chatroom")
+
+	var detail map[string]interface{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &detail), IsNil)
+	c.Check(detail["revision"], Equals, "0")
+	c.Check(detail["channels"], DeepEquals, []interface{}{})
 }
 
 func (s *HandlersSuite) TestAdd(c *C) {
@@ -165,7 +334,38 @@ func (s *HandlersSuite) TestUpdateInvalidStatus(c *C) {
 	c.Assert(err, IsNil)
 
 	s.h.MakeMuxer("", mux.NewRouter()).ServeHTTP(rec, req)
-	c.Assert(rec.Code, Equals, http.StatusInternalServerError)
+	c.Assert(rec.Code, Equals, http.StatusBadRequest)
+}
+
+func (s *HandlersSuite) TestUpdateErrors(c *C) {
+	s.c.Snaps = []*client.Snap{common.NewDefaultSnap()}
+	s.c.Snaps[0].Status = "active"
+
+	tests := []struct {
+		body    string
+		code    int
+		message string
+	}{
+		{`{"status": `, http.StatusBadRequest, "Invalid update: unexpected end of JSON input"},
+		{`{"status": null}`, http.StatusBadRequest, "Invalid update: missing status"},
+		{`{"status": 1}`, http.StatusBadRequest, "Invalid status: .*"},
+		{`{"status": "removing"}`, http.StatusBadRequest, `Invalid status "removing", expected enabling, disabling or cancel`},
+		{`{"status": "enabling"}`, http.StatusConflict, "Snap not installed and disabled"},
+		{`{"status": "cancel"}`, http.StatusConflict, "No operation to abort for snap chatroom"},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/chatroom", bytes.NewBufferString(tt.body))
+		c.Assert(err, IsNil)
+
+		s.h.MakeMuxer("", mux.NewRouter()).ServeHTTP(rec, req)
+		c.Check(rec.Code, Equals, tt.code, Commentf(tt.body))
+
+		var resp ErrorResponse
+		c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), IsNil)
+		c.Check(resp.Message, Matches, tt.message)
+	}
 }
 
 func (s *HandlersSuite) TestUpdateEnabling(c *C) {
@@ -232,10 +432,20 @@ func (s *HandlersSuite) TestSnapOperationResponseError(c *C) {
 
 	c.Assert(rec.Code, Equals, http.StatusInternalServerError)
 
-	var r response
+	var r ErrorResponse
 	err := json.Unmarshal(rec.Body.Bytes(), &r)
 	c.Assert(err, IsNil)
-	c.Assert(r, DeepEquals, response{Message: "Processing error", Package: "foo"})
+	c.Assert(r, DeepEquals, ErrorResponse{Kind: "internal-error", Message: "bar"})
+
+	rec = httptest.NewRecorder()
+	s.h.snapOperationResponse("foo", &client.Error{
+		Kind:    client.ErrorKindSnapAlreadyInstalled,
+		Message: "snap \"foo\" is already installed",
+	}, rec)
+
+	c.Assert(rec.Code, Equals, http.StatusConflict)
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &r), IsNil)
+	c.Assert(r.Snapd, DeepEquals, &SnapdError{Kind: "snap-already-installed"})
 }
 
 func (s *HandlersSuite) TestSnapOperationResponse(c *C) {
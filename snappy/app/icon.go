@@ -23,6 +23,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
+
+	"github.com/snapcore/snapd/snap"
 
 	"github.com/snapcore/snapweb/snappy/snapdclient"
 )
@@ -51,10 +54,8 @@ var tryLocateCachedIconForSnap = func(snapName string) (string, error) {
 	return filepath.Join("/", relativePath, filepath.Base(found[0])), nil
 }
 
-// TODO there is a lot of dup work there since
-// we do snapd requests everytime even for icons
-// that we got already (just to get the name, we should
-// locally cache it)
+// localIconPath asks snapd for the icon of an installed snap and saves it
+// under the icon directory, iconCache avoiding to do so for every request
 var localIconPath = func(c snapdclient.SnapdClient, name string) (relativePath string, err error) {
 	icon, err := c.Icon(name)
 	if err != nil {
@@ -100,3 +101,67 @@ func IconDir() (dataPath, relativeBasePath string, err error) {
 
 	return dataPath, "icons", nil
 }
+
+type cachedIcon struct {
+	revision snap.Revision
+	path     string
+}
+
+// iconCache remembers where the icon of each installed snap revision was
+// saved, a refresh of the snap invalidating it
+type iconCache struct {
+	sync.Mutex
+	icons map[string]cachedIcon
+}
+
+// path returns the icon path of the snap revision, resolving it with
+// localIconPath when the revision is not known yet
+func (ic *iconCache) path(c snapdclient.SnapdClient, name string, revision snap.Revision) (string, error) {
+	ic.Lock()
+	cached, ok := ic.icons[name]
+	ic.Unlock()
+
+	if ok && cached.revision == revision {
+		return cached.path, nil
+	}
+	if ok {
+		// the snap was refreshed, its saved icon may well be stale
+		ic.invalidate(name)
+	}
+
+	path, err := localIconPath(c, name)
+	if err != nil {
+		return path, err
+	}
+
+	ic.Lock()
+	if ic.icons == nil {
+		ic.icons = make(map[string]cachedIcon)
+	}
+	ic.icons[name] = cachedIcon{revision: revision, path: path}
+	ic.Unlock()
+
+	return path, nil
+}
+
+// invalidate forgets the icon of the snap and removes its saved copy
+func (ic *iconCache) invalidate(name string) {
+	ic.Lock()
+	cached, ok := ic.icons[name]
+	delete(ic.icons, name)
+	ic.Unlock()
+
+	if !ok {
+		return
+	}
+
+	dataPath, relativePath, err := IconDir()
+	if err != nil {
+		return
+	}
+	rel, err := filepath.Rel(filepath.Join("/", relativePath), cached.path)
+	if err != nil {
+		return
+	}
+	os.Remove(filepath.Join(dataPath, rel))
+}
@@ -25,6 +25,7 @@ import (
 	"path/filepath"
 
 	"github.com/snapcore/snapd/client"
+	"github.com/snapcore/snapd/snap"
 
 	"github.com/snapcore/snapweb/snappy/snapdclient"
 
@@ -169,3 +170,66 @@ func (s *IconSuite) TestLocateCachedIcons(c *C) {
 		os.Remove(iconFilePath)
 	}
 }
+
+type IconCacheSuite struct {
+	c        *snapdclient.FakeSnapdClient
+	dataPath string
+	icons    iconCache
+}
+
+var _ = Suite(&IconCacheSuite{})
+
+func (s *IconCacheSuite) SetUpTest(c *C) {
+	s.dataPath = c.MkDir()
+	os.Setenv("SNAP_DATA", s.dataPath)
+	s.c = &snapdclient.FakeSnapdClient{}
+	s.icons = iconCache{}
+}
+
+func (s *IconCacheSuite) TestCachedPerRevision(c *C) {
+	for i := 0; i < 3; i++ {
+		path, err := s.icons.path(s.c, "mysnap", snap.R(1))
+		c.Assert(err, IsNil)
+		c.Check(path, Equals, "/icons/mysnap_icon.png")
+	}
+	c.Check(s.c.IconRequests, DeepEquals, []string{"mysnap"})
+
+	_, err := s.icons.path(s.c, "othersnap", snap.R(1))
+	c.Assert(err, IsNil)
+	c.Check(s.c.IconRequests, DeepEquals, []string{"mysnap", "othersnap"})
+}
+
+func (s *IconCacheSuite) TestRefreshInvalidates(c *C) {
+	iconPath := filepath.Join(s.dataPath, "icons", "mysnap_icon.png")
+
+	_, err := s.icons.path(s.c, "mysnap", snap.R(1))
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(iconPath, []byte("stale"), 0644), IsNil)
+
+	path, err := s.icons.path(s.c, "mysnap", snap.R(2))
+	c.Assert(err, IsNil)
+	c.Check(path, Equals, "/icons/mysnap_icon.png")
+	c.Check(s.c.IconRequests, DeepEquals, []string{"mysnap", "mysnap"})
+
+	contents, err := ioutil.ReadFile(iconPath)
+	c.Assert(err, IsNil)
+	c.Check(string(contents), Equals, "png")
+}
+
+func (s *IconCacheSuite) TestErrorsNotCached(c *C) {
+	previousLocalIconPath := localIconPath
+	defer func() {
+		localIconPath = previousLocalIconPath
+	}()
+	localIconPath = func(c snapdclient.SnapdClient, name string) (string, error) {
+		return "", ErrIconNotExist
+	}
+
+	_, err := s.icons.path(s.c, "mysnap", snap.R(1))
+	c.Assert(err, Equals, ErrIconNotExist)
+
+	localIconPath = previousLocalIconPath
+	path, err := s.icons.path(s.c, "mysnap", snap.R(1))
+	c.Assert(err, IsNil)
+	c.Check(path, Equals, "/icons/mysnap_icon.png")
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snappy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var interfaceAddrs = func(ifname string) ([]net.Addr, error) {
+	intf, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, err
+	}
+	return intf.Addrs()
+}
+
+// HTTPListenAddresses returns the host:port addresses the HTTP end-point
+// listens on
+func (c Config) HTTPListenAddresses() ([]string, error) {
+	return listenAddresses(c.HTTPAddresses, c.BindInterfaces, c.HTTPPort)
+}
+
+// HTTPSListenAddresses returns the host:port addresses the HTTPS end-point
+// listens on
+func (c Config) HTTPSListenAddresses() ([]string, error) {
+	return listenAddresses(c.HTTPSAddresses, c.BindInterfaces, c.HTTPSPort)
+}
+
+// listenAddresses combines the explicit addresses with the ones of the given
+// interfaces; addresses without a port get the default one. Interface
+// addresses are looked up when called, so that they follow the configuration
+// reloads.
+func listenAddresses(addresses []string, ifnames []string, port int) ([]string, error) {
+	var result []string
+
+	for _, addr := range addresses {
+		host, p, err := splitListenAddress(addr)
+		if err != nil {
+			return nil, err
+		}
+		if p == 0 {
+			p = port
+		}
+		result = append(result, net.JoinHostPort(host, strconv.Itoa(p)))
+	}
+
+	for _, ifname := range ifnames {
+		addrs, err := interfaceAddrs(ifname)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot bind to interface %s: %s", ifname, err)
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			host := ipnet.IP.String()
+			if ipnet.IP.IsLinkLocalUnicast() && ipnet.IP.To4() == nil {
+				// IPv6 link-local addresses need a zone to be bound to
+				host += "%" + ifname
+			}
+			result = append(result, net.JoinHostPort(host, strconv.Itoa(port)))
+		}
+	}
+
+	if len(addresses) == 0 && len(ifnames) == 0 {
+		result = append(result, net.JoinHostPort(defaultListenHost, strconv.Itoa(port)))
+	}
+
+	return result, nil
+}
+
+// splitListenAddress parses "host", "host:port", "[ipv6]" or "[ipv6]:port",
+// returning 0 as the port when none is given. The host must be empty or an
+// IP address.
+func splitListenAddress(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		// no port, possibly a bracketed or bare IPv6 address
+		host = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+		portStr = ""
+	}
+
+	ip := host
+	if i := strings.LastIndex(ip, "%"); i >= 0 {
+		ip = ip[:i]
+	}
+	if ip != "" && net.ParseIP(ip) == nil {
+		return "", 0, fmt.Errorf("Invalid listen address %q: %q is not an IP address", addr, host)
+	}
+
+	if portStr == "" {
+		return host, 0, nil
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err == nil {
+		err = validatePort(port)
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid listen address %q: invalid port %q", addr, portStr)
+	}
+
+	return host, port, nil
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snappy
+
+import (
+	"errors"
+	"net"
+
+	. "gopkg.in/check.v1"
+)
+
+type ListenSuite struct {
+	interfaceAddrs func(string) ([]net.Addr, error)
+}
+
+var _ = Suite(&ListenSuite{})
+
+func (s *ListenSuite) SetUpTest(c *C) {
+	s.interfaceAddrs = interfaceAddrs
+	interfaceAddrs = func(ifname string) ([]net.Addr, error) {
+		if ifname != "eth0" {
+			return nil, errors.New("no such network interface")
+		}
+		_, v4, _ := net.ParseCIDR("192.168.1.10/24")
+		v4.IP = net.ParseIP("192.168.1.10")
+		_, v6, _ := net.ParseCIDR("fe80::1/64")
+		v6.IP = net.ParseIP("fe80::1")
+		return []net.Addr{v4, v6}, nil
+	}
+}
+
+func (s *ListenSuite) TearDownTest(c *C) {
+	interfaceAddrs = s.interfaceAddrs
+}
+
+func (s *ListenSuite) TestSplitListenAddress(c *C) {
+	tests := []struct {
+		addr string
+		host string
+		port int
+	}{
+		{"127.0.0.1", "127.0.0.1", 0},
+		{"127.0.0.1:8080", "127.0.0.1", 8080},
+		{":8080", "", 8080},
+		{"::1", "::1", 0},
+		{"[::1]", "::1", 0},
+		{"[::1]:8080", "::1", 8080},
+		{"[fe80::1%eth0]:8080", "fe80::1%eth0", 8080},
+	}
+
+	for _, t := range tests {
+		host, port, err := splitListenAddress(t.addr)
+		c.Check(err, IsNil, Commentf(t.addr))
+		c.Check(host, Equals, t.host, Commentf(t.addr))
+		c.Check(port, Equals, t.port, Commentf(t.addr))
+	}
+}
+
+func (s *ListenSuite) TestSplitInvalidListenAddress(c *C) {
+	for _, addr := range []string{"localhost", "example.com:80", "127.0.0.1:0", "127.0.0.1:http", "[::1]:70000"} {
+		_, _, err := splitListenAddress(addr)
+		c.Check(err, ErrorMatches, `Invalid listen address .*`, Commentf(addr))
+	}
+}
+
+func (s *ListenSuite) TestDefaultListenAddresses(c *C) {
+	config := Config{HTTPPort: 4200, HTTPSPort: 4201}
+
+	addrs, err := config.HTTPListenAddresses()
+	c.Assert(err, IsNil)
+	c.Check(addrs, DeepEquals, []string{net.JoinHostPort(defaultListenHost, "4200")})
+
+	addrs, err = config.HTTPSListenAddresses()
+	c.Assert(err, IsNil)
+	c.Check(addrs, DeepEquals, []string{net.JoinHostPort(defaultListenHost, "4201")})
+}
+
+func (s *ListenSuite) TestListenAddresses(c *C) {
+	config := Config{
+		HTTPPort:       4200,
+		HTTPSPort:      4201,
+		HTTPAddresses:  []string{"127.0.0.1", "[::1]:8080"},
+		HTTPSAddresses: []string{"10.0.0.1:8443"},
+		BindInterfaces: []string{"eth0"},
+	}
+
+	addrs, err := config.HTTPListenAddresses()
+	c.Assert(err, IsNil)
+	c.Check(addrs, DeepEquals, []string{
+		"127.0.0.1:4200",
+		"[::1]:8080",
+		"192.168.1.10:4200",
+		"[fe80::1%eth0]:4200",
+	})
+
+	addrs, err = config.HTTPSListenAddresses()
+	c.Assert(err, IsNil)
+	c.Check(addrs, DeepEquals, []string{
+		"10.0.0.1:8443",
+		"192.168.1.10:4201",
+		"[fe80::1%eth0]:4201",
+	})
+}
+
+func (s *ListenSuite) TestListenAddressesUnknownInterface(c *C) {
+	config := Config{HTTPPort: 4200, BindInterfaces: []string{"wlan9"}}
+
+	_, err := config.HTTPListenAddresses()
+	c.Check(err, ErrorMatches, "Cannot bind to interface wlan9: no such network interface")
+}
+
+func (s *ListenSuite) TestValidateListenSettings(c *C) {
+	config := DefaultConfig()
+	config.HTTPAddresses = []string{"localhost"}
+	c.Check(config.Validate(), ErrorMatches, `Invalid listen address "localhost".*`)
+
+	config = DefaultConfig()
+	config.BindInterfaces = []string{""}
+	c.Check(config.Validate(), ErrorMatches, "Empty interface name in bindInterfaces")
+
+	config = DefaultConfig()
+	config.UnixSocket = "snapweb.socket"
+	c.Check(config.Validate(), ErrorMatches, `unixSocket must be an absolute path, got "snapweb.socket"`)
+}
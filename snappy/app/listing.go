@@ -0,0 +1,243 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snappy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/snapcore/snapd/client"
+)
+
+// snapSorters are the keys the packages can be sorted by
+var snapSorters = map[string]func(a, b *client.Snap) bool{
+	"name": func(a, b *client.Snap) bool {
+		return a.Name < b.Name
+	},
+	"size": func(a, b *client.Snap) bool {
+		return snapSize(a) < snapSize(b)
+	},
+	"install_date": func(a, b *client.Snap) bool {
+		return a.InstallDate.Before(b.InstallDate)
+	},
+	"developer": func(a, b *client.Snap) bool {
+		return a.Developer < b.Developer
+	},
+}
+
+// payloadFields are the json names of the snapPkg fields
+var payloadFields = jsonFieldNames(reflect.TypeOf(snapPkg{}))
+
+// listOptions tells which part of the packages to return, and how
+type listOptions struct {
+	// Limit is the maximum number of packages returned, 0 for all of them
+	Limit  int
+	Offset int
+	// Sort is a snapSorters key, Descending reversing its order
+	Sort       string
+	Descending bool
+	// Fields restricts the packages to these fields, all of them if empty
+	Fields []string
+}
+
+func jsonFieldNames(t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func snapSize(s *client.Snap) int64 {
+	if isInstalledSnap(s) {
+		return s.InstalledSize
+	}
+	return s.DownloadSize
+}
+
+func parseCount(r *http.Request, name string, min int) (int, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min {
+		return 0, fmt.Errorf("Invalid %s %q, expected an integer of at least %d", name, value, min)
+	}
+	return n, nil
+}
+
+func parseListOptions(r *http.Request) (listOptions, error) {
+	var opts listOptions
+	var err error
+
+	if opts.Limit, err = parseCount(r, "limit", 1); err != nil {
+		return opts, err
+	}
+	if opts.Offset, err = parseCount(r, "offset", 0); err != nil {
+		return opts, err
+	}
+
+	if key := r.FormValue("sort"); key != "" {
+		opts.Descending = strings.HasPrefix(key, "-")
+		opts.Sort = strings.TrimPrefix(key, "-")
+		if _, ok := snapSorters[opts.Sort]; !ok {
+			return opts, fmt.Errorf("Invalid sort %q, expected name, size, install_date or developer", key)
+		}
+	}
+
+	if fields := r.FormValue("fields"); fields != "" {
+		for _, field := range strings.Split(fields, ",") {
+			field = strings.TrimSpace(field)
+			if !contains(payloadFields, field) {
+				return opts, fmt.Errorf("Unknown field %q, expected one of %s",
+					field, strings.Join(payloadFields, ", "))
+			}
+			opts.Fields = append(opts.Fields, field)
+		}
+	}
+
+	return opts, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// wants tells whether the field is part of the selected ones
+func (opts listOptions) wants(field string) bool {
+	return len(opts.Fields) == 0 || contains(opts.Fields, field)
+}
+
+// sortSnaps sorts the snaps in place, keeping the order given by snapd when
+// no sort was asked for and breaking ties by name
+func (opts listOptions) sortSnaps(snaps []*client.Snap) {
+	if opts.Sort == "" {
+		return
+	}
+
+	less := snapSorters[opts.Sort]
+	sort.SliceStable(snaps, func(i, j int) bool {
+		a, b := snaps[i], snaps[j]
+		if opts.Descending {
+			a, b = b, a
+		}
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		return a.Name < b.Name
+	})
+}
+
+// page returns the slice of the snaps selected by the limit and offset
+func (opts listOptions) page(snaps []*client.Snap) []*client.Snap {
+	if opts.Offset >= len(snaps) {
+		return snaps[:0]
+	}
+
+	snaps = snaps[opts.Offset:]
+	if opts.Limit > 0 && opts.Limit < len(snaps) {
+		snaps = snaps[:opts.Limit]
+	}
+	return snaps
+}
+
+// project returns the packages restricted to the selected fields
+func (opts listOptions) project(pkgs []snapPkg) (interface{}, error) {
+	if len(opts.Fields) == 0 {
+		return pkgs, nil
+	}
+
+	projected := make([]map[string]*json.RawMessage, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		b, err := json.Marshal(pkg)
+		if err != nil {
+			return nil, err
+		}
+
+		var all map[string]*json.RawMessage
+		if err := json.Unmarshal(b, &all); err != nil {
+			return nil, err
+		}
+
+		fields := make(map[string]*json.RawMessage, len(opts.Fields))
+		for _, field := range opts.Fields {
+			if value, ok := all[field]; ok {
+				fields[field] = value
+			}
+		}
+		projected = append(projected, fields)
+	}
+
+	return projected, nil
+}
+
+// setPageHeaders gives the total number of packages and, when paginated,
+// the links to the other pages
+func (opts listOptions) setPageHeaders(w http.ResponseWriter, u *url.URL, total int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+	if opts.Limit == 0 {
+		return
+	}
+
+	link := func(offset int, rel string) string {
+		q := u.Query()
+		q.Set("offset", strconv.Itoa(offset))
+		q.Set("limit", strconv.Itoa(opts.Limit))
+		return fmt.Sprintf("<%s?%s>; rel=%q", u.Path, q.Encode(), rel)
+	}
+
+	last := 0
+	if total > 0 {
+		last = (total - 1) / opts.Limit * opts.Limit
+	}
+
+	links := []string{link(0, "first")}
+	if opts.Offset > 0 {
+		prev := opts.Offset - opts.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, link(prev, "prev"))
+	}
+	if opts.Offset+opts.Limit < total {
+		links = append(links, link(opts.Offset+opts.Limit, "next"))
+	}
+	links = append(links, link(last, "last"))
+
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
@@ -22,17 +22,118 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 )
 
-// NetFilter manages an IP-based filter to limit access to Snapweb
+const (
+	// DefaultIPv4Prefix is the smallest prefix length of the local IPv4
+	// networks allowed by default, ie. class-C networks with 256 hosts max.
+	DefaultIPv4Prefix int = 24
+	// DefaultIPv6Prefix is the smallest prefix length of the local IPv6
+	// networks allowed by default, ie. a single subnet.
+	DefaultIPv6Prefix int = 64
+)
+
+// PrefixPolicy sets, per address family, the smallest prefix length a local
+// network must have to be allowed. Zero selects the default value.
+type PrefixPolicy struct {
+	IPv4 int
+	IPv6 int
+}
+
+// accepts checks whether a local network is small enough to be allowed
+func (p PrefixPolicy) accepts(ipnet *net.IPNet) bool {
+	ones, bits := ipnet.Mask.Size()
+
+	min := p.IPv6
+	if min == 0 {
+		min = DefaultIPv6Prefix
+	}
+	if bits == 8*net.IPv4len {
+		min = p.IPv4
+		if min == 0 {
+			min = DefaultIPv4Prefix
+		}
+	}
+
+	return ones >= min
+}
+
+// how often interface rules are resolved again, to follow address changes
+var interfaceRefreshInterval = 10 * time.Second
+
+// maximum number of addresses remembered by the filter
+const filterCacheSize = 1024
+
+var interfaceNames = func() ([]string, error) {
+	iflist, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(iflist))
+	for i, intf := range iflist {
+		names[i] = intf.Name
+	}
+	return names, nil
+}
+
+// filterRule allows or denies access from a network, or from the networks
+// of an interface
+type filterRule struct {
+	allow   bool
+	network *net.IPNet
+	// interface name for interface rules, "*" standing for all of them
+	ifname string
+	// networks of the interface, as last resolved
+	ifnetworks []*net.IPNet
+}
+
+func (r *filterRule) matches(ip net.IP) bool {
+	if r.network != nil {
+		return r.network.Contains(ip)
+	}
+
+	for _, n := range r.ifnetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NetFilter manages an IP-based filter to limit access to Snapweb.
+// Rules are evaluated in the order they were added, the first matching one
+// deciding; addresses matching no rule are blocked.
 type NetFilter struct {
-	allowedNetworks []*net.IPNet
-	acceptCache     net.IP
+	sync.RWMutex
+	rules          []*filterRule
+	trustedProxies []*net.IPNet
+	prefixPolicy   PrefixPolicy
+	lastRefresh    time.Time
+
+	cacheLock sync.Mutex
+	cache     map[string]bool
 }
 
 // NewFilter creates a new empty NetFilter to block all connections by default
 func NewFilter() *NetFilter {
-	return &NetFilter{}
+	return &NetFilter{
+		cache: make(map[string]bool),
+	}
+}
+
+// SetPrefixPolicy changes the prefix lengths of the local networks allowed
+// through AddLocalNetworks or AddLocalNetworkForInterface
+func (f *NetFilter) SetPrefixPolicy(policy PrefixPolicy) {
+	f.Lock()
+	f.prefixPolicy = policy
+	f.lastRefresh = time.Time{}
+	f.Unlock()
+
+	f.clearCache()
 }
 
 // IsAllowed verifies if an IP is allowed to access Snapweb
@@ -41,33 +142,104 @@ func (f *NetFilter) IsAllowed(ip net.IP) bool {
 		return false
 	}
 
-	// if an IP was already checked for, accept it again
-	if ip.Equal(f.acceptCache) {
-		return true
+	// IPv4-mapped IPv6 addresses, as seen on dual-stack sockets, are
+	// checked against the IPv4 rules
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
 	}
 
-	// check "allow" rules
-	for _, n := range f.allowedNetworks {
-		if n.Contains(ip) {
-			f.acceptCache = ip
-			return true
+	f.refreshIfNeeded()
+
+	// if an IP was already checked for, give the same answer
+	key := ip.String()
+	if allowed, ok := f.cached(key); ok {
+		return allowed
+	}
+
+	allowed := false
+
+	f.RLock()
+	for _, r := range f.rules {
+		if r.matches(ip) {
+			allowed = r.allow
+			break
 		}
 	}
+	f.RUnlock()
 
-	// block by default
-	return false
+	f.remember(key, allowed)
+
+	return allowed
+}
+
+func (f *NetFilter) cached(key string) (allowed bool, ok bool) {
+	f.cacheLock.Lock()
+	defer f.cacheLock.Unlock()
+
+	allowed, ok = f.cache[key]
+	return allowed, ok
+}
+
+func (f *NetFilter) remember(key string, allowed bool) {
+	f.cacheLock.Lock()
+	defer f.cacheLock.Unlock()
+
+	if len(f.cache) >= filterCacheSize {
+		// make room by forgetting an arbitrary address
+		for k := range f.cache {
+			delete(f.cache, k)
+			break
+		}
+	}
+	f.cache[key] = allowed
+}
+
+func (f *NetFilter) clearCache() {
+	f.cacheLock.Lock()
+	f.cache = make(map[string]bool)
+	f.cacheLock.Unlock()
+}
+
+func (f *NetFilter) addRule(r *filterRule) {
+	f.Lock()
+	f.rules = append(f.rules, r)
+	if r.ifname != "" {
+		// resolve the interface on next use
+		f.lastRefresh = time.Time{}
+	}
+	f.Unlock()
+
+	f.clearCache()
+}
+
+func parseNetwork(network string) (*net.IPNet, error) {
+	_, n, err := net.ParseCIDR(network)
+	if err != nil {
+		log.Println("unable to parse", network, "ignoring it")
+		return nil, fmt.Errorf("Invalid network CIDR %s", network)
+	}
+	return n, nil
 }
 
 // AllowNetwork adds a network definition (CIDR format) to the list of allowed networks
 func (f *NetFilter) AllowNetwork(network string) error {
-	// look for a network expression
-	if _, net, err := net.ParseCIDR(network); err == nil {
-		f.allowedNetworks = append(f.allowedNetworks, net)
-	} else {
-		log.Println("unable to parse", network, "ignoring it")
-		return fmt.Errorf("Invalid network CIDR %s", network)
+	n, err := parseNetwork(network)
+	if err != nil {
+		return err
 	}
 
+	f.addRule(&filterRule{allow: true, network: n})
+	return nil
+}
+
+// DenyNetwork adds a network definition (CIDR format) to the list of denied networks
+func (f *NetFilter) DenyNetwork(network string) error {
+	n, err := parseNetwork(network)
+	if err != nil {
+		return err
+	}
+
+	f.addRule(&filterRule{allow: false, network: n})
 	return nil
 }
 
@@ -76,55 +248,252 @@ func (f *NetFilter) AllowNetwork(network string) error {
 // connections originating from any of the local networks are authorized,
 // anything else is refused
 func (f *NetFilter) AddLocalNetworks() {
-	iflist, err := net.Interfaces()
+	f.addRule(&filterRule{allow: true, ifname: "*"})
+}
+
+// AddLocalNetworkForInterface adds the network for a given interface to the list of allowed
+// networks
+func (f *NetFilter) AddLocalNetworkForInterface(ifname string) {
+	f.addRule(&filterRule{allow: true, ifname: ifname})
+}
+
+// DenyInterface adds all the networks of a given interface to the list of
+// denied networks
+func (f *NetFilter) DenyInterface(ifname string) {
+	f.addRule(&filterRule{allow: false, ifname: ifname})
+}
+
+// AddRule adds a rule of the form "allow <network>", "deny <network>",
+// "allow <interface>" or "deny <interface>", networks being in CIDR format
+func (f *NetFilter) AddRule(rule string) error {
+	allow, target, err := ParseFilterRule(rule)
 	if err != nil {
-		log.Println("Unable to enumerate network interfaces", err.Error())
-		return
+		return err
 	}
 
-	for _, intf := range iflist {
-		f.AddLocalNetworkForInterface(intf.Name)
+	switch {
+	case strings.Contains(target, "/") && allow:
+		return f.AllowNetwork(target)
+	case strings.Contains(target, "/"):
+		return f.DenyNetwork(target)
+	case allow:
+		f.AddLocalNetworkForInterface(target)
+	default:
+		f.DenyInterface(target)
 	}
+
+	return nil
 }
 
-// AddLocalNetworkForInterface adds the network for a given interface to the list of allowed
-// networks
-func (f *NetFilter) AddLocalNetworkForInterface(ifname string) {
-	intf, err := net.InterfaceByName(ifname)
+// ParseFilterRule splits a rule as accepted by AddRule into its action and
+// its network or interface name
+func ParseFilterRule(rule string) (allow bool, target string, err error) {
+	fields := strings.Fields(rule)
+	if len(fields) != 2 {
+		return false, "", fmt.Errorf("Invalid filter rule %q, expected \"allow|deny <network|interface>\"", rule)
+	}
+
+	switch fields[0] {
+	case "allow":
+		allow = true
+	case "deny":
+		allow = false
+	default:
+		return false, "", fmt.Errorf("Invalid filter rule %q, unknown action %q", rule, fields[0])
+	}
+
+	target = fields[1]
+	if strings.Contains(target, "/") {
+		if _, _, err := net.ParseCIDR(target); err != nil {
+			return false, "", fmt.Errorf("Invalid filter rule %q, %q is not a network in CIDR notation", rule, target)
+		}
+	}
+
+	return allow, target, nil
+}
+
+// TrustProxy adds a network (CIDR format) of reverse proxies whose
+// X-Forwarded-For header is used to find the address of the client
+func (f *NetFilter) TrustProxy(network string) error {
+	n, err := parseNetwork(network)
 	if err != nil {
-		log.Println("Error with interface", ifname, err.Error())
-		return
+		return err
+	}
+
+	f.Lock()
+	f.trustedProxies = append(f.trustedProxies, n)
+	f.Unlock()
+
+	return nil
+}
+
+func (f *NetFilter) isTrustedProxy(ip net.IP) bool {
+	f.RLock()
+	defer f.RUnlock()
+
+	for _, n := range f.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Refresh resolves the networks of the interface rules again, following
+// addresses added to or removed from the interfaces. It is done
+// automatically every interfaceRefreshInterval when requests come in.
+func (f *NetFilter) Refresh() {
+	f.Lock()
+	changed := f.refresh()
+	f.Unlock()
+
+	if changed {
+		f.clearCache()
+	}
+}
+
+func (f *NetFilter) refreshIfNeeded() {
+	f.RLock()
+	due := time.Since(f.lastRefresh) >= interfaceRefreshInterval
+	f.RUnlock()
+
+	if due {
+		f.Refresh()
 	}
+}
+
+// refresh resolves the interface rules, to be called with the lock held.
+// It returns whether any rule changed.
+func (f *NetFilter) refresh() bool {
+	f.lastRefresh = time.Now()
 
-	addrs, err := intf.Addrs()
+	var all []string
+	changed := false
+
+	for _, r := range f.rules {
+		if r.ifname == "" {
+			continue
+		}
+
+		ifnames := []string{r.ifname}
+		if r.ifname == "*" {
+			if all == nil {
+				var err error
+				if all, err = interfaceNames(); err != nil {
+					log.Println("Unable to enumerate network interfaces", err.Error())
+				}
+			}
+			ifnames = all
+		}
+
+		var networks []*net.IPNet
+		for _, ifname := range ifnames {
+			networks = append(networks, f.interfaceNetworks(ifname, r.allow)...)
+		}
+
+		if !sameNetworks(networks, r.ifnetworks) {
+			r.ifnetworks = networks
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// interfaceNetworks returns the networks of an interface; only local
+// networks are returned for allow rules
+func (f *NetFilter) interfaceNetworks(ifname string, allow bool) []*net.IPNet {
+	addrs, err := interfaceAddrs(ifname)
 	if err != nil {
-		log.Println("Error adding interface", intf.Name, err.Error())
-		return
+		log.Println("Error adding interface", ifname, err.Error())
+		return nil
 	}
 
+	var networks []*net.IPNet
 	for _, a := range addrs {
-		if ipnet, ok := a.(*net.IPNet); ok {
-			if ipnet.IP.IsLoopback() {
-				f.AllowNetwork(ipnet.String())
-			} else if ipnet.IP.To4() != nil {
-				// only consider IPv4 networks
-				// only consider class-C networks, ie with 256 hosts max.
-				if ones, _ := ipnet.Mask.Size(); ones >= 24 {
-					f.AllowNetwork(ipnet.String())
-				}
-			} // TODO: add proper IPV6 support
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || (allow && !f.isLocalNetwork(ipnet)) {
+			continue
+		}
+		networks = append(networks, &net.IPNet{IP: ipnet.IP.Mask(ipnet.Mask), Mask: ipnet.Mask})
+	}
+	return networks
+}
+
+func sameNetworks(a, b []*net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].String() != b[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// isLocalNetwork checks whether an interface network is to be allowed:
+// loopback, IPv4 networks, and IPv6 link-local or unique local networks,
+// provided they are no larger than what the prefix policy accepts
+func (f *NetFilter) isLocalNetwork(ipnet *net.IPNet) bool {
+	switch {
+	case ipnet.IP.IsLoopback():
+		return true
+	case ipnet.IP.To4() != nil, ipnet.IP.IsLinkLocalUnicast(), isUniqueLocal(ipnet.IP):
+		return f.prefixPolicy.accepts(ipnet)
+	}
+
+	// global IPv6 addresses are reachable from anywhere
+	return false
+}
+
+// isUniqueLocal checks whether an IPv6 address is in fc00::/7 (RFC 4193)
+func isUniqueLocal(ip net.IP) bool {
+	return len(ip) == net.IPv6len && ip[0]&0xfe == 0xfc
+}
+
+// remoteIP extracts the IP address of a request's RemoteAddr, dropping the
+// zone of IPv6 link-local addresses
+func remoteIP(remoteAddr string) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host)
+}
+
+// clientIP finds the address of the client of a request: the remote
+// address, or when it is a trusted proxy, the last address of the
+// X-Forwarded-For chain that is not a trusted proxy
+func (f *NetFilter) clientIP(r *http.Request) net.IP {
+	ip := remoteIP(r.RemoteAddr)
+	if ip == nil || !f.isTrustedProxy(ip) {
+		return ip
+	}
+
+	var forwarded []string
+	for _, h := range r.Header[http.CanonicalHeaderKey("X-Forwarded-For")] {
+		forwarded = append(forwarded, strings.Split(h, ",")...)
+	}
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip = remoteIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil || !f.isTrustedProxy(ip) {
+			return ip
 		}
 	}
 
+	return ip
 }
 
 // FilterHandler wraps and limits access to an http.Handler with the help of a NetFilter
 func (f *NetFilter) FilterHandler(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		host, _, _ := net.SplitHostPort(r.RemoteAddr)
-		ip := net.ParseIP(host)
-		if !f.IsAllowed(ip) {
-			log.Println("Unauthorized access from", r.RemoteAddr)
+		if ip := f.clientIP(r); !f.IsAllowed(ip) {
+			log.Println("Unauthorized access from", ip, "via", r.RemoteAddr)
 			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 			return
 		}
@@ -18,9 +18,12 @@
 package snappy
 
 import (
+	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"time"
 
 	. "gopkg.in/check.v1"
 )
@@ -129,3 +132,271 @@ func (s *FilterSuite) TestAddSpecificInterface(c *C) {
 	res := f.IsAllowed(net.ParseIP("127.0.0.1"))
 	c.Assert(res, Equals, true)
 }
+
+func (s *FilterSuite) TestIPv4MappedAddresses(c *C) {
+	f := NewFilter()
+	f.AllowNetwork("192.168.0.0/24")
+
+	c.Check(f.IsAllowed(net.ParseIP("::ffff:192.168.0.1")), Equals, true)
+	c.Check(f.IsAllowed(net.ParseIP("::ffff:192.168.1.1")), Equals, false)
+
+	handler := f.FilterHandler(simpleHandler())
+
+	for addr, code := range map[string]int{
+		"[::ffff:192.168.0.1]:80": http.StatusOK,
+		"[::ffff:10.0.0.1]:80":    http.StatusForbidden,
+		"192.168.0.1:80":          http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = addr
+		handler.ServeHTTP(rec, req)
+		c.Check(rec.Code, Equals, code, Commentf(addr))
+	}
+}
+
+func (s *FilterSuite) TestLinkLocalRemoteAddress(c *C) {
+	f := NewFilter()
+	f.AllowNetwork("fe80::/64")
+
+	handler := f.FilterHandler(simpleHandler())
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "[fe80::2%eth0]:80"
+	handler.ServeHTTP(rec, req)
+	c.Check(rec.Code, Equals, http.StatusOK)
+}
+
+func fakeInterfaceAddrs(cidrs ...string) func(string) ([]net.Addr, error) {
+	return func(string) ([]net.Addr, error) {
+		var addrs []net.Addr
+		for _, cidr := range cidrs {
+			ip, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+			ipnet.IP = ip
+			addrs = append(addrs, ipnet)
+		}
+		return addrs, nil
+	}
+}
+
+func (s *FilterSuite) TestLocalIPv6Networks(c *C) {
+	defer func(f func(string) ([]net.Addr, error)) { interfaceAddrs = f }(interfaceAddrs)
+	interfaceAddrs = fakeInterfaceAddrs(
+		"::1/128",
+		"fe80::1/64",
+		"fd12:3456:789a:1::1/64",
+		"2001:db8::1/64",
+	)
+
+	f := NewFilter()
+	f.AddLocalNetworkForInterface("eth0")
+
+	c.Check(f.IsAllowed(net.ParseIP("::1")), Equals, true)
+	// link-local
+	c.Check(f.IsAllowed(net.ParseIP("fe80::2")), Equals, true)
+	// unique local
+	c.Check(f.IsAllowed(net.ParseIP("fd12:3456:789a:1::2")), Equals, true)
+	c.Check(f.IsAllowed(net.ParseIP("fd12:3456:789a:2::2")), Equals, false)
+	// global addresses are not considered local
+	c.Check(f.IsAllowed(net.ParseIP("2001:db8::2")), Equals, false)
+}
+
+func (s *FilterSuite) TestPrefixPolicy(c *C) {
+	defer func(f func(string) ([]net.Addr, error)) { interfaceAddrs = f }(interfaceAddrs)
+	interfaceAddrs = fakeInterfaceAddrs(
+		"10.1.2.3/16",
+		"192.168.0.2/24",
+		"fd00:1::1/48",
+		"fd00:2::1/64",
+	)
+
+	tests := []struct {
+		policy  PrefixPolicy
+		allowed map[string]bool
+	}{
+		// defaults: /24 and smaller for IPv4, /64 and smaller for IPv6
+		{PrefixPolicy{}, map[string]bool{
+			"10.1.200.1":    false,
+			"192.168.0.3":   true,
+			"fd00:1:0:5::1": false,
+			"fd00:2::2":     true,
+		}},
+		{PrefixPolicy{IPv4: 16, IPv6: 48}, map[string]bool{
+			"10.1.200.1":    true,
+			"192.168.0.3":   true,
+			"fd00:1:0:5::1": true,
+			"fd00:2::2":     true,
+		}},
+		{PrefixPolicy{IPv4: 32, IPv6: 128}, map[string]bool{
+			"10.1.200.1":    false,
+			"192.168.0.3":   false,
+			"fd00:1:0:5::1": false,
+			"fd00:2::2":     false,
+		}},
+	}
+
+	for _, t := range tests {
+		f := NewFilter()
+		f.SetPrefixPolicy(t.policy)
+		f.AddLocalNetworkForInterface("eth0")
+
+		for ip, allowed := range t.allowed {
+			c.Check(f.IsAllowed(net.ParseIP(ip)), Equals, allowed, Commentf("%v %s", t.policy, ip))
+		}
+	}
+}
+
+func (s *FilterSuite) TestRulesOrder(c *C) {
+	f := NewFilter()
+	c.Assert(f.DenyNetwork("192.168.0.128/25"), IsNil)
+	c.Assert(f.AllowNetwork("192.168.0.0/24"), IsNil)
+	c.Assert(f.DenyNetwork("192.168.0.0/26"), IsNil)
+
+	c.Check(f.IsAllowed(net.ParseIP("192.168.0.200")), Equals, false)
+	// the allow rule comes before the second deny rule
+	c.Check(f.IsAllowed(net.ParseIP("192.168.0.1")), Equals, true)
+	c.Check(f.IsAllowed(net.ParseIP("192.168.1.1")), Equals, false)
+}
+
+func (s *FilterSuite) TestAddRule(c *C) {
+	defer func(f func(string) ([]net.Addr, error)) { interfaceAddrs = f }(interfaceAddrs)
+	interfaceAddrs = func(ifname string) ([]net.Addr, error) {
+		if ifname == "eth1" {
+			return fakeInterfaceAddrs("192.168.1.2/24")(ifname)
+		}
+		return fakeInterfaceAddrs("192.168.0.2/24")(ifname)
+	}
+
+	f := NewFilter()
+	for _, rule := range []string{"deny eth1", "allow 192.168.0.0/16", "allow eth0"} {
+		c.Assert(f.AddRule(rule), IsNil)
+	}
+
+	c.Check(f.IsAllowed(net.ParseIP("192.168.1.1")), Equals, false)
+	c.Check(f.IsAllowed(net.ParseIP("192.168.5.1")), Equals, true)
+
+	for rule, err := range map[string]string{
+		"allow":               `Invalid filter rule "allow", expected .*`,
+		"permit 10.0.0.0/8":   `Invalid filter rule "permit 10.0.0.0/8", unknown action "permit"`,
+		"deny 10.0.0.0/33":    `Invalid filter rule "deny 10.0.0.0/33", "10.0.0.0/33" is not a network in CIDR notation`,
+		"allow eth0 10.0.0.1": `Invalid filter rule "allow eth0 10.0.0.1", expected .*`,
+	} {
+		c.Check(f.AddRule(rule), ErrorMatches, err)
+	}
+}
+
+func (s *FilterSuite) TestTrustedProxy(c *C) {
+	f := NewFilter()
+	f.AllowNetwork("192.168.0.0/24")
+	c.Assert(f.TrustProxy("10.0.0.0/24"), IsNil)
+	c.Assert(f.TrustProxy("bogus"), NotNil)
+
+	handler := f.FilterHandler(simpleHandler())
+
+	tests := []struct {
+		remote    string
+		forwarded []string
+		code      int
+	}{
+		// X-Forwarded-For is ignored unless coming from a trusted proxy
+		{"192.168.0.1:80", []string{"172.16.0.1"}, http.StatusOK},
+		{"172.16.0.1:80", []string{"192.168.0.1"}, http.StatusForbidden},
+		// trusted proxies are followed back to the client
+		{"10.0.0.1:80", []string{"192.168.0.1"}, http.StatusOK},
+		{"10.0.0.1:80", []string{"192.168.0.1, 10.0.0.2"}, http.StatusOK},
+		{"10.0.0.1:80", []string{"192.168.0.1", "10.0.0.2"}, http.StatusOK},
+		// but spoofed addresses before an untrusted hop are not
+		{"10.0.0.1:80", []string{"192.168.0.1, 172.16.0.1"}, http.StatusForbidden},
+		{"10.0.0.1:80", []string{"garbage"}, http.StatusForbidden},
+		// the proxy itself is not allowed
+		{"10.0.0.1:80", nil, http.StatusForbidden},
+	}
+
+	for _, t := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = t.remote
+		for _, h := range t.forwarded {
+			req.Header.Add("X-Forwarded-For", h)
+		}
+		handler.ServeHTTP(rec, req)
+		c.Check(rec.Code, Equals, t.code, Commentf("%s %v", t.remote, t.forwarded))
+	}
+}
+
+func (s *FilterSuite) TestCacheIsBounded(c *C) {
+	f := NewFilter()
+	f.AllowNetwork("10.0.0.0/8")
+
+	for i := 0; i < 2*filterCacheSize; i++ {
+		ip := net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+		c.Assert(f.IsAllowed(ip), Equals, true)
+	}
+	c.Check(len(f.cache) <= filterCacheSize, Equals, true)
+}
+
+func (s *FilterSuite) TestConcurrentAccess(c *C) {
+	f := NewFilter()
+	f.AllowNetwork("10.0.0.0/24")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				ip := net.ParseIP(fmt.Sprintf("10.0.%d.%d", i%2, j))
+				c.Check(f.IsAllowed(ip), Equals, i%2 == 0)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (s *FilterSuite) TestInterfaceChanges(c *C) {
+	defer func(f func(string) ([]net.Addr, error)) { interfaceAddrs = f }(interfaceAddrs)
+	defer func(f func() ([]string, error)) { interfaceNames = f }(interfaceNames)
+	defer func(d time.Duration) { interfaceRefreshInterval = d }(interfaceRefreshInterval)
+
+	interfaceRefreshInterval = time.Hour
+	interfaceNames = func() ([]string, error) { return []string{"eth0"}, nil }
+	interfaceAddrs = fakeInterfaceAddrs("192.168.0.2/24")
+
+	f := NewFilter()
+	f.AddLocalNetworks()
+
+	c.Check(f.IsAllowed(net.ParseIP("192.168.0.1")), Equals, true)
+	c.Check(f.IsAllowed(net.ParseIP("192.168.1.1")), Equals, false)
+
+	// the interface changes network
+	interfaceAddrs = fakeInterfaceAddrs("192.168.1.2/24")
+
+	// nothing changes until the rules are refreshed
+	c.Check(f.IsAllowed(net.ParseIP("192.168.1.1")), Equals, false)
+
+	f.Refresh()
+	c.Check(f.IsAllowed(net.ParseIP("192.168.0.1")), Equals, false)
+	c.Check(f.IsAllowed(net.ParseIP("192.168.1.1")), Equals, true)
+
+	// which happens by itself after a while
+	interfaceRefreshInterval = 0
+	interfaceAddrs = fakeInterfaceAddrs("192.168.2.2/24")
+	c.Check(f.IsAllowed(net.ParseIP("192.168.2.1")), Equals, true)
+}
+
+func (s *FilterSuite) TestMissingInterfaceAppears(c *C) {
+	defer func(f func(string) ([]net.Addr, error)) { interfaceAddrs = f }(interfaceAddrs)
+	interfaceAddrs = func(string) ([]net.Addr, error) { return nil, fmt.Errorf("no such network interface") }
+
+	f := NewFilter()
+	f.AddLocalNetworkForInterface("wlan0")
+	c.Check(f.IsAllowed(net.ParseIP("192.168.0.1")), Equals, false)
+
+	interfaceAddrs = fakeInterfaceAddrs("192.168.0.2/24")
+	f.Refresh()
+	c.Check(f.IsAllowed(net.ParseIP("192.168.0.1")), Equals, true)
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snappy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultCurrency is the currency of the store, preferred when no other is
+const defaultCurrency = "USD"
+
+var currencyPattern = regexp.MustCompile("^[A-Z]{3}$")
+
+// regionCurrencies gives the currency of the regions of the Accept-Language
+// tags, for the currencies the store may price snaps in
+var regionCurrencies = map[string]string{
+	"US": "USD", "PR": "USD", "EC": "USD", "SV": "USD",
+	"AT": "EUR", "BE": "EUR", "CY": "EUR", "DE": "EUR", "EE": "EUR",
+	"ES": "EUR", "FI": "EUR", "FR": "EUR", "GR": "EUR", "IE": "EUR",
+	"IT": "EUR", "LT": "EUR", "LU": "EUR", "LV": "EUR", "MT": "EUR",
+	"NL": "EUR", "PT": "EUR", "SI": "EUR", "SK": "EUR",
+	"GB": "GBP", "CH": "CHF", "SE": "SEK", "NO": "NOK", "DK": "DKK",
+	"PL": "PLN", "CZ": "CZK", "HU": "HUF", "RO": "RON", "RU": "RUB",
+	"CA": "CAD", "MX": "MXN", "BR": "BRL", "AR": "ARS",
+	"AU": "AUD", "NZ": "NZD", "JP": "JPY", "CN": "CNY", "TW": "TWD",
+	"KR": "KRW", "IN": "INR", "ZA": "ZAR",
+}
+
+type snapPrices map[string]float64
+
+// currency returns the first of the preferred currencies the snap is priced
+// in, or the first of its currencies in alphabetical order
+func (p snapPrices) currency(preferred []string) string {
+	for _, currency := range preferred {
+		if _, ok := p[currency]; ok {
+			return currency
+		}
+	}
+
+	currencies := make([]string, 0, len(p))
+	for currency := range p {
+		currencies = append(currencies, currency)
+	}
+	if len(currencies) == 0 {
+		return ""
+	}
+	sort.Strings(currencies)
+	return currencies[0]
+}
+
+func formatPrice(amount float64, currency string) string {
+	return fmt.Sprintf("%s %s", strconv.FormatFloat(amount, 'f', -1, 32), currency)
+}
+
+// selectCurrency gives the price of the package in the preferred currency
+func (pkg *snapPkg) selectCurrency(preferred []string) {
+	pkg.Currency = pkg.Prices.currency(preferred)
+	pkg.Price = ""
+	if pkg.Currency != "" {
+		pkg.Price = formatPrice(pkg.Prices[pkg.Currency], pkg.Currency)
+	}
+}
+
+// acceptedCurrencies returns the currencies of the regions of the languages
+// accepted by the client, from the most to the least preferred
+func acceptedCurrencies(acceptLanguage string) []string {
+	type language struct {
+		region  string
+		quality float64
+	}
+
+	var languages []language
+	for _, item := range strings.Split(acceptLanguage, ",") {
+		params := strings.Split(item, ";")
+		l := language{quality: 1}
+
+		subtags := strings.Split(strings.TrimSpace(params[0]), "-")
+		for _, subtag := range subtags[1:] {
+			// skipping the script, as in zh-Hant-TW
+			if len(subtag) == 2 {
+				l.region = strings.ToUpper(subtag)
+				break
+			}
+		}
+
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					l.quality = q
+				}
+			}
+		}
+
+		if l.region != "" && l.quality > 0 {
+			languages = append(languages, l)
+		}
+	}
+
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].quality > languages[j].quality
+	})
+
+	var currencies []string
+	for _, l := range languages {
+		if currency, ok := regionCurrencies[l.region]; ok && !contains(currencies, currency) {
+			currencies = append(currencies, currency)
+		}
+	}
+	return currencies
+}
+
+// preferredCurrencies returns the currencies to give the prices in, by order
+// of preference: the configured one, the ones of the client languages and
+// the one of the store
+func (h *Handler) preferredCurrencies(r *http.Request) []string {
+	var currencies []string
+	if h.settings != nil && h.settings.Config().Currency != "" {
+		currencies = append(currencies, h.settings.Config().Currency)
+	}
+	currencies = append(currencies, acceptedCurrencies(r.Header.Get("Accept-Language"))...)
+	return append(currencies, defaultCurrency)
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snappy
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/snapcore/snapd/client"
+
+	"github.com/snapcore/snapweb/statetracker"
+)
+
+// purchaseState tells whether a snap is owned and, if not, for how much
+// and whether it can be bought
+type purchaseState struct {
+	Owned      bool       `json:"owned"`
+	Prices     snapPrices `json:"prices,omitempty"`
+	Currency   string     `json:"currency,omitempty"`
+	Price      string     `json:"price,omitempty"`
+	ReadyToBuy bool       `json:"ready_to_buy"`
+	// Message tells why the snap cannot be bought yet
+	Message string `json:"message,omitempty"`
+	// State is the outcome of the purchase, as given by the store
+	State string `json:"state,omitempty"`
+}
+
+type purchaseRequest struct {
+	// Currency defaults to the preferred one
+	Currency string `json:"currency"`
+}
+
+// isOwned tells whether the snap can be installed without buying it, snapd
+// only giving the priced status to the snaps the user did not buy
+func isOwned(snap *client.Snap) bool {
+	return snap.Status != statetracker.StatusPriced || len(snap.Prices) == 0
+}
+
+func (h *Handler) purchaseState(snap *client.Snap, currencies []string) purchaseState {
+	if isOwned(snap) {
+		return purchaseState{Owned: true}
+	}
+
+	state := purchaseState{Prices: snap.Prices}
+	state.Currency = state.Prices.currency(currencies)
+	state.Price = formatPrice(state.Prices[state.Currency], state.Currency)
+
+	if err := h.snapdClient.ReadyToBuy(); err != nil {
+		state.Message = err.Error()
+	} else {
+		state.ReadyToBuy = true
+	}
+
+	return state
+}
+
+func (h *Handler) getPurchase(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	snap, err := h.getSnap(name)
+	if err != nil {
+		WriteError(w, ErrorStatus(err), err)
+		return
+	}
+
+	h.jsonResponseOrError(h.purchaseState(snap, h.preferredCurrencies(r)), w)
+}
+
+func (h *Handler) purchase(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var req purchaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		WriteErrorf(w, http.StatusBadRequest, "Invalid purchase request: %s", err)
+		return
+	}
+
+	snap, err := h.getSnap(name)
+	if err != nil {
+		WriteError(w, ErrorStatus(err), err)
+		return
+	}
+
+	if isOwned(snap) {
+		WriteErrorf(w, http.StatusConflict, "Snap %s is already owned", name)
+		return
+	}
+
+	prices := snapPrices(snap.Prices)
+	currency := req.Currency
+	if currency == "" {
+		currency = prices.currency(h.preferredCurrencies(r))
+	}
+	price, ok := prices[currency]
+	if !ok {
+		WriteErrorf(w, http.StatusBadRequest, "Snap %s is not priced in %s", name, currency)
+		return
+	}
+
+	if err := h.snapdClient.ReadyToBuy(); err != nil {
+		WriteError(w, http.StatusForbidden, err)
+		return
+	}
+
+	result, err := h.snapdClient.Buy(&client.BuyOptions{
+		SnapID:   snap.ID,
+		Price:    price,
+		Currency: currency,
+	})
+	if err != nil {
+		log.Printf("Cannot buy %s for %s: %s", name, formatPrice(price, currency), err)
+		WriteError(w, ErrorStatus(err), err)
+		return
+	}
+
+	h.jsonResponseOrError(purchaseState{Owned: true, State: result.State}, w)
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snappy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/snapcore/snapd/client"
+
+	"github.com/snapcore/snapweb/snappy/common"
+	"github.com/snapcore/snapweb/snappy/snapdclient"
+	"github.com/snapcore/snapweb/statetracker"
+
+	. "gopkg.in/check.v1"
+)
+
+type PurchaseSuite struct {
+	c *snapdclient.FakeSnapdClient
+	h Handler
+}
+
+var _ = Suite(&PurchaseSuite{})
+
+func (s *PurchaseSuite) SetUpTest(c *C) {
+	os.Setenv("SNAP_DATA", c.MkDir())
+
+	priced := common.NewSnap("paid")
+	priced.ID = "paid-id"
+	priced.Status = statetracker.StatusPriced
+	priced.Prices = map[string]float64{"USD": 2.99, "EUR": 2.49, "GBP": 1.99}
+
+	s.c = &snapdclient.FakeSnapdClient{
+		Err:        errors.New("not installed"),
+		StoreSnaps: []*client.Snap{priced, common.NewSnap("free")},
+	}
+	s.h = Handler{stateTracker: statetracker.New()}
+	s.h.setClient(s.c)
+}
+
+func (s *PurchaseSuite) request(c *C, method, url, body, acceptLanguage string) (*httptest.ResponseRecorder, purchaseState) {
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	c.Assert(err, IsNil)
+	if acceptLanguage != "" {
+		req.Header.Set("Accept-Language", acceptLanguage)
+	}
+
+	s.h.MakeMuxer("", mux.NewRouter()).ServeHTTP(rec, req)
+
+	var state purchaseState
+	if rec.Code == http.StatusOK {
+		c.Assert(json.Unmarshal(rec.Body.Bytes(), &state), IsNil)
+	}
+	return rec, state
+}
+
+func (s *PurchaseSuite) TestOwned(c *C) {
+	rec, state := s.request(c, "GET", "/free/purchase", "", "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Check(state, DeepEquals, purchaseState{Owned: true})
+}
+
+func (s *PurchaseSuite) TestNotFound(c *C) {
+	rec, _ := s.request(c, "GET", "/unknown/purchase", "", "")
+	c.Check(rec.Code, Equals, http.StatusNotFound)
+}
+
+func (s *PurchaseSuite) TestPriced(c *C) {
+	rec, state := s.request(c, "GET", "/paid/purchase", "", "fr-FR, en-US;q=0.5")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Check(state, DeepEquals, purchaseState{
+		Prices:     snapPrices{"USD": 2.99, "EUR": 2.49, "GBP": 1.99},
+		Currency:   "EUR",
+		Price:      "2.49 EUR",
+		ReadyToBuy: true,
+	})
+
+	// the configured currency prevails
+	s.h.settings = NewConfigWatcher(Config{Currency: "GBP"})
+	_, state = s.request(c, "GET", "/paid/purchase", "", "fr-FR")
+	c.Check(state.Price, Equals, "1.99 GBP")
+}
+
+func (s *PurchaseSuite) TestPricedNotReady(c *C) {
+	s.c.NotReadyErr = errors.New("no payment methods")
+
+	rec, state := s.request(c, "GET", "/paid/purchase", "", "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Check(state.Owned, Equals, false)
+	c.Check(state.Price, Equals, "2.99 USD")
+	c.Check(state.ReadyToBuy, Equals, false)
+	c.Check(state.Message, Equals, "no payment methods")
+}
+
+func (s *PurchaseSuite) TestBuy(c *C) {
+	rec, state := s.request(c, "POST", "/paid/purchase", "", "en-GB")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Check(state, DeepEquals, purchaseState{Owned: true, State: "Complete"})
+	c.Check(s.c.Bought, DeepEquals, []client.BuyOptions{
+		{SnapID: "paid-id", Price: 1.99, Currency: "GBP"},
+	})
+
+	rec, _ = s.request(c, "POST", "/paid/purchase", `{"currency": "EUR"}`, "en-GB")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Check(s.c.Bought[1], DeepEquals, client.BuyOptions{SnapID: "paid-id", Price: 2.49, Currency: "EUR"})
+}
+
+func (s *PurchaseSuite) TestBuyErrors(c *C) {
+	tests := []struct {
+		name        string
+		body        string
+		notReadyErr error
+		buyErr      error
+		code        int
+		kind        string
+		message     string
+		snapd       *SnapdError
+	}{
+		{"free", "", nil, nil, http.StatusConflict, "conflict", "Snap free is already owned", nil},
+		{"unknown", "", nil, nil, http.StatusNotFound, "not-found", "Snap unknown could not be retrieved", nil},
+		{"paid", "{", nil, nil, http.StatusBadRequest, "bad-request", "Invalid purchase request: unexpected EOF", nil},
+		{"paid", `{"currency": "JPY"}`, nil, nil, http.StatusBadRequest, "bad-request", "Snap paid is not priced in JPY", nil},
+		{"paid", "", errors.New("terms not accepted"), nil, http.StatusForbidden, "forbidden", "terms not accepted", nil},
+		{"paid", "", nil, &client.Error{Kind: client.ErrorKindPaymentDeclined, Message: "payment declined"},
+			http.StatusPaymentRequired, "payment-required", "payment declined", &SnapdError{Kind: "payment-declined"}},
+		{"paid", "", nil, &client.Error{Kind: client.ErrorKindLoginRequired, Message: "login required"},
+			http.StatusForbidden, "forbidden", "login required", &SnapdError{Kind: "login-required"}},
+		{"paid", "", nil, &client.Error{Kind: client.ErrorKindTermsNotAccepted, Message: "terms not accepted"},
+			http.StatusForbidden, "forbidden", "terms not accepted", &SnapdError{Kind: "terms-not-accepted"}},
+		{"paid", "", nil, errors.New("store failure"), http.StatusInternalServerError, "internal-error", "store failure", nil},
+	}
+
+	for _, tt := range tests {
+		s.c.NotReadyErr = tt.notReadyErr
+		s.c.BuyErr = tt.buyErr
+
+		rec, _ := s.request(c, "POST", "/"+tt.name+"/purchase", tt.body, "")
+		c.Check(rec.Code, Equals, tt.code, Commentf(tt.message))
+
+		var resp ErrorResponse
+		c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), IsNil)
+		c.Check(resp, DeepEquals, ErrorResponse{Kind: tt.kind, Message: tt.message, Snapd: tt.snapd})
+	}
+	c.Check(s.c.Bought, HasLen, 0)
+
+	// snapd cannot be reached
+	s.c.BuyErr = snapdConnectionError(c)
+	rec, _ := s.request(c, "POST", "/paid/purchase", "", "")
+	c.Check(rec.Code, Equals, http.StatusServiceUnavailable)
+}
+
+func (s *PurchaseSuite) TestInstallNotBought(c *C) {
+	err := s.h.installPackage("paid")
+	c.Check(err, ErrorMatches, "Snap paid must be bought first")
+	c.Check(s.c.Installed, Equals, "")
+}
+
+func (s *PurchaseSuite) TestListingCurrency(c *C) {
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/?fields=name,price,currency,prices", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Accept-Language", "de-CH, de;q=0.8")
+
+	s.h.getAll(rec, req)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	var pkgs []map[string]interface{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &pkgs), IsNil)
+	c.Check(pkgs, DeepEquals, []map[string]interface{}{
+		{
+			"name":     "paid",
+			"price":    "2.99 USD",
+			"currency": "USD",
+			"prices":   map[string]interface{}{"USD": 2.99, "EUR": 2.49, "GBP": 1.99},
+		},
+		{"name": "free"},
+	})
+}
@@ -0,0 +1,352 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snappy
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/snapcore/snapd/client"
+
+	"github.com/snapcore/snapweb/snappy/snapdclient"
+)
+
+var (
+	// storeCacheTTL is how long the store query results are reused
+	storeCacheTTL = time.Minute
+	// changePollInterval is how often a running change is checked for
+	// completion, to invalidate the store cache once it is done
+	changePollInterval = time.Second
+
+	timeNow = time.Now
+)
+
+// the results of the store queries shared by all the clients
+var sharedStoreCache = &storeCache{}
+
+type findKey struct {
+	query   string
+	section string
+	private bool
+}
+
+type findResult struct {
+	snaps []*client.Snap
+	info  *client.ResultInfo
+	time  time.Time
+}
+
+type findOneResult struct {
+	snap *client.Snap
+	info *client.ResultInfo
+	time time.Time
+}
+
+type detailsResult struct {
+	details *snapdclient.SnapDetails
+	time    time.Time
+}
+
+type sectionsResult struct {
+	sections []string
+	time     time.Time
+}
+
+// storeCache keeps the results of the store queries for storeCacheTTL,
+// until the installed snaps change
+type storeCache struct {
+	sync.Mutex
+	finds    map[findKey]findResult
+	snaps    map[string]findOneResult
+	details  map[string]detailsResult
+	sections *sectionsResult
+	// installed fingerprints the installed snaps as last listed
+	installed string
+}
+
+func fresh(t time.Time) bool {
+	return timeNow().Sub(t) < storeCacheTTL
+}
+
+func (sc *storeCache) find(key findKey) ([]*client.Snap, *client.ResultInfo, bool) {
+	sc.Lock()
+	defer sc.Unlock()
+
+	result, ok := sc.finds[key]
+	if !ok || !fresh(result.time) {
+		return nil, nil, false
+	}
+
+	// the callers sort the snaps in place
+	return append([]*client.Snap(nil), result.snaps...), result.info, true
+}
+
+func (sc *storeCache) storeFind(key findKey, snaps []*client.Snap, info *client.ResultInfo) {
+	sc.Lock()
+	defer sc.Unlock()
+
+	if sc.finds == nil {
+		sc.finds = make(map[findKey]findResult)
+	}
+
+	// each search keystroke has its query, do not keep them all
+	for k, result := range sc.finds {
+		if !fresh(result.time) {
+			delete(sc.finds, k)
+		}
+	}
+
+	sc.finds[key] = findResult{
+		snaps: append([]*client.Snap(nil), snaps...),
+		info:  info,
+		time:  timeNow(),
+	}
+}
+
+func (sc *storeCache) findOne(name string) (*client.Snap, *client.ResultInfo, bool) {
+	sc.Lock()
+	defer sc.Unlock()
+
+	result, ok := sc.snaps[name]
+	if !ok || !fresh(result.time) {
+		return nil, nil, false
+	}
+	return result.snap, result.info, true
+}
+
+func (sc *storeCache) storeFindOne(name string, snap *client.Snap, info *client.ResultInfo) {
+	sc.Lock()
+	defer sc.Unlock()
+
+	if sc.snaps == nil {
+		sc.snaps = make(map[string]findOneResult)
+	}
+
+	for k, result := range sc.snaps {
+		if !fresh(result.time) {
+			delete(sc.snaps, k)
+		}
+	}
+
+	sc.snaps[name] = findOneResult{snap: snap, info: info, time: timeNow()}
+}
+
+func (sc *storeCache) findOneDetails(name string) (*snapdclient.SnapDetails, bool) {
+	sc.Lock()
+	defer sc.Unlock()
+
+	result, ok := sc.details[name]
+	if !ok || !fresh(result.time) {
+		return nil, false
+	}
+	return result.details, true
+}
+
+func (sc *storeCache) storeFindOneDetails(name string, details *snapdclient.SnapDetails) {
+	sc.Lock()
+	defer sc.Unlock()
+
+	if sc.details == nil {
+		sc.details = make(map[string]detailsResult)
+	}
+
+	for k, result := range sc.details {
+		if !fresh(result.time) {
+			delete(sc.details, k)
+		}
+	}
+
+	sc.details[name] = detailsResult{details: details, time: timeNow()}
+}
+
+func (sc *storeCache) getSections() ([]string, bool) {
+	sc.Lock()
+	defer sc.Unlock()
+
+	if sc.sections == nil || !fresh(sc.sections.time) {
+		return nil, false
+	}
+	return append([]string(nil), sc.sections.sections...), true
+}
+
+func (sc *storeCache) storeSections(sections []string) {
+	sc.Lock()
+	defer sc.Unlock()
+
+	sc.sections = &sectionsResult{
+		sections: append([]string(nil), sections...),
+		time:     timeNow(),
+	}
+}
+
+// invalidate forgets all the results
+func (sc *storeCache) invalidate() {
+	sc.Lock()
+	defer sc.Unlock()
+
+	sc.finds = nil
+	sc.snaps = nil
+	sc.details = nil
+	sc.sections = nil
+}
+
+// observeInstalled invalidates the results when the installed snaps are not
+// the ones last listed, as after a refresh or a change made outside snapweb
+func (sc *storeCache) observeInstalled(snaps []*client.Snap) {
+	lines := make([]string, 0, len(snaps))
+	for _, snap := range snaps {
+		lines = append(lines, fmt.Sprintf("%s %s %s", snap.Name, snap.Revision, snap.Status))
+	}
+	sort.Strings(lines)
+
+	h := sha256.New()
+	for _, line := range lines {
+		fmt.Fprintln(h, line)
+	}
+	installed := fmt.Sprintf("%x", h.Sum(nil))
+
+	sc.Lock()
+	changed := sc.installed != "" && sc.installed != installed
+	sc.installed = installed
+	sc.Unlock()
+
+	if changed {
+		sc.invalidate()
+	}
+}
+
+// invalidateWhenReady waits for the change to be done to invalidate the
+// results, which it may well have made stale
+func (sc *storeCache) invalidateWhenReady(c snapdclient.SnapdClient, changeID string) {
+	for {
+		change, err := c.Change(changeID)
+		if err != nil || change == nil || change.Ready {
+			break
+		}
+		time.Sleep(changePollInterval)
+	}
+
+	sc.invalidate()
+}
+
+// cachingClient is a SnapdClient reusing the results of the store queries
+type cachingClient struct {
+	snapdclient.SnapdClient
+	cache *storeCache
+}
+
+// NewCachingClient returns a client caching the results of the store
+// queries made through c, the cache being shared by all such clients
+func NewCachingClient(c snapdclient.SnapdClient) snapdclient.SnapdClient {
+	return &cachingClient{
+		SnapdClient: c,
+		cache:       sharedStoreCache,
+	}
+}
+
+// Find returns the snaps of the store matching the query
+func (c *cachingClient) Find(opts *client.FindOptions) ([]*client.Snap, *client.ResultInfo, error) {
+	key := findKey{query: opts.Query, section: opts.Section, private: opts.Private}
+	if snaps, info, ok := c.cache.find(key); ok {
+		return snaps, info, nil
+	}
+
+	snaps, info, err := c.SnapdClient.Find(opts)
+	if err == nil {
+		c.cache.storeFind(key, snaps, info)
+	}
+	return snaps, info, err
+}
+
+// FindOne returns the named snap of the store
+func (c *cachingClient) FindOne(name string) (*client.Snap, *client.ResultInfo, error) {
+	if snap, info, ok := c.cache.findOne(name); ok {
+		return snap, info, nil
+	}
+
+	snap, info, err := c.SnapdClient.FindOne(name)
+	if err == nil && snap != nil {
+		c.cache.storeFindOne(name, snap, info)
+	}
+	return snap, info, err
+}
+
+// FindOneDetails returns the details of the named snap of the store
+func (c *cachingClient) FindOneDetails(name string) (*snapdclient.SnapDetails, error) {
+	if details, ok := c.cache.findOneDetails(name); ok {
+		return details, nil
+	}
+
+	details, err := c.SnapdClient.FindOneDetails(name)
+	if err == nil {
+		c.cache.storeFindOneDetails(name, details)
+	}
+	return details, err
+}
+
+// Sections returns the sections of the store
+func (c *cachingClient) Sections() ([]string, error) {
+	if sections, ok := c.cache.getSections(); ok {
+		return sections, nil
+	}
+
+	sections, err := c.SnapdClient.Sections()
+	if err == nil {
+		c.cache.storeSections(sections)
+	}
+	return sections, err
+}
+
+// List returns the installed snaps, invalidating the cache when they changed
+func (c *cachingClient) List(names []string, opts *client.ListOptions) ([]*client.Snap, error) {
+	snaps, err := c.SnapdClient.List(names, opts)
+	if err == nil && len(names) == 0 {
+		c.cache.observeInstalled(snaps)
+	}
+	return snaps, err
+}
+
+// Install installs the snap, invalidating the cache once done
+func (c *cachingClient) Install(name string, options *client.SnapOptions) (string, error) {
+	changeID, err := c.SnapdClient.Install(name, options)
+	if err == nil {
+		go c.cache.invalidateWhenReady(c.SnapdClient, changeID)
+	}
+	return changeID, err
+}
+
+// Remove removes the snap, invalidating the cache once done
+func (c *cachingClient) Remove(name string, options *client.SnapOptions) (string, error) {
+	changeID, err := c.SnapdClient.Remove(name, options)
+	if err == nil {
+		go c.cache.invalidateWhenReady(c.SnapdClient, changeID)
+	}
+	return changeID, err
+}
+
+// Buy buys the snap, invalidating the cache where it is still priced
+func (c *cachingClient) Buy(opts *client.BuyOptions) (*client.BuyResult, error) {
+	result, err := c.SnapdClient.Buy(opts)
+	if err == nil {
+		c.cache.invalidate()
+	}
+	return result, err
+}
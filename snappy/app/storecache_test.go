@@ -0,0 +1,275 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snappy
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/snapcore/snapd/client"
+	"github.com/snapcore/snapd/snap"
+
+	"github.com/snapcore/snapweb/snappy/common"
+	"github.com/snapcore/snapweb/snappy/snapdclient"
+
+	. "gopkg.in/check.v1"
+)
+
+// countingClient counts the store queries reaching snapd
+type countingClient struct {
+	*snapdclient.FakeSnapdClient
+	sync.Mutex
+	finds    int
+	findOnes int
+	details  int
+	sections int
+	changes  int
+}
+
+func (c *countingClient) Find(opts *client.FindOptions) ([]*client.Snap, *client.ResultInfo, error) {
+	c.finds++
+	return c.FakeSnapdClient.Find(opts)
+}
+
+func (c *countingClient) FindOne(name string) (*client.Snap, *client.ResultInfo, error) {
+	c.findOnes++
+	return c.FakeSnapdClient.FindOne(name)
+}
+
+func (c *countingClient) FindOneDetails(name string) (*snapdclient.SnapDetails, error) {
+	c.details++
+	return c.FakeSnapdClient.FindOneDetails(name)
+}
+
+func (c *countingClient) Sections() ([]string, error) {
+	c.sections++
+	return c.FakeSnapdClient.Sections()
+}
+
+func (c *countingClient) Change(id string) (*client.Change, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.changes++
+	// the change is done the second time it is looked at
+	return &client.Change{ID: id, Ready: c.changes > 1}, nil
+}
+
+type StoreCacheSuite struct {
+	snapd *countingClient
+	cache *storeCache
+	c     *cachingClient
+	now   time.Time
+
+	previousTimeNow            func() time.Time
+	previousChangePollInterval time.Duration
+}
+
+var _ = Suite(&StoreCacheSuite{})
+
+func (s *StoreCacheSuite) SetUpTest(c *C) {
+	s.previousTimeNow = timeNow
+	s.previousChangePollInterval = changePollInterval
+
+	s.now = time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)
+	timeNow = func() time.Time { return s.now }
+	changePollInterval = time.Millisecond
+
+	s.snapd = &countingClient{FakeSnapdClient: &snapdclient.FakeSnapdClient{
+		StoreSnaps:   []*client.Snap{common.NewSnap("b"), common.NewSnap("a")},
+		SnapSections: []string{"games"},
+		StoreDetails: map[string]*snapdclient.SnapDetails{"a": {License: "MIT"}},
+	}}
+	s.cache = &storeCache{}
+	s.c = &cachingClient{SnapdClient: s.snapd, cache: s.cache}
+}
+
+func (s *StoreCacheSuite) TearDownTest(c *C) {
+	timeNow = s.previousTimeNow
+	changePollInterval = s.previousChangePollInterval
+}
+
+func (s *StoreCacheSuite) TestFindCachedPerQuery(c *C) {
+	opts := &client.FindOptions{Query: "foo"}
+
+	snaps, _, err := s.c.Find(opts)
+	c.Assert(err, IsNil)
+	c.Assert(snaps, HasLen, 2)
+	// reordering the results does not change the cached ones
+	snaps[0], snaps[1] = snaps[1], snaps[0]
+
+	snaps, _, err = s.c.Find(&client.FindOptions{Query: "foo"})
+	c.Assert(err, IsNil)
+	c.Check(snaps[0].Name, Equals, "b")
+	c.Check(s.snapd.finds, Equals, 1)
+
+	for _, opts := range []*client.FindOptions{
+		{Query: "bar"},
+		{Query: "foo", Section: "games"},
+		{Query: "foo", Private: true},
+	} {
+		_, _, err = s.c.Find(opts)
+		c.Assert(err, IsNil)
+	}
+	c.Check(s.snapd.finds, Equals, 4)
+}
+
+func (s *StoreCacheSuite) TestFindExpires(c *C) {
+	opts := &client.FindOptions{Query: "foo"}
+
+	_, _, err := s.c.Find(opts)
+	c.Assert(err, IsNil)
+
+	s.now = s.now.Add(storeCacheTTL - time.Second)
+	_, _, err = s.c.Find(opts)
+	c.Assert(err, IsNil)
+	c.Check(s.snapd.finds, Equals, 1)
+
+	s.now = s.now.Add(time.Second)
+	_, _, err = s.c.Find(opts)
+	c.Assert(err, IsNil)
+	c.Check(s.snapd.finds, Equals, 2)
+}
+
+func (s *StoreCacheSuite) TestErrorsNotCached(c *C) {
+	s.snapd.StoreErr = errors.New("offline")
+	s.snapd.Err = errors.New("offline")
+
+	_, _, err := s.c.Find(&client.FindOptions{Query: "foo"})
+	c.Assert(err, NotNil)
+	_, err = s.c.Sections()
+	c.Assert(err, NotNil)
+
+	s.snapd.StoreErr = nil
+	s.snapd.Err = nil
+
+	snaps, _, err := s.c.Find(&client.FindOptions{Query: "foo"})
+	c.Assert(err, IsNil)
+	c.Check(snaps, HasLen, 2)
+	sections, err := s.c.Sections()
+	c.Assert(err, IsNil)
+	c.Check(sections, DeepEquals, []string{"games"})
+
+	c.Check(s.snapd.finds, Equals, 2)
+	c.Check(s.snapd.sections, Equals, 2)
+}
+
+func (s *StoreCacheSuite) TestFindOneAndSectionsCached(c *C) {
+	for i := 0; i < 2; i++ {
+		snap, _, err := s.c.FindOne("a")
+		c.Assert(err, IsNil)
+		c.Check(snap.Name, Equals, "a")
+
+		details, err := s.c.FindOneDetails("a")
+		c.Assert(err, IsNil)
+		c.Check(details.License, Equals, "MIT")
+
+		sections, err := s.c.Sections()
+		c.Assert(err, IsNil)
+		c.Check(sections, DeepEquals, []string{"games"})
+	}
+
+	c.Check(s.snapd.findOnes, Equals, 1)
+	c.Check(s.snapd.details, Equals, 1)
+	c.Check(s.snapd.sections, Equals, 1)
+}
+
+func (s *StoreCacheSuite) TestInstallInvalidatesOnceDone(c *C) {
+	_, _, err := s.c.Find(&client.FindOptions{Query: "foo"})
+	c.Assert(err, IsNil)
+
+	_, err = s.c.Install("a", nil)
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 1000; i++ {
+		if _, _, ok := s.cache.find(findKey{query: "foo"}); !ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	s.snapd.Lock()
+	c.Check(s.snapd.changes, Equals, 2)
+	s.snapd.Unlock()
+
+	_, _, err = s.c.Find(&client.FindOptions{Query: "foo"})
+	c.Assert(err, IsNil)
+	c.Check(s.snapd.finds, Equals, 2)
+}
+
+func (s *StoreCacheSuite) TestInstalledChangeInvalidates(c *C) {
+	installed := []*client.Snap{common.NewSnap("a")}
+	installed[0].Revision = snap.R(1)
+	s.snapd.Snaps = installed
+
+	_, err := s.c.List(nil, nil)
+	c.Assert(err, IsNil)
+	_, _, err = s.c.Find(&client.FindOptions{Query: "foo"})
+	c.Assert(err, IsNil)
+
+	// listing the same snaps keeps the results
+	_, err = s.c.List(nil, nil)
+	c.Assert(err, IsNil)
+	_, _, err = s.c.Find(&client.FindOptions{Query: "foo"})
+	c.Assert(err, IsNil)
+	c.Check(s.snapd.finds, Equals, 1)
+
+	// refreshed
+	installed[0].Revision = snap.R(2)
+	_, err = s.c.List(nil, nil)
+	c.Assert(err, IsNil)
+	_, _, err = s.c.Find(&client.FindOptions{Query: "foo"})
+	c.Assert(err, IsNil)
+	c.Check(s.snapd.finds, Equals, 2)
+}
+
+func (s *StoreCacheSuite) TestETagMatches(c *C) {
+	tests := []struct {
+		ifNoneMatch string
+		matches     bool
+	}{
+		{"", false},
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"def", "abc"`, true},
+		{`"def"`, false},
+		{`abc`, false},
+		{`*`, true},
+	}
+
+	for _, tt := range tests {
+		c.Check(etagMatches(tt.ifNoneMatch, `"abc"`), Equals, tt.matches, Commentf(tt.ifNoneMatch))
+	}
+}
+
+func (s *StoreCacheSuite) TestBuyInvalidates(c *C) {
+	_, _, err := s.c.Find(&client.FindOptions{Query: "foo"})
+	c.Assert(err, IsNil)
+
+	s.snapd.BuyErr = errors.New("payment declined")
+	_, err = s.c.Buy(&client.BuyOptions{SnapID: "id"})
+	c.Assert(err, NotNil)
+	_, _, ok := s.cache.find(findKey{query: "foo"})
+	c.Check(ok, Equals, true)
+
+	s.snapd.BuyErr = nil
+	_, err = s.c.Buy(&client.BuyOptions{SnapID: "id"})
+	c.Assert(err, IsNil)
+	_, _, ok = s.cache.find(findKey{query: "foo"})
+	c.Check(ok, Equals, false)
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snapdclient
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/snapcore/snapd/asserts"
+)
+
+// ErrUnknownAssertionType is returned for assertion types snapd does not know
+var ErrUnknownAssertionType = errors.New("Unknown assertion type")
+
+// Assertion is an assertion with its decoded headers
+type Assertion struct {
+	Type     string                 `json:"type"`
+	Revision int                    `json:"revision"`
+	Headers  map[string]interface{} `json:"headers"`
+	Body     string                 `json:"body,omitempty"`
+	// Signed is the complete assertion, as signed text
+	Signed string `json:"signed"`
+}
+
+// decodeHeader checks that a header value only holds what assertions can,
+// strings, lists and maps, returning it in a form suitable for JSON
+func decodeHeader(name string, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			decoded, err := decodeHeader(fmt.Sprintf("%s[%d]", name, i), item)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = decoded
+		}
+		return list, nil
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			decoded, err := decodeHeader(name+"."+key, item)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = decoded
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("Invalid header %s: unexpected %T", name, value)
+	}
+}
+
+// NewAssertion decodes the headers of an assertion returned by snapd
+func NewAssertion(a asserts.Assertion) (Assertion, error) {
+	headers := a.Headers()
+
+	// sorted, for the error on a malformed header to be reproducible
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	decoded := make(map[string]interface{}, len(headers))
+	for _, name := range names {
+		value, err := decodeHeader(name, headers[name])
+		if err != nil {
+			return Assertion{}, err
+		}
+		decoded[name] = value
+	}
+
+	assertion := Assertion{
+		Revision: a.Revision(),
+		Headers:  decoded,
+		Body:     string(a.Body()),
+		Signed:   string(asserts.Encode(a)),
+	}
+	if t := a.Type(); t != nil {
+		assertion.Type = t.Name
+	}
+
+	return assertion, nil
+}
+
+// GetAssertions returns the assertions of the given type known to snapd,
+// with headers matching the given ones
+func GetAssertions(c SnapdClient, assertType string, headers map[string]string) ([]Assertion, error) {
+	if asserts.Type(assertType) == nil {
+		return nil, ErrUnknownAssertionType
+	}
+
+	known, err := c.Known(assertType, headers)
+	if err != nil {
+		return nil, err
+	}
+
+	assertions := make([]Assertion, 0, len(known))
+	for _, a := range known {
+		assertion, err := NewAssertion(a)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed %s assertion: %v", assertType, err)
+		}
+		assertions = append(assertions, assertion)
+	}
+
+	return assertions, nil
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snapdclient
+
+import (
+	"github.com/snapcore/snapd/asserts"
+	. "gopkg.in/check.v1"
+)
+
+// fakeAssertion is an assertion made of its headers, body and signature
+type fakeAssertion struct {
+	assertType string
+	revision   int
+	headers    map[string]interface{}
+	body       string
+	signature  string
+}
+
+func (a *fakeAssertion) Type() *asserts.AssertionType {
+	return asserts.Type(a.assertType)
+}
+
+func (a *fakeAssertion) Revision() int {
+	return a.revision
+}
+
+func (a *fakeAssertion) Header(name string) interface{} {
+	return a.headers[name]
+}
+
+func (a *fakeAssertion) Headers() map[string]interface{} {
+	return a.headers
+}
+
+func (a *fakeAssertion) Body() []byte {
+	return []byte(a.body)
+}
+
+func (a *fakeAssertion) Signature() (content, signature []byte) {
+	return []byte("type: " + a.assertType), []byte(a.signature)
+}
+
+type AssertionsSuite struct{}
+
+var _ = Suite(&AssertionsSuite{})
+
+func newAccountKey(account, name string) *fakeAssertion {
+	return &fakeAssertion{
+		assertType: "account-key",
+		revision:   2,
+		headers: map[string]interface{}{
+			"type":       "account-key",
+			"account-id": account,
+			"name":       name,
+			"constraints": []interface{}{
+				map[string]interface{}{"series": []interface{}{"16"}},
+			},
+		},
+		body:      "PUBLIC KEY",
+		signature: "SIGNATURE",
+	}
+}
+
+func (s *AssertionsSuite) TestNewAssertion(c *C) {
+	assertion, err := NewAssertion(newAccountKey("canonical", "root"))
+	c.Assert(err, IsNil)
+
+	c.Check(assertion, DeepEquals, Assertion{
+		Type:     "account-key",
+		Revision: 2,
+		Headers: map[string]interface{}{
+			"type":       "account-key",
+			"account-id": "canonical",
+			"name":       "root",
+			"constraints": []interface{}{
+				map[string]interface{}{"series": []interface{}{"16"}},
+			},
+		},
+		Body:   "PUBLIC KEY",
+		Signed: "type: account-key\n\nSIGNATURE",
+	})
+}
+
+func (s *AssertionsSuite) TestNewAssertionMalformedHeader(c *C) {
+	for _, value := range []interface{}{
+		42,
+		[]interface{}{"a", 1.5},
+		map[string]interface{}{"series": []interface{}{nil}},
+	} {
+		a := newAccountKey("canonical", "root")
+		a.headers["since"] = value
+
+		_, err := NewAssertion(a)
+		c.Check(err, ErrorMatches, `Invalid header since.*: unexpected .*`, Commentf("%#v", value))
+	}
+}
+
+func (s *AssertionsSuite) TestGetAssertions(c *C) {
+	fake := &FakeSnapdClient{
+		Assertions: map[string][]asserts.Assertion{
+			"account-key": {newAccountKey("canonical", "root"), newAccountKey("acme", "build")},
+		},
+	}
+
+	assertions, err := GetAssertions(fake, "account-key", map[string]string{})
+	c.Assert(err, IsNil)
+	c.Check(assertions, HasLen, 2)
+
+	assertions, err = GetAssertions(fake, "account-key", map[string]string{"account-id": "acme"})
+	c.Assert(err, IsNil)
+	c.Assert(assertions, HasLen, 1)
+	c.Check(assertions[0].Headers["name"], Equals, "build")
+
+	assertions, err = GetAssertions(fake, "serial", map[string]string{})
+	c.Assert(err, IsNil)
+	c.Check(assertions, HasLen, 0)
+}
+
+func (s *AssertionsSuite) TestGetAssertionsUnknownType(c *C) {
+	_, err := GetAssertions(&FakeSnapdClient{}, "fruit", map[string]string{})
+	c.Check(err, Equals, ErrUnknownAssertionType)
+}
+
+func (s *AssertionsSuite) TestGetAssertionsMalformed(c *C) {
+	a := newAccountKey("canonical", "root")
+	a.headers["since"] = 2017
+	fake := &FakeSnapdClient{
+		Assertions: map[string][]asserts.Assertion{"account-key": {a}},
+	}
+
+	_, err := GetAssertions(fake, "account-key", map[string]string{})
+	c.Check(err, ErrorMatches, `Malformed account-key assertion: Invalid header since: unexpected int`)
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snapdclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/snapcore/snapd/client"
+)
+
+// snapdSocket is where snapd serves its REST API
+var snapdSocket = "/run/snapd.socket"
+
+// Publisher is the publisher of a snap
+type Publisher struct {
+	ID          string `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display-name"`
+	// Validation is "verified" for publishers whose identity was checked
+	Validation string `json:"validation"`
+}
+
+// Media is a screenshot, icon, banner or video of a snap
+type Media struct {
+	Type   string `json:"type"`
+	URL    string `json:"url"`
+	Width  int64  `json:"width"`
+	Height int64  `json:"height"`
+}
+
+// SnapDetails are the fields of a snap that snapd gives but that the snapd
+// client pinned in dependencies.tsv does not decode
+type SnapDetails struct {
+	Title           string     `json:"title"`
+	Publisher       *Publisher `json:"publisher"`
+	License         string     `json:"license"`
+	Contact         string     `json:"contact"`
+	Website         string     `json:"website"`
+	Base            string     `json:"base"`
+	Media           []Media    `json:"media"`
+	TrackingChannel string     `json:"tracking-channel"`
+	// Hold is until when the refreshes of an installed snap are held
+	Hold *time.Time `json:"hold"`
+}
+
+// response is the envelope of the responses of snapd
+type response struct {
+	Type   string          `json:"type"`
+	Result json.RawMessage `json:"result"`
+}
+
+func newRawClient() *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", snapdSocket)
+		},
+	}}
+}
+
+// get decodes the result of a GET request to snapd, whose errors are
+// returned as a *client.Error
+func (a *ClientAdapter) get(path string, query url.Values, result interface{}) error {
+	u := url.URL{Scheme: "http", Host: "localhost", Path: path, RawQuery: query.Encode()}
+	resp, err := a.rawClient.Get(u.String())
+	if err != nil {
+		return fmt.Errorf("cannot communicate with snapd: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var r response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("cannot decode the response of snapd: %s", err)
+	}
+
+	if r.Type == "error" {
+		var e client.Error
+		if err := json.Unmarshal(r.Result, &e); err != nil {
+			return fmt.Errorf("cannot decode the error of snapd: %s", err)
+		}
+		return &e
+	}
+
+	if err := json.Unmarshal(r.Result, result); err != nil {
+		return fmt.Errorf("cannot decode the result of snapd: %s", err)
+	}
+	return nil
+}
+
+// SnapDetails returns the details of the installed snap with the given name
+func (a *ClientAdapter) SnapDetails(name string) (*SnapDetails, error) {
+	var details SnapDetails
+	if err := a.get("/v2/snaps/"+name, nil, &details); err != nil {
+		return nil, err
+	}
+	return &details, nil
+}
+
+// FindOneDetails returns the details of the snap of the store with the
+// given name
+func (a *ClientAdapter) FindOneDetails(name string) (*SnapDetails, error) {
+	var details []*SnapDetails
+	if err := a.get("/v2/find", url.Values{"name": {name}}, &details); err != nil {
+		return nil, err
+	}
+	if len(details) == 0 {
+		return nil, &client.Error{
+			Kind:    client.ErrorKindSnapNotFound,
+			Value:   name,
+			Message: "snap not found",
+		}
+	}
+	return details[0], nil
+}
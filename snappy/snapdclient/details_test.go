@@ -0,0 +1,141 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snapdclient
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/snapcore/snapd/client"
+	. "gopkg.in/check.v1"
+)
+
+type DetailsSuite struct {
+	server   *http.Server
+	previous string
+	a        *ClientAdapter
+}
+
+var _ = Suite(&DetailsSuite{})
+
+func (s *DetailsSuite) SetUpTest(c *C) {
+	s.previous = snapdSocket
+	snapdSocket = filepath.Join(c.MkDir(), "snapd.socket")
+
+	listener, err := net.Listen("unix", snapdSocket)
+	c.Assert(err, IsNil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/snaps/chatroom", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"type":"sync","status-code":200,"result":{
+			"name":"chatroom",
+			"tracking-channel":"latest/stable",
+			"hold":"2017-08-01T00:00:00Z",
+			"media":[{"type":"icon","url":"https://example.com/icon.png"}]}}`)
+	})
+	mux.HandleFunc("/v2/snaps/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"type":"error","status-code":404,"result":{"message":"snap not installed","kind":"snap-not-found","value":"foo"}}`)
+	})
+	mux.HandleFunc("/v2/find", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("name") != "chatroom" {
+			fmt.Fprint(w, `{"type":"sync","status-code":200,"result":[]}`)
+			return
+		}
+		fmt.Fprint(w, `{"type":"sync","status-code":200,"result":[{
+			"name":"chatroom",
+			"title":"Chat Room",
+			"license":"GPL-3.0",
+			"contact":"mailto:ogra@example.com",
+			"website":"https://example.com/chatroom",
+			"base":"core18",
+			"publisher":{"id":"ogra-id","username":"ogra","display-name":"Oliver Grawert","validation":"verified"},
+			"media":[{"type":"screenshot","url":"https://example.com/1.png","width":640,"height":480}]}]}`)
+	})
+
+	s.server = &http.Server{Handler: mux}
+	go s.server.Serve(listener)
+
+	s.a = &ClientAdapter{rawClient: newRawClient()}
+}
+
+func (s *DetailsSuite) TearDownTest(c *C) {
+	s.server.Close()
+	snapdSocket = s.previous
+}
+
+func (s *DetailsSuite) TestSnapDetails(c *C) {
+	details, err := s.a.SnapDetails("chatroom")
+	c.Assert(err, IsNil)
+
+	hold := time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC)
+	c.Check(details, DeepEquals, &SnapDetails{
+		TrackingChannel: "latest/stable",
+		Hold:            &hold,
+		Media:           []Media{{Type: "icon", URL: "https://example.com/icon.png"}},
+	})
+}
+
+func (s *DetailsSuite) TestSnapDetailsError(c *C) {
+	_, err := s.a.SnapDetails("foo")
+	c.Check(err, DeepEquals, &client.Error{
+		Kind:    client.ErrorKindSnapNotFound,
+		Value:   "foo",
+		Message: "snap not installed",
+	})
+}
+
+func (s *DetailsSuite) TestFindOneDetails(c *C) {
+	details, err := s.a.FindOneDetails("chatroom")
+	c.Assert(err, IsNil)
+
+	c.Check(details, DeepEquals, &SnapDetails{
+		Title:   "Chat Room",
+		License: "GPL-3.0",
+		Contact: "mailto:ogra@example.com",
+		Website: "https://example.com/chatroom",
+		Base:    "core18",
+		Publisher: &Publisher{
+			ID:          "ogra-id",
+			Username:    "ogra",
+			DisplayName: "Oliver Grawert",
+			Validation:  "verified",
+		},
+		Media: []Media{{Type: "screenshot", URL: "https://example.com/1.png", Width: 640, Height: 480}},
+	})
+}
+
+func (s *DetailsSuite) TestFindOneDetailsNotFound(c *C) {
+	_, err := s.a.FindOneDetails("foo")
+	c.Check(err, DeepEquals, &client.Error{
+		Kind:    client.ErrorKindSnapNotFound,
+		Value:   "foo",
+		Message: "snap not found",
+	})
+}
+
+func (s *DetailsSuite) TestSnapdUnreachable(c *C) {
+	s.server.Close()
+	snapdSocket = filepath.Join(c.MkDir(), "missing.socket")
+
+	_, err := s.a.SnapDetails("chatroom")
+	c.Check(err, ErrorMatches, "cannot communicate with snapd: .*")
+}
@@ -0,0 +1,344 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snapdclient
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/snapcore/snapd/asserts"
+)
+
+var (
+	procPath = "/proc"
+	// the file systems whose usage is reported, when they exist
+	diskPaths = []string{"/writable", "/snap", "/var"}
+	statfs    = syscall.Statfs
+)
+
+// CPUInfo describes the processor
+type CPUInfo struct {
+	Model string `json:"model"`
+	Cores int    `json:"cores"`
+}
+
+// MemoryUsage is the usage of the memory or of the swap, in bytes
+type MemoryUsage struct {
+	Total     uint64 `json:"total"`
+	Available uint64 `json:"available"`
+}
+
+// DiskUsage is the usage of a file system, in bytes
+type DiskUsage struct {
+	Path      string `json:"path"`
+	Total     uint64 `json:"total"`
+	Available uint64 `json:"available"`
+}
+
+// DeviceInfo describes the device, its hardware and its resource usage
+type DeviceInfo struct {
+	Brand  string `json:"brand"`
+	Model  string `json:"model"`
+	Serial string `json:"serial"`
+	// Grade of the model, for the models that have one
+	Grade string `json:"grade,omitempty"`
+	// Gadget and Kernel are the names of the gadget and kernel snaps
+	Gadget        string   `json:"gadget"`
+	Kernel        string   `json:"kernel"`
+	OS            string   `json:"operatingSystem"`
+	KernelVersion string   `json:"kernelVersion"`
+	Architecture  string   `json:"architecture"`
+	Interfaces    []string `json:"interfaces"`
+	// Uptime is left to the callers to format
+	Uptime      time.Duration `json:"-"`
+	CPU         CPUInfo       `json:"cpu"`
+	LoadAverage [3]float64    `json:"loadAverage"`
+	Memory      MemoryUsage   `json:"memory"`
+	Swap        MemoryUsage   `json:"swap"`
+	Disks       []DiskUsage   `json:"disks"`
+}
+
+// snap architecture names of the Go ones
+var snapArchitectures = map[string]string{
+	"386":     "i386",
+	"arm":     "armhf",
+	"ppc64le": "ppc64el",
+}
+
+func architecture() string {
+	if arch, ok := snapArchitectures[runtime.GOARCH]; ok {
+		return arch
+	}
+	return runtime.GOARCH
+}
+
+// headerString returns a string header of the assertion, or the empty
+// string if it is missing or not a string
+func headerString(a asserts.Assertion, name string) string {
+	s, _ := a.Header(name).(string)
+	return s
+}
+
+// knownAssertion returns the first assertion of the given type, if any
+func knownAssertion(c SnapdClient, assertType string) asserts.Assertion {
+	assertions, err := c.Known(assertType, map[string]string{})
+	if err != nil {
+		log.Println(fmt.Sprintf("GetDeviceInfo: No %s type info found: %s", assertType, err))
+		return nil
+	}
+	if len(assertions) == 0 {
+		log.Println("GetDeviceInfo: No assertions returned for " + assertType + " type")
+		return nil
+	}
+	return assertions[0]
+}
+
+// GetDeviceInfo returns information about the device.
+func GetDeviceInfo(c SnapdClient) (*DeviceInfo, error) {
+	sysInfo, err := c.ServerVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	ifaces, err := c.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &DeviceInfo{
+		Brand:        "Unknown",
+		Model:        "Unknown",
+		Serial:       "Unknown",
+		OS:           sysInfo.OSID + " " + sysInfo.Series,
+		Architecture: architecture(),
+		Interfaces:   []string{},
+		Disks:        []DiskUsage{},
+	}
+
+	for _, slot := range ifaces.Slots {
+		info.Interfaces = append(info.Interfaces, slot.Name)
+	}
+
+	if model := knownAssertion(c, "model"); model != nil {
+		info.Brand = headerString(model, "brand-id")
+		info.Model = headerString(model, "model")
+		info.Grade = headerString(model, "grade")
+		info.Gadget = headerString(model, "gadget")
+		info.Kernel = headerString(model, "kernel")
+	}
+
+	if serial := knownAssertion(c, "serial"); serial != nil {
+		info.Brand = headerString(serial, "brand-id")
+		info.Model = headerString(serial, "model")
+		info.Serial = headerString(serial, "serial")
+	}
+
+	if info.Uptime, err = readUptime(); err != nil {
+		return nil, err
+	}
+
+	// the rest is informative, and left out if unavailable
+	if info.KernelVersion, err = readKernelVersion(); err != nil {
+		log.Println("GetDeviceInfo: Cannot read the kernel version:", err)
+	}
+	if info.CPU, err = readCPUInfo(); err != nil {
+		log.Println("GetDeviceInfo: Cannot read the CPU information:", err)
+	}
+	if info.LoadAverage, err = readLoadAverage(); err != nil {
+		log.Println("GetDeviceInfo: Cannot read the load average:", err)
+	}
+	if info.Memory, info.Swap, err = ReadMemoryUsage(); err != nil {
+		log.Println("GetDeviceInfo: Cannot read the memory usage:", err)
+	}
+	info.Disks = ReadDiskUsage()
+
+	return info, nil
+}
+
+func readUptime() (time.Duration, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procPath, "uptime"))
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("Invalid uptime %q", data)
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid uptime %q", data)
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
+
+func readKernelVersion() (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procPath, "sys", "kernel", "osrelease"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// readCPUInfo parses /proc/cpuinfo, whose fields vary with the architecture
+func readCPUInfo() (CPUInfo, error) {
+	f, err := os.Open(filepath.Join(procPath, "cpuinfo"))
+	if err != nil {
+		return CPUInfo{}, err
+	}
+	defer f.Close()
+
+	var cpu CPUInfo
+	// the board name, on ARM, and the old name of the model field
+	var hardware, processor string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+		switch key {
+		case "processor":
+			cpu.Cores++
+		case "Processor":
+			processor = value
+		case "model name":
+			if cpu.Model == "" {
+				cpu.Model = value
+			}
+		case "Hardware", "Model":
+			hardware = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return CPUInfo{}, err
+	}
+
+	if cpu.Model == "" {
+		cpu.Model = processor
+	}
+	if hardware != "" {
+		if cpu.Model == "" {
+			cpu.Model = hardware
+		} else {
+			cpu.Model += " (" + hardware + ")"
+		}
+	}
+	if cpu.Cores == 0 {
+		cpu.Cores = runtime.NumCPU()
+	}
+
+	return cpu, nil
+}
+
+func readLoadAverage() ([3]float64, error) {
+	var load [3]float64
+
+	data, err := ioutil.ReadFile(filepath.Join(procPath, "loadavg"))
+	if err != nil {
+		return load, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return load, fmt.Errorf("Invalid load average %q", data)
+	}
+	for i := range load {
+		if load[i], err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return load, fmt.Errorf("Invalid load average %q", data)
+		}
+	}
+
+	return load, nil
+}
+
+// ReadMemoryUsage returns the memory and swap usage from /proc/meminfo
+func ReadMemoryUsage() (memory MemoryUsage, swap MemoryUsage, err error) {
+	f, err := os.Open(filepath.Join(procPath, "meminfo"))
+	if err != nil {
+		return memory, swap, err
+	}
+	defer f.Close()
+
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(strings.Replace(scanner.Text(), ":", " ", 1))
+		if len(fields) < 2 {
+			continue
+		}
+		if v, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[fields[0]] = v * 1024
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return memory, swap, err
+	}
+
+	if _, ok := values["MemTotal"]; !ok {
+		return memory, swap, fmt.Errorf("No MemTotal in meminfo")
+	}
+
+	memory.Total = values["MemTotal"]
+	if available, ok := values["MemAvailable"]; ok {
+		memory.Available = available
+	} else {
+		// kernels before 3.14
+		memory.Available = values["MemFree"] + values["Buffers"] + values["Cached"]
+	}
+	swap.Total = values["SwapTotal"]
+	swap.Available = values["SwapFree"]
+
+	return memory, swap, nil
+}
+
+// ReadDiskUsage returns the usage of the file systems of the device
+func ReadDiskUsage() []DiskUsage {
+	disks := []DiskUsage{}
+
+	for _, path := range diskPaths {
+		var st syscall.Statfs_t
+		if err := statfs(path, &st); err != nil {
+			if !os.IsNotExist(err) {
+				log.Println(fmt.Sprintf("GetDeviceInfo: Cannot get the usage of %s: %s", path, err))
+			}
+			continue
+		}
+
+		disks = append(disks, DiskUsage{
+			Path:      path,
+			Total:     st.Blocks * uint64(st.Bsize),
+			Available: st.Bavail * uint64(st.Bsize),
+		})
+	}
+
+	return disks
+}
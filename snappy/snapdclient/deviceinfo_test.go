@@ -0,0 +1,158 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snapdclient
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/client"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type DeviceInfoSuite struct{}
+
+var _ = Suite(&DeviceInfoSuite{})
+
+func (s *DeviceInfoSuite) SetUpTest(c *C) {
+	procPath = "testdata/amd64"
+	diskPaths = []string{"/writable", "/snap"}
+	statfs = func(path string, st *syscall.Statfs_t) error {
+		if path == "/snap" {
+			return os.ErrNotExist
+		}
+		st.Bsize = 4096
+		st.Blocks = 1000
+		st.Bavail = 250
+		return nil
+	}
+}
+
+func (s *DeviceInfoSuite) TearDownTest(c *C) {
+	procPath = "/proc"
+	diskPaths = []string{"/writable", "/snap", "/var"}
+	statfs = syscall.Statfs
+}
+
+func (s *DeviceInfoSuite) TestGetDeviceInfo(c *C) {
+	fake := &FakeSnapdClient{
+		Version: client.ServerVersion{OSID: "ubuntu-core", Series: "16"},
+		Assertions: map[string][]asserts.Assertion{
+			"model": {&fakeAssertion{headers: map[string]interface{}{
+				"brand-id": "canonical",
+				"model":    "pc",
+				"gadget":   "pc",
+				"kernel":   "pc-kernel",
+			}}},
+			"serial": {&fakeAssertion{headers: map[string]interface{}{
+				"brand-id": "canonical",
+				"model":    "pc",
+				"serial":   "1234",
+			}}},
+		},
+	}
+
+	info, err := GetDeviceInfo(fake)
+	c.Assert(err, IsNil)
+
+	c.Check(info.Brand, Equals, "canonical")
+	c.Check(info.Model, Equals, "pc")
+	c.Check(info.Serial, Equals, "1234")
+	c.Check(info.Grade, Equals, "")
+	c.Check(info.Gadget, Equals, "pc")
+	c.Check(info.Kernel, Equals, "pc-kernel")
+	c.Check(info.OS, Equals, "ubuntu-core 16")
+	c.Check(info.KernelVersion, Equals, "4.4.0-62-generic")
+	c.Check(info.Architecture, Not(Equals), "")
+	c.Check(info.Uptime, Equals, 93784*time.Second)
+	c.Check(info.CPU, Equals, CPUInfo{Model: "Intel(R) Core(TM) i5-7200U CPU @ 2.50GHz", Cores: 2})
+	c.Check(info.LoadAverage, Equals, [3]float64{0.52, 0.58, 0.59})
+	c.Check(info.Memory, Equals, MemoryUsage{Total: 8054244 * 1024, Available: 4031116 * 1024})
+	c.Check(info.Swap, Equals, MemoryUsage{Total: 2097148 * 1024, Available: 2097000 * 1024})
+	c.Check(info.Disks, DeepEquals, []DiskUsage{{Path: "/writable", Total: 4096000, Available: 1024000}})
+}
+
+func (s *DeviceInfoSuite) TestGetDeviceInfoWithoutAssertions(c *C) {
+	info, err := GetDeviceInfo(&FakeSnapdClient{})
+	c.Assert(err, IsNil)
+
+	c.Check(info.Brand, Equals, "Unknown")
+	c.Check(info.Model, Equals, "Unknown")
+	c.Check(info.Serial, Equals, "Unknown")
+	c.Check(info.Interfaces, DeepEquals, []string{})
+}
+
+func (s *DeviceInfoSuite) TestModelGrade(c *C) {
+	fake := &FakeSnapdClient{
+		Assertions: map[string][]asserts.Assertion{
+			"model": {&fakeAssertion{headers: map[string]interface{}{
+				"brand-id": "canonical",
+				"model":    "ubuntu-core-20-amd64",
+				"grade":    "signed",
+				// unexpected types are ignored
+				"kernel": []interface{}{"pc-kernel"},
+			}}},
+		},
+	}
+
+	info, err := GetDeviceInfo(fake)
+	c.Assert(err, IsNil)
+	c.Check(info.Model, Equals, "ubuntu-core-20-amd64")
+	c.Check(info.Grade, Equals, "signed")
+	c.Check(info.Kernel, Equals, "")
+	c.Check(info.Serial, Equals, "Unknown")
+}
+
+func (s *DeviceInfoSuite) TestARMProcFiles(c *C) {
+	procPath = "testdata/armhf"
+
+	cpu, err := readCPUInfo()
+	c.Assert(err, IsNil)
+	c.Check(cpu, Equals, CPUInfo{Model: "ARMv7 Processor rev 4 (v7l) (BCM2709)", Cores: 4})
+
+	// without MemAvailable
+	memory, swap, err := ReadMemoryUsage()
+	c.Assert(err, IsNil)
+	c.Check(memory, Equals, MemoryUsage{Total: 947748 * 1024, Available: 620000 * 1024})
+	c.Check(swap, Equals, MemoryUsage{})
+
+	uptime, err := readUptime()
+	c.Assert(err, IsNil)
+	c.Check(uptime, Equals, 61*time.Second)
+}
+
+func (s *DeviceInfoSuite) TestMissingProcFiles(c *C) {
+	procPath = c.MkDir()
+
+	_, err := readUptime()
+	c.Check(err, NotNil)
+
+	// the uptime is needed, the rest is optional
+	_, err = GetDeviceInfo(&FakeSnapdClient{})
+	c.Check(err, NotNil)
+
+	_, err = readLoadAverage()
+	c.Check(err, NotNil)
+	_, _, err = ReadMemoryUsage()
+	c.Check(err, NotNil)
+}
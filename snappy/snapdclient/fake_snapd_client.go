@@ -18,12 +18,36 @@
 package snapdclient
 
 import (
+	"sync"
+
 	"github.com/snapcore/snapd/asserts"
 	"github.com/snapcore/snapd/client"
 )
 
+// FakeStore is a fake Store for testing purposes, remembering the purchases
+type FakeStore struct {
+	NotReadyErr error
+	BuyErr      error
+	Bought      []client.BuyOptions
+}
+
+// ReadyToBuy checks that the user can buy snaps
+func (f *FakeStore) ReadyToBuy() error {
+	return f.NotReadyErr
+}
+
+// Buy buys a priced snap
+func (f *FakeStore) Buy(opts *client.BuyOptions) (*client.BuyResult, error) {
+	if f.BuyErr != nil {
+		return nil, f.BuyErr
+	}
+	f.Bought = append(f.Bought, *opts)
+	return &client.BuyResult{State: "Complete"}, nil
+}
+
 // FakeSnapdClient is a fake SnapdClient for testing purposes
 type FakeSnapdClient struct {
+	FakeStore
 	Snaps           []*client.Snap
 	StoreSnaps      []*client.Snap
 	Err             error
@@ -40,10 +64,26 @@ type FakeSnapdClient struct {
 	AbortedChangeID string
 	ChangeID        string
 	CurrentChange   *client.Change
+	// Assertions returned by Known, by type
+	Assertions map[string][]asserts.Assertion
+	// Acked assertions
+	Acked  [][]byte
+	AckErr error
+	// Names of the snaps whose icon was asked for
+	IconRequests []string
+	// Details of the snaps, installed and of the store, by name
+	Details      map[string]*SnapDetails
+	StoreDetails map[string]*SnapDetails
+
+	mu sync.Mutex
 }
 
 // Icon returns the icon of an installed snap
 func (f *FakeSnapdClient) Icon(name string) (*client.Icon, error) {
+	f.mu.Lock()
+	f.IconRequests = append(f.IconRequests, name)
+	f.mu.Unlock()
+
 	icon := &client.Icon{
 		Filename: "icon.png",
 		Content:  []byte("png"),
@@ -115,7 +155,28 @@ func (f *FakeSnapdClient) Interfaces() (client.Interfaces, error) {
 
 // Known queries assertions with type assertTypeName and matching assertion headers.
 func (f *FakeSnapdClient) Known(assertTypeName string, headers map[string]string) ([]asserts.Assertion, error) {
-	return nil, nil
+	var result []asserts.Assertion
+
+next:
+	for _, a := range f.Assertions[assertTypeName] {
+		for name, value := range headers {
+			if s, ok := a.Header(name).(string); !ok || s != value {
+				continue next
+			}
+		}
+		result = append(result, a)
+	}
+
+	return result, nil
+}
+
+// Ack adds an assertion to the system assertion database
+func (f *FakeSnapdClient) Ack(b []byte) error {
+	if f.AckErr != nil {
+		return f.AckErr
+	}
+	f.Acked = append(f.Acked, b)
+	return nil
 }
 
 // Sections returns the list of existing sections in the store.
@@ -136,6 +197,25 @@ func (f *FakeSnapdClient) FindOne(name string) (*client.Snap, *client.ResultInfo
 	return nil, nil, f.StoreErr
 }
 
+// SnapDetails returns the details of the named installed snap
+func (f *FakeSnapdClient) SnapDetails(name string) (*SnapDetails, error) {
+	if details, ok := f.Details[name]; ok {
+		return details, nil
+	}
+	return nil, &client.Error{Kind: client.ErrorKindSnapNotFound, Value: name, Message: "snap not installed"}
+}
+
+// FindOneDetails returns the details of the named snap of the store
+func (f *FakeSnapdClient) FindOneDetails(name string) (*SnapDetails, error) {
+	if details, ok := f.StoreDetails[name]; ok {
+		return details, nil
+	}
+	if f.StoreErr != nil {
+		return nil, f.StoreErr
+	}
+	return nil, &client.Error{Kind: client.ErrorKindSnapNotFound, Value: name, Message: "snap not found"}
+}
+
 // Change returns the list of ongoing changes for a given snap and changeid
 func (f *FakeSnapdClient) Change(id string) (*client.Change, error) {
 	return f.CurrentChange, nil
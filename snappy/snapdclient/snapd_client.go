@@ -18,9 +18,8 @@
 package snapdclient
 
 import (
-	"fmt"
 	"log"
-	"syscall"
+	"net/http"
 	"time"
 
 	"github.com/snapcore/snapd/asserts"
@@ -30,14 +29,26 @@ import (
 
 var timesyncdConfigurationFilePath = "/etc/systemd/timesyncd.conf"
 
+// Store is the part of the snapd REST API dealing with the purchase of
+// priced snaps
+type Store interface {
+	// ReadyToBuy checks that the user can buy snaps: logged in to the
+	// store, with a payment method and having accepted its terms
+	ReadyToBuy() error
+	Buy(opts *client.BuyOptions) (*client.BuyResult, error)
+}
+
 // SnapdClient is a client of the snapd REST API
 type SnapdClient interface {
+	Store
 	Icon(name string) (*client.Icon, error)
 	Snap(name string) (*client.Snap, *client.ResultInfo, error)
 	List(names []string, opts *client.ListOptions) ([]*client.Snap, error)
 	Sections() ([]string, error)
 	Find(opts *client.FindOptions) ([]*client.Snap, *client.ResultInfo, error)
 	FindOne(name string) (*client.Snap, *client.ResultInfo, error)
+	SnapDetails(name string) (*SnapDetails, error)
+	FindOneDetails(name string) (*SnapDetails, error)
 	Install(name string, options *client.SnapOptions) (string, error)
 	Remove(name string, options *client.SnapOptions) (string, error)
 	ServerVersion() (*client.ServerVersion, error)
@@ -48,17 +59,21 @@ type SnapdClient interface {
 	Enable(id string, options *client.SnapOptions) (string, error)
 	Disable(id string, options *client.SnapOptions) (string, error)
 	Abort(id string) (*client.Change, error)
+	Ack(b []byte) error
 }
 
 // ClientAdapter adapts our expectations to the snapd client API.
 type ClientAdapter struct {
 	snapdClient *client.Client
+	// rawClient gets what snapdClient does not decode
+	rawClient *http.Client
 }
 
 // NewClientAdapter creates a new ClientAdapter for use in snapweb.
 func NewClientAdapter() *ClientAdapter {
 	return &ClientAdapter{
 		snapdClient: client.New(nil),
+		rawClient:   newRawClient(),
 	}
 }
 
@@ -111,6 +126,22 @@ func (a *ClientAdapter) Known(assertTypeName string, headers map[string]string)
 	return a.snapdClient.Known(assertTypeName, headers)
 }
 
+// ReadyToBuy checks that the user can buy snaps
+func (a *ClientAdapter) ReadyToBuy() error {
+	return a.snapdClient.ReadyToBuy()
+}
+
+// Buy buys a priced snap from the store
+func (a *ClientAdapter) Buy(opts *client.BuyOptions) (*client.BuyResult, error) {
+	return a.snapdClient.Buy(opts)
+}
+
+// Ack adds the given assertion, and its prerequisites, to the system
+// assertion database.
+func (a *ClientAdapter) Ack(b []byte) error {
+	return a.snapdClient.Ack(b)
+}
+
 // FindOne returns a list of snaps available for install from the
 // store for this system and that match the query
 func (a *ClientAdapter) FindOne(name string) (*client.Snap, *client.ResultInfo, error) {
@@ -175,60 +206,6 @@ func GetCoreConfig(keys []string) (map[string]interface{}, error) {
 	}, nil
 }
 
-// GetModelInfo returns information about the device.
-func GetModelInfo(c SnapdClient) (map[string]interface{}, error) {
-	// Server version
-	sysInfo, err := c.ServerVersion()
-	if err != nil {
-		return nil, err
-	}
-
-	// Interfaces
-	ifaces, err := c.Interfaces()
-	if err != nil {
-		return nil, err
-	}
-
-	var allInterfaces []string
-	for _, slot := range ifaces.Slots {
-		allInterfaces = append(allInterfaces, slot.Name)
-	}
-
-	// Model Info
-	brandName := "Unknown"
-	modelName := "Unknown"
-	serialNumber := "Unknown"
-
-	serialInfo, err := c.Known("serial", map[string]string{})
-	if err == nil {
-		if len(serialInfo) == 0 {
-			log.Println("GetModelInfo: No assertions returned for serial type")
-		} else {
-			brandName = serialInfo[0].Header("brand-id").(string)
-			modelName = serialInfo[0].Header("model").(string)
-			serialNumber = serialInfo[0].Header("serial").(string)
-		}
-	} else {
-		log.Println(fmt.Sprintf("GetModelInfo: No serial type info found: %s", err))
-	}
-
-	// Uptime
-	var msi syscall.Sysinfo_t
-	err = syscall.Sysinfo(&msi)
-	if err != nil {
-		return nil, err
-	}
-
-	return map[string]interface{}{
-		"Brand":      brandName,
-		"Model":      modelName,
-		"Serial":     serialNumber,
-		"OS":         sysInfo.OSID + " " + sysInfo.Series,
-		"Interfaces": allInterfaces,
-		"Uptime":     (time.Duration(msi.Uptime) * time.Second).String(),
-	}, nil
-}
-
 // CreateUser creates a local user on the system
 func (a *ClientAdapter) CreateUser(request *client.CreateUserOptions) (*client.CreateUserResult, error) {
 	return a.snapdClient.CreateUser(request)
@@ -82,20 +82,35 @@ func New() *StateTracker {
 	}
 }
 
-// State returns the state of the given snap
+// State returns the state of the given snap. The progress of a running
+// operation is asked to snapd without holding the tracker lock, so that
+// concurrent callers do not wait on each other's round-trips.
 func (s *StateTracker) State(c snapdclient.SnapdClient, snap *client.Snap) *SnapState {
 	s.Lock()
-	defer s.Unlock()
-
 	cstate, ok := s.states[snap.Name]
+	s.Unlock()
+
 	if !ok {
 		return &SnapState{
 			Status: translateStatus(snap),
 		}
 	}
 
-	if changing, changeID := s.IsTrackedForRunningOperation(snap); changing && c != nil {
-		change, err := c.Change(changeID)
+	if hasOperationCompleted(cstate.Status, snap) {
+		s.Lock()
+		// only forget the operation we looked at, not one tracked since
+		if tracked, ok := s.states[snap.Name]; ok && tracked.ChangeID == cstate.ChangeID {
+			delete(s.states, snap.Name)
+		}
+		s.Unlock()
+
+		return &SnapState{
+			Status: translateStatus(snap),
+		}
+	}
+
+	if c != nil {
+		change, err := c.Change(cstate.ChangeID)
 
 		if change != nil && err == nil {
 			for _, task := range change.Tasks {
@@ -111,20 +126,16 @@ func (s *StateTracker) State(c snapdclient.SnapdClient, snap *client.Snap) *Snap
 		}
 	}
 
-	if hasOperationCompleted(cstate.Status, snap) {
-		delete(s.states, snap.Name)
-		return &SnapState{
-			Status: translateStatus(snap),
-		}
-	}
-
 	return &cstate
 }
 
 // IsTrackedForRunningOperation checks if a given snap is currently concerned by
 // by a running operation
 func (s *StateTracker) IsTrackedForRunningOperation(snap *client.Snap) (bool, string) {
+	s.Lock()
 	state, ok := s.states[snap.Name]
+	s.Unlock()
+
 	if !ok {
 		return false, ""
 	}
@@ -232,3 +232,47 @@ func (s *StateTrackerSuite) TestTrackInstallingChange(c *C) {
 		DeepEquals,
 		&SnapState{Status: StatusInstalling, ChangeID: changeID, LocalSize: 2, TaskSummary: "summary"})
 }
+
+// lockCheckingClient tells whether the tracker could be locked while the
+// change was being fetched
+type lockCheckingClient struct {
+	*snapdclient.FakeSnapdClient
+	t        *StateTracker
+	unlocked bool
+}
+
+func (c *lockCheckingClient) Change(id string) (*client.Change, error) {
+	locked := make(chan struct{})
+	go func() {
+		c.t.Lock()
+		c.t.Unlock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		c.unlocked = true
+	case <-time.After(time.Second):
+	}
+
+	return c.FakeSnapdClient.Change(id)
+}
+
+func (s *StateTrackerSuite) TestChangeFetchedUnlocked(c *C) {
+	snap := &client.Snap{Name: "name", Status: client.StatusAvailable}
+	s.t.TrackInstall("ID", snap)
+
+	cl := &lockCheckingClient{FakeSnapdClient: s.c, t: s.t}
+	c.Assert(s.t.State(cl, snap).Status, Equals, StatusInstalling)
+	c.Check(cl.unlocked, Equals, true)
+}
+
+func (s *StateTrackerSuite) TestCompletedOperationForgotten(c *C) {
+	snap := &client.Snap{Name: "name", Status: client.StatusActive}
+	s.t.TrackUninstall("ID", snap)
+	c.Assert(s.t.State(nil, snap).Status, Equals, StatusUninstalling)
+
+	snap.Status = client.StatusRemoved
+	c.Assert(s.t.State(nil, snap).Status, Equals, StatusUninstalled)
+	c.Check(s.t.states, HasLen, 0)
+}
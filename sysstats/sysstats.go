@@ -0,0 +1,393 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package sysstats samples the resource usage of the system at regular
+// intervals, keeping the recent samples in memory:
+// - the CPU usage and the memory, swap and disk usage,
+// - the network throughput of every interface,
+// - the number of processes of every snap.
+package sysstats
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/snapcore/snapweb/snappy/snapdclient"
+)
+
+var (
+	procPath   = "/proc"
+	readMemory = snapdclient.ReadMemoryUsage
+	readDisks  = snapdclient.ReadDiskUsage
+	timeNow    = time.Now
+)
+
+// Throughput is the traffic of a network interface, in bytes per second
+type Throughput struct {
+	Received    float64 `json:"received"`
+	Transmitted float64 `json:"transmitted"`
+}
+
+// Sample is the resource usage at a given time
+type Sample struct {
+	Time time.Time `json:"time"`
+	// CPU is the percentage of the time the processors were busy since the
+	// previous sample
+	CPU     float64                 `json:"cpu"`
+	Memory  snapdclient.MemoryUsage `json:"memory"`
+	Swap    snapdclient.MemoryUsage `json:"swap"`
+	Disks   []snapdclient.DiskUsage `json:"disks"`
+	Network map[string]Throughput   `json:"network"`
+	// Processes counts the processes of every snap
+	Processes map[string]int `json:"processes"`
+}
+
+// counters are the cumulative values the rates are computed from
+type counters struct {
+	time    time.Time
+	cpuBusy uint64
+	cpuAll  uint64
+	network map[string][2]uint64
+}
+
+// Sampler takes a sample every interval, keeping them for the retention
+// period in a ring buffer
+type Sampler struct {
+	sync.Mutex
+	interval time.Duration
+	samples  []Sample
+	// next is where the next sample goes, count how many samples are kept
+	next  int
+	count int
+	prev  *counters
+
+	listeners []func(Sample)
+	stop      chan struct{}
+}
+
+// New returns a sampler for the given interval and retention
+func New(interval, retention time.Duration) *Sampler {
+	s := &Sampler{}
+	s.Configure(interval, retention)
+	return s
+}
+
+func capacity(interval, retention time.Duration) int {
+	if n := int(retention / interval); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// Configure changes the interval and the retention, keeping the most recent
+// samples that still fit; the new interval applies after the next sample
+func (s *Sampler) Configure(interval, retention time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	size := capacity(interval, retention)
+	kept := s.recent(size)
+
+	s.interval = interval
+	s.samples = make([]Sample, size)
+	copy(s.samples, kept)
+	s.count = len(kept)
+	s.next = len(kept) % size
+}
+
+// OnSample registers a function to be called with every new sample
+func (s *Sampler) OnSample(f func(Sample)) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.listeners = append(s.listeners, f)
+}
+
+// Start samples in the background until Stop is called
+func (s *Sampler) Start() {
+	s.Lock()
+	if s.stop != nil {
+		s.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	s.stop = stop
+	s.Unlock()
+
+	go func() {
+		for {
+			s.Sample()
+
+			s.Lock()
+			interval := s.interval
+			s.Unlock()
+
+			select {
+			case <-time.After(interval):
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background sampling
+func (s *Sampler) Stop() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+// Sample takes a sample right away, records it and notifies the listeners
+func (s *Sampler) Sample() Sample {
+	sample, current := take()
+
+	s.Lock()
+	if s.prev != nil {
+		sample.CPU, sample.Network = rates(s.prev, current)
+	}
+	s.prev = current
+
+	s.samples[s.next] = sample
+	s.next = (s.next + 1) % len(s.samples)
+	if s.count < len(s.samples) {
+		s.count++
+	}
+
+	listeners := make([]func(Sample), len(s.listeners))
+	copy(listeners, s.listeners)
+	s.Unlock()
+
+	for _, f := range listeners {
+		f(sample)
+	}
+
+	return sample
+}
+
+// Since returns the samples taken after the given time, oldest first
+func (s *Sampler) Since(t time.Time) []Sample {
+	s.Lock()
+	defer s.Unlock()
+
+	result := []Sample{}
+	for _, sample := range s.recent(s.count) {
+		if sample.Time.After(t) {
+			result = append(result, sample)
+		}
+	}
+	return result
+}
+
+// recent returns up to n of the most recent samples, oldest first; the
+// caller holds the lock
+func (s *Sampler) recent(n int) []Sample {
+	if n > s.count {
+		n = s.count
+	}
+
+	result := make([]Sample, 0, n)
+	for i := n; i > 0; i-- {
+		result = append(result, s.samples[(s.next-i+len(s.samples))%len(s.samples)])
+	}
+	return result
+}
+
+// take reads the current usage and counters
+func take() (Sample, *counters) {
+	now := timeNow()
+	sample := Sample{
+		Time:      now,
+		Disks:     readDisks(),
+		Network:   map[string]Throughput{},
+		Processes: map[string]int{},
+	}
+	current := &counters{time: now}
+
+	var err error
+	if sample.Memory, sample.Swap, err = readMemory(); err != nil {
+		log.Println("Cannot read the memory usage:", err)
+	}
+	if current.cpuBusy, current.cpuAll, err = readCPUTimes(); err != nil {
+		log.Println("Cannot read the CPU usage:", err)
+	}
+	if current.network, err = readNetworkCounters(); err != nil {
+		log.Println("Cannot read the network counters:", err)
+	}
+	if sample.Processes, err = countSnapProcesses(); err != nil {
+		log.Println("Cannot count the snap processes:", err)
+	}
+
+	return sample, current
+}
+
+// rates computes the CPU usage and the network throughput between two
+// readings of the counters
+func rates(prev, current *counters) (float64, map[string]Throughput) {
+	var cpu float64
+	if current.cpuAll > prev.cpuAll && current.cpuBusy >= prev.cpuBusy {
+		cpu = 100 * float64(current.cpuBusy-prev.cpuBusy) / float64(current.cpuAll-prev.cpuAll)
+	}
+
+	network := map[string]Throughput{}
+	elapsed := current.time.Sub(prev.time).Seconds()
+	if elapsed <= 0 {
+		return cpu, network
+	}
+	for name, now := range current.network {
+		before, ok := prev.network[name]
+		// counters reset when an interface comes back
+		if !ok || now[0] < before[0] || now[1] < before[1] {
+			continue
+		}
+		network[name] = Throughput{
+			Received:    float64(now[0]-before[0]) / elapsed,
+			Transmitted: float64(now[1]-before[1]) / elapsed,
+		}
+	}
+
+	return cpu, network
+}
+
+// readCPUTimes returns the busy and total time of all the processors, from
+// the first line of /proc/stat
+func readCPUTimes() (busy uint64, all uint64, err error) {
+	f, err := os.Open(filepath.Join(procPath, "stat"))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return 0, 0, fmt.Errorf("Empty %s", f.Name())
+	}
+
+	// cpu user nice system idle iowait irq softirq steal guest guest_nice
+	fields := strings.Fields(scanner.Text())
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, 0, fmt.Errorf("Invalid CPU times %q", scanner.Text())
+	}
+
+	// guest times are already part of the user ones
+	if len(fields) > 9 {
+		fields = fields[:9]
+	}
+
+	var idle uint64
+	for i, field := range fields[1:] {
+		v, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Invalid CPU times %q", scanner.Text())
+		}
+		all += v
+		// idle and iowait
+		if i == 3 || i == 4 {
+			idle += v
+		}
+	}
+
+	return all - idle, all, nil
+}
+
+// readNetworkCounters returns the received and transmitted bytes of the
+// interfaces, but the loopback, from /proc/net/dev
+func readNetworkCounters() (map[string][2]uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procPath, "net", "dev"))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string][2]uint64)
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			// the two header lines
+			continue
+		}
+
+		name := strings.TrimSpace(parts[0])
+		fields := strings.Fields(parts[1])
+		if name == "lo" || len(fields) < 9 {
+			continue
+		}
+
+		received, err1 := strconv.ParseUint(fields[0], 10, 64)
+		transmitted, err2 := strconv.ParseUint(fields[8], 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("Invalid network counters %q", line)
+		}
+		result[name] = [2]uint64{received, transmitted}
+	}
+
+	return result, nil
+}
+
+// snapName returns the snap a process belongs to from its control groups,
+// where snap applications run in snap.<snap>.<app> services or scopes
+func snapName(cgroup string) string {
+	for _, line := range strings.Split(cgroup, "\n") {
+		for _, part := range strings.Split(line, "/") {
+			if !strings.HasPrefix(part, "snap.") {
+				continue
+			}
+			if fields := strings.Split(part, "."); len(fields) >= 3 && fields[1] != "" {
+				return fields[1]
+			}
+		}
+	}
+	return ""
+}
+
+// countSnapProcesses counts the running processes of every snap
+func countSnapProcesses() (map[string]int, error) {
+	entries, err := ioutil.ReadDir(procPath)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]int)
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+
+		// the process may have exited meanwhile
+		data, err := ioutil.ReadFile(filepath.Join(procPath, entry.Name(), "cgroup"))
+		if err != nil {
+			continue
+		}
+
+		if name := snapName(string(data)); name != "" {
+			result[name]++
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,227 @@
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package sysstats
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/snapcore/snapweb/snappy/snapdclient"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type SamplerSuite struct {
+	now time.Time
+}
+
+var _ = Suite(&SamplerSuite{})
+
+func (s *SamplerSuite) SetUpTest(c *C) {
+	procPath = "testdata/proc"
+	readMemory = func() (snapdclient.MemoryUsage, snapdclient.MemoryUsage, error) {
+		return snapdclient.MemoryUsage{Total: 1000, Available: 400},
+			snapdclient.MemoryUsage{Total: 100, Available: 100}, nil
+	}
+	readDisks = func() []snapdclient.DiskUsage {
+		return []snapdclient.DiskUsage{{Path: "/writable", Total: 4096000, Available: 1024000}}
+	}
+	s.now = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time {
+		return s.now
+	}
+}
+
+func (s *SamplerSuite) TearDownTest(c *C) {
+	procPath = "/proc"
+	readMemory = snapdclient.ReadMemoryUsage
+	readDisks = snapdclient.ReadDiskUsage
+	timeNow = time.Now
+}
+
+func (s *SamplerSuite) TestReadCPUTimes(c *C) {
+	busy, all, err := readCPUTimes()
+	c.Assert(err, IsNil)
+	c.Check(busy, Equals, uint64(1500))
+	c.Check(all, Equals, uint64(10000))
+}
+
+func (s *SamplerSuite) TestReadCPUTimesInvalid(c *C) {
+	procPath = c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(procPath, "stat"), []byte("cpu 1 x 3 4\n"), 0644), IsNil)
+
+	_, _, err := readCPUTimes()
+	c.Check(err, ErrorMatches, `Invalid CPU times .*`)
+}
+
+func (s *SamplerSuite) TestReadNetworkCounters(c *C) {
+	counters, err := readNetworkCounters()
+	c.Assert(err, IsNil)
+	c.Check(counters, DeepEquals, map[string][2]uint64{
+		"eth0":  {100000, 50000},
+		"wlan0": {0, 0},
+	})
+}
+
+func (s *SamplerSuite) TestSnapName(c *C) {
+	for cgroup, name := range map[string]string{
+		"0::/system.slice/snap.snapweb.snapweb.service":                "snapweb",
+		"1:name=systemd:/user.slice/snap.hello.world.1234.scope\n0::/": "hello",
+		"0::/system.slice/snap-core.mount":                             "",
+		"0::/system.slice/snap.mount":                                  "",
+		"0::/user.slice/user-1000.slice/session-1.scope":               "",
+	} {
+		c.Check(snapName(cgroup), Equals, name, Commentf("%q", cgroup))
+	}
+}
+
+func (s *SamplerSuite) TestCountSnapProcesses(c *C) {
+	counts, err := countSnapProcesses()
+	c.Assert(err, IsNil)
+	c.Check(counts, DeepEquals, map[string]int{"snapweb": 2, "hello": 1})
+}
+
+func (s *SamplerSuite) TestFirstSampleHasNoRates(c *C) {
+	sample := New(time.Second, time.Minute).Sample()
+
+	c.Check(sample.Time, Equals, s.now)
+	c.Check(sample.CPU, Equals, 0.0)
+	c.Check(sample.Network, HasLen, 0)
+	c.Check(sample.Memory, Equals, snapdclient.MemoryUsage{Total: 1000, Available: 400})
+	c.Check(sample.Disks, HasLen, 1)
+	c.Check(sample.Processes, DeepEquals, map[string]int{"snapweb": 2, "hello": 1})
+}
+
+func (s *SamplerSuite) TestRates(c *C) {
+	prev := &counters{
+		time:    s.now,
+		cpuBusy: 1000,
+		cpuAll:  5000,
+		network: map[string][2]uint64{"eth0": {1000, 500}, "wlan0": {5000, 5000}},
+	}
+	current := &counters{
+		time:    s.now.Add(10 * time.Second),
+		cpuBusy: 1250,
+		cpuAll:  6000,
+		network: map[string][2]uint64{"eth0": {11000, 1500}, "wlan0": {10, 10}, "usb0": {10, 10}},
+	}
+
+	cpu, network := rates(prev, current)
+	c.Check(cpu, Equals, 25.0)
+	c.Check(network, DeepEquals, map[string]Throughput{
+		"eth0": {Received: 1000, Transmitted: 100},
+	})
+}
+
+func (s *SamplerSuite) TestRingBuffer(c *C) {
+	sampler := New(10*time.Second, 30*time.Second)
+
+	start := s.now
+	for i := 0; i < 5; i++ {
+		s.now = start.Add(time.Duration(i) * 10 * time.Second)
+		sampler.Sample()
+	}
+
+	samples := sampler.Since(time.Time{})
+	c.Assert(samples, HasLen, 3)
+	c.Check(samples[0].Time, Equals, start.Add(20*time.Second))
+	c.Check(samples[2].Time, Equals, start.Add(40*time.Second))
+
+	samples = sampler.Since(start.Add(30 * time.Second))
+	c.Assert(samples, HasLen, 1)
+	c.Check(samples[0].Time, Equals, start.Add(40*time.Second))
+
+	c.Check(sampler.Since(start.Add(time.Hour)), HasLen, 0)
+}
+
+func (s *SamplerSuite) TestConfigureKeepsRecentSamples(c *C) {
+	sampler := New(10*time.Second, 40*time.Second)
+
+	start := s.now
+	for i := 0; i < 4; i++ {
+		s.now = start.Add(time.Duration(i) * 10 * time.Second)
+		sampler.Sample()
+	}
+
+	sampler.Configure(10*time.Second, 20*time.Second)
+	samples := sampler.Since(time.Time{})
+	c.Assert(samples, HasLen, 2)
+	c.Check(samples[0].Time, Equals, start.Add(20*time.Second))
+
+	s.now = start.Add(40 * time.Second)
+	sampler.Sample()
+	samples = sampler.Since(time.Time{})
+	c.Assert(samples, HasLen, 2)
+	c.Check(samples[1].Time, Equals, start.Add(40*time.Second))
+
+	sampler.Configure(10*time.Second, time.Minute)
+	c.Check(sampler.Since(time.Time{}), HasLen, 2)
+}
+
+func (s *SamplerSuite) TestOnSample(c *C) {
+	sampler := New(time.Second, time.Minute)
+
+	var received []Sample
+	sampler.OnSample(func(sample Sample) {
+		received = append(received, sample)
+	})
+
+	sampler.Sample()
+	sampler.Sample()
+	c.Check(received, HasLen, 2)
+}
+
+func (s *SamplerSuite) TestStartStop(c *C) {
+	timeNow = time.Now
+	sampler := New(time.Millisecond, time.Second)
+
+	samples := make(chan Sample, 10)
+	sampler.OnSample(func(sample Sample) {
+		select {
+		case samples <- sample:
+		default:
+		}
+	})
+
+	sampler.Start()
+	// starting twice is harmless
+	sampler.Start()
+	defer sampler.Stop()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-samples:
+		case <-time.After(5 * time.Second):
+			c.Fatal("No sample taken")
+		}
+	}
+}
+
+func (s *SamplerSuite) TestMissingProc(c *C) {
+	procPath = filepath.Join(c.MkDir(), "missing")
+	_, err := os.Stat(procPath)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	sample := New(time.Second, time.Minute).Sample()
+	c.Check(sample.Processes, HasLen, 0)
+	c.Check(sample.Network, HasLen, 0)
+}
@@ -53,7 +53,6 @@ module.exports = Backbone.Marionette.LayoutView.extend({
           model.trigger('success', model, response);
         },
         error: function(model, response) {
-          var error = eval(response.reponseText);
           model.trigger('invalid', model, response.responseText);
         }
       });
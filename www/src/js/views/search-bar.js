@@ -5,10 +5,13 @@ var Backbone = require('backbone');
 Backbone.$ = $;
 var Marionette = require('backbone.marionette');
 var template = require('../templates/search-bar.hbs');
+var sectionTemplate = require('../templates/search-bar-section.hbs');
 
 var SectionsListItemView = Marionette.ItemView.extend({
   tagName: 'li',
-  template: _.template('<a href="<%= link %>"><%= text %></a>'),
+  template: function(model) {
+    return sectionTemplate(model);
+  },
   className: 'p-inline-list__item'
 });
 
@@ -1,6 +1,5 @@
 // snap layout view
 var $ = require('jquery');
-var _ = require('lodash');
 var Backbone = require('backbone');
 Backbone.$ = $;
 var Marionette = require('backbone.marionette');
@@ -8,6 +7,7 @@ var Handlebars = require('hbsfy/runtime');
 var InstallBehavior = require('../behaviors/install.js');
 var EnableBehavior = require('../behaviors/enabler.js');
 var template = require('../templates/snap-layout.hbs');
+var interfaceTemplate = require('../templates/snap-interface-item.hbs');
 var CONF = require('../config.js');
 
 // Handles the install/remove button
@@ -17,7 +17,9 @@ Handlebars.registerPartial('enabler', require('../templates/_enabler.hbs'));
 
 var SnapInterfaceListItemView = Marionette.ItemView.extend({
   tagName: 'li',
-  template: _.template('<%= name %>'),
+  template: function(model) {
+    return interfaceTemplate(model);
+  },
 });
 
 var SnapInterfaceCollectionView = Marionette.CollectionView.extend({